@@ -0,0 +1,35 @@
+// k6 load test of the hot delivery path.
+// needs a server with the items of the fixture collection test of package fake at BASE_URL, then run
+// "k6 run bench/k6/delivery.js". the in-process benchmarks are in pkg/rest: go test ./pkg/rest -run ^$ -bench .
+import http from 'k6/http';
+import { check } from 'k6';
+
+const base = __ENV.BASE_URL || 'http://localhost:8080/media';
+
+export const options = {
+    scenarios: {
+        tiles: { executor: 'constant-arrival-rate', rate: 500, timeUnit: '1s', duration: '30s', preAllocatedVUs: 50, exec: 'tile' },
+        metadata: { executor: 'constant-arrival-rate', rate: 200, timeUnit: '1s', duration: '30s', preAllocatedVUs: 20, exec: 'metadata' },
+        denied: { executor: 'constant-arrival-rate', rate: 100, timeUnit: '1s', duration: '30s', preAllocatedVUs: 10, exec: 'denied' },
+    },
+    thresholds: {
+        'http_req_duration{scenario:tiles}': ['p(99)<50'],
+        'http_req_duration{scenario:metadata}': ['p(99)<50'],
+        'http_req_failed{scenario:tiles}': ['rate<0.01'],
+    },
+};
+
+export function tile() {
+    const res = http.get(`${base}/iiif/3/test/image/0,0,32,32/32,/0/default.jpg`);
+    check(res, { 'tile 200': (r) => r.status === 200 });
+}
+
+export function metadata() {
+    const res = http.get(`${base}/test/image/metadata`);
+    check(res, { 'metadata 200': (r) => r.status === 200 });
+}
+
+export function denied() {
+    const res = http.get(`${base}/test/restricted/item`);
+    check(res, { 'denied 401': (r) => r.status === 401 });
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"emperror.dev/errors"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// adminClient talks to the admin api of a running instance
+type adminClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newAdminClient(conf *MediaserverMainConfig, addr string, insecure bool) (*adminClient, error) {
+	if addr == "" {
+		addr = conf.ExternalAddr
+	}
+	alg := "HS256"
+	if len(conf.JWTAlg) > 0 {
+		alg = conf.JWTAlg[0]
+	}
+	token, err := rest.MintToken(conf.JWTKey, alg, rest.AdminSubject, 5*time.Minute)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create admin token")
+	}
+	return &adminClient{
+		baseURL: strings.TrimRight(addr, "/") + "/admin",
+		token:   token,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
+	}, nil
+}
+
+func (ac *adminClient) post(path string, body any, result any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, errors.Wrap(err, "cannot marshal request")
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(http.MethodPost, ac.baseURL+path, reader)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot create request for %s", path)
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot post %s", req.URL)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, errors.Wrapf(err, "cannot read response of %s", req.URL)
+	}
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, errors.Errorf("%s: %s: %s", req.URL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if result != nil {
+		if err := json.Unmarshal(data, result); err != nil {
+			return resp.StatusCode, errors.Wrapf(err, "cannot decode response of %s", req.URL)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// readItems returns the items of the command line or of the list file ("-" for stdin)
+func readItems(args []string, listFile string) ([]string, error) {
+	items := append([]string{}, args...)
+	if listFile == "" {
+		return items, nil
+	}
+	var r io.Reader = os.Stdin
+	if listFile != "-" {
+		f, err := os.Open(listFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot open %s", listFile)
+		}
+		defer f.Close()
+		r = f
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items = append(items, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", listFile)
+	}
+	return items, nil
+}
+
+type adminFlags struct {
+	flags      *flag.FlagSet
+	configfile *string
+	addr       *string
+	insecure   *bool
+	list       *string
+}
+
+func newAdminFlags(name, usage string) *adminFlags {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	af := &adminFlags{
+		flags:      flags,
+		configfile: flags.String("config", "", "location of toml configuration file"),
+		addr:       flags.String("addr", "", "base url of the instance (default: externaladdr of configuration)"),
+		insecure:   flags.Bool("insecure", false, "do not verify the tls certificate of the instance"),
+		list:       flags.String("list", "", "file with one <collection>/<signature> per line, - for stdin"),
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s\n", usage)
+		flags.PrintDefaults()
+	}
+	return af
+}
+
+// client parses the arguments and returns the admin client and the items
+func (af *adminFlags) client(args []string) (*adminClient, []string) {
+	af.flags.Parse(args)
+	conf, err := loadConfig(*af.configfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	items, err := readItems(af.flags.Args(), *af.list)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if len(items) == 0 {
+		af.flags.Usage()
+		os.Exit(2)
+	}
+	ac, err := newAdminClient(conf, *af.addr, *af.insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	return ac, items
+}
+
+// prewarm generates derivatives of items on a running instance
+func prewarm(args []string) {
+	af := newAdminFlags("prewarm", "prewarm [flags] -action <action>/<params> [-action ...] <collection>/<signature>...")
+	var actions multiFlag
+	af.flags.Var(&actions, "action", "derivative to generate as <action>/<params>, can be repeated")
+	ac, items := af.client(args)
+	if len(actions) == 0 {
+		af.flags.Usage()
+		os.Exit(2)
+	}
+	var results []rest.PrewarmResult
+	statusCode, err := ac.post("/prewarm", &rest.PrewarmRequest{Items: items, Actions: actions}, &results)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			fmt.Printf("%s %s: error: %s\n", result.Item, result.Action, result.Error)
+		case result.Generated:
+			fmt.Printf("%s %s: generated\n", result.Item, result.Action)
+		default:
+			fmt.Printf("%s %s: exists\n", result.Item, result.Action)
+		}
+	}
+	if statusCode != http.StatusOK {
+		os.Exit(1)
+	}
+}
+
+// purge invalidates the caches of items on a running instance
+func purge(args []string) {
+	af := newAdminFlags("purge", "purge [flags] <collection>/<signature>...")
+	ac, items := af.client(args)
+	var failed bool
+	for _, item := range items {
+		if _, err := ac.post("/invalidate/"+strings.Trim(item, "/"), nil, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: purged\n", item)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// multiFlag collects repeated flags
+type multiFlag []string
+
+func (mf *multiFlag) String() string {
+	return strings.Join(*mf, ",")
+}
+
+func (mf *multiFlag) Set(value string) error {
+	*mf = append(*mf, value)
+	return nil
+}
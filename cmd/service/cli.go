@@ -0,0 +1,98 @@
+package main
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/je4/certloader/v2/pkg/loader"
+	"github.com/je4/mediaservermain/v2/config"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	configutil "github.com/je4/utils/v2/pkg/config"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var commands = map[string]func(args []string){
+	"serve":    serve,
+	"validate": validate,
+	"token":    token,
+	"prewarm":  prewarm,
+	"purge":    purge,
+	"soak":     soakTest,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [command] [flags]
+
+commands:
+  serve     run the media server (default), with -demo on in-memory sample content
+  validate  check the configuration
+  token     mint a signed url token
+  prewarm   generate derivatives on a running instance
+  purge     invalidate cached items on a running instance
+  soak      run a load test against fake backends and report leaks
+
+run '%s <command> -h' for the flags of a command
+`, filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+}
+
+func main() {
+	// without command, the server is started for compatibility with "mediaservermain -config ..."
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		serve(os.Args[1:])
+		return
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	cmd(os.Args[2:])
+}
+
+// loadConfig loads the configuration file or the embedded default configuration
+func loadConfig(configfile string) (*MediaserverMainConfig, error) {
+	var cfgFS fs.FS
+	var cfgFile string
+	if configfile != "" {
+		cfgFS = os.DirFS(filepath.Dir(configfile))
+		cfgFile = filepath.Base(configfile)
+	} else {
+		cfgFS = config.ConfigFS
+		cfgFile = "mediaservermain.toml"
+	}
+
+	conf := &MediaserverMainConfig{
+		LocalAddr: "localhost:8443",
+		//ResolverTimeout: config.Duration(10 * time.Minute),
+		ExternalAddr:            "https://localhost:8443",
+		LogLevel:                "DEBUG",
+		ResolverTimeout:         configutil.Duration(10 * time.Minute),
+		ResolverNotFoundTimeout: configutil.Duration(10 * time.Second),
+		ActionTemplateTimeout:   configutil.Duration(120 * time.Second),
+		HandoffTimeout:          configutil.Duration(30 * time.Second),
+		VFSReloadGrace:          configutil.Duration(10 * time.Minute),
+		ServiceName:             "mediaservermain",
+		CollectionCacheTimeout:  configutil.Duration(10 * time.Minute),
+		CollectionCacheSize:     30,
+		ItemCacheSize:           1000,
+		TokenCacheSize:          10000,
+		TokenCacheTimeout:       configutil.Duration(10 * time.Minute),
+		AccessCacheSize:         10000,
+		AccessCacheTimeout:      configutil.Duration(time.Minute),
+		ClientTLS: &loader.Config{
+			Type: "DEV",
+		},
+		RequestLog: &rest.RequestLogConfig{
+			SampleRate:    1,
+			SlowThreshold: configutil.Duration(5 * time.Second),
+		},
+	}
+	if err := LoadMediaserverMainConfig(cfgFS, cfgFile, conf); err != nil {
+		return nil, errors.Wrapf(err, "cannot load toml from [%v] %s", cfgFS, cfgFile)
+	}
+	return conf, nil
+}
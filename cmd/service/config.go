@@ -5,6 +5,7 @@ import (
 	"github.com/BurntSushi/toml"
 	loaderConfig "github.com/je4/certloader/v2/pkg/loader"
 	"github.com/je4/filesystem/v3/pkg/vfsrw"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
 	"github.com/je4/utils/v2/pkg/config"
 	"github.com/je4/utils/v2/pkg/stashconfig"
 	"io/fs"
@@ -12,28 +13,104 @@ import (
 )
 
 type MediaserverMainConfig struct {
-	LocalAddr               string                `toml:"localaddr"`
-	Domain                  string                `toml:"domain"`
-	ExternalAddr            string                `toml:"externaladdr"`
-	IIIF                    string                `toml:"iiif"`
-	IIIFPrefix              string                `toml:"iiifprefix"`
-	IIIFBaseAction          string                `toml:"iiifbaseaction"`
-	JWTKey                  string                `toml:"jwtkey"`
-	JWTAlg                  []string              `toml:"jwtalg"`
-	ResolverAddr            string                `toml:"resolveraddr"`
-	ResolverTimeout         config.Duration       `toml:"resolvertimeout"`
-	ResolverNotFoundTimeout config.Duration       `toml:"resolvernotfoundtimeout"`
-	WebTLS                  *loaderConfig.Config  `toml:"webtls"`
-	ClientTLS               *loaderConfig.Config  `toml:"client"`
-	LogFile                 string                `toml:"logfile"`
-	LogLevel                string                `toml:"loglevel"`
-	GRPCClient              map[string]string     `toml:"grpcclient"`
-	VFS                     map[string]*vfsrw.VFS `toml:"vfs"`
-	Log                     stashconfig.Config    `toml:"log"`
-	ActionTemplateTimeout   config.Duration       `toml:"actiontemplatetimeout"`
-	CollectionCacheTimeout  config.Duration       `toml:"collectioncachetimeout"`
-	CollectionCacheSize     int                   `toml:"collectioncachesize"`
-	ItemCacheSize           int                   `toml:"itemcachesize"`
+	LocalAddr               string                                  `toml:"localaddr"`
+	LocalAddrs              []string                                `toml:"localaddrs"`
+	Domain                  string                                  `toml:"domain"`
+	ExternalAddr            string                                  `toml:"externaladdr"`
+	IIIF                    string                                  `toml:"iiif"`
+	IIIFPrefix              string                                  `toml:"iiifprefix"`
+	IIIFBaseAction          string                                  `toml:"iiifbaseaction"`
+	JWTKey                  string                                  `toml:"jwtkey"`
+	JWTAlg                  []string                                `toml:"jwtalg"`
+	JWTAllowWeakKeys        bool                                    `toml:"jwtallowweakkeys"`
+	CollectionJWT           map[string]*rest.CollectionJWTConfig    `toml:"collectionjwt"`
+	ResolverAddr            string                                  `toml:"resolveraddr"`
+	ResolverTimeout         config.Duration                         `toml:"resolvertimeout"`
+	ResolverNotFoundTimeout config.Duration                         `toml:"resolvernotfoundtimeout"`
+	DatabaseAddr            string                                  `toml:"databaseaddr"`
+	ActionAddr              string                                  `toml:"actionaddr"`
+	WebTLS                  *loaderConfig.Config                    `toml:"webtls"`
+	WebTLSHosts             map[string]*loaderConfig.Config         `toml:"webtlshosts"`
+	ClientTLS               *loaderConfig.Config                    `toml:"client"`
+	LogFile                 string                                  `toml:"logfile"`
+	LogLevel                string                                  `toml:"loglevel"`
+	GRPCClient              map[string]string                       `toml:"grpcclient"`
+	GRPC                    *rest.GRPCClientConfig                  `toml:"grpc"`
+	VFS                     map[string]*vfsrw.VFS                   `toml:"vfs"`
+	Log                     stashconfig.Config                      `toml:"log"`
+	ActionTemplateTimeout   config.Duration                         `toml:"actiontemplatetimeout"`
+	HandoffTimeout          config.Duration                         `toml:"handofftimeout"`
+	ServiceName             string                                  `toml:"servicename"`
+	CollectionCacheTimeout  config.Duration                         `toml:"collectioncachetimeout"`
+	CollectionCacheSize     int                                     `toml:"collectioncachesize"`
+	ItemCacheSize           int                                     `toml:"itemcachesize"`
+	TokenCacheSize          int                                     `toml:"tokencachesize"`
+	TokenCacheTimeout       config.Duration                         `toml:"tokencachetimeout"`
+	AccessCacheSize         int                                     `toml:"accesscachesize"`
+	AccessCacheTimeout      config.Duration                         `toml:"accesscachetimeout"`
+	CDN                     *rest.CDNConfig                         `toml:"cdn"`
+	ResponseCache           *rest.ResponseCacheConfig               `toml:"responsecache"`
+	Receipt                 *rest.ReceiptConfig                     `toml:"receipt"`
+	TileHints               *rest.TileHintsConfig                   `toml:"tilehints"`
+	RequestSigning          *rest.RequestSigningConfig              `toml:"requestsigning"`
+	ShortLinks              *rest.ShortLinkConfig                   `toml:"shortlinks"`
+	PIDs                    *rest.PIDConfig                         `toml:"pids"`
+	PIDMint                 *rest.PIDMintConfig                     `toml:"pidmint"`
+	Embed                   *rest.EmbedConfig                       `toml:"embed"`
+	Headers                 *rest.HeaderPolicyConfig                `toml:"headers"`
+	Beacon                  *rest.BeaconConfig                      `toml:"beacon"`
+	Capabilities            map[string][]string                     `toml:"capabilities"`
+	METSALTOAction          string                                  `toml:"metsaltoaction"`
+	ActivityStreamPageSize  int                                     `toml:"activitystreampagesize"`
+	CollectionLanguages     map[string]string                       `toml:"collectionlanguages"`
+	RequestLog              *rest.RequestLogConfig                  `toml:"requestlog"`
+	ServerTiming            bool                                    `toml:"servertiming"`
+	Chaos                   *rest.ChaosConfig                       `toml:"chaos"`
+	LoadShed                *rest.LoadShedConfig                    `toml:"loadshed"`
+	DefaultActions          map[string]string                       `toml:"defaultactions"`
+	ActionDependencies      map[string][]string                     `toml:"actiondependencies"`
+	InfoPage                *rest.InfoPageConfig                    `toml:"infopage"`
+	Layers                  *rest.LayersConfig                      `toml:"layers"`
+	Manifest                *rest.ManifestConfig                    `toml:"manifest"`
+	Annotations             *rest.AnnotationConfig                  `toml:"annotations"`
+	Transcriptions          *rest.TranscriptionConfig               `toml:"transcriptions"`
+	Rights                  *rest.RightsConfig                      `toml:"rights"`
+	MetadataEmbed           *rest.MetadataEmbedConfig               `toml:"metadataembed"`
+	FastPath                *rest.FastPathConfig                    `toml:"fastpath"`
+	CachePolicy             *rest.CachePolicyConfig                 `toml:"cachepolicy"`
+	Backpressure            *rest.BackpressureConfig                `toml:"backpressure"`
+	Preview                 *rest.PreviewConfig                     `toml:"preview"`
+	Alternatives            map[string][]*rest.AlternativeConfig    `toml:"alternatives"`
+	Captions                *rest.CaptionsConfig                    `toml:"captions"`
+	AudioRenditions         []*rest.AudioRendition                  `toml:"audiorenditions"`
+	DataSaver               map[string]string                       `toml:"datasaver"`
+	ClientHints             *rest.ClientHintsConfig                 `toml:"clienthints"`
+	SizeBudget              *rest.SizeBudgetConfig                  `toml:"sizebudget"`
+	StorageQuota            *rest.StorageQuotaConfig                `toml:"storagequota"`
+	Accounting              *rest.AccountingConfig                  `toml:"accounting"`
+	DarkCollections         []string                                `toml:"darkcollections"`
+	Exhibitions             *rest.ExhibitionConfig                  `toml:"exhibitions"`
+	ResponseFilters         map[string][]*rest.ResponseFilterConfig `toml:"responsefilters"`
+	AccessPolicies          map[string]*rest.AccessPolicyConfig     `toml:"accesspolicies"`
+	ViewQuotas              map[string]*rest.ViewQuotaConfig        `toml:"viewquotas"`
+	Seats                   map[string]*rest.SeatConfig             `toml:"seats"`
+	PrintRequests           *rest.PrintRequestConfig                `toml:"printrequests"`
+	Mailer                  *rest.MailerConfig                      `toml:"mailer"`
+	Reports                 *rest.ReportConfig                      `toml:"reports"`
+	ActionErrors            *rest.ActionErrorConfig                 `toml:"actionerrors"`
+	Quarantine              *rest.QuarantineConfig                  `toml:"quarantine"`
+	GenerationPeers         *rest.GenerationPeersConfig             `toml:"generationpeers"`
+	Disconnect              *rest.DisconnectConfig                  `toml:"disconnect"`
+	VFSMapping              *rest.VFSMappingConfig                  `toml:"vfsmapping"`
+	VFSReloadGrace          config.Duration                         `toml:"vfsreloadgrace"`
+	VFSHealth               *rest.VFSHealthConfig                   `toml:"vfshealth"`
+	StreamBuffers           map[string]int                          `toml:"streambuffers"`
+	Progressive             *rest.ProgressiveConfig                 `toml:"progressive"`
+	InfoCache               *rest.InfoCacheConfig                   `toml:"infocache"`
+	Precompressed           []string                                `toml:"precompressed"`
+	Fallback                *rest.FallbackConfig                    `toml:"fallback"`
+	ReadOnly                bool                                    `toml:"readonly"`
+	Tenants                 map[string]*rest.TenantConfig           `toml:"tenants"`
 }
 
 func LoadMediaserverMainConfig(fSys fs.FS, fp string, conf *MediaserverMainConfig) error {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/fake"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// demoAdminKey is the admin key of the demo mode. the demo listens on localhost only
+const demoAdminKey = "demo-admin-key-0123456789abcdef0123"
+
+// serveDemo runs the server with in-memory backends of package fake and sample images, no configuration or
+// backend services needed. the images of dir are served instead of the bundled samples if dir is not empty
+func serveDemo(addr, dir string) {
+	_logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).With().Timestamp().Logger().Level(zerolog.InfoLevel)
+	var logger zLogger.ZLogger = &_logger
+
+	demo, err := fake.NewDemo(dir)
+	if err != nil {
+		log.Fatalf("cannot create demo content: %v", err)
+	}
+	extAddr := "http://" + addr
+	ctrl, err := rest.New(&rest.ServerConfig{
+		Addr:         addr,
+		ExtAddr:      extAddr,
+		JWTAlgs:      []string{"HS256", "HS384", "HS512"},
+		DBClient:     demo.DB,
+		ActionClient: demo.Actions,
+		VFS:          demo.FS,
+		Logger:       logger,
+	}, rest.WithAdminKey(demoAdminKey))
+	if err != nil {
+		log.Fatalf("cannot create controller: %v", err)
+	}
+
+	fmt.Printf("demo mode - all data is kept in memory\n\n")
+	for _, signature := range demo.Public {
+		fmt.Printf("  %s/%s/%s/item\n", extAddr, fake.DemoCollection, signature)
+		fmt.Printf("  %s/%s/%s/resize/size320x/formatjpeg\n", extAddr, fake.DemoCollection, signature)
+		fmt.Printf("  %s/%s/%s/metadata\n", extAddr, fake.DemoCollection, signature)
+	}
+	for _, signature := range demo.Restricted {
+		subject := rest.AccessSubject(fake.DemoCollection, signature, "item", "")
+		token, err := rest.MintToken(fake.DemoJWTKey, "HS256", subject, 24*time.Hour)
+		if err != nil {
+			log.Fatalf("cannot mint demo token: %v", err)
+		}
+		fmt.Printf("  %s/%s (restricted, without token: 401)\n", extAddr, subject)
+		fmt.Printf("  %s/%s?token=%s\n", extAddr, subject, token)
+	}
+	adminToken, err := rest.MintToken(demoAdminKey, "HS256", rest.AdminSubject, 24*time.Hour)
+	if err != nil {
+		log.Fatalf("cannot mint admin token: %v", err)
+	}
+	fmt.Printf("\nadmin api: curl -H 'Authorization: Bearer %s' %s/admin/collections\n\n", adminToken, extAddr)
+
+	var wg = &sync.WaitGroup{}
+	if err := ctrl.Start(wg); err != nil {
+		log.Fatalf("cannot start server: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	ctrl.GracefulStop()
+	wg.Wait()
+}
@@ -0,0 +1,26 @@
+package main
+
+// serviceEvent is a platform independent request to the running service
+type serviceEvent int
+
+const (
+	// eventStop requests a graceful shutdown
+	eventStop serviceEvent = iota
+	// eventHandoff requests a zero downtime upgrade by a new binary
+	eventHandoff
+	// eventReload requests reloading the vfs configuration
+	eventReload
+)
+
+func (e serviceEvent) String() string {
+	switch e {
+	case eventStop:
+		return "stop"
+	case eventHandoff:
+		return "handoff"
+	case eventReload:
+		return "reload"
+	default:
+		return "unknown"
+	}
+}
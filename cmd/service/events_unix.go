@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// serviceEvents maps SIGINT and SIGTERM to stop, SIGUSR2 to handoff and SIGHUP to reload.
+// the returned function must be called after the service has stopped
+func serviceEvents(name string) (<-chan serviceEvent, func(), error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP)
+	events := make(chan serviceEvent, 1)
+	go func() {
+		for s := range sigs {
+			switch s {
+			case syscall.SIGUSR2:
+				events <- eventHandoff
+			case syscall.SIGHUP:
+				events <- eventReload
+			default:
+				events <- eventStop
+			}
+		}
+	}()
+	return events, func() { signal.Stop(sigs) }, nil
+}
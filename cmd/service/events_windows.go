@@ -0,0 +1,72 @@
+//go:build windows
+
+package main
+
+import (
+	"emperror.dev/errors"
+	"golang.org/x/sys/windows/svc"
+	"os"
+	"os/signal"
+)
+
+type windowsService struct {
+	events  chan serviceEvent
+	stopped chan struct{}
+}
+
+// Execute implements svc.Handler. stop and shutdown requests are passed to the service,
+// the handler waits until the service has finished before reporting stopped
+func (ws *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				ws.events <- eventStop
+				<-ws.stopped
+				return false, 0
+			}
+		case <-ws.stopped:
+			// service ended on its own
+			return false, 0
+		}
+	}
+}
+
+// serviceEvents uses the service control manager if started as windows service and ctrl+c otherwise.
+// the returned function must be called after the service has stopped
+func serviceEvents(name string) (<-chan serviceEvent, func(), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot determine whether running as windows service")
+	}
+	events := make(chan serviceEvent, 1)
+	if !isService {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		go func() {
+			for range sigs {
+				events <- eventStop
+			}
+		}()
+		return events, func() { signal.Stop(sigs) }, nil
+	}
+	ws := &windowsService{events: events, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(name, ws); err != nil {
+			// without service control manager the service cannot be stopped, so stop it now
+			events <- eventStop
+		}
+	}()
+	return events, func() {
+		close(ws.stopped)
+		<-done
+	}, nil
+}
@@ -1,61 +1,49 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"emperror.dev/errors"
 	"flag"
 	"fmt"
 	"github.com/je4/certloader/v2/pkg/loader"
 	"github.com/je4/filesystem/v3/pkg/vfsrw"
-	"github.com/je4/mediaservermain/v2/config"
 	"github.com/je4/mediaservermain/v2/pkg/rest"
 	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
 	"github.com/je4/miniresolver/v2/pkg/resolver"
-	configutil "github.com/je4/utils/v2/pkg/config"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	ublogger "gitlab.switch.ch/ub-unibas/go-ublogger"
 	"io"
 	"io/fs"
 	"log"
 	"os"
-	"os/signal"
-	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 )
 
-var configfile = flag.String("config", "", "location of toml configuration file")
+// serve runs the media server. it is the default command
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configfile := flags.String("config", "", "location of toml configuration file")
+	demo := flags.Bool("demo", false, "run with in-memory backends and sample images, no configuration or backend services needed")
+	demoAddr := flags.String("demoaddr", "localhost:8761", "listen address of the demo mode")
+	demoDir := flags.String("demodir", "", "directory with png, jpeg or gif images for the demo mode (default: bundled samples)")
+	flags.Parse(args)
 
-func main() {
-	flag.Parse()
-
-	var cfgFS fs.FS
-	var cfgFile string
-	if *configfile != "" {
-		cfgFS = os.DirFS(filepath.Dir(*configfile))
-		cfgFile = filepath.Base(*configfile)
-	} else {
-		cfgFS = config.ConfigFS
-		cfgFile = "mediaservermain.toml"
+	if *demo {
+		serveDemo(*demoAddr, *demoDir)
+		return
 	}
 
-	conf := &MediaserverMainConfig{
-		LocalAddr: "localhost:8443",
-		//ResolverTimeout: config.Duration(10 * time.Minute),
-		ExternalAddr:            "https://localhost:8443",
-		LogLevel:                "DEBUG",
-		ResolverTimeout:         configutil.Duration(10 * time.Minute),
-		ResolverNotFoundTimeout: configutil.Duration(10 * time.Second),
-		ActionTemplateTimeout:   configutil.Duration(120 * time.Second),
-		CollectionCacheTimeout:  configutil.Duration(10 * time.Minute),
-		CollectionCacheSize:     30,
-		ItemCacheSize:           1000,
-		ClientTLS: &loader.Config{
-			Type: "DEV",
-		},
+	conf, err := loadConfig(*configfile)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
-	if err := LoadMediaserverMainConfig(cfgFS, cfgFile, conf); err != nil {
-		log.Fatalf("cannot load toml from [%v] %s: %v", cfgFS, cfgFile, err)
+	if err := checkJWTKey(conf.JWTKey); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(conf.JWTAlg) == 0 {
+		log.Fatalf("no jwtalg set")
 	}
 
 	// create logger instance
@@ -112,6 +100,21 @@ func main() {
 		logger.Fatal().Err(err).Msg("cannot create server loader")
 	}
 	defer webLoader.Close()
+	if len(conf.WebTLSHosts) > 0 {
+		hostTLSConfigs := map[string]*tls.Config{}
+		for host, hostConf := range conf.WebTLSHosts {
+			hostTLSConfig, hostLoader, err := loader.CreateServerLoader(false, hostConf, nil, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msgf("cannot create server loader for host %s", host)
+			}
+			defer hostLoader.Close()
+			hostTLSConfigs[host] = hostTLSConfig
+		}
+		webTLSConfig, err = newSNITLSConfig(webTLSConfig, hostTLSConfigs)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("cannot create sni tls config")
+		}
+	}
 
 	/*
 		serverCert, serverLoader, err := loader.CreateServerLoader(false, conf.ServerTLS, nil, logger)
@@ -127,8 +130,21 @@ func main() {
 	}
 	defer clientLoader.Close()
 
-	logger.Info().Msgf("resolver address is %s", conf.ResolverAddr)
-	resolverClient, err := resolver.NewMiniresolverClient(conf.ResolverAddr, conf.GRPCClient, clientCert, nil, time.Duration(conf.ResolverTimeout), time.Duration(conf.ResolverNotFoundTimeout), logger)
+	var rpcMetrics *rest.RPCMetrics
+	if conf.GRPC != nil && conf.GRPC.Metrics {
+		rpcMetrics = rest.NewRPCMetrics()
+	}
+	dialOpts, err := rest.GRPCDialOptions(conf.GRPC, rpcMetrics)
+	if err != nil {
+		logger.Fatal().Msgf("invalid grpc client config: %v", err)
+	}
+
+	if conf.ResolverAddr == "" {
+		logger.Info().Msgf("no resolver, database at %s, action controller at %s", conf.DatabaseAddr, conf.ActionAddr)
+	} else {
+		logger.Info().Msgf("resolver address is %s", conf.ResolverAddr)
+	}
+	resolverClient, err := resolver.NewMiniresolverClient(conf.ResolverAddr, backendClientMap(conf), clientCert, nil, time.Duration(conf.ResolverTimeout), time.Duration(conf.ResolverNotFoundTimeout), logger, dialOpts...)
 	if err != nil {
 		logger.Fatal().Msgf("cannot create resolver client: %v", err)
 	}
@@ -146,6 +162,12 @@ func main() {
 	}
 	resolver.DoPing(actionControllerClient, logger)
 
+	// the dispatcher lists the actions of all workers for /actions, discovery falls back to probing if it fails
+	actionCatalogClient, err := resolver.NewClient[mediaserverproto.ActionDispatcherClient](resolverClient, mediaserverproto.NewActionDispatcherClient, mediaserverproto.ActionDispatcher_ServiceDesc.ServiceName, conf.Domain)
+	if err != nil {
+		logger.Panic().Msgf("cannot create mediaserveractiondispatcher grpc client: %v", err)
+	}
+
 	ctrl, err := rest.NewMainController(
 		conf.LocalAddr,
 		conf.ExternalAddr,
@@ -161,19 +183,168 @@ func main() {
 		conf.CollectionCacheSize,
 		time.Duration(conf.CollectionCacheTimeout),
 		time.Duration(conf.ActionTemplateTimeout),
-		logger)
+		logger,
+		// the reloadable vfs must be wrapped by the other options
+		append([]rest.Option{rest.WithVFSReload(func() (fs.FS, error) {
+			newConf, err := loadConfig(*configfile)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return vfsrw.NewFS(newConf.VFS, logger)
+		}, time.Duration(conf.VFSReloadGrace)), rest.WithRPCMetrics(rpcMetrics), rest.WithActionCatalog(actionCatalogClient)}, controllerOptions(conf)...)...,
+	)
 	if err != nil {
 		logger.Fatal().Msgf("cannot create controller: %v", err)
 	}
 	var wg = &sync.WaitGroup{}
-	ctrl.Start(wg)
+	if err := ctrl.Start(wg); err != nil {
+		logger.Fatal().Err(err).Msg("cannot start server")
+	}
+	if err := rest.HandoffReady(); err != nil {
+		logger.Error().Err(err).Msg("cannot signal handoff readiness")
+	}
+	if err := sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		logger.Error().Err(err).Msg("cannot notify systemd")
+	}
+	watchdogCtx, watchdogCancel := context.WithCancel(context.Background())
+	defer watchdogCancel()
+	if interval, ok := sdWatchdogInterval(); ok {
+		go sdWatchdog(watchdogCtx, interval)
+	}
 
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	events, stopEvents, err := serviceEvents(conf.ServiceName)
+	if err != nil {
+		logger.Fatal().Msgf("cannot handle service events: %v", err)
+	}
+	defer stopEvents()
 	fmt.Println("press ctrl+c to stop server")
-	s := <-done
-	fmt.Println("got signal:", s)
+	var handedOff bool
+	for {
+		e := <-events
+		fmt.Println("got event:", e)
+		if e == eventReload {
+			if err := ctrl.ReloadVFS(); err != nil {
+				logger.Error().Err(err).Msg("cannot reload vfs")
+			}
+			continue
+		}
+		if e != eventHandoff {
+			break
+		}
+		// zero downtime upgrade: the new binary takes over the listeners, this process finishes running requests.
+		// the new process becomes MAINPID and owns the systemd watchdog
+		os.Unsetenv("WATCHDOG_PID")
+		if _, err := ctrl.Handoff(time.Duration(conf.HandoffTimeout)); err != nil {
+			logger.Error().Err(err).Msg("handoff failed")
+			continue
+		}
+		handedOff = true
+		break
+	}
 
+	if !handedOff {
+		sdNotify("STOPPING=1")
+	}
 	ctrl.GracefulStop()
+	watchdogCancel()
 	wg.Wait()
 }
+
+// backendClientMap adds the static backend addresses to the grpcclient map. the resolver uses the map
+// before asking the miniresolver, so static addresses bypass it with the same client tls config
+func backendClientMap(conf *MediaserverMainConfig) map[string]string {
+	clientMap := map[string]string{}
+	for name, addr := range conf.GRPCClient {
+		clientMap[name] = addr
+	}
+	if conf.DatabaseAddr != "" {
+		clientMap[backendServiceName(conf.Domain, mediaserverproto.Database_ServiceDesc.ServiceName)] = conf.DatabaseAddr
+	}
+	if conf.ActionAddr != "" {
+		clientMap[backendServiceName(conf.Domain, mediaserverproto.Action_ServiceDesc.ServiceName)] = conf.ActionAddr
+		clientMap[backendServiceName(conf.Domain, mediaserverproto.ActionDispatcher_ServiceDesc.ServiceName)] = conf.ActionAddr
+	}
+	return clientMap
+}
+
+// backendServiceName is the key of a service in the grpcclient map
+func backendServiceName(domain, name string) string {
+	if domain == "" {
+		return name
+	}
+	return domain + "." + name
+}
+
+// controllerOptions maps the configuration to the optional controller features
+func controllerOptions(conf *MediaserverMainConfig) []rest.Option {
+	return []rest.Option{
+		rest.WithListenAddrs(conf.LocalAddrs...),
+		rest.WithAdminKey(conf.JWTKey),
+		rest.WithCollectionJWT(conf.CollectionJWT),
+		rest.WithWeakJWTKeys(conf.JWTAllowWeakKeys),
+		rest.WithRequestSigning(conf.RequestSigning),
+		rest.WithTokenCache(conf.TokenCacheSize, time.Duration(conf.TokenCacheTimeout)),
+		rest.WithAccessCache(conf.AccessCacheSize, time.Duration(conf.AccessCacheTimeout)),
+		rest.WithCDN(conf.CDN),
+		rest.WithResponseCache(conf.ResponseCache),
+		rest.WithReceipts(conf.Receipt),
+		rest.WithMETS(conf.METSALTOAction),
+		rest.WithActivityStream(conf.ActivityStreamPageSize),
+		rest.WithCollectionLanguages(conf.CollectionLanguages),
+		rest.WithRequestLog(conf.RequestLog),
+		rest.WithServerTiming(conf.ServerTiming),
+		rest.WithChaos(conf.Chaos),
+		rest.WithVFSHealth(conf.VFSHealth),
+		rest.WithStreamBuffers(conf.StreamBuffers),
+		rest.WithProgressiveDelivery(conf.Progressive),
+		rest.WithInfoCache(conf.InfoCache),
+		rest.WithPrecompressed(conf.Precompressed),
+		rest.WithDerivativeFallback(conf.Fallback),
+		rest.WithReadOnly(conf.ReadOnly),
+		rest.WithTenants(conf.Tenants),
+		rest.WithLoadShedding(conf.LoadShed),
+		rest.WithShortLinks(conf.ShortLinks),
+		rest.WithPIDs(conf.PIDs),
+		rest.WithPIDMinting(conf.PIDMint),
+		rest.WithDefaultActions(conf.DefaultActions),
+		rest.WithActionDependencies(conf.ActionDependencies),
+		rest.WithTileHints(conf.TileHints),
+		rest.WithEmbed(conf.Embed),
+		rest.WithHeaderPolicy(conf.Headers),
+		rest.WithBeacon(conf.Beacon),
+		rest.WithCapabilities(conf.Capabilities),
+		rest.WithInfoPage(conf.InfoPage),
+		rest.WithLayers(conf.Layers),
+		rest.WithManifest(conf.Manifest),
+		rest.WithAnnotations(conf.Annotations),
+		rest.WithTranscriptions(conf.Transcriptions),
+		rest.WithRights(conf.Rights),
+		rest.WithMetadataEmbed(conf.MetadataEmbed),
+		rest.WithFastPath(conf.FastPath),
+		rest.WithCachePolicy(conf.CachePolicy),
+		rest.WithBackpressure(conf.Backpressure),
+		rest.WithPreview(conf.Preview),
+		rest.WithAlternatives(conf.Alternatives),
+		rest.WithCaptions(conf.Captions),
+		rest.WithAudioRenditions(conf.AudioRenditions),
+		rest.WithDataSaver(conf.DataSaver),
+		rest.WithClientHints(conf.ClientHints),
+		rest.WithSizeBudget(conf.SizeBudget),
+		rest.WithStorageQuota(conf.StorageQuota),
+		rest.WithAccounting(conf.Accounting),
+		rest.WithDarkCollections(conf.DarkCollections),
+		rest.WithExhibitions(conf.Exhibitions),
+		rest.WithResponseFilters(conf.ResponseFilters),
+		rest.WithAccessPolicies(conf.AccessPolicies),
+		rest.WithViewQuotas(conf.ViewQuotas),
+		rest.WithSeats(conf.Seats),
+		rest.WithPrintRequests(conf.PrintRequests),
+		rest.WithMailerConfig(conf.Mailer),
+		rest.WithReports(conf.Reports),
+		rest.WithActionErrors(conf.ActionErrors),
+		rest.WithQuarantine(conf.Quarantine),
+		rest.WithGenerationPeers(conf.GenerationPeers),
+		rest.WithDisconnectPolicy(conf.Disconnect),
+		rest.WithVFSMapping(conf.VFSMapping),
+	}
+}
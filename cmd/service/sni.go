@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"emperror.dev/errors"
+	"strings"
+)
+
+type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+func certificateFunc(tlsConfig *tls.Config) (getCertificateFunc, error) {
+	if tlsConfig.GetCertificate != nil {
+		return tlsConfig.GetCertificate, nil
+	}
+	if len(tlsConfig.Certificates) > 0 {
+		cert := &tlsConfig.Certificates[0]
+		return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert, nil }, nil
+	}
+	return nil, errors.New("no certificate in tls config")
+}
+
+// newSNITLSConfig selects the server certificate by the server name of the client hello.
+// host names may start with "*." to match all direct subdomains. unknown names get the default certificate
+func newSNITLSConfig(defaultConfig *tls.Config, hostConfigs map[string]*tls.Config) (*tls.Config, error) {
+	defaultFunc, err := certificateFunc(defaultConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid default tls config")
+	}
+	hosts := map[string]getCertificateFunc{}
+	for name, hostConfig := range hostConfigs {
+		f, err := certificateFunc(hostConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tls config for host %s", name)
+		}
+		hosts[strings.ToLower(name)] = f
+	}
+	tlsConfig := defaultConfig.Clone()
+	tlsConfig.Certificates = nil
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if f, ok := hosts[name]; ok {
+			return f(hello)
+		}
+		if _, domain, found := strings.Cut(name, "."); found {
+			if f, ok := hosts["*."+domain]; ok {
+				return f(hello)
+			}
+		}
+		return defaultFunc(hello)
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"github.com/je4/mediaservermain/v2/pkg/soak"
+	"github.com/je4/mediaservermain/v2/pkg/webtest"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// soakTest runs the load generator against an in-process server with the fake backends. with -config, the features
+// of the configuration are enabled, the backends are fake nevertheless
+func soakTest(args []string) {
+	flags := flag.NewFlagSet("soak", flag.ExitOnError)
+	configfile := flags.String("config", "", "toml configuration whose features are enabled (default: none)")
+	duration := flags.Duration("duration", time.Hour, "duration of the load after the warmup")
+	warmup := flags.Duration("warmup", 5*time.Minute, "load before sampling starts")
+	interval := flags.Duration("interval", time.Minute, "time between samples")
+	concurrency := flags.Int("concurrency", 8, "number of clients")
+	keys := flags.Int("keys", 2000, "number of distinct items and sizes, should exceed the cache sizes")
+	tolerance := flags.Float64("tolerance", 0.1, "allowed growth of the second half of the samples over the first")
+	reportFile := flags.String("report", "", "write the report with all samples as json to this file")
+	flags.Parse(args)
+
+	var opts []rest.Option
+	if *configfile != "" {
+		conf, err := loadConfig(*configfile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		// samples are read from the admin api with the key of the test server
+		opts = append(controllerOptions(conf), rest.WithAdminKey(webtest.AdminKey))
+	}
+	srv, err := webtest.NewServer(opts...)
+	if err != nil {
+		log.Fatalf("cannot start server: %v", err)
+	}
+	defer srv.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("soak test for %v after %v warmup with %d clients\n", *duration, *warmup, *concurrency)
+	report, err := soak.Run(ctx, srv, &soak.Config{
+		Duration:    *duration,
+		Warmup:      *warmup,
+		Interval:    *interval,
+		Concurrency: *concurrency,
+		Keys:        *keys,
+		Tolerance:   *tolerance,
+		Progress: func(s *rest.RuntimeStats, requests int64) {
+			fmt.Printf("%s requests=%d goroutines=%d heap=%dKiB objects=%d sizes=%v\n", s.Time.Format(time.RFC3339), requests, s.Goroutines, s.HeapAlloc>>10, s.HeapObjects, s.Sizes)
+		},
+	})
+	if err != nil {
+		log.Fatalf("soak test failed: %v", err)
+	}
+	if *reportFile != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("cannot marshal report: %v", err)
+		}
+		if err := os.WriteFile(*reportFile, data, 0o644); err != nil {
+			log.Fatalf("cannot write report: %v", err)
+		}
+	}
+	fmt.Printf("\n%d requests, %d errors, status %v\n", report.Requests, report.Errors, report.Status)
+	fmt.Printf("goroutines %d before, %d after, heap %dKiB before, %dKiB after\n", report.Baseline.Goroutines, report.Final.Goroutines, report.Baseline.HeapAlloc>>10, report.Final.HeapAlloc>>10)
+	if report.OK() {
+		fmt.Println("no leaks found")
+		return
+	}
+	for _, leak := range report.Leaks {
+		fmt.Printf("leak: %s\n", leak)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state notification to systemd (sd_notify(3)). without NOTIFY_SOCKET it does nothing
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// abstract namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to notify socket %s", os.Getenv("NOTIFY_SOCKET"))
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrapf(err, "cannot send '%s' to notify socket", state)
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns the interval for watchdog keep-alive messages if the watchdog is enabled
+func sdWatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0, false
+		}
+	}
+	// systemd recommends sending keep-alives at half the timeout
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
+
+// sdWatchdog sends keep-alive messages until the context is cancelled
+func sdWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
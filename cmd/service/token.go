@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"os"
+	"strings"
+	"time"
+)
+
+// token prints a signed url for <collection>/<signature>/<action>/<params>.
+// without -key the running instance signs the token with the key of the collection from the database
+func token(args []string) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	configfile := flags.String("config", "", "location of toml configuration file")
+	key := flags.String("key", "", "jwt key of the collection (hmac secret or pem encoded private key). if empty, the running instance mints the token")
+	alg := flags.String("alg", "", "jwt alg if -key is given (default: first jwtalg of configuration)")
+	ttl := flags.Duration("ttl", 0, "validity of the token (default: defaultttl of the collection or 1h)")
+	addr := flags.String("addr", "", "base url of the instance (default: externaladdr of configuration)")
+	insecure := flags.Bool("insecure", false, "do not verify the tls certificate of the instance")
+	short := flags.Bool("short", false, "print a short link instead of the signed url. needs the running instance")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: token [flags] <collection>/<signature>/<action>[/<params>]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	conf, err := loadConfig(*configfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	parts := strings.SplitN(strings.Trim(flags.Arg(0), "/"), "/", 4)
+	if len(parts) < 3 {
+		fmt.Fprintf(os.Stderr, "invalid path '%s'. use <collection>/<signature>/<action>[/<params>]\n", flags.Arg(0))
+		os.Exit(2)
+	}
+	var paramStr string
+	if len(parts) == 4 {
+		paramStr = parts[3]
+	}
+
+	if *key == "" {
+		var ttlStr string
+		if *ttl > 0 {
+			ttlStr = ttl.String()
+		}
+		ac, err := newAdminClient(conf, *addr, *insecure)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		var result rest.TokenResponse
+		if _, err := ac.post("/token", &rest.TokenRequest{
+			Collection: parts[0],
+			Signature:  parts[1],
+			Action:     parts[2],
+			Params:     paramStr,
+			TTL:        ttlStr,
+			Short:      *short,
+		}, &result); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if *short {
+			fmt.Println(result.Short)
+			return
+		}
+		fmt.Println(result.URL)
+		return
+	}
+
+	if *alg == "" && len(conf.JWTAlg) > 0 {
+		*alg = conf.JWTAlg[0]
+	}
+	if *short {
+		fmt.Fprintf(os.Stderr, "-short cannot be used with -key\n")
+		os.Exit(2)
+	}
+	if *ttl <= 0 {
+		*ttl = time.Hour
+		if cc, ok := conf.CollectionJWT[parts[0]]; ok && cc.DefaultTTL > 0 {
+			*ttl = time.Duration(cc.DefaultTTL)
+		}
+	}
+	if cc, ok := conf.CollectionJWT[parts[0]]; ok && cc.MaxTTL > 0 && *ttl > time.Duration(cc.MaxTTL) {
+		fmt.Fprintf(os.Stderr, "ttl %v exceeds maximum of %v for collection %s\n", *ttl, time.Duration(cc.MaxTTL), parts[0])
+		os.Exit(2)
+	}
+	subject := rest.AccessSubject(parts[0], parts[1], parts[2], paramStr)
+	tokenStr, err := rest.MintToken(*key, *alg, subject, *ttl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s/%s?token=%s\n", strings.TrimRight(conf.ExternalAddr, "/"), subject, tokenStr)
+}
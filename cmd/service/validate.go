@@ -0,0 +1,88 @@
+package main
+
+import (
+	"emperror.dev/errors"
+	"flag"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"net/url"
+	"os"
+)
+
+// validate checks the configuration and exits with status 1 on errors
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configfile := flags.String("config", "", "location of toml configuration file")
+	flags.Parse(args)
+
+	conf, err := loadConfig(*configfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err := validateConfig(conf); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("configuration ok")
+}
+
+// sampleJWTKey is the jwtkey of former sample configurations, which is known to everybody
+const sampleJWTKey = "geheim"
+
+// checkJWTKey rejects a missing jwtkey and the key of the sample configuration
+func checkJWTKey(key string) error {
+	if key == "" {
+		return errors.New("no jwtkey set")
+	}
+	if key == sampleJWTKey {
+		return errors.New("jwtkey of the sample configuration set, please configure a secret key")
+	}
+	return nil
+}
+
+func validateConfig(conf *MediaserverMainConfig) error {
+	var errs []error
+	if conf.LocalAddr == "" && len(conf.LocalAddrs) == 0 {
+		errs = append(errs, errors.New("neither localaddr nor localaddrs set"))
+	}
+	if u, err := url.Parse(conf.ExternalAddr); err != nil {
+		errs = append(errs, errors.Wrapf(err, "invalid externaladdr '%s'", conf.ExternalAddr))
+	} else if u.Scheme == "" || u.Host == "" {
+		errs = append(errs, errors.Errorf("externaladdr '%s' must be an absolute url", conf.ExternalAddr))
+	}
+	if conf.ResolverAddr == "" {
+		// without resolver all backends need a static address
+		clientMap := backendClientMap(conf)
+		for _, service := range []string{mediaserverproto.Database_ServiceDesc.ServiceName, mediaserverproto.Action_ServiceDesc.ServiceName} {
+			name := backendServiceName(conf.Domain, service)
+			if clientMap[name] == "" {
+				errs = append(errs, errors.Errorf("neither resolveraddr nor static address for %s set", name))
+			}
+		}
+	}
+	if _, err := rest.GRPCDialOptions(conf.GRPC, nil); err != nil {
+		errs = append(errs, errors.Wrap(err, "invalid grpc config"))
+	}
+	if err := checkJWTKey(conf.JWTKey); err != nil {
+		errs = append(errs, err)
+	}
+	if len(conf.JWTAlg) == 0 {
+		errs = append(errs, errors.New("no jwtalg set"))
+	}
+	if conf.IIIF != "" && conf.IIIFBaseAction == "" {
+		errs = append(errs, errors.New("iiif requires iiifbaseaction"))
+	}
+	if conf.ItemCacheSize <= 0 || conf.CollectionCacheSize <= 0 {
+		errs = append(errs, errors.New("itemcachesize and collectioncachesize must be positive"))
+	}
+	nop := zerolog.Nop()
+	var logger zLogger.ZLogger = &nop
+	if err := rest.ValidateOptions(conf.JWTAlg, logger, controllerOptions(conf)...); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Combine(errs...)
+}
@@ -11,12 +11,18 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/je4/certloader/v2 v2.0.9
 	github.com/je4/filesystem/v3 v3.0.15
+	github.com/je4/genericproto/v2 v2.0.3
 	github.com/je4/mediaserveraction/v2 v2.0.19
 	github.com/je4/mediaserverproto/v2 v2.0.46
 	github.com/je4/miniresolver/v2 v2.0.25
 	github.com/je4/utils/v2 v2.0.50
+	github.com/rs/zerolog v1.33.0
 	gitlab.switch.ch/ub-unibas/go-ublogger v1.0.1-0.20241003150841-9a98ca0d50cf
+	go.starlark.net v0.0.0-20241226192728-8dfa5b98479f
+	golang.org/x/sys v0.26.0
+	golang.org/x/text v0.19.0
 	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.35.1
 )
 
 require (
@@ -43,7 +49,6 @@ require (
 	github.com/goccy/go-json v0.10.3 // indirect
 	github.com/google/certificate-transparency-go v1.2.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/je4/genericproto/v2 v2.0.3 // indirect
 	github.com/je4/minivault/v2 v2.0.1 // indirect
 	github.com/je4/trustutil/v2 v2.0.26 // indirect
 	github.com/josharian/intern v1.0.0 // indirect
@@ -63,7 +68,6 @@ require (
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pkg/sftp v1.13.6 // indirect
 	github.com/rs/xid v1.6.0 // indirect
-	github.com/rs/zerolog v1.33.0 // indirect
 	github.com/smallstep/certinfo v1.12.2 // indirect
 	github.com/swaggo/files v1.0.1 // indirect
 	github.com/swaggo/gin-swagger v1.6.0 // indirect
@@ -77,11 +81,8 @@ require (
 	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/exp v0.0.0-20241004190924-225e2abe05e6 // indirect
 	golang.org/x/net v0.30.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/text v0.19.0 // indirect
 	golang.org/x/tools v0.26.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241007155032-5fefd90f89a9 // indirect
-	google.golang.org/protobuf v1.35.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	k8s.io/klog/v2 v2.130.1 // indirect
 )
@@ -0,0 +1,92 @@
+package fake
+
+import (
+	"context"
+	genericproto "github.com/je4/genericproto/v2/pkg/generic/proto"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"sync"
+)
+
+// ActionFunc creates the cache entry of an action. the metadata is completed with action, params and storage
+type ActionFunc func(in *mediaserverproto.ActionParam) (*mediaserverproto.CacheMetadata, error)
+
+// Actions is an in-memory action backend. successful actions are stored in the database, like the action controller does
+type Actions struct {
+	sync.Mutex
+	db      *Database
+	params  map[string][]string
+	actions map[string]ActionFunc
+	calls   map[string]int
+}
+
+func NewActions(db *Database) *Actions {
+	return &Actions{
+		db:      db,
+		params:  map[string][]string{},
+		actions: map[string]ActionFunc{},
+		calls:   map[string]int{},
+	}
+}
+
+func actionKey(mediaType, action string) string {
+	return mediaType + "::" + action
+}
+
+// AddAction registers an action of a media type with its allowed parameters
+func (a *Actions) AddAction(mediaType, action string, params []string, fn ActionFunc) {
+	a.Lock()
+	defer a.Unlock()
+	a.params[actionKey(mediaType, action)] = params
+	if fn != nil {
+		a.actions[actionKey(mediaType, action)] = fn
+	}
+}
+
+// Calls returns the number of calls of a method, e.g. "Action"
+func (a *Actions) Calls(method string) int {
+	a.Lock()
+	defer a.Unlock()
+	return a.calls[method]
+}
+
+func (a *Actions) GetParams(ctx context.Context, in *mediaserverproto.ParamsParam, opts ...grpc.CallOption) (*genericproto.StringList, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.calls["GetParams"]++
+	params, ok := a.params[actionKey(in.GetType(), in.GetAction())]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "action %s::%s not found", in.GetType(), in.GetAction())
+	}
+	return &genericproto.StringList{Values: params}, nil
+}
+
+func (a *Actions) Action(ctx context.Context, in *mediaserverproto.ActionParam, opts ...grpc.CallOption) (*mediaserverproto.Cache, error) {
+	a.Lock()
+	a.calls["Action"]++
+	fn, ok := a.actions[actionKey(in.GetItem().GetMetadata().GetType(), in.GetAction())]
+	a.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "action %s::%s not found", in.GetItem().GetMetadata().GetType(), in.GetAction())
+	}
+	md, err := fn(in)
+	if err != nil {
+		return nil, err
+	}
+	md = proto.Clone(md).(*mediaserverproto.CacheMetadata)
+	md.Action = in.GetAction()
+	md.Params = actionCache.ActionParams(in.GetParams()).String()
+	if md.Storage == nil {
+		md.Storage = in.GetStorage()
+	}
+	cache := &mediaserverproto.Cache{
+		Identifier: in.GetItem().GetIdentifier(),
+		Metadata:   md,
+	}
+	a.db.AddCache(cache)
+	return cache, nil
+}
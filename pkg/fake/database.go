@@ -0,0 +1,317 @@
+// Package fake provides in-memory implementations of the database and action backends
+// and a small fixture to exercise the rest controller without the grpc services
+package fake
+
+import (
+	"context"
+	"fmt"
+	genericproto "github.com/je4/genericproto/v2/pkg/generic/proto"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func itemKey(collection, signature string) string {
+	return collection + "/" + signature
+}
+
+func cacheKey(collection, signature, action, params string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", collection, signature, action, params)
+}
+
+// Database is an in-memory database backend. all returned messages are copies
+type Database struct {
+	sync.RWMutex
+	items       map[string]*mediaserverproto.Item
+	metadata    map[string]string
+	caches      map[string]*mediaserverproto.Cache
+	collections map[string]*mediaserverproto.Collection
+	storages    map[string]*mediaserverproto.Storage
+	removed     []*rest.ItemChange
+	calls       map[string]int
+	streams     atomic.Int64
+}
+
+func NewDatabase() *Database {
+	return &Database{
+		items:       map[string]*mediaserverproto.Item{},
+		metadata:    map[string]string{},
+		caches:      map[string]*mediaserverproto.Cache{},
+		collections: map[string]*mediaserverproto.Collection{},
+		storages:    map[string]*mediaserverproto.Storage{},
+		calls:       map[string]int{},
+	}
+}
+
+// AddStorage adds or replaces a storage
+func (db *Database) AddStorage(stor *mediaserverproto.Storage) {
+	db.Lock()
+	defer db.Unlock()
+	db.storages[stor.GetName()] = proto.Clone(stor).(*mediaserverproto.Storage)
+}
+
+// AddCollection adds or replaces a collection
+func (db *Database) AddCollection(coll *mediaserverproto.Collection) {
+	db.Lock()
+	defer db.Unlock()
+	db.collections[coll.GetName()] = proto.Clone(coll).(*mediaserverproto.Collection)
+}
+
+// AddItem adds or replaces an item and its metadata json
+func (db *Database) AddItem(item *mediaserverproto.Item, metadata string) {
+	db.Lock()
+	defer db.Unlock()
+	key := itemKey(item.GetIdentifier().GetCollection(), item.GetIdentifier().GetSignature())
+	db.items[key] = proto.Clone(item).(*mediaserverproto.Item)
+	if metadata != "" {
+		db.metadata[key] = metadata
+	}
+}
+
+// AddCache adds or replaces a cache entry of an action with its canonical parameter string
+func (db *Database) AddCache(cache *mediaserverproto.Cache) {
+	db.Lock()
+	defer db.Unlock()
+	md := cache.GetMetadata()
+	key := cacheKey(cache.GetIdentifier().GetCollection(), cache.GetIdentifier().GetSignature(), md.GetAction(), md.GetParams())
+	db.caches[key] = proto.Clone(cache).(*mediaserverproto.Cache)
+}
+
+// RemoveItem removes an item, its metadata and all its cache entries
+func (db *Database) RemoveItem(collection, signature string) {
+	db.Lock()
+	defer db.Unlock()
+	key := itemKey(collection, signature)
+	if item, ok := db.items[key]; ok {
+		db.removed = append(db.removed, &rest.ItemChange{Type: "Delete", Collection: collection, Signature: signature, Time: time.Now(), Public: item.GetPublic()})
+	}
+	delete(db.items, key)
+	delete(db.metadata, key)
+	for k, cache := range db.caches {
+		if cache.GetIdentifier().GetCollection() == collection && cache.GetIdentifier().GetSignature() == signature {
+			delete(db.caches, k)
+		}
+	}
+}
+
+// Calls returns the number of calls of a method, e.g. "GetItem"
+func (db *Database) Calls(method string) int {
+	db.RLock()
+	defer db.RUnlock()
+	return db.calls[method]
+}
+
+// OpenStreams returns the number of streams neither drained nor canceled. a grpc stream holds its resources until then
+func (db *Database) OpenStreams() int64 {
+	return db.streams.Load()
+}
+
+func (db *Database) count(method string) {
+	db.calls[method]++
+}
+
+func (db *Database) GetItem(ctx context.Context, in *mediaserverproto.ItemIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Item, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetItem")
+	item, ok := db.items[itemKey(in.GetCollection(), in.GetSignature())]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "item %s/%s not found", in.GetCollection(), in.GetSignature())
+	}
+	return proto.Clone(item).(*mediaserverproto.Item), nil
+}
+
+// GetChildItems returns the items with the given parent, ordered by signature
+func (db *Database) GetChildItems(ctx context.Context, in *mediaserverproto.ItemsRequest, opts ...grpc.CallOption) (*mediaserverproto.ItemsResult, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetChildItems")
+	parent := in.GetIdentifier()
+	var children []*mediaserverproto.Item
+	for _, item := range db.items {
+		if p := item.GetParent(); p != nil && p.GetCollection() == parent.GetCollection() && p.GetSignature() == parent.GetSignature() {
+			children = append(children, proto.Clone(item).(*mediaserverproto.Item))
+		}
+	}
+	if len(children) == 0 {
+		return nil, status.Errorf(codes.NotFound, "no child items of %s/%s", parent.GetCollection(), parent.GetSignature())
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].GetIdentifier().GetSignature() < children[j].GetIdentifier().GetSignature()
+	})
+	total := int64(len(children))
+	result := &genericproto.PageResult{Total: total}
+	if page := in.GetPageRequest().GetPage(); page != nil && page.GetPageSize() > 0 {
+		start := min(page.GetPageNo()*page.GetPageSize(), total)
+		end := min(start+page.GetPageSize(), total)
+		children = children[start:end]
+		result.PageSize = page.GetPageSize()
+		result.PageNo = page.GetPageNo()
+	}
+	return &mediaserverproto.ItemsResult{
+		Items: children,
+		PageResponse: &genericproto.PageResponse{
+			PageResponse: &genericproto.PageResponse_PageResult{PageResult: result},
+		},
+	}, nil
+}
+
+func (db *Database) GetItemMetadata(ctx context.Context, in *mediaserverproto.ItemIdentifier, opts ...grpc.CallOption) (*wrapperspb.StringValue, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetItemMetadata")
+	metadata, ok := db.metadata[itemKey(in.GetCollection(), in.GetSignature())]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "metadata of %s/%s not found", in.GetCollection(), in.GetSignature())
+	}
+	return wrapperspb.String(metadata), nil
+}
+
+func (db *Database) GetCache(ctx context.Context, in *mediaserverproto.CacheRequest, opts ...grpc.CallOption) (*mediaserverproto.Cache, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetCache")
+	key := cacheKey(in.GetIdentifier().GetCollection(), in.GetIdentifier().GetSignature(), in.GetAction(), in.GetParams())
+	cache, ok := db.caches[key]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "cache %s not found", key)
+	}
+	return proto.Clone(cache).(*mediaserverproto.Cache), nil
+}
+
+func (db *Database) GetStorage(ctx context.Context, in *mediaserverproto.StorageIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Storage, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetStorage")
+	stor, ok := db.storages[in.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "storage %s not found", in.GetName())
+	}
+	return proto.Clone(stor).(*mediaserverproto.Storage), nil
+}
+
+func (db *Database) GetCollection(ctx context.Context, in *mediaserverproto.CollectionIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Collection, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetCollection")
+	coll, ok := db.collections[in.GetCollection()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "collection %s not found", in.GetCollection())
+	}
+	return proto.Clone(coll).(*mediaserverproto.Collection), nil
+}
+
+// GetItemChanges lists the items by their update or creation time and the removed items by their removal.
+// items without timestamps are left out
+func (db *Database) GetItemChanges(ctx context.Context, cursor rest.ChangeCursor, before bool, limit int) ([]*rest.ItemChange, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetItemChanges")
+	changes := slices.Clone(db.removed)
+	for _, item := range db.items {
+		created, updated := item.GetCreated(), item.GetUpdated()
+		change := &rest.ItemChange{Type: "Create", Collection: item.GetIdentifier().GetCollection(), Signature: item.GetIdentifier().GetSignature(), Public: item.GetPublic()}
+		switch {
+		case updated.IsValid() && updated.GetSeconds() > 0:
+			change.Time = updated.AsTime()
+			if !created.IsValid() || !created.AsTime().Equal(change.Time) {
+				change.Type = "Update"
+			}
+		case created.IsValid() && created.GetSeconds() > 0:
+			change.Time = created.AsTime()
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Cursor().Before(changes[j].Cursor()) })
+	if before {
+		if cursor != (rest.ChangeCursor{}) {
+			changes = changes[:sort.Search(len(changes), func(i int) bool { return !changes[i].Cursor().Before(cursor) })]
+		}
+		return changes[max(0, len(changes)-limit):], nil
+	}
+	changes = changes[sort.Search(len(changes), func(i int) bool { return cursor.Before(changes[i].Cursor()) }):]
+	return changes[:min(limit, len(changes))], nil
+}
+
+// GetCollections streams all collections ordered by name
+func (db *Database) GetCollections(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (mediaserverproto.Database_GetCollectionsClient, error) {
+	db.Lock()
+	defer db.Unlock()
+	db.count("GetCollections")
+	var names []string
+	for name := range db.collections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	stream := &collectionStream{ctx: ctx, open: &db.streams}
+	for _, name := range names {
+		stream.collections = append(stream.collections, proto.Clone(db.collections[name]).(*mediaserverproto.Collection))
+	}
+	db.streams.Add(1)
+	stream.stop = context.AfterFunc(ctx, stream.close)
+	return stream, nil
+}
+
+// collectionStream is a client stream over a fixed list of collections
+type collectionStream struct {
+	ctx         context.Context
+	collections []*mediaserverproto.Collection
+	open        *atomic.Int64
+	closed      atomic.Bool
+	stop        func() bool
+}
+
+// close ends the stream after the last message or with its context
+func (s *collectionStream) close() {
+	if s.closed.CompareAndSwap(false, true) {
+		s.open.Add(-1)
+	}
+}
+
+func (s *collectionStream) Recv() (*mediaserverproto.Collection, error) {
+	if err := s.ctx.Err(); err != nil {
+		s.close()
+		return nil, status.FromContextError(err).Err()
+	}
+	if len(s.collections) == 0 {
+		s.stop()
+		s.close()
+		return nil, io.EOF
+	}
+	coll := s.collections[0]
+	s.collections = s.collections[1:]
+	return coll, nil
+}
+
+func (s *collectionStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (s *collectionStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (s *collectionStream) CloseSend() error             { return nil }
+func (s *collectionStream) Context() context.Context     { return s.ctx }
+func (s *collectionStream) SendMsg(m any) error          { return nil }
+
+func (s *collectionStream) RecvMsg(m any) error {
+	coll, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	target, ok := m.(*mediaserverproto.Collection)
+	if !ok {
+		return status.Errorf(codes.Internal, "invalid message type %T", m)
+	}
+	proto.Merge(target, coll)
+	return nil
+}
@@ -0,0 +1,255 @@
+package fake
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"fmt"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// demo names
+const (
+	DemoCollection = "demo"
+	DemoStorage    = "demo"
+	// DemoJWTKey is the hmac key of the demo collection
+	DemoJWTKey = "demo-collection-key-0123456789abcdef"
+)
+
+// Demo is a populated backend for exploring the http api. restricted items need a token signed with DemoJWTKey
+type Demo struct {
+	DB      *Database
+	Actions *Actions
+	FS      *FS
+	Storage *mediaserverproto.Storage
+	// Public and Restricted are the signatures of the demo items
+	Public     []string
+	Restricted []string
+}
+
+var demoSignatureRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// NewDemo creates the demo backends. the images of dir are public items, bundled samples are used if dir is empty.
+// the image type supports the "resize" action with "size" (e.g. "size320x240") and "format" ("png" or "jpeg")
+func NewDemo(dir string) (*Demo, error) {
+	d := &Demo{
+		DB: NewDatabase(),
+		FS: NewFS(),
+		Storage: &mediaserverproto.Storage{
+			Name:       DemoStorage,
+			Filebase:   "vfs://" + DemoStorage,
+			Datadir:    "data",
+			Subitemdir: "sub",
+			Tempdir:    "temp",
+		},
+	}
+	d.Actions = NewActions(d.DB)
+	d.DB.AddStorage(d.Storage)
+	d.DB.AddCollection(&mediaserverproto.Collection{
+		Name:            DemoCollection,
+		Description:     "demo collection",
+		SignaturePrefix: DemoCollection + "_",
+		Storage:         d.Storage,
+		Jwtkey:          DemoJWTKey,
+	})
+	d.Actions.AddAction("image", "resize", []string{"size", "format"}, d.resize)
+	// tokens are checked in canonical form, which needs the params of the action
+	d.Actions.AddAction("image", "item", []string{}, nil)
+
+	if dir == "" {
+		samples := []struct {
+			signature string
+			public    bool
+			img       image.Image
+		}{
+			{"gradient", true, gradientImage(800, 600)},
+			{"rings", true, ringsImage(640, 640)},
+			{"checker", false, checkerImage(1024, 768, 64)},
+		}
+		for _, s := range samples {
+			buf := &bytes.Buffer{}
+			if err := png.Encode(buf, s.img); err != nil {
+				return nil, errors.Wrapf(err, "cannot encode sample %s", s.signature)
+			}
+			name := "data/" + s.signature + ".png"
+			d.FS.AddFile(DemoStorage+"/"+name, buf.Bytes())
+			if err := d.addImage(s.signature, name, s.public, buf.Bytes()); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		return d, nil
+	}
+
+	dirFS := os.DirFS(dir)
+	d.FS.Mount(DemoStorage+"/data", dirFS)
+	entries, err := fs.ReadDir(dirFS, ".")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read demo directory %s", dir)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(dirFS, entry.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read %s", entry.Name())
+		}
+		signature := demoSignatureRegexp.ReplaceAllString(strings.TrimSuffix(entry.Name(), path.Ext(entry.Name())), "_")
+		if err := d.addImage(signature, "data/"+entry.Name(), true, data); err != nil {
+			// not an image
+			continue
+		}
+	}
+	if len(d.Public) == 0 {
+		return nil, errors.Errorf("no png, jpeg or gif images in %s", dir)
+	}
+	return d, nil
+}
+
+// addImage adds an image item whose master is at name below the storage
+func (d *Demo) addImage(signature, name string, public bool, data []byte) error {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "cannot decode %s", name)
+	}
+	mimeType := "image/" + format
+	sum := sha512.Sum512(data)
+	item := &mediaserverproto.Item{
+		Identifier: &mediaserverproto.ItemIdentifier{Collection: DemoCollection, Signature: signature},
+		Urn:        d.Storage.GetFilebase() + "/" + name,
+		Public:     public,
+		Metadata: &mediaserverproto.ItemMetadata{
+			Type:     ptr("image"),
+			Mimetype: ptr(mimeType),
+			Sha512:   ptr(hex.EncodeToString(sum[:])),
+		},
+	}
+	d.DB.AddItem(item, fmt.Sprintf(`{"title":"%s","type":"image","width":%d,"height":%d}`, signature, cfg.Width, cfg.Height))
+	d.DB.AddCache(&mediaserverproto.Cache{
+		Identifier: item.Identifier,
+		Metadata: &mediaserverproto.CacheMetadata{
+			Action:   "item",
+			Width:    int64(cfg.Width),
+			Height:   int64(cfg.Height),
+			Size:     int64(len(data)),
+			MimeType: mimeType,
+			Path:     name,
+			Storage:  d.Storage,
+		},
+	})
+	if public {
+		d.Public = append(d.Public, signature)
+	} else {
+		d.Restricted = append(d.Restricted, signature)
+	}
+	return nil
+}
+
+// resize scales the master with nearest neighbour sampling. a missing dimension keeps the aspect ratio
+func (d *Demo) resize(in *mediaserverproto.ActionParam) (*mediaserverproto.CacheMetadata, error) {
+	data, err := d.FS.ReadFile(in.GetItem().GetUrn())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", in.GetItem().GetUrn())
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot decode %s", in.GetItem().GetUrn())
+	}
+	bounds := src.Bounds()
+	width, height := 0, 0
+	if size := in.GetParams()["size"]; size != "" {
+		w, h, _ := strings.Cut(size, "x")
+		width, _ = strconv.Atoi(w)
+		height, _ = strconv.Atoi(h)
+	}
+	switch {
+	case width <= 0 && height <= 0:
+		width, height = bounds.Dx(), bounds.Dy()
+	case width <= 0:
+		width = max(1, bounds.Dx()*height/bounds.Dy())
+	case height <= 0:
+		height = max(1, bounds.Dy()*width/bounds.Dx())
+	}
+	if width > 4096 || height > 4096 {
+		return nil, errors.Errorf("size %dx%d exceeds 4096x4096", width, height)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	format := in.GetParams()["format"]
+	buf := &bytes.Buffer{}
+	switch format {
+	case "jpeg", "jpg":
+		format = "jpeg"
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 85})
+	case "", "png":
+		format = "png"
+		err = png.Encode(buf, dst)
+	default:
+		return nil, errors.Errorf("unsupported format '%s' - should be png or jpeg", format)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode image")
+	}
+	name := fmt.Sprintf("cache/%s_resize_%dx%d.%s", in.GetItem().GetIdentifier().GetSignature(), width, height, format)
+	d.FS.AddFile(DemoStorage+"/"+name, buf.Bytes())
+	return &mediaserverproto.CacheMetadata{
+		Width:    int64(width),
+		Height:   int64(height),
+		Size:     int64(buf.Len()),
+		MimeType: "image/" + format,
+		Path:     name,
+	}, nil
+}
+
+func gradientImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(255 * x / width), G: uint8(255 * y / height), B: 160, A: 255})
+		}
+	}
+	return img
+}
+
+func ringsImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	cx, cy := float64(width)/2, float64(height)/2
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			v := uint8(127 + 127*math.Sin(math.Hypot(float64(x)-cx, float64(y)-cy)/8))
+			img.Set(x, y, color.RGBA{R: v, G: 64, B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+func checkerImage(width, height, field int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			if (x/field+y/field)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 230})
+			} else {
+				img.SetGray(x, y, color.Gray{Y: 40})
+			}
+		}
+	}
+	return img
+}
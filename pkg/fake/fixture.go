@@ -0,0 +1,129 @@
+package fake
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// fixture names
+const (
+	Collection      = "test"
+	Storage         = "test"
+	PublicImage     = "image"
+	RestrictedImage = "restricted"
+	Video           = "video"
+)
+
+// Fixture is a populated backend with a public and a restricted image and a restricted video
+// with the public action "item/". the image type supports the "resize" action with "size" and "format"
+type Fixture struct {
+	DB      *Database
+	Actions *Actions
+	FS      *FS
+	Storage *mediaserverproto.Storage
+}
+
+func pngImage(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// NewFixture creates the backends with the fixture data
+func NewFixture() *Fixture {
+	f := &Fixture{
+		DB: NewDatabase(),
+		FS: NewFS(),
+		Storage: &mediaserverproto.Storage{
+			Name:       Storage,
+			Filebase:   "vfs://test",
+			Datadir:    "data",
+			Subitemdir: "sub",
+			Tempdir:    "temp",
+		},
+	}
+	f.Actions = NewActions(f.DB)
+	f.DB.AddStorage(f.Storage)
+	f.DB.AddCollection(&mediaserverproto.Collection{
+		Name:            Collection,
+		Description:     "test collection",
+		SignaturePrefix: Collection + "_",
+		Storage:         f.Storage,
+	})
+	imageData := pngImage(64, 48)
+	f.AddMaster(&mediaserverproto.Item{Public: true, Metadata: &mediaserverproto.ItemMetadata{Type: ptr("image"), Mimetype: ptr("image/png")}}, PublicImage, imageData, 64, 48, 0)
+	f.AddMaster(&mediaserverproto.Item{Metadata: &mediaserverproto.ItemMetadata{Type: ptr("image"), Mimetype: ptr("image/png")}}, RestrictedImage, imageData, 64, 48, 0)
+	f.AddMaster(&mediaserverproto.Item{PublicActions: []string{"item/"}, Metadata: &mediaserverproto.ItemMetadata{Type: ptr("video"), Mimetype: ptr("video/mp4")}}, Video, []byte("not a real video"), 320, 240, 10)
+	f.Actions.AddAction("image", "resize", []string{"size", "format"}, f.resize)
+	// public actions are checked in canonical form, which needs the params of the action
+	f.Actions.AddAction("video", "item", []string{}, nil)
+	return f
+}
+
+// AddMaster adds an item of the fixture collection with its master file and "item" cache entry
+func (f *Fixture) AddMaster(item *mediaserverproto.Item, signature string, data []byte, width, height, duration int64) {
+	item.Identifier = &mediaserverproto.ItemIdentifier{Collection: Collection, Signature: signature}
+	item.Urn = "vfs://test/data/" + signature
+	sum := sha512.Sum512(data)
+	item.Metadata.Sha512 = ptr(hex.EncodeToString(sum[:]))
+	name := fmt.Sprintf("data/%s", signature)
+	f.FS.AddFile("test/"+name, data)
+	f.DB.AddItem(item, fmt.Sprintf(`{"title":"%s","type":"%s"}`, signature, item.GetMetadata().GetType()))
+	f.DB.AddCache(&mediaserverproto.Cache{
+		Identifier: item.Identifier,
+		Metadata: &mediaserverproto.CacheMetadata{
+			Action:   "item",
+			Width:    width,
+			Height:   height,
+			Duration: duration,
+			Size:     int64(len(data)),
+			MimeType: item.GetMetadata().GetMimetype(),
+			Path:     name,
+			Storage:  f.Storage,
+		},
+	})
+}
+
+// resize renders a png of the requested size, e.g. "size32x24"
+func (f *Fixture) resize(in *mediaserverproto.ActionParam) (*mediaserverproto.CacheMetadata, error) {
+	width, height := 64, 48
+	if size := in.GetParams()["size"]; size != "" {
+		w, h, _ := strings.Cut(size, "x")
+		if v, err := strconv.Atoi(w); err == nil && v > 0 {
+			width = v
+		}
+		if v, err := strconv.Atoi(h); err == nil && v > 0 {
+			height = v
+		}
+	}
+	data := pngImage(width, height)
+	name := fmt.Sprintf("data/%s_resize_%dx%d.png", in.GetItem().GetIdentifier().GetSignature(), width, height)
+	f.FS.AddFile("test/"+name, data)
+	return &mediaserverproto.CacheMetadata{
+		Width:    int64(width),
+		Height:   int64(height),
+		Size:     int64(len(data)),
+		MimeType: "image/png",
+		Path:     name,
+	}, nil
+}
@@ -0,0 +1,84 @@
+package fake
+
+import (
+	"io/fs"
+	"strings"
+	"sync"
+	"testing/fstest"
+)
+
+// FS is an in-memory vfs. names may be given with or without the "vfs://" prefix.
+// directories can be mounted from other filesystems, in-memory files take precedence
+type FS struct {
+	sync.RWMutex
+	files  fstest.MapFS
+	mounts map[string]fs.FS
+}
+
+func NewFS() *FS {
+	return &FS{files: fstest.MapFS{}, mounts: map[string]fs.FS{}}
+}
+
+func (f *FS) name(name string) string {
+	return strings.TrimPrefix(name, "vfs://")
+}
+
+// Mount serves all names below dir from fsys, e.g. Mount("demo/data", os.DirFS("images"))
+func (f *FS) Mount(dir string, fsys fs.FS) {
+	f.Lock()
+	defer f.Unlock()
+	f.mounts[strings.Trim(f.name(dir), "/")] = fsys
+}
+
+// mounted returns the mounted filesystem and relative name of a name not found in memory
+func (f *FS) mounted(name string) (fs.FS, string, bool) {
+	for dir, fsys := range f.mounts {
+		if rel, ok := strings.CutPrefix(name, dir+"/"); ok {
+			return fsys, rel, true
+		}
+	}
+	return nil, "", false
+}
+
+// AddFile adds or replaces a file
+func (f *FS) AddFile(name string, data []byte) {
+	f.Lock()
+	defer f.Unlock()
+	f.files[f.name(name)] = &fstest.MapFile{Data: data, Mode: 0644}
+}
+
+func (f *FS) Open(name string) (fs.File, error) {
+	f.RLock()
+	defer f.RUnlock()
+	name = f.name(name)
+	if _, ok := f.files[name]; !ok {
+		if fsys, rel, ok := f.mounted(name); ok {
+			return fsys.Open(rel)
+		}
+	}
+	return f.files.Open(name)
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	f.RLock()
+	defer f.RUnlock()
+	name = f.name(name)
+	if _, ok := f.files[name]; !ok {
+		if fsys, rel, ok := f.mounted(name); ok {
+			return fs.Stat(fsys, rel)
+		}
+	}
+	return f.files.Stat(name)
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	name = f.name(name)
+	if _, ok := f.files[name]; !ok {
+		if fsys, rel, ok := f.mounted(name); ok {
+			return fs.ReadFile(fsys, rel)
+		}
+	}
+	return f.files.ReadFile(name)
+}
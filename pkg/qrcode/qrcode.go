@@ -0,0 +1,542 @@
+// Package qrcode encodes short texts like urls as qr codes (iso/iec 18004) in byte mode
+package qrcode
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// Level is the error correction level. about 7% (L), 15% (M), 25% (Q) or 30% (H) of the codewords can be restored
+type Level int
+
+const (
+	LevelL Level = iota
+	LevelM
+	LevelQ
+	LevelH
+)
+
+// formatLevel are the bits of the levels in the format information
+var formatLevel = [...]int{LevelL: 1, LevelM: 0, LevelQ: 3, LevelH: 2}
+
+// block structure of a version and level: ec codewords per block, blocks and data codewords of group 1 and 2
+type versionInfo struct {
+	ecPerBlock int
+	blocks1    int
+	data1      int
+	blocks2    int
+	data2      int
+}
+
+var versions = [...][]versionInfo{
+	LevelL: {
+		{},
+		{7, 1, 19, 0, 0},
+		{10, 1, 34, 0, 0},
+		{15, 1, 55, 0, 0},
+		{20, 1, 80, 0, 0},
+		{26, 1, 108, 0, 0},
+		{18, 2, 68, 0, 0},
+		{20, 2, 78, 0, 0},
+		{24, 2, 97, 0, 0},
+		{30, 2, 116, 0, 0},
+		{18, 2, 68, 2, 69},
+		{20, 4, 81, 0, 0},
+		{24, 2, 92, 2, 93},
+		{26, 4, 107, 0, 0},
+		{30, 3, 115, 1, 116},
+		{22, 5, 87, 1, 88},
+		{24, 5, 98, 1, 99},
+		{28, 1, 107, 5, 108},
+		{30, 5, 120, 1, 121},
+		{28, 3, 113, 4, 114},
+		{28, 3, 107, 5, 108},
+	},
+	LevelM: {
+		{},
+		{10, 1, 16, 0, 0},
+		{16, 1, 28, 0, 0},
+		{26, 1, 44, 0, 0},
+		{18, 2, 32, 0, 0},
+		{24, 2, 43, 0, 0},
+		{16, 4, 27, 0, 0},
+		{18, 4, 31, 0, 0},
+		{22, 2, 38, 2, 39},
+		{22, 3, 36, 2, 37},
+		{26, 4, 43, 1, 44},
+		{30, 1, 50, 4, 51},
+		{22, 6, 36, 2, 37},
+		{22, 8, 37, 1, 38},
+		{24, 4, 40, 5, 41},
+		{24, 5, 41, 5, 42},
+		{28, 7, 45, 3, 46},
+		{28, 10, 46, 1, 47},
+		{26, 9, 43, 4, 44},
+		{26, 3, 44, 11, 45},
+		{26, 3, 41, 13, 42},
+	},
+	LevelQ: {
+		{},
+		{13, 1, 13, 0, 0},
+		{22, 1, 22, 0, 0},
+		{18, 2, 17, 0, 0},
+		{26, 2, 24, 0, 0},
+		{18, 2, 15, 2, 16},
+		{24, 4, 19, 0, 0},
+		{18, 2, 14, 4, 15},
+		{22, 4, 18, 2, 19},
+		{20, 4, 16, 4, 17},
+		{24, 6, 19, 2, 20},
+		{28, 4, 22, 4, 23},
+		{26, 4, 20, 6, 21},
+		{24, 8, 20, 4, 21},
+		{20, 11, 16, 5, 17},
+		{30, 5, 24, 7, 25},
+		{24, 15, 19, 2, 20},
+		{28, 1, 22, 15, 23},
+		{28, 17, 22, 1, 23},
+		{26, 17, 21, 4, 22},
+		{30, 15, 24, 5, 25},
+	},
+	LevelH: {
+		{},
+		{17, 1, 9, 0, 0},
+		{28, 1, 16, 0, 0},
+		{22, 2, 13, 0, 0},
+		{16, 4, 9, 0, 0},
+		{22, 2, 11, 2, 12},
+		{28, 4, 15, 0, 0},
+		{26, 4, 13, 1, 14},
+		{26, 4, 14, 2, 15},
+		{24, 4, 12, 4, 13},
+		{28, 6, 15, 2, 16},
+		{24, 3, 12, 8, 13},
+		{28, 7, 14, 4, 15},
+		{22, 12, 11, 4, 12},
+		{24, 11, 12, 5, 13},
+		{24, 11, 12, 7, 13},
+		{30, 3, 15, 13, 16},
+		{28, 2, 14, 17, 15},
+		{28, 2, 14, 19, 15},
+		{26, 9, 13, 16, 14},
+		{28, 15, 15, 10, 16},
+	},
+}
+
+// alignments are the center coordinates of the alignment patterns per version
+var alignments = [][]int{
+	nil,
+	nil,
+	{6, 18},
+	{6, 22},
+	{6, 26},
+	{6, 30},
+	{6, 34},
+	{6, 22, 38},
+	{6, 24, 42},
+	{6, 26, 46},
+	{6, 28, 50},
+	{6, 30, 54},
+	{6, 32, 58},
+	{6, 34, 62},
+	{6, 26, 46, 66},
+	{6, 26, 48, 70},
+	{6, 26, 50, 74},
+	{6, 30, 54, 78},
+	{6, 30, 56, 82},
+	{6, 30, 58, 86},
+	{6, 34, 62, 90},
+}
+
+// MaxVersion is the largest supported version. it holds 666 bytes at level M
+const MaxVersion = 20
+
+func (vi versionInfo) dataCodewords() int {
+	return vi.blocks1*vi.data1 + vi.blocks2*vi.data2
+}
+
+// Code is a qr code. Modules[y][x] is true for dark modules
+type Code struct {
+	Version int
+	Level   Level
+	Size    int
+	Modules [][]bool
+	// function marks finder, timing, alignment, format and version modules
+	function [][]bool
+}
+
+// Encode creates the smallest qr code containing data with error correction level M
+func Encode(data []byte) (*Code, error) {
+	return EncodeLevel(data, LevelM)
+}
+
+// EncodeLevel creates the smallest qr code containing data with an error correction level
+func EncodeLevel(data []byte, level Level) (*Code, error) {
+	if level < LevelL || level > LevelH {
+		return nil, errors.Errorf("invalid error correction level %d", level)
+	}
+	version := 0
+	for v := 1; v <= MaxVersion; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*versions[level][v].dataCodewords() {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.Errorf("data too long for qr code: %d bytes", len(data))
+	}
+	qr := newCode(version, level)
+	qr.drawFunctionPatterns()
+	qr.drawCodewords(qr.addErrorCorrection(qr.dataCodewords(data)))
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormat(mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask)
+	}
+	qr.applyMask(bestMask)
+	qr.drawFormat(bestMask)
+	return qr, nil
+}
+
+func newCode(version int, level Level) *Code {
+	size := 17 + 4*version
+	qr := &Code{Version: version, Level: level, Size: size, Modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range qr.Modules {
+		qr.Modules[y] = make([]bool, size)
+		qr.function[y] = make([]bool, size)
+	}
+	return qr
+}
+
+func (qr *Code) setFunction(x, y int, dark bool) {
+	qr.Modules[y][x] = dark
+	qr.function[y][x] = true
+}
+
+func (qr *Code) drawFunctionPatterns() {
+	for i := 0; i < qr.Size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+	qr.drawFinder(3, 3)
+	qr.drawFinder(qr.Size-4, 3)
+	qr.drawFinder(3, qr.Size-4)
+	positions := alignments[qr.Version]
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// reserve the format areas
+	qr.drawFormat(0)
+	if qr.Version >= 7 {
+		rem := qr.Version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := qr.Version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := qr.Size-11+i%3, i/3
+			qr.setFunction(a, b, dark)
+			qr.setFunction(b, a, dark)
+		}
+	}
+}
+
+// drawFinder draws a finder pattern with its separator around the center x, y
+func (qr *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= qr.Size || yy < 0 || yy >= qr.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			qr.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information with the level and the mask
+func (qr *Code) drawFormat(mask int) {
+	data := formatLevel[qr.Level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.Size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.Size-8, true)
+}
+
+// dataCodewords encodes data in byte mode and pads it to the capacity of the version
+func (qr *Code) dataCodewords(data []byte) []byte {
+	capacity := versions[qr.Level][qr.Version].dataCodewords()
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 != 0)
+		}
+	}
+	appendBits(0x4, 4)
+	if qr.Version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	appendBits(0, min(4, capacity*8-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	result := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		result = append(result, b)
+	}
+	for pad := byte(0xec); len(result) < capacity; pad ^= 0xec ^ 0x11 {
+		result = append(result, pad)
+	}
+	return result
+}
+
+// addErrorCorrection splits data into blocks, appends the reed-solomon codewords and interleaves the blocks
+func (qr *Code) addErrorCorrection(data []byte) []byte {
+	vi := versions[qr.Level][qr.Version]
+	generator := rsGenerator(vi.ecPerBlock)
+	var blocks, ecBlocks [][]byte
+	for i := 0; i < vi.blocks1+vi.blocks2; i++ {
+		n := vi.data1
+		if i >= vi.blocks1 {
+			n = vi.data2
+		}
+		block := data[:n]
+		data = data[n:]
+		blocks = append(blocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, generator))
+	}
+	var result []byte
+	for i := 0; i < max(vi.data1, vi.data2); i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < vi.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// drawCodewords places the codewords in the zigzag pattern. remaining modules stay light
+func (qr *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := qr.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.Size - 1 - vert
+				}
+				if !qr.function[y][x] && i < len(data)*8 {
+					qr.Modules[y][x] = (data[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (qr *Code) applyMask(mask int) {
+	for y := 0; y < qr.Size; y++ {
+		for x := 0; x < qr.Size; x++ {
+			if qr.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			qr.Modules[y][x] = qr.Modules[y][x] != invert
+		}
+	}
+}
+
+var finderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores the current modules with the four rules of the standard
+func (qr *Code) penalty() int {
+	var result, dark int
+	line := make([]bool, qr.Size)
+	for _, horizontal := range []bool{true, false} {
+		for a := 0; a < qr.Size; a++ {
+			for b := 0; b < qr.Size; b++ {
+				if horizontal {
+					line[b] = qr.Modules[a][b]
+				} else {
+					line[b] = qr.Modules[b][a]
+				}
+			}
+			run := 1
+			for b := 1; b <= qr.Size; b++ {
+				if b < qr.Size && line[b] == line[b-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += 3 + run - 5
+				}
+				run = 1
+			}
+			for b := 0; b+11 <= qr.Size; b++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, v := range pattern {
+						if line[b+k] != v {
+							match = false
+							break
+						}
+					}
+					if match {
+						result += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < qr.Size; y++ {
+		for x := 0; x < qr.Size; x++ {
+			if qr.Modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.Size && y+1 < qr.Size {
+				c := qr.Modules[y][x]
+				if c == qr.Modules[y][x+1] && c == qr.Modules[y+1][x] && c == qr.Modules[y+1][x+1] {
+					result += 3
+				}
+			}
+		}
+	}
+	total := qr.Size * qr.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	result += k * 10
+	return result
+}
+
+// quietZone is the light border around the code in modules
+const quietZone = 4
+
+// Image renders the code with scale pixels per module
+func (qr *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (qr.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < qr.Size; y++ {
+		for x := 0; x < qr.Size; x++ {
+			if !qr.Modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+quietZone)*scale+dx, (y+quietZone)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// SVG renders the code as svg with scale pixels per module
+func (qr *Code) SVG(scale int) string {
+	if scale < 1 {
+		scale = 1
+	}
+	size := qr.Size + 2*quietZone
+	var path strings.Builder
+	for y := 0; y < qr.Size; y++ {
+		for x := 0; x < qr.Size; x++ {
+			if qr.Modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="%d" height="%d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		size, size, size*scale, size*scale, path.String())
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
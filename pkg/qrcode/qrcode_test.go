@@ -0,0 +1,215 @@
+package qrcode
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"strings"
+	"testing"
+)
+
+// TestReedSolomon checks the error correction codewords of the 1-M symbol "01234567" of iso/iec 18004 annex I
+func TestReedSolomon(t *testing.T) {
+	data := []byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11}
+	expected := []byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55}
+	if got := rsRemainder(data, rsGenerator(len(expected))); !bytes.Equal(got, expected) {
+		t.Errorf("error correction codewords %x, expected %x", got, expected)
+	}
+}
+
+// formatInformation are the format bits of iso/iec 18004 table C.1 per level and mask, most significant bit first
+var formatInformation = map[Level][8]string{
+	LevelL: {"111011111000100", "111001011110011", "111110110101010", "111100010011101", "110011000101111", "110001100011000", "110110001000001", "110100101110110"},
+	LevelM: {"101010000010010", "101000100100101", "101111001111100", "101101101001011", "100010111111001", "100000011001110", "100111110010111", "100101010100000"},
+	LevelQ: {"011010101011111", "011000001101000", "011111100110001", "011101000000110", "010010010110100", "010000110000011", "010111011011010", "010101111101101"},
+	LevelH: {"001011010001001", "001001110111110", "001110011100111", "001100111010000", "000011101100010", "000001001010101", "000110100001100", "000100000111011"},
+}
+
+// readFormat returns level and mask of the first copy of the format information
+func readFormat(modules [][]bool) (Level, int, error) {
+	var positions [][2]int
+	for i := 0; i <= 5; i++ {
+		positions = append(positions, [2]int{8, i})
+	}
+	positions = append(positions, [2]int{8, 7}, [2]int{8, 8}, [2]int{7, 8})
+	for i := 9; i < 15; i++ {
+		positions = append(positions, [2]int{14 - i, 8})
+	}
+	bits := make([]byte, 15)
+	for i, pos := range positions {
+		bits[14-i] = '0'
+		if modules[pos[1]][pos[0]] {
+			bits[14-i] = '1'
+		}
+	}
+	for level, masks := range formatInformation {
+		for mask, format := range masks {
+			if format == string(bits) {
+				return level, mask, nil
+			}
+		}
+	}
+	return 0, 0, errors.Errorf("unknown format information %s", bits)
+}
+
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// decode reads the data of a code without errors
+func decode(modules [][]bool) ([]byte, Level, error) {
+	size := len(modules)
+	version := (size - 17) / 4
+	if version < 1 || version > MaxVersion || 17+4*version != size {
+		return nil, 0, errors.Errorf("invalid size %d", size)
+	}
+	level, mask, err := readFormat(modules)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	function := newCode(version, level)
+	function.drawFunctionPatterns()
+	vi := versions[level][version]
+	total := vi.blocks1*(vi.data1+vi.ecPerBlock) + vi.blocks2*(vi.data2+vi.ecPerBlock)
+	codewords := make([]byte, total)
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if function.function[y][x] || i >= total*8 {
+					continue
+				}
+				if modules[y][x] != masked(mask, x, y) {
+					codewords[i>>3] |= 1 << (7 - i&7)
+				}
+				i++
+			}
+		}
+	}
+	// deinterleave the blocks and check their syndromes
+	blocks := make([][]byte, vi.blocks1+vi.blocks2)
+	pos := 0
+	for k := 0; k < max(vi.data1, vi.data2); k++ {
+		for b := range blocks {
+			n := vi.data1
+			if b >= vi.blocks1 {
+				n = vi.data2
+			}
+			if k < n {
+				blocks[b] = append(blocks[b], codewords[pos])
+				pos++
+			}
+		}
+	}
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	for k := 0; k < vi.ecPerBlock; k++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[pos])
+			pos++
+		}
+	}
+	for b, block := range blocks {
+		var root byte = 1
+		for k := 0; k < vi.ecPerBlock; k++ {
+			var syndrome byte
+			for _, c := range block {
+				syndrome = gfMultiply(syndrome, root) ^ c
+			}
+			if syndrome != 0 {
+				return nil, 0, errors.Errorf("block %d: syndrome %d is %d", b, k, syndrome)
+			}
+			root = gfMultiply(root, 0x02)
+		}
+	}
+	bit := 0
+	read := func(n int) int {
+		var value int
+		for ; n > 0; n-- {
+			value = value<<1 | int(data[bit>>3]>>(7-bit&7)&1)
+			bit++
+		}
+		return value
+	}
+	if mode := read(4); mode != 0x4 {
+		return nil, 0, errors.Errorf("mode %04b is not byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	result := make([]byte, read(countBits))
+	for k := range result {
+		result[k] = byte(read(8))
+	}
+	return result, level, nil
+}
+
+func TestEncodeDecode(t *testing.T) {
+	texts := map[Level]string{
+		LevelL: "https://mediaserver.test/media/s/abc123",
+		LevelM: "https://mediaserver.test/media/test/image/viewer?page=" + strings.Repeat("1", 120),
+		LevelQ: "https://mediaserver.test/media/embed/test/image",
+		LevelH: "https://mediaserver.test/media/test/video/item#t=" + strings.Repeat("9", 200),
+	}
+	for level, text := range texts {
+		code, err := EncodeLevel([]byte(text), level)
+		if err != nil {
+			t.Fatalf("level %d: cannot encode: %v", level, err)
+		}
+		data, decodedLevel, err := decode(code.Modules)
+		if err != nil {
+			t.Fatalf("level %d, version %d: cannot decode: %v", level, code.Version, err)
+		}
+		if decodedLevel != level {
+			t.Errorf("level %d, version %d: decoded level %d", level, code.Version, decodedLevel)
+		}
+		if string(data) != text {
+			t.Errorf("level %d, version %d: decoded %q, expected %q", level, code.Version, data, text)
+		}
+	}
+}
+
+func TestEncodeDefaultLevel(t *testing.T) {
+	code, err := Encode([]byte("https://mediaserver.test/media/s/abc123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, level, err := decode(code.Modules); err != nil || level != LevelM {
+		t.Errorf("decoded level %d, expected %d: %v", level, LevelM, err)
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := EncodeLevel(bytes.Repeat([]byte("x"), 667), LevelM); err == nil {
+		t.Error("667 bytes encoded at level M")
+	}
+	if _, err := EncodeLevel([]byte("x"), Level(4)); err == nil {
+		t.Error("invalid level accepted")
+	}
+}
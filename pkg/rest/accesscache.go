@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"github.com/bluele/gcache"
+	"sync"
+	"time"
+)
+
+type accessCacheKey struct {
+	collection, signature string
+}
+
+// itemAccess holds the cached public access decisions of an item. public is set for public items, actions holds
+// the canonical subjects of public actions
+type itemAccess struct {
+	sync.RWMutex
+	public  bool
+	actions map[string]struct{}
+}
+
+// WithAccessCache caches positive access decisions for public items and public actions of up to size items for ttl
+func WithAccessCache(size int, ttl time.Duration) Option {
+	return func(ctrl *mainController) error {
+		if size <= 0 || ttl <= 0 {
+			return nil
+		}
+		ctrl.accessCache = gcache.New(size).LRU().Expiration(ttl).Build()
+		return nil
+	}
+}
+
+func (ctrl *mainController) itemAccess(collection, signature string, create bool) *itemAccess {
+	key := accessCacheKey{collection: collection, signature: signature}
+	if v, err := ctrl.accessCache.GetIFPresent(key); err == nil {
+		return v.(*itemAccess)
+	}
+	if !create {
+		return nil
+	}
+	// concurrent requests may replace the entry of each other, which only loses a decision
+	ia := &itemAccess{actions: map[string]struct{}{}}
+	ctrl.accessCache.Set(key, ia)
+	return ia
+}
+
+// publicAccess returns true if a public access decision for the request is cached
+func (ctrl *mainController) publicAccess(collection, signature, action, paramStr string) bool {
+	if ctrl.accessCache == nil {
+		return false
+	}
+	ia := ctrl.itemAccess(collection, signature, false)
+	if ia == nil {
+		return false
+	}
+	ia.RLock()
+	defer ia.RUnlock()
+	if ia.public {
+		return true
+	}
+	_, ok := ia.actions[AccessSubject(collection, signature, action, paramStr)]
+	return ok
+}
+
+// setPublicItem caches the access to all actions of a public item
+func (ctrl *mainController) setPublicItem(collection, signature string) {
+	if ctrl.accessCache == nil {
+		return
+	}
+	ia := ctrl.itemAccess(collection, signature, true)
+	ia.Lock()
+	ia.public = true
+	ia.Unlock()
+}
+
+// setPublicAccess caches the access to a public action of an item
+func (ctrl *mainController) setPublicAccess(collection, signature, action, paramStr string) {
+	if ctrl.accessCache == nil {
+		return
+	}
+	subject := AccessSubject(collection, signature, action, paramStr)
+	ia := ctrl.itemAccess(collection, signature, true)
+	ia.Lock()
+	ia.actions[subject] = struct{}{}
+	ia.Unlock()
+}
+
+// removeAccess deletes all cached access decisions of an item
+func (ctrl *mainController) removeAccess(collection, signature string) {
+	if ctrl.accessCache == nil {
+		return
+	}
+	ctrl.accessCache.Remove(accessCacheKey{collection: collection, signature: signature})
+}
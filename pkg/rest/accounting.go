@@ -0,0 +1,297 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccountingConfig struct {
+	Enabled bool `toml:"enabled"`
+	// File keeps the accounting data in the vfs across restarts, e.g. "vfs://testcache/accounting.json"
+	File string `toml:"file"`
+	// Interval between the writes of File, default 5m
+	Interval config.Duration `toml:"interval"`
+}
+
+// AccountingRecord is the usage of a collection in a month
+type AccountingRecord struct {
+	Month       string `json:"month"`
+	Collection  string `json:"collection"`
+	Requests    int64  `json:"requests"`
+	BytesServed int64  `json:"bytesserved"`
+	Derivatives int64  `json:"derivatives"`
+	// DerivativeBytes is the size of the derivatives generated in the month
+	DerivativeBytes int64 `json:"derivativebytes"`
+	// StorageBytes is the highest storage usage of the month, only known for collections with storage quota
+	StorageBytes int64 `json:"storagebytes"`
+	// Errors are the responses with server errors, Denied the responses 401 and 403
+	Errors int64 `json:"errors"`
+	Denied int64 `json:"denied"`
+}
+
+var accountingHeader = []string{"month", "collection", "requests", "bytesserved", "derivatives", "derivativebytes", "storagebytes", "errors", "denied"}
+
+type accountingKey struct {
+	month      string
+	collection string
+}
+
+type accounting struct {
+	sync.Mutex
+	file     string
+	interval time.Duration
+	records  map[accountingKey]*AccountingRecord
+}
+
+// WithAccounting collects the monthly usage per collection for the export at GET /admin/accounting
+func WithAccounting(conf *AccountingConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		a := &accounting{
+			file:     conf.File,
+			interval: time.Duration(conf.Interval),
+			records:  map[accountingKey]*AccountingRecord{},
+		}
+		if a.interval <= 0 {
+			a.interval = 5 * time.Minute
+		}
+		ctrl.accounting = a
+		return nil
+	}
+}
+
+func accountingMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// record returns the record of the current month. the lock must be held
+func (a *accounting) record(collection string) *AccountingRecord {
+	key := accountingKey{month: accountingMonth(time.Now()), collection: collection}
+	r, ok := a.records[key]
+	if !ok {
+		r = &AccountingRecord{Month: key.month, Collection: collection}
+		a.records[key] = r
+	}
+	return r
+}
+
+// accountingHandler returns the middleware counting the requests and bytes served per collection
+func (ctrl *mainController) accountingHandler() gin.HandlerFunc {
+	if ctrl.accounting == nil {
+		return nil
+	}
+	return func(c *gin.Context) {
+		c.Next()
+		collection := c.Param("collection")
+		if collection == "" {
+			return
+		}
+		ctrl.accountRequest(collection, c.Writer.Status(), c.Writer.Size())
+	}
+}
+
+// accountRequest counts a finished request of a collection
+func (ctrl *mainController) accountRequest(collection string, status, size int) {
+	a := ctrl.accounting
+	a.Lock()
+	defer a.Unlock()
+	r := a.record(collection)
+	r.Requests++
+	r.BytesServed += int64(max(0, size))
+	switch {
+	case status >= 500:
+		r.Errors++
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		r.Denied++
+	}
+}
+
+// accountDerivative counts a generated derivative
+func (ctrl *mainController) accountDerivative(item *mediaserverproto.Item, cache *mediaserverproto.Cache) {
+	a := ctrl.accounting
+	if a == nil || cache == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	r := a.record(item.GetIdentifier().GetCollection())
+	r.Derivatives++
+	r.DerivativeBytes += cache.GetMetadata().GetSize()
+}
+
+// accountStorage records the storage usage of a collection
+func (ctrl *mainController) accountStorage(collection string, bytes int64) {
+	a := ctrl.accounting
+	if a == nil {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+	r := a.record(collection)
+	r.StorageBytes = max(r.StorageBytes, bytes)
+}
+
+func (ctrl *mainController) loadAccounting() error {
+	a := ctrl.accounting
+	data, err := fs.ReadFile(ctrl.vfs, a.file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return errors.Wrapf(err, "cannot read %s", a.file)
+	}
+	var records []*AccountingRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return errors.Wrapf(err, "cannot unmarshal %s", a.file)
+	}
+	a.Lock()
+	defer a.Unlock()
+	for _, r := range records {
+		key := accountingKey{month: r.Month, collection: r.Collection}
+		if current, ok := a.records[key]; ok {
+			// requests counted before the file was loaded
+			r.Requests += current.Requests
+			r.BytesServed += current.BytesServed
+			r.Derivatives += current.Derivatives
+			r.DerivativeBytes += current.DerivativeBytes
+			r.StorageBytes = max(r.StorageBytes, current.StorageBytes)
+			r.Errors += current.Errors
+			r.Denied += current.Denied
+		}
+		a.records[key] = r
+	}
+	return nil
+}
+
+func (ctrl *mainController) saveAccounting() error {
+	a := ctrl.accounting
+	data, err := json.Marshal(a.export(""))
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal accounting")
+	}
+	fp, err := writefs.Create(ctrl.vfs, a.file)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", a.file)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", a.file)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", a.file)
+}
+
+// runAccounting keeps the accounting file up to date. it is written a last time on shutdown
+func (ctrl *mainController) runAccounting(ctx context.Context) {
+	a := ctrl.accounting
+	if a.file == "" {
+		return
+	}
+	if err := ctrl.loadAccounting(); err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot load accounting")
+	}
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := ctrl.saveAccounting(); err != nil {
+				ctrl.logger.Error().Err(err).Msg("cannot save accounting")
+			}
+			return
+		case <-ticker.C:
+			if err := ctrl.saveAccounting(); err != nil {
+				ctrl.logger.Error().Err(err).Msg("cannot save accounting")
+			}
+		}
+	}
+}
+
+// export returns the records of a month or of all months if month is empty, ordered by month and collection
+func (a *accounting) export(month string) []AccountingRecord {
+	a.Lock()
+	var result = []AccountingRecord{}
+	for key, r := range a.records {
+		if month != "" && key.month != month {
+			continue
+		}
+		result = append(result, *r)
+	}
+	a.Unlock()
+	slices.SortFunc(result, func(x, y AccountingRecord) int {
+		if c := strings.Compare(x.Month, y.Month); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Collection, y.Collection)
+	})
+	return result
+}
+
+// adminAccounting exports the accounting data. ?month=2006-01 selects a month, ?format=csv or "Accept: text/csv" returns csv
+func (ctrl *mainController) adminAccounting(c *gin.Context) {
+	a := ctrl.accounting
+	if a == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "accounting not enabled"})
+		return
+	}
+	month := c.Query("month")
+	if month != "" {
+		if _, err := time.Parse("2006-01", month); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid month '%s' - should be YYYY-MM", month)})
+			return
+		}
+	}
+	records := a.export(month)
+	format := c.Query("format")
+	if format == "" && strings.Contains(c.GetHeader("Accept"), "text/csv") {
+		format = "csv"
+	}
+	switch format {
+	case "", "json":
+		c.JSON(http.StatusOK, records)
+	case "csv":
+		name := "accounting.csv"
+		if month != "" {
+			name = fmt.Sprintf("accounting-%s.csv", month)
+		}
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		w.Write(accountingHeader)
+		for _, r := range records {
+			w.Write([]string{
+				r.Month,
+				r.Collection,
+				strconv.FormatInt(r.Requests, 10),
+				strconv.FormatInt(r.BytesServed, 10),
+				strconv.FormatInt(r.Derivatives, 10),
+				strconv.FormatInt(r.DerivativeBytes, 10),
+				strconv.FormatInt(r.StorageBytes, 10),
+				strconv.FormatInt(r.Errors, 10),
+				strconv.FormatInt(r.Denied, 10),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			ctrl.logger.Error().Err(err).Msg("cannot write accounting csv")
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid format '%s' - should be json or csv", format)})
+	}
+}
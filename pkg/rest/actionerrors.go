@@ -0,0 +1,376 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ActionErrorConfig struct {
+	Enabled bool `toml:"enabled"`
+	// File keeps the queue in the vfs across restarts, e.g. "vfs://testcache/actionerrors.json"
+	File string `toml:"file"`
+	// Interval between the checks for due retries and the writes of File, default 1m
+	Interval config.Duration `toml:"interval"`
+	// Backoff is the delay of the first automatic retry, doubled with every failure up to MaxBackoff. default 1m and 6h
+	Backoff    config.Duration `toml:"backoff"`
+	MaxBackoff config.Duration `toml:"maxbackoff"`
+	// MaxRetries is the number of failures after which transient errors are no longer retried, default 8
+	MaxRetries int `toml:"maxretries"`
+	// Size is the maximum number of entries, the oldest are dropped. default 10000
+	Size int `toml:"size"`
+}
+
+// ActionError is a failed generation of a derivative
+type ActionError struct {
+	ID         string    `json:"id"`
+	Collection string    `json:"collection"`
+	Signature  string    `json:"signature"`
+	Action     string    `json:"action"`
+	Params     string    `json:"params"`
+	Error      string    `json:"error"`
+	Code       string    `json:"code"`
+	Transient  bool      `json:"transient"`
+	Count      int       `json:"count"`
+	First      time.Time `json:"first"`
+	Last       time.Time `json:"last"`
+	// NextRetry is the time of the next automatic retry, zero if there is none
+	NextRetry time.Time `json:"nextretry"`
+}
+
+type actionErrors struct {
+	sync.Mutex
+	conf       *ActionErrorConfig
+	interval   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	entries    map[string]*ActionError
+	dirty      bool
+}
+
+// WithActionErrors records failed generations in a queue at /admin/actionerrors. transient failures are retried
+// automatically with exponential backoff
+func WithActionErrors(conf *ActionErrorConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		ae := &actionErrors{
+			conf:       conf,
+			interval:   time.Duration(conf.Interval),
+			backoff:    time.Duration(conf.Backoff),
+			maxBackoff: time.Duration(conf.MaxBackoff),
+			entries:    map[string]*ActionError{},
+		}
+		if ae.interval <= 0 {
+			ae.interval = time.Minute
+		}
+		if ae.backoff <= 0 {
+			ae.backoff = time.Minute
+		}
+		if ae.maxBackoff <= 0 {
+			ae.maxBackoff = 6 * time.Hour
+		}
+		if conf.MaxRetries <= 0 {
+			conf.MaxRetries = 8
+		}
+		if conf.Size <= 0 {
+			conf.Size = 10000
+		}
+		if conf.File != "" {
+			data, err := fs.ReadFile(ctrl.vfs, conf.File)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Wrapf(err, "cannot read %s", conf.File)
+			}
+			if err == nil {
+				var entries []*ActionError
+				if err := json.Unmarshal(data, &entries); err != nil {
+					return errors.Wrapf(err, "cannot unmarshal %s", conf.File)
+				}
+				for _, e := range entries {
+					ae.entries[e.ID] = e
+				}
+			}
+		}
+		ctrl.actionErrors = ae
+		return nil
+	}
+}
+
+// transientError reports whether a generation may succeed if retried later
+func transientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if stat, ok := status.FromError(err); ok {
+		switch stat.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+	}
+	return false
+}
+
+func actionErrorID(collection, signature, action, params string) string {
+	return AccessSubject(collection, signature, action, params)
+}
+
+// recordActionError adds a failed generation to the queue or counts it again
+func (ctrl *mainController) recordActionError(param *mediaserverproto.ActionParam, err error) {
+	ae := ctrl.actionErrors
+	if ae == nil {
+		return
+	}
+	collection := param.GetItem().GetIdentifier().GetCollection()
+	signature := param.GetItem().GetIdentifier().GetSignature()
+	params := actionCache.ActionParams(param.GetParams()).String()
+	id := actionErrorID(collection, signature, param.GetAction(), params)
+	now := time.Now()
+	ae.Lock()
+	defer ae.Unlock()
+	e, ok := ae.entries[id]
+	if !ok {
+		if len(ae.entries) >= ae.conf.Size {
+			ae.dropOldest()
+		}
+		e = &ActionError{ID: id, Collection: collection, Signature: signature, Action: param.GetAction(), Params: params, First: now}
+		ae.entries[id] = e
+	}
+	e.Count++
+	e.Last = now
+	e.Error = err.Error()
+	e.Code = status.Code(err).String()
+	e.Transient = transientError(err)
+	e.NextRetry = time.Time{}
+	if e.Transient && e.Count <= ae.conf.MaxRetries {
+		delay := ae.backoff
+		for i := 1; i < e.Count && delay < ae.maxBackoff; i++ {
+			delay *= 2
+		}
+		e.NextRetry = now.Add(min(delay, ae.maxBackoff))
+	}
+	ae.dirty = true
+}
+
+// dropOldest removes the entry with the oldest failure. the lock must be held
+func (ae *actionErrors) dropOldest() {
+	var oldest *ActionError
+	for _, e := range ae.entries {
+		if oldest == nil || e.Last.Before(oldest.Last) {
+			oldest = e
+		}
+	}
+	if oldest != nil {
+		delete(ae.entries, oldest.ID)
+	}
+}
+
+// clearActionError removes a generation from the queue after it succeeded
+func (ctrl *mainController) clearActionError(param *mediaserverproto.ActionParam) {
+	ae := ctrl.actionErrors
+	if ae == nil {
+		return
+	}
+	id := actionErrorID(param.GetItem().GetIdentifier().GetCollection(), param.GetItem().GetIdentifier().GetSignature(),
+		param.GetAction(), actionCache.ActionParams(param.GetParams()).String())
+	ae.Lock()
+	defer ae.Unlock()
+	if _, ok := ae.entries[id]; ok {
+		delete(ae.entries, id)
+		ae.dirty = true
+	}
+}
+
+// list returns copies of the entries matching the filter, latest failure first
+func (ae *actionErrors) list(filter func(e *ActionError) bool) []ActionError {
+	ae.Lock()
+	var result = []ActionError{}
+	for _, e := range ae.entries {
+		if filter == nil || filter(e) {
+			result = append(result, *e)
+		}
+	}
+	ae.Unlock()
+	slices.SortFunc(result, func(a, b ActionError) int {
+		if c := b.Last.Compare(a.Last); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return result
+}
+
+// retryActionError generates the derivative again. success or failure is recorded by generate
+func (ctrl *mainController) retryActionError(ctx context.Context, e ActionError) error {
+	_, err := ctrl.prewarm(ctx, e.Collection, e.Signature, e.Action, e.Params)
+	if err == nil {
+		// the derivative may have been created by a request in the meantime
+		ae := ctrl.actionErrors
+		ae.Lock()
+		if _, ok := ae.entries[e.ID]; ok {
+			delete(ae.entries, e.ID)
+			ae.dirty = true
+		}
+		ae.Unlock()
+	}
+	return err
+}
+
+func (ctrl *mainController) saveActionErrors() error {
+	ae := ctrl.actionErrors
+	ae.Lock()
+	if !ae.dirty || ae.conf.File == "" {
+		ae.Unlock()
+		return nil
+	}
+	ae.dirty = false
+	ae.Unlock()
+	data, err := json.Marshal(ae.list(nil))
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal action errors")
+	}
+	fp, err := writefs.Create(ctrl.vfs, ae.conf.File)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", ae.conf.File)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", ae.conf.File)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", ae.conf.File)
+}
+
+// runActionErrors retries the due transient failures and keeps the file up to date. it is written a last time on shutdown
+func (ctrl *mainController) runActionErrors(ctx context.Context) {
+	ae := ctrl.actionErrors
+	ticker := time.NewTicker(ae.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := ctrl.saveActionErrors(); err != nil {
+				ctrl.logger.Error().Err(err).Msg("cannot save action errors")
+			}
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		due := ae.list(func(e *ActionError) bool {
+			return !e.NextRetry.IsZero() && !now.Before(e.NextRetry)
+		})
+		for _, e := range due {
+			if ctx.Err() != nil || ctrl.readOnly.Load() {
+				break
+			}
+			if err := ctrl.retryActionError(ctx, e); err != nil {
+				ctrl.logger.Warn().Err(err).Msgf("retry %d of %s failed", e.Count, e.ID)
+				continue
+			}
+			ctrl.logger.Info().Msgf("retry of %s succeeded", e.ID)
+		}
+		if err := ctrl.saveActionErrors(); err != nil {
+			ctrl.logger.Error().Err(err).Msg("cannot save action errors")
+		}
+	}
+}
+
+// actionErrorFilter selects entries by ?collection= and ?transient=true|false
+func actionErrorFilter(c *gin.Context) func(e *ActionError) bool {
+	collection := c.Query("collection")
+	transient := c.Query("transient")
+	return func(e *ActionError) bool {
+		if collection != "" && e.Collection != collection {
+			return false
+		}
+		if transient != "" && (transient == "true") != e.Transient {
+			return false
+		}
+		return true
+	}
+}
+
+func (ctrl *mainController) adminActionErrors(c *gin.Context) {
+	if ctrl.actionErrors == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "action error queue not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, ctrl.actionErrors.list(actionErrorFilter(c)))
+}
+
+// ActionErrorRequest selects entries by id. all entries matching the query filter if empty
+type ActionErrorRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// actionErrorSelection returns the entries of the request
+func (ctrl *mainController) actionErrorSelection(c *gin.Context) ([]ActionError, bool) {
+	var req ActionErrorRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+			return nil, false
+		}
+	}
+	filter := actionErrorFilter(c)
+	return ctrl.actionErrors.list(func(e *ActionError) bool {
+		return filter(e) && (len(req.IDs) == 0 || slices.Contains(req.IDs, e.ID))
+	}), true
+}
+
+// adminRetryActionErrors retries the selected entries immediately
+func (ctrl *mainController) adminRetryActionErrors(c *gin.Context) {
+	if ctrl.actionErrors == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "action error queue not enabled"})
+		return
+	}
+	entries, ok := ctrl.actionErrorSelection(c)
+	if !ok {
+		return
+	}
+	var results = []PrewarmResult{}
+	for _, e := range entries {
+		result := PrewarmResult{Item: e.Collection + "/" + e.Signature, Action: strings.Trim(e.Action+"/"+e.Params, "/"), Generated: true}
+		if err := ctrl.retryActionError(c.Request.Context(), e); err != nil {
+			result.Generated = false
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	ctrl.logger.Info().Str("audit", "actionerrors").Int("retried", len(entries)).Str("remote", c.ClientIP()).Msg("action errors retried")
+	c.JSON(http.StatusOK, results)
+}
+
+// adminDeleteActionErrors removes the selected entries, e.g. after the master file has been replaced
+func (ctrl *mainController) adminDeleteActionErrors(c *gin.Context) {
+	ae := ctrl.actionErrors
+	if ae == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "action error queue not enabled"})
+		return
+	}
+	entries, ok := ctrl.actionErrorSelection(c)
+	if !ok {
+		return
+	}
+	ae.Lock()
+	for _, e := range entries {
+		delete(ae.entries, e.ID)
+	}
+	ae.dirty = ae.dirty || len(entries) > 0
+	ae.Unlock()
+	ctrl.logger.Info().Str("audit", "actionerrors").Int("deleted", len(entries)).Str("remote", c.ClientIP()).Msg("action errors deleted")
+	c.JSON(http.StatusOK, gin.H{"deleted": len(entries)})
+}
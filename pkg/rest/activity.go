@@ -0,0 +1,252 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WithActivityStream enables the iiif change discovery endpoints with pages of pageSize changes. the changes are
+// listed by the database, which must implement ItemChanges. entries are filtered by the access to the metadata of
+// the item for the token of the request
+func WithActivityStream(pageSize int) Option {
+	return func(ctrl *mainController) error {
+		if pageSize <= 0 {
+			return nil
+		}
+		if ctrl.itemChanges == nil {
+			return errors.New("activity stream needs a database listing item changes")
+		}
+		ctrl.activityPageSize = pageSize
+		return nil
+	}
+}
+
+// Cursor returns the position of the change
+func (ch *ItemChange) Cursor() ChangeCursor {
+	return ChangeCursor{Time: ch.Time, Collection: ch.Collection, Signature: ch.Signature}
+}
+
+// Before reports whether the cursor is ordered before other
+func (cc ChangeCursor) Before(other ChangeCursor) bool {
+	if !cc.Time.Equal(other.Time) {
+		return cc.Time.Before(other.Time)
+	}
+	if cc.Collection != other.Collection {
+		return cc.Collection < other.Collection
+	}
+	return cc.Signature < other.Signature
+}
+
+// String returns the cursor as opaque url path segment
+func (cc ChangeCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cc.Time.UTC().Format(time.RFC3339Nano) + "\n" + cc.Collection + "\n" + cc.Signature))
+}
+
+func parseChangeCursor(s string) (ChangeCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ChangeCursor{}, errors.Wrapf(err, "invalid cursor '%s'", s)
+	}
+	parts := strings.SplitN(string(data), "\n", 3)
+	if len(parts) != 3 {
+		return ChangeCursor{}, errors.Errorf("invalid cursor '%s'", s)
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return ChangeCursor{}, errors.Wrapf(err, "invalid time in cursor '%s'", s)
+	}
+	return ChangeCursor{Time: t, Collection: parts[1], Signature: parts[2]}, nil
+}
+
+// activityPage is a page of changes with the cursors of the preceding and following pages
+type activityPage struct {
+	changes []*ItemChange
+	prev    string
+	next    string
+}
+
+// loadActivityPage loads the changes of a page. position is "first", "last", "after" or "before", the latter
+// relative to cursor. pages are addressed by the changes at their borders, so they do not shift with new changes
+func (ctrl *mainController) loadActivityPage(ctx context.Context, position string, cursor ChangeCursor) (*activityPage, error) {
+	size := ctrl.activityPageSize
+	before := position == "last" || position == "before"
+	if position == "first" || position == "last" {
+		cursor = ChangeCursor{}
+	}
+	// one more change tells whether there is another page in the direction of the request
+	changes, err := ctrl.itemChanges.GetItemChanges(ctx, cursor, before, size+1)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get item changes")
+	}
+	page := &activityPage{}
+	more := len(changes) > size
+	if before {
+		if more {
+			changes = changes[len(changes)-size:]
+		}
+	} else if more {
+		changes = changes[:size]
+	}
+	page.changes = changes
+	if len(changes) == 0 {
+		if position == "after" {
+			page.prev = "before/" + cursor.String()
+		}
+		return page, nil
+	}
+	first, last := changes[0].Cursor(), changes[len(changes)-1].Cursor()
+	switch position {
+	case "first":
+		if more {
+			page.next = "after/" + last.String()
+		}
+	case "after":
+		// the cursor is a change of the preceding page
+		page.prev = "before/" + first.String()
+		if more {
+			page.next = "after/" + last.String()
+		}
+	case "before":
+		if more {
+			page.prev = "before/" + first.String()
+		}
+		page.next = "after/" + last.String()
+	case "last":
+		if more {
+			page.prev = "before/" + first.String()
+		}
+	}
+	return page, nil
+}
+
+// activityFilter decides which changes of a page are listed for the token of the request. the dark state is looked
+// up once per collection and the access check is only needed for restricted items
+type activityFilter struct {
+	ctrl  *mainController
+	token string
+	dark  map[string]bool
+}
+
+func (ctrl *mainController) newActivityFilter(token string) *activityFilter {
+	return &activityFilter{ctrl: ctrl, token: token, dark: map[string]bool{}}
+}
+
+// visible checks whether the metadata of the item of a change may be read
+func (af *activityFilter) visible(ch *ItemChange) bool {
+	dark, ok := af.dark[ch.Collection]
+	if !ok {
+		dark = af.ctrl.dark.is(ch.Collection)
+		af.dark[ch.Collection] = dark
+	}
+	if dark {
+		return false
+	}
+	if ch.Public {
+		return true
+	}
+	// deleted items cannot be checked any more
+	if ch.Type == "Delete" {
+		return false
+	}
+	if af.ctrl.exhibited(ch.Collection, ch.Signature, "metadata") {
+		return true
+	}
+	return af.ctrl.access.CheckAccess(ch.Collection, ch.Signature, "metadata", "", af.token) == nil
+}
+
+const activityStreamsContext = "http://iiif.io/api/discovery/1/context.json"
+
+func (ctrl *mainController) activityPageURL(page string) string {
+	return ctrl.externalURL("activity", "page", page)
+}
+
+func (ctrl *mainController) initActivity(group *gin.RouterGroup) {
+	if ctrl.activityPageSize == 0 {
+		return
+	}
+	group.GET("/activity/all-changes", ctrl.activityCollection)
+	group.GET("/activity/page/first", ctrl.activityPage)
+	group.GET("/activity/page/last", ctrl.activityPage)
+	group.GET("/activity/page/after/:cursor", ctrl.activityPage)
+	group.GET("/activity/page/before/:cursor", ctrl.activityPage)
+}
+
+func (ctrl *mainController) activityCollection(c *gin.Context) {
+	setLinkHeader(c,
+		link{rel: "self", href: ctrl.externalURL("activity", "all-changes")},
+		link{rel: "first", href: ctrl.activityPageURL("first")},
+		link{rel: "last", href: ctrl.activityPageURL("last")},
+	)
+	c.JSON(http.StatusOK, gin.H{
+		"@context": activityStreamsContext,
+		"id":       ctrl.externalURL("activity", "all-changes"),
+		"type":     "OrderedCollection",
+		"first":    gin.H{"id": ctrl.activityPageURL("first"), "type": "OrderedCollectionPage"},
+		"last":     gin.H{"id": ctrl.activityPageURL("last"), "type": "OrderedCollectionPage"},
+	})
+}
+
+func (ctrl *mainController) activityPage(c *gin.Context) {
+	// first, last, after/:cursor or before/:cursor
+	_, position, _ := strings.Cut(c.FullPath(), "/activity/page/")
+	position, _, _ = strings.Cut(position, "/")
+	var cursor ChangeCursor
+	self := position
+	if param := c.Param("cursor"); param != "" {
+		var err error
+		if cursor, err = parseChangeCursor(param); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		self = position + "/" + param
+	}
+	page, err := ctrl.loadActivityPage(c.Request.Context(), position, cursor)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot load activity page")
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	links := []link{
+		{rel: "self", href: ctrl.activityPageURL(self)},
+		{rel: "first", href: ctrl.activityPageURL("first")},
+		{rel: "last", href: ctrl.activityPageURL("last")},
+	}
+	result := gin.H{
+		"@context": activityStreamsContext,
+		"id":       ctrl.activityPageURL(self),
+		"type":     "OrderedCollectionPage",
+		"partOf":   gin.H{"id": ctrl.externalURL("activity", "all-changes"), "type": "OrderedCollection"},
+	}
+	if page.prev != "" {
+		links = append(links, link{rel: "prev", href: ctrl.activityPageURL(page.prev)})
+		result["prev"] = gin.H{"id": ctrl.activityPageURL(page.prev), "type": "OrderedCollectionPage"}
+	}
+	if page.next != "" {
+		links = append(links, link{rel: "next", href: ctrl.activityPageURL(page.next)})
+		result["next"] = gin.H{"id": ctrl.activityPageURL(page.next), "type": "OrderedCollectionPage"}
+	}
+	setLinkHeader(c, links...)
+	filter := ctrl.newActivityFilter(c.Query("token"))
+	items := make([]gin.H, 0, len(page.changes))
+	for _, ch := range page.changes {
+		// the page keeps its borders, dark and inaccessible items are left out
+		if !filter.visible(ch) {
+			continue
+		}
+		items = append(items, gin.H{
+			"type": ch.Type,
+			"object": gin.H{
+				"id":   ctrl.externalURL(ch.Collection, ch.Signature, "metadata"),
+				"type": "Dataset",
+			},
+			"endTime": ch.Time.UTC().Format(time.RFC3339),
+		})
+	}
+	result["orderedItems"] = items
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,152 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// changeList lists changes sorted by their cursor
+type changeList []*ItemChange
+
+func (cl changeList) GetItemChanges(ctx context.Context, cursor ChangeCursor, before bool, limit int) ([]*ItemChange, error) {
+	if before {
+		end := len(cl)
+		if cursor != (ChangeCursor{}) {
+			end = sort.Search(len(cl), func(i int) bool { return !cl[i].Cursor().Before(cursor) })
+		}
+		return cl[max(0, end-limit):end], nil
+	}
+	start := sort.Search(len(cl), func(i int) bool { return cursor.Before(cl[i].Cursor()) })
+	return cl[start:min(len(cl), start+limit)], nil
+}
+
+func testChanges(signatures ...string) changeList {
+	base := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	var changes changeList
+	for i, signature := range signatures {
+		// two changes share a timestamp, the signature breaks the tie
+		changes = append(changes, &ItemChange{Type: "Update", Collection: "test", Signature: signature, Time: base.Add(time.Duration(i/2) * time.Second)})
+	}
+	return changes
+}
+
+func TestChangeCursor(t *testing.T) {
+	cursor := ChangeCursor{Time: time.Date(2026, 10, 1, 12, 0, 0, 123456789, time.UTC), Collection: "test", Signature: "a/b\nc"}
+	parsed, err := parseChangeCursor(cursor.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Time.Equal(cursor.Time) || parsed.Collection != cursor.Collection || parsed.Signature != cursor.Signature {
+		t.Errorf("parsed cursor %v, expected %v", parsed, cursor)
+	}
+	for _, invalid := range []string{"", "!", "dGVzdA", cursor.String()[1:]} {
+		if _, err := parseChangeCursor(invalid); err == nil {
+			t.Errorf("invalid cursor '%s' accepted", invalid)
+		}
+	}
+}
+
+func TestActivityPage(t *testing.T) {
+	changes := testChanges("a", "b", "c", "d", "e")
+	cursor := func(i int) string { return changes[i].Cursor().String() }
+	ctrl := &mainController{itemChanges: changes, activityPageSize: 2}
+	for _, tc := range []struct {
+		position   string
+		cursor     int
+		signatures []string
+		prev, next string
+	}{
+		{position: "first", signatures: []string{"a", "b"}, next: "after/" + cursor(1)},
+		{position: "after", cursor: 1, signatures: []string{"c", "d"}, prev: "before/" + cursor(2), next: "after/" + cursor(3)},
+		{position: "after", cursor: 3, signatures: []string{"e"}, prev: "before/" + cursor(4)},
+		{position: "after", cursor: 4, prev: "before/" + cursor(4)},
+		{position: "last", signatures: []string{"d", "e"}, prev: "before/" + cursor(3)},
+		{position: "before", cursor: 3, signatures: []string{"b", "c"}, prev: "before/" + cursor(1), next: "after/" + cursor(2)},
+		{position: "before", cursor: 1, signatures: []string{"a"}, next: "after/" + cursor(0)},
+	} {
+		var c ChangeCursor
+		if tc.position == "after" || tc.position == "before" {
+			c = changes[tc.cursor].Cursor()
+		}
+		page, err := ctrl.loadActivityPage(context.Background(), tc.position, c)
+		if err != nil {
+			t.Fatalf("%s %d: %v", tc.position, tc.cursor, err)
+		}
+		var signatures []string
+		for _, ch := range page.changes {
+			signatures = append(signatures, ch.Signature)
+		}
+		if !slices.Equal(signatures, tc.signatures) {
+			t.Errorf("%s %d: changes %v, expected %v", tc.position, tc.cursor, signatures, tc.signatures)
+		}
+		if page.prev != tc.prev || page.next != tc.next {
+			t.Errorf("%s %d: prev '%s' and next '%s', expected '%s' and '%s'", tc.position, tc.cursor, page.prev, page.next, tc.prev, tc.next)
+		}
+	}
+}
+
+func TestActivityPageStable(t *testing.T) {
+	changes := testChanges("a", "b", "c", "d")
+	ctrl := &mainController{itemChanges: changes, activityPageSize: 2}
+	first, err := ctrl.loadActivityPage(context.Background(), "first", ChangeCursor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new changes are appended to the end and do not move the following page
+	ctrl.itemChanges = append(changes, testChanges("a", "b", "c", "d", "e", "f")[4:]...)
+	next, err := ctrl.loadActivityPage(context.Background(), "after", first.changes[1].Cursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.changes) != 2 || next.changes[0].Signature != "c" || next.changes[1].Signature != "d" {
+		t.Errorf("following page changed with new changes: %v", next.changes)
+	}
+	if next.next == "" {
+		t.Error("no next page after new changes")
+	}
+}
+
+// tokenAccess grants access to the items listed for a token and counts the checks
+type tokenAccess struct {
+	items  map[string][]string
+	checks int
+}
+
+func (ta *tokenAccess) CheckAccess(collection, signature, action, paramStr, token string) error {
+	ta.checks++
+	if slices.Contains(ta.items[token], collection+"/"+signature) {
+		return nil
+	}
+	return errors.New("access denied")
+}
+
+func TestActivityFilter(t *testing.T) {
+	access := &tokenAccess{items: map[string][]string{"token": {"test/restricted"}}}
+	ctrl := &mainController{access: access}
+	ctrl.dark.set("legalhold", true)
+	for _, tc := range []struct {
+		change  ItemChange
+		token   string
+		visible bool
+		checks  int
+	}{
+		{change: ItemChange{Type: "Update", Collection: "test", Signature: "public", Public: true}, visible: true},
+		{change: ItemChange{Type: "Delete", Collection: "test", Signature: "public", Public: true}, visible: true},
+		{change: ItemChange{Type: "Delete", Collection: "test", Signature: "restricted"}, token: "token"},
+		{change: ItemChange{Type: "Update", Collection: "legalhold", Signature: "public", Public: true}},
+		{change: ItemChange{Type: "Update", Collection: "test", Signature: "restricted"}, checks: 1},
+		{change: ItemChange{Type: "Update", Collection: "test", Signature: "restricted"}, token: "token", visible: true, checks: 1},
+	} {
+		access.checks = 0
+		if visible := ctrl.newActivityFilter(tc.token).visible(&tc.change); visible != tc.visible {
+			t.Errorf("%s of %s/%s with token '%s': visible %v, expected %v", tc.change.Type, tc.change.Collection, tc.change.Signature, tc.token, visible, tc.visible)
+		}
+		if access.checks != tc.checks {
+			t.Errorf("%s of %s/%s with token '%s': %d access checks, expected %d", tc.change.Type, tc.change.Collection, tc.change.Signature, tc.token, access.checks, tc.checks)
+		}
+	}
+}
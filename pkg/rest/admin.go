@@ -0,0 +1,132 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// AdminSubject is the subject of tokens for the admin api. they are signed with the global jwt key
+const AdminSubject = "admin"
+
+// requestToken returns the token of a request from the authorization header or the token query parameter
+func requestToken(c *gin.Context) string {
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return c.Query("token")
+}
+
+// adminAuth accepts only tokens signed with the admin key and subject "admin"
+func (ctrl *mainController) adminAuth(c *gin.Context) {
+	if ctrl.adminKey == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin access not configured"})
+		return
+	}
+	token := requestToken(c)
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "no token provided"})
+		return
+	}
+	jwtToken, err := ctrl.parseToken(token, ctrl.jwtAlgs, &jwtKey{secret: []byte(ctrl.adminKey)})
+	if err != nil {
+		ctrl.logger.Info().Err(err).Msg("admin access denied")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("access denied: %v", err)})
+		return
+	}
+	subject, err := jwtToken.Claims.GetSubject()
+	if err != nil || subject != AdminSubject {
+		ctrl.logger.Info().Msgf("admin access denied for subject '%s'", subject)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("invalid subject '%s' in jwt token - should be '%s'", subject, AdminSubject)})
+		return
+	}
+	c.Next()
+}
+
+// invalidateItem removes all locally cached data of an item
+func (ctrl *mainController) invalidateItem(collection, signature string) {
+	ctrl.items.Invalidate(collection, signature)
+	ctrl.removeAccess(collection, signature)
+	ctrl.removeInfo(collection, signature)
+	ctrl.removeRights(collection, signature)
+	ctrl.removeEmbeddedMetadata(collection, signature)
+	if ctrl.responseCache != nil {
+		ctrl.responseCache.removeItem(collection, signature)
+	}
+}
+
+func (ctrl *mainController) initAdmin(admin *gin.RouterGroup) {
+	admin.POST("/invalidate/:collection/:signature", ctrl.denyReadOnly, ctrl.adminInvalidate)
+	admin.POST("/export/bagit", ctrl.adminExportBagit)
+	admin.POST("/prewarm", ctrl.denyReadOnly, ctrl.adminPrewarm)
+	admin.POST("/generate", ctrl.denyReadOnly, ctrl.adminGenerate)
+	admin.POST("/token", ctrl.adminToken)
+	admin.GET("/cache/dump", ctrl.adminCacheDump)
+	admin.POST("/vfs/reload", ctrl.denyReadOnly, ctrl.adminReloadVFS)
+	admin.GET("/vfs/metrics", ctrl.adminVFSMetrics)
+	admin.GET("/stream/metrics", ctrl.adminStreamMetrics)
+	admin.GET("/grpc/metrics", ctrl.adminRPCMetrics)
+	admin.GET("/pids/*identifier", ctrl.adminPID)
+	admin.PUT("/pids/*identifier", ctrl.denyReadOnly, ctrl.adminPutPID)
+	admin.DELETE("/pids/*identifier", ctrl.denyReadOnly, ctrl.adminDeletePID)
+	admin.POST("/readonly", ctrl.adminReadOnly)
+	admin.GET("/tenants", ctrl.adminTenants)
+	admin.GET("/collections", ctrl.adminCollections)
+	admin.GET("/collections/:collection", ctrl.adminCollection)
+	admin.GET("/items/:collection/:signature/public", ctrl.adminPublicActions)
+	admin.POST("/items/:collection/:signature/public/validate", ctrl.adminValidatePublicActions)
+	admin.POST("/items/:collection/:signature/pid", ctrl.denyReadOnly, ctrl.adminMintPID)
+	admin.GET("/items/:collection/:signature/preview", ctrl.adminPreview)
+	admin.GET("/items/:collection/:signature/captions", ctrl.adminCaptions)
+	admin.PUT("/items/:collection/:signature/captions/:lang", ctrl.denyReadOnly, ctrl.adminPutCaption)
+	admin.DELETE("/items/:collection/:signature/captions/:lang", ctrl.denyReadOnly, ctrl.adminDeleteCaption)
+	admin.POST("/canonical", ctrl.adminCanonical)
+	admin.GET("/sizebudget", ctrl.adminSizeBudget)
+	admin.GET("/quota", ctrl.adminQuota)
+	admin.POST("/quota/scan", ctrl.adminQuotaScan)
+	admin.GET("/accounting", ctrl.adminAccounting)
+	admin.GET("/fastpath", ctrl.adminFastPath)
+	admin.GET("/dark", ctrl.adminDark)
+	admin.PUT("/dark/:collection", ctrl.adminSetDark)
+	admin.DELETE("/dark/:collection", ctrl.adminSetDark)
+	admin.GET("/exhibitions", ctrl.adminExhibitions)
+	admin.PUT("/exhibitions/:id", ctrl.denyReadOnly, ctrl.adminPutExhibition)
+	admin.DELETE("/exhibitions/:id", ctrl.denyReadOnly, ctrl.adminDeleteExhibition)
+	admin.GET("/seats", ctrl.adminSeats)
+	admin.GET("/printrequests", ctrl.adminPrintRequests)
+	admin.POST("/printrequests/:id/:decision", ctrl.denyReadOnly, ctrl.adminDecidePrintRequest)
+	admin.GET("/reports", ctrl.adminReports)
+	admin.POST("/reports", ctrl.denyReadOnly, ctrl.adminReports)
+	admin.GET("/actionerrors", ctrl.adminActionErrors)
+	admin.POST("/actionerrors/retry", ctrl.denyReadOnly, ctrl.adminRetryActionErrors)
+	admin.DELETE("/actionerrors", ctrl.adminDeleteActionErrors)
+	admin.GET("/quarantine", ctrl.adminQuarantine)
+	admin.PUT("/quarantine/:collection/:signature", ctrl.denyReadOnly, ctrl.adminSetQuarantine)
+	admin.DELETE("/quarantine/:collection/:signature", ctrl.denyReadOnly, ctrl.adminSetQuarantine)
+	admin.GET("/disconnects", ctrl.adminDisconnects)
+	admin.GET("/transcriptions", ctrl.adminTranscriptions)
+	admin.POST("/transcriptions/:id/:decision", ctrl.denyReadOnly, ctrl.adminDecideTranscription)
+	admin.GET("/stats", ctrl.adminStats)
+	admin.GET("/runtime", ctrl.adminRuntime)
+}
+
+func (ctrl *mainController) adminInvalidate(c *gin.Context) {
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	ctrl.invalidateItem(collection, signature)
+	result := gin.H{
+		"collection": collection,
+		"signature":  signature,
+	}
+	if ctrl.purger != nil {
+		if err := ctrl.purger.Purge(c.Request.Context(), collection, signature); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot purge cdn for %s/%s", collection, signature)
+			result["error"] = fmt.Sprintf("cannot purge cdn for %s/%s: %v", collection, signature, err)
+			c.JSON(http.StatusBadGateway, result)
+			return
+		}
+		result["purged"] = true
+	}
+	c.JSON(http.StatusOK, result)
+}
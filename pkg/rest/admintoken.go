@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// maximum validity of tokens minted by the admin api
+const maxMintTTL = 30 * 24 * time.Hour
+
+// TokenRequest asks for a temporary access link. TTL is a duration like "24h"
+type TokenRequest struct {
+	Collection string `json:"collection"`
+	Signature  string `json:"signature"`
+	Action     string `json:"action"`
+	Params     string `json:"params,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	// Short additionally creates a short link for the url
+	Short bool `json:"short,omitempty"`
+	// Email sends the url to the address in the language Lang
+	Email string `json:"email,omitempty"`
+	Lang  string `json:"lang,omitempty"`
+}
+
+type TokenResponse struct {
+	URL     string    `json:"url"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Short   string    `json:"short,omitempty"`
+	Mailed  bool      `json:"mailed,omitempty"`
+}
+
+// mintCollectionToken signs a token with the hmac key of the collection
+func (ctrl *mainController) mintCollectionToken(collection, subject string, ttl time.Duration) (string, error) {
+	coll, err := ctrl.getCollection(collection)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get collection %s", collection)
+	}
+	key, err := ctrl.collectionKey(collection, coll.GetJwtkey())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(key.secret) == 0 {
+		return "", errors.Errorf("collection %s has only a public key, tokens must be signed by the key owner", collection)
+	}
+	for _, alg := range ctrl.collectionAlgs(collection) {
+		if !strings.HasPrefix(alg, "HS") {
+			continue
+		}
+		return MintToken(string(key.secret), alg, subject, ttl)
+	}
+	return "", errors.Errorf("no hmac jwt alg allowed for collection %s", collection)
+}
+
+func (ctrl *mainController) adminToken(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if req.Collection == "" || req.Signature == "" || req.Action == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "collection, signature and action are required"})
+		return
+	}
+	ttl := time.Hour
+	if cc, ok := ctrl.collectionJWT[req.Collection]; ok && cc.DefaultTTL > 0 {
+		ttl = time.Duration(cc.DefaultTTL)
+	}
+	maxTTL, _ := ctrl.tokenPolicy(req.Collection)
+	if maxTTL > 0 && req.TTL == "" && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if req.Email != "" {
+		if _, err := mail.ParseAddress(req.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid email '%s'", req.Email)})
+			return
+		}
+	}
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid ttl '%s'", req.TTL)})
+			return
+		}
+	}
+	if ttl > maxMintTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ttl %s exceeds maximum of %s", ttl, maxMintTTL)})
+		return
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ttl %s exceeds maximum of %s for collection %s", ttl, maxTTL, req.Collection)})
+		return
+	}
+	subject := AccessSubject(req.Collection, req.Signature, req.Action, strings.Trim(req.Params, "/"))
+	token, err := ctrl.mintCollectionToken(req.Collection, subject, ttl)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot mint token for %s", subject)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot mint token for %s: %v", subject, err)})
+		return
+	}
+	ctrl.logger.Info().Msgf("minted token for %s valid for %s", subject, ttl)
+	result := TokenResponse{
+		URL:     ctrl.externalURL(subject) + "?token=" + token,
+		Token:   token,
+		Expires: time.Now().Add(ttl),
+	}
+	if req.Short {
+		if ctrl.shortLinks == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "short links not enabled"})
+			return
+		}
+		if result.Short, err = ctrl.createShortLink(result.URL, ttl); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot create short link for %s", subject)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot create short link for %s: %v", subject, err)})
+			return
+		}
+	}
+	if req.Email != "" {
+		link := result.URL
+		if result.Short != "" {
+			link = result.Short
+		}
+		if result.Mailed, err = ctrl.sendTemplate(c.Request.Context(), req.Email, req.Lang, "signed_link", map[string]any{
+			"Collection": req.Collection,
+			"Signature":  req.Signature,
+			"Expires":    result.Expires.UTC().Format(time.RFC1123),
+			"URL":        link,
+		}); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot mail token for %s", subject)
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
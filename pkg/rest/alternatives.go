@@ -0,0 +1,151 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type AlternativeConfig struct {
+	// Kind of the alternative, e.g. "ocr", "transcript", "audiodescription" or the text track kinds
+	// "captions", "subtitles" and "descriptions" which are added to the video and audio viewer
+	Kind string `toml:"kind"`
+	// Action is the "action/params" of the derivative, e.g. "webvtt/langde"
+	Action string `toml:"action"`
+	Lang   string `toml:"lang"`
+	Label  string `toml:"label"`
+}
+
+// textTrackKinds are the alternatives which are html text tracks
+var textTrackKinds = []string{"captions", "subtitles", "descriptions"}
+
+var alternativeKindRegexp = regexp.MustCompile(`^[a-z]+$`)
+
+// WithAlternatives lists the accessibility alternatives per media type at /:collection/:signature/alternatives
+func WithAlternatives(alternatives map[string][]*AlternativeConfig) Option {
+	return func(ctrl *mainController) error {
+		for mediaType, alts := range alternatives {
+			for _, alt := range alts {
+				if !alternativeKindRegexp.MatchString(alt.Kind) {
+					return errors.Errorf("invalid alternative kind '%s' for media type %s", alt.Kind, mediaType)
+				}
+				if strings.Trim(alt.Action, "/") == "" {
+					return errors.Errorf("empty action of alternative %s for media type %s", alt.Kind, mediaType)
+				}
+			}
+		}
+		ctrl.alternativeActions = alternatives
+		return nil
+	}
+}
+
+type alternative struct {
+	Kind     string `json:"kind"`
+	Lang     string `json:"lang,omitempty"`
+	Label    string `json:"label,omitempty"`
+	MimeType string `json:"mimetype"`
+	Action   string `json:"action"`
+	URL      string `json:"url"`
+}
+
+// availableAlternatives returns the alternatives of an item which exist in the cache and may be accessed with the token.
+// missing derivatives are not generated
+func (ctrl *mainController) availableAlternatives(c *gin.Context, item *mediaserverproto.Item, token string) []*alternative {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	mediaType := item.GetMetadata().GetType()
+	var result = []*alternative{}
+	for _, alt := range ctrl.alternativeActions[mediaType] {
+		action, paramStr, _ := strings.Cut(normalizePath(alt.Action), "/")
+		canonical, err := ctrl.canonicalAction(mediaType, action, paramStr)
+		if err != nil {
+			ctrl.logger.Warn().Err(err).Msgf("cannot get alternative %s of %s/%s", alt.Kind, collection, signature)
+			continue
+		}
+		action, paramStr, _ = strings.Cut(canonical, "/")
+		if err := ctrl.checkAccess(c, collection, signature, action, paramStr, token); err != nil {
+			continue
+		}
+		cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
+			Identifier: &mediaserverproto.ItemIdentifier{
+				Collection: collection,
+				Signature:  signature,
+			},
+			Action: action,
+			Params: paramStr,
+		})
+		if err != nil {
+			if stat, ok := status.FromError(err); !ok || stat.Code() != codes.NotFound {
+				ctrl.logger.Error().Err(err).Msgf("cannot get cache for %s/%s/%s", collection, signature, canonical)
+			}
+			continue
+		}
+		u := ctrl.externalURL(collection, signature, action, paramStr)
+		if token != "" {
+			u += "?token=" + token
+		}
+		result = append(result, &alternative{
+			Kind:     alt.Kind,
+			Lang:     alt.Lang,
+			Label:    alt.Label,
+			MimeType: cache.GetMetadata().GetMimeType(),
+			Action:   canonical,
+			URL:      u,
+		})
+	}
+	return append(result, ctrl.captionAlternatives(c, item, token)...)
+}
+
+// alternatives answers /:collection/:signature/alternatives with the list of alternatives and
+// /:collection/:signature/alternatives/:kind[/:lang] with a redirect to the derivative.
+// access is checked for every alternative
+func (ctrl *mainController) alternatives(c *gin.Context, item *mediaserverproto.Item, collection, signature, paramStr, token string) {
+	alts := ctrl.availableAlternatives(c, item, token)
+	kind, lang, _ := strings.Cut(strings.Trim(paramStr, "/"), "/")
+	if kind == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"collection":   collection,
+			"signature":    signature,
+			"alternatives": alts,
+		})
+		return
+	}
+	for _, alt := range alts {
+		if alt.Kind != kind || (lang != "" && alt.Lang != lang) {
+			continue
+		}
+		c.Redirect(http.StatusFound, alt.URL)
+		return
+	}
+	ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Errorf("no alternative %s/%s for %s/%s", kind, lang, collection, signature), "no_alternative", collection+"/"+signature)
+}
+
+type embedTrack struct {
+	Kind  string
+	Src   string
+	Lang  string
+	Label string
+}
+
+// embedTracks returns the text tracks of the viewer
+func (ctrl *mainController) embedTracks(c *gin.Context, item *mediaserverproto.Item, token string) []embedTrack {
+	var tracks []embedTrack
+	for _, alt := range ctrl.availableAlternatives(c, item, token) {
+		if !slices.Contains(textTrackKinds, alt.Kind) {
+			continue
+		}
+		label := alt.Label
+		if label == "" {
+			label = alt.Lang
+		}
+		tracks = append(tracks, embedTrack{Kind: alt.Kind, Src: alt.URL, Lang: alt.Lang, Label: label})
+	}
+	return tracks
+}
@@ -0,0 +1,431 @@
+package rest
+
+import (
+	"crypto/rand"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotationsAction is the action of tokens allowed to create and delete annotations. reading follows the access
+// of the item
+const annotationsAction = "annotations"
+
+type AnnotationConfig struct {
+	Enabled bool `toml:"enabled"`
+	// File keeps the annotations in the vfs across restarts, e.g. "vfs://testcache/annotations.json"
+	File string `toml:"file"`
+	// MaxPerCanvas is the number of published annotations of an item, default 1000
+	MaxPerCanvas int `toml:"maxpercanvas"`
+	// MaxPendingPerCanvas is the number of annotations of an item waiting for moderation, default 100
+	MaxPendingPerCanvas int `toml:"maxpendingpercanvas"`
+	// MaxSize is the size of a single annotation in bytes, default 64KiB
+	MaxSize int64 `toml:"maxsize"`
+}
+
+// Annotation is a stored w3c web annotation of the canvas of an item
+type Annotation struct {
+	ID         string    `json:"id"`
+	Collection string    `json:"collection"`
+	Signature  string    `json:"signature"`
+	Created    time.Time `json:"created"`
+	// Document is the annotation as posted without id and created
+	Document json.RawMessage `json:"document"`
+	// Status is empty for published annotations, AnnotationPending until moderated
+	Status string `json:"status,omitempty"`
+}
+
+// AnnotationPending is the status of submissions waiting for moderation
+const AnnotationPending = "pending"
+
+var errAnnotationLimit = errors.New("maximum number of annotations reached")
+
+type annotations struct {
+	sync.Mutex
+	conf  *AnnotationConfig
+	items map[itemIdentifier][]*Annotation
+}
+
+// WithAnnotations enables w3c web annotations of item canvases at /annotations/:collection/:signature. annotations
+// are listed as iiif annotation page with the access of the item and created or deleted with a token for the
+// action "annotations"
+func WithAnnotations(conf *AnnotationConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if conf.MaxPerCanvas <= 0 {
+			conf.MaxPerCanvas = 1000
+		}
+		if conf.MaxPendingPerCanvas <= 0 {
+			conf.MaxPendingPerCanvas = 100
+		}
+		if conf.MaxSize <= 0 {
+			conf.MaxSize = 64 << 10
+		}
+		an := &annotations{
+			conf:  conf,
+			items: map[itemIdentifier][]*Annotation{},
+		}
+		if conf.File != "" {
+			data, err := fs.ReadFile(ctrl.vfs, conf.File)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Wrapf(err, "cannot read %s", conf.File)
+			}
+			if err == nil {
+				var list []*Annotation
+				if err := json.Unmarshal(data, &list); err != nil {
+					return errors.Wrapf(err, "cannot unmarshal %s", conf.File)
+				}
+				for _, a := range list {
+					key := itemIdentifier{collection: a.Collection, signature: a.Signature}
+					an.items[key] = append(an.items[key], a)
+				}
+			}
+		}
+		ctrl.annotations = an
+		return nil
+	}
+}
+
+// setItems replaces the annotations of an item, e.g. to roll back a change which could not be saved. the lock
+// must be held
+func (an *annotations) setItems(key itemIdentifier, items []*Annotation) {
+	if len(items) == 0 {
+		delete(an.items, key)
+		return
+	}
+	an.items[key] = items
+}
+
+// saveAnnotations writes all annotations to the file. the lock must be held
+func (ctrl *mainController) saveAnnotations() error {
+	an := ctrl.annotations
+	if an.conf.File == "" {
+		return nil
+	}
+	var list = []*Annotation{}
+	for _, items := range an.items {
+		list = append(list, items...)
+	}
+	slices.SortFunc(list, func(a, b *Annotation) int {
+		return a.Created.Compare(b.Created)
+	})
+	data, err := json.Marshal(list)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal annotations")
+	}
+	fp, err := writefs.Create(ctrl.vfs, an.conf.File)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", an.conf.File)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", an.conf.File)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", an.conf.File)
+}
+
+// canvasURL is the canvas of an item, the target of its annotations
+func (ctrl *mainController) canvasURL(collection, signature string) string {
+	return ctrl.externalURL(collection, signature, "layers")
+}
+
+// annotationPageURL is the iiif annotation page of an item, referenced from its canvas
+func (ctrl *mainController) annotationPageURL(collection, signature string) string {
+	return ctrl.externalURL("annotations", collection, signature)
+}
+
+// annotationDocument returns the annotation with id, created and the canvas as default target
+func (ctrl *mainController) annotationDocument(a *Annotation) (map[string]any, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(a.Document, &doc); err != nil {
+		return nil, errors.Wrapf(err, "invalid annotation %s", a.ID)
+	}
+	doc["id"] = ctrl.externalURL("annotations", a.Collection, a.Signature, a.ID)
+	doc["type"] = "Annotation"
+	doc["created"] = a.Created.UTC().Format(time.RFC3339)
+	if _, ok := doc["target"]; !ok {
+		doc["target"] = ctrl.canvasURL(a.Collection, a.Signature)
+	}
+	return doc, nil
+}
+
+// annotationTargetSource returns the resource of a target, a string or an object with source or id
+func annotationTargetSource(target any) string {
+	switch t := target.(type) {
+	case string:
+		return t
+	case map[string]any:
+		for _, field := range []string{"source", "id"} {
+			if s, ok := t[field].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// annotationAccess checks the item and the token of an annotation request. writing needs a token for the
+// action "annotations", public items and exhibitions only allow reading
+func (ctrl *mainController) annotationAccess(c *gin.Context, write bool) (string, string, bool) {
+	if ctrl.annotations == nil {
+		c.Status(http.StatusNotFound)
+		return "", "", false
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	if _, err := ctrl.getItem(collection, signature); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("item %s/%s not found", collection, signature)})
+		return "", "", false
+	}
+	token := requestToken(c)
+	if write {
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "no token provided"})
+			return "", "", false
+		}
+		subject, err := ctrl.tokenSubject(collection, token)
+		if expected := AccessSubject(collection, signature, annotationsAction, ""); err != nil || subject != expected {
+			ctrl.logger.Info().Err(err).Msgf("annotation access denied for %s/%s with subject '%s'", collection, signature, subject)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("access denied for %s/%s", collection, signature)})
+			return "", "", false
+		}
+		return collection, signature, true
+	}
+	if !ctrl.exhibited(collection, signature, annotationsAction) {
+		if err := ctrl.access.CheckAccess(collection, signature, annotationsAction, "", token); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("access denied for %s/%s", collection, signature)})
+			return "", "", false
+		}
+	}
+	return collection, signature, true
+}
+
+// listAnnotations answers GET /annotations/:collection/:signature with the iiif annotation page of the canvas
+func (ctrl *mainController) listAnnotations(c *gin.Context) {
+	collection, signature, ok := ctrl.annotationAccess(c, false)
+	if !ok {
+		return
+	}
+	an := ctrl.annotations
+	// moderation changes the status of stored annotations, so they are copied with the lock held
+	var list []Annotation
+	an.Lock()
+	for _, a := range an.items[itemIdentifier{collection: collection, signature: signature}] {
+		if a.Status == "" {
+			list = append(list, *a)
+		}
+	}
+	an.Unlock()
+	var items = []map[string]any{}
+	for i := range list {
+		doc, err := ctrl.annotationDocument(&list[i])
+		if err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot read annotation of %s/%s", collection, signature)
+			continue
+		}
+		items = append(items, doc)
+	}
+	data, err := json.Marshal(map[string]any{
+		"@context": []string{"http://www.w3.org/ns/anno.jsonld", "http://iiif.io/api/presentation/3/context.json"},
+		"id":       ctrl.annotationPageURL(collection, signature),
+		"type":     "AnnotationPage",
+		"items":    items,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot marshal annotations: %v", err)})
+		return
+	}
+	// deletions do not change a modification time, the page is validated by its etag only
+	c.Header("Cache-Control", "no-cache")
+	if notModified(c, time.Time{}, contentETag(data)) {
+		return
+	}
+	c.Data(http.StatusOK, `application/ld+json;profile="http://iiif.io/api/presentation/3/context.json"`, data)
+}
+
+// getAnnotation answers GET /annotations/:collection/:signature/:id with a single annotation
+func (ctrl *mainController) getAnnotation(c *gin.Context) {
+	collection, signature, ok := ctrl.annotationAccess(c, false)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+	an := ctrl.annotations
+	an.Lock()
+	list := an.items[itemIdentifier{collection: collection, signature: signature}]
+	idx := slices.IndexFunc(list, func(a *Annotation) bool {
+		return a.ID == id && a.Status == ""
+	})
+	var a *Annotation
+	if idx >= 0 {
+		copied := *list[idx]
+		a = &copied
+	}
+	an.Unlock()
+	if a == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("annotation %s of %s/%s not found", id, collection, signature)})
+		return
+	}
+	doc, err := ctrl.annotationDocument(a)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	doc["@context"] = "http://www.w3.org/ns/anno.jsonld"
+	data, err := json.Marshal(doc)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot marshal annotation: %v", err)})
+		return
+	}
+	if notModified(c, a.Created, contentETag(data)) {
+		return
+	}
+	c.Data(http.StatusOK, `application/ld+json;profile="http://www.w3.org/ns/anno.jsonld"`, data)
+}
+
+// countAnnotations returns the number of annotations with the status
+func countAnnotations(items []*Annotation, status string) int {
+	var n int
+	for _, a := range items {
+		if a.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// addAnnotation stores a new annotation document unless the item has the maximum number of annotations with the
+// status. pending annotations have their own limit, so that submissions cannot block published annotations
+func (ctrl *mainController) addAnnotation(collection, signature string, document json.RawMessage, status string) (*Annotation, error) {
+	an := ctrl.annotations
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, errors.Wrap(err, "cannot create annotation id")
+	}
+	a := &Annotation{
+		ID:         shortLinkEncoding.EncodeToString(buf),
+		Collection: collection,
+		Signature:  signature,
+		Created:    time.Now(),
+		Document:   document,
+		Status:     status,
+	}
+	key := itemIdentifier{collection: collection, signature: signature}
+	an.Lock()
+	defer an.Unlock()
+	limit := an.conf.MaxPerCanvas
+	if status == AnnotationPending {
+		limit = an.conf.MaxPendingPerCanvas
+	}
+	if countAnnotations(an.items[key], status) >= limit {
+		return nil, errors.Wrapf(errAnnotationLimit, "%s/%s has %d annotations", collection, signature, limit)
+	}
+	previous := an.items[key]
+	an.items[key] = append(previous, a)
+	// annotations not saved would be lost with the next restart
+	if err := ctrl.saveAnnotations(); err != nil {
+		an.setItems(key, previous)
+		return nil, errors.Wrap(err, "cannot save annotations")
+	}
+	return a, nil
+}
+
+// createAnnotation stores the w3c web annotation of the request body. the target defaults to the canvas of the
+// item, other targets must refer to it
+func (ctrl *mainController) createAnnotation(c *gin.Context) {
+	collection, signature, ok := ctrl.annotationAccess(c, true)
+	if !ok {
+		return
+	}
+	an := ctrl.annotations
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, an.conf.MaxSize)
+	var doc map[string]any
+	if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid annotation: %v", err)})
+		return
+	}
+	if t, ok := doc["type"]; ok && t != "Annotation" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid annotation type '%v' - should be 'Annotation'", t)})
+		return
+	}
+	if _, ok := doc["body"]; !ok {
+		if _, ok := doc["bodyValue"]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "annotation without body"})
+			return
+		}
+	}
+	canvas := ctrl.canvasURL(collection, signature)
+	if target, ok := doc["target"]; ok {
+		if source := annotationTargetSource(target); source != canvas && !strings.HasPrefix(source, canvas+"#") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("annotation target '%s' is not the canvas %s", source, canvas)})
+			return
+		}
+	}
+	// the server assigns the identity of the annotation
+	delete(doc, "id")
+	delete(doc, "created")
+	delete(doc, "@context")
+	document, err := json.Marshal(doc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid annotation: %v", err)})
+		return
+	}
+	a, err := ctrl.addAnnotation(collection, signature, document, "")
+	if err != nil {
+		if errors.Is(err, errAnnotationLimit) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := ctrl.annotationDocument(a)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	result["@context"] = "http://www.w3.org/ns/anno.jsonld"
+	ctrl.logger.Info().Str("audit", "annotation").Str("collection", collection).Str("signature", signature).Msgf("annotation %s created", a.ID)
+	c.Header("Location", result["id"].(string))
+	c.JSON(http.StatusCreated, result)
+}
+
+// deleteAnnotation removes an annotation with a token for the action "annotations"
+func (ctrl *mainController) deleteAnnotation(c *gin.Context) {
+	collection, signature, ok := ctrl.annotationAccess(c, true)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+	key := itemIdentifier{collection: collection, signature: signature}
+	an := ctrl.annotations
+	an.Lock()
+	defer an.Unlock()
+	idx := slices.IndexFunc(an.items[key], func(a *Annotation) bool {
+		return a.ID == id
+	})
+	if idx < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("annotation %s of %s/%s not found", id, collection, signature)})
+		return
+	}
+	previous := an.items[key]
+	an.setItems(key, slices.Delete(slices.Clone(previous), idx, idx+1))
+	if err := ctrl.saveAnnotations(); err != nil {
+		an.setItems(key, previous)
+		ctrl.logger.Error().Err(err).Msg("cannot save annotations")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot save annotations: %v", err)})
+		return
+	}
+	ctrl.logger.Info().Str("audit", "annotation").Str("collection", collection).Str("signature", signature).Msgf("annotation %s deleted", id)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AudioRendition is an audio-only derivative of video items created by the action controller
+type AudioRendition struct {
+	// MimeType of the rendition, e.g. "audio/mpeg"
+	MimeType string `toml:"mimetype"`
+	// Action is the "action/params" of the video action, e.g. "audio/formatmp3/bitrate96k"
+	Action string `toml:"action"`
+}
+
+// WithAudioRenditions adds the audio delivery mode for video items at /:collection/:signature/item?delivery=audio[/subtype].
+// /item requests of video items preferring the audio types are redirected as well. the first rendition is the default
+func WithAudioRenditions(renditions []*AudioRendition) Option {
+	return func(ctrl *mainController) error {
+		for _, r := range renditions {
+			mediaType, _, err := mime.ParseMediaType(r.MimeType)
+			if err != nil || !strings.HasPrefix(mediaType, "audio/") {
+				return errors.Errorf("invalid audio rendition mime type '%s'", r.MimeType)
+			}
+			if strings.Trim(r.Action, "/") == "" {
+				return errors.Errorf("empty action of audio rendition %s", r.MimeType)
+			}
+		}
+		ctrl.audioRenditions = renditions
+		return nil
+	}
+}
+
+// acceptQuality returns the quality of a mime type in an accept header, the most specific range applies
+func acceptQuality(accept, mimeType string) float64 {
+	mainType, _, _ := strings.Cut(mimeType, "/")
+	quality, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+		var s int
+		switch mediaRange {
+		case mimeType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+// negotiateAudio returns the rendition for an accept header. if video is accepted at least as much as audio there is no rendition
+func (ctrl *mainController) negotiateAudio(accept, videoMime string) *AudioRendition {
+	if accept == "" {
+		return nil
+	}
+	videoQuality := acceptQuality(accept, videoMime)
+	var best *AudioRendition
+	bestQuality := 0.0
+	for _, r := range ctrl.audioRenditions {
+		if q := acceptQuality(accept, r.MimeType); q > bestQuality {
+			best, bestQuality = r, q
+		}
+	}
+	if best == nil || bestQuality <= videoQuality {
+		return nil
+	}
+	return best
+}
+
+// selectAudio returns the rendition of ?delivery=audio/<subtype> or the accepted rendition of ?delivery=audio
+func (ctrl *mainController) selectAudio(c *gin.Context, subtype string) *AudioRendition {
+	if subtype != "" {
+		for _, r := range ctrl.audioRenditions {
+			if strings.EqualFold(r.MimeType, "audio/"+subtype) {
+				return r
+			}
+		}
+		return nil
+	}
+	if r := ctrl.negotiateAudio(c.GetHeader("Accept"), "video/*"); r != nil {
+		return r
+	}
+	return ctrl.audioRenditions[0]
+}
+
+// audioRedirect redirects to the audio rendition of a video item. access is checked by the rendition action
+func (ctrl *mainController) audioRedirect(c *gin.Context, item *mediaserverproto.Item, collection, signature string, rendition *AudioRendition) {
+	c.Header("Vary", "Accept")
+	mediaType := item.GetMetadata().GetType()
+	if rendition == nil || mediaType != "video" {
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Errorf("no audio rendition for %s/%s of type '%s'", collection, signature, mediaType), "no_audio", collection+"/"+signature)
+		return
+	}
+	action, paramStr, _ := strings.Cut(normalizePath(rendition.Action), "/")
+	canonical, err := ctrl.canonicalAction(mediaType, action, paramStr)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get audio rendition %s of %s/%s", rendition.MimeType, collection, signature)
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Wrapf(err, "no audio rendition for %s/%s", collection, signature), "no_audio", collection+"/"+signature)
+		return
+	}
+	traceDecision(c, "audio", "%s %s", rendition.MimeType, canonical)
+	target := ctrl.externalURL(collection, signature, canonical)
+	query := c.Request.URL.Query()
+	query.Del("delivery")
+	if len(query) > 0 {
+		target = fmt.Sprintf("%s?%s", target, query.Encode())
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// audioMode handles ?delivery=audio and the accept negotiation of /item for video items. it returns false if the request
+// is not answered with an audio rendition
+func (ctrl *mainController) audioMode(c *gin.Context, item *mediaserverproto.Item, collection, signature, action string) bool {
+	// audio items are delivered as they are
+	if len(ctrl.audioRenditions) == 0 || action != "item" || item.GetMetadata().GetType() == "audio" {
+		return false
+	}
+	if mode, subtype, _ := strings.Cut(c.Query("delivery"), "/"); mode == "audio" {
+		ctrl.audioRedirect(c, item, collection, signature, ctrl.selectAudio(c, subtype))
+		return true
+	}
+	if item.GetMetadata().GetType() != "video" {
+		return false
+	}
+	// the item depends on the accept header from now on
+	c.Header("Vary", "Accept")
+	videoMime := item.GetMetadata().GetMimetype()
+	if videoMime == "" {
+		videoMime = "video/*"
+	}
+	if rendition := ctrl.negotiateAudio(c.GetHeader("Accept"), videoMime); rendition != nil {
+		ctrl.audioRedirect(c, item, collection, signature, rendition)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package rest
+
+import (
+	"context"
+	genericproto "github.com/je4/genericproto/v2/pkg/generic/proto"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"time"
+)
+
+// Database is the part of mediaserverproto.DatabaseClient used by the controller.
+// the grpc client satisfies it, tests may use the in-memory implementation of package fake
+type Database interface {
+	GetItem(ctx context.Context, in *mediaserverproto.ItemIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Item, error)
+	GetChildItems(ctx context.Context, in *mediaserverproto.ItemsRequest, opts ...grpc.CallOption) (*mediaserverproto.ItemsResult, error)
+	GetItemMetadata(ctx context.Context, in *mediaserverproto.ItemIdentifier, opts ...grpc.CallOption) (*wrapperspb.StringValue, error)
+	GetCache(ctx context.Context, in *mediaserverproto.CacheRequest, opts ...grpc.CallOption) (*mediaserverproto.Cache, error)
+	GetStorage(ctx context.Context, in *mediaserverproto.StorageIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Storage, error)
+	GetCollection(ctx context.Context, in *mediaserverproto.CollectionIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Collection, error)
+	GetCollections(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (mediaserverproto.Database_GetCollectionsClient, error)
+}
+
+// Actions is the part of mediaserverproto.ActionClient used by the controller
+type Actions interface {
+	GetParams(ctx context.Context, in *mediaserverproto.ParamsParam, opts ...grpc.CallOption) (*genericproto.StringList, error)
+	Action(ctx context.Context, in *mediaserverproto.ActionParam, opts ...grpc.CallOption) (*mediaserverproto.Cache, error)
+}
+
+// ActionCatalog is the part of mediaserverproto.ActionDispatcherClient listing the actions of all action workers
+type ActionCatalog interface {
+	GetActions(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*mediaserverproto.ActionMap, error)
+}
+
+// ItemChange is a create, update or delete of an item. changes are ordered by time, collection and signature
+type ItemChange struct {
+	// Type is "Create", "Update" or "Delete"
+	Type       string
+	Collection string
+	Signature  string
+	Time       time.Time
+	// Public is the public flag of the item, of deleted items at their deletion
+	Public bool
+}
+
+// ChangeCursor is the position of a change in the order of all changes. the zero cursor is before the first change
+type ChangeCursor struct {
+	Time       time.Time
+	Collection string
+	Signature  string
+}
+
+// ItemChanges lists the item changes of a catalogue from their update timestamps. it is implemented by databases
+// which can list items by update time. the database service has no such rpc yet
+type ItemChanges interface {
+	// GetItemChanges returns up to limit changes in ascending order, following the cursor or, with before, preceding
+	// it. before with the zero cursor returns the latest changes
+	GetItemChanges(ctx context.Context, cursor ChangeCursor, before bool, limit int) ([]*ItemChange, error)
+}
+
+var (
+	_ Database      = (mediaserverproto.DatabaseClient)(nil)
+	_ Actions       = (mediaserverproto.ActionClient)(nil)
+	_ ActionCatalog = (mediaserverproto.ActionDispatcherClient)(nil)
+)
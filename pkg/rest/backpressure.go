@@ -0,0 +1,183 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type BackpressureConfig struct {
+	Enabled bool `toml:"enabled"`
+	// WriteTimeout is the time a client may take to accept a chunk, default 30s. slower clients are disconnected,
+	// which releases the copy buffer of their response
+	WriteTimeout config.Duration `toml:"writetimeout"`
+	// ChunkSize is the maximum number of bytes handed to the connection at once, default 64KiB
+	ChunkSize int `toml:"chunksize"`
+	// StallThreshold is the duration of a chunk write counted as stall, default 1s
+	StallThreshold config.Duration `toml:"stallthreshold"`
+}
+
+// StreamMetrics are the statistics of streamed responses per source at GET /admin/stream/metrics
+type StreamMetrics struct {
+	Streams int64 `json:"streams"`
+	Active  int64 `json:"active"`
+	Bytes   int64 `json:"bytes"`
+	Stalls  int64 `json:"stalls"`
+	// StallTime and MaxStall are in milliseconds
+	StallTime float64 `json:"stalltime"`
+	MaxStall  float64 `json:"maxstall"`
+	// Timeouts are the clients disconnected after the write timeout
+	Timeouts int64 `json:"timeouts"`
+}
+
+type streamCounters struct {
+	streams, active, bytes, stalls, stallNanos, maxStallNanos, timeouts atomic.Int64
+}
+
+// streamSources are the deliveries using the streaming writer
+var streamSources = []string{"vfs", "iiif"}
+
+type backpressure struct {
+	conf           *BackpressureConfig
+	writeTimeout   time.Duration
+	stallThreshold time.Duration
+	counters       map[string]*streamCounters
+}
+
+// WithBackpressure writes vfs files and iiif responses in chunks with a deadline, so that slow clients cannot hold
+// buffers for long and stalls show up at GET /admin/stream/metrics
+func WithBackpressure(conf *BackpressureConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if conf.ChunkSize == 0 {
+			conf.ChunkSize = 64 << 10
+		}
+		if conf.ChunkSize < 4<<10 {
+			return errors.Errorf("backpressure chunk size %d is smaller than 4KiB", conf.ChunkSize)
+		}
+		bp := &backpressure{
+			conf:           conf,
+			writeTimeout:   time.Duration(conf.WriteTimeout),
+			stallThreshold: time.Duration(conf.StallThreshold),
+			counters:       map[string]*streamCounters{},
+		}
+		if bp.writeTimeout <= 0 {
+			bp.writeTimeout = 30 * time.Second
+		}
+		if bp.stallThreshold <= 0 {
+			bp.stallThreshold = time.Second
+		}
+		for _, source := range streamSources {
+			bp.counters[source] = &streamCounters{}
+		}
+		ctrl.backpressure = bp
+		return nil
+	}
+}
+
+// streamWriter writes chunks with a deadline each. the deadline needs the connection, so wrapping writers of the
+// chain have to implement Unwrap. without it chunks are written and measured without deadline
+type streamWriter struct {
+	gin.ResponseWriter
+	bp       *backpressure
+	counters *streamCounters
+	rc       *http.ResponseController
+	deadline bool
+}
+
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	var written int
+	for len(data) > 0 {
+		chunk := data[:min(len(data), w.bp.conf.ChunkSize)]
+		if w.deadline {
+			if err := w.rc.SetWriteDeadline(time.Now().Add(w.bp.writeTimeout)); err != nil {
+				w.deadline = false
+			}
+		}
+		start := time.Now()
+		n, err := w.ResponseWriter.Write(chunk)
+		elapsed := time.Since(start)
+		written += n
+		w.counters.bytes.Add(int64(n))
+		if elapsed >= w.bp.stallThreshold {
+			w.counters.stalls.Add(1)
+			w.counters.stallNanos.Add(int64(elapsed))
+			for {
+				maxStall := w.counters.maxStallNanos.Load()
+				if int64(elapsed) <= maxStall || w.counters.maxStallNanos.CompareAndSwap(maxStall, int64(elapsed)) {
+					break
+				}
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				w.counters.timeouts.Add(1)
+			}
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+func (w *streamWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// streamResponse replaces the writer of the request with the streaming writer until the returned function is called
+func (ctrl *mainController) streamResponse(c *gin.Context, source string) func() {
+	bp := ctrl.backpressure
+	if bp == nil {
+		return func() {}
+	}
+	counters := bp.counters[source]
+	w := &streamWriter{
+		ResponseWriter: c.Writer,
+		bp:             bp,
+		counters:       counters,
+		rc:             http.NewResponseController(c.Writer),
+		deadline:       true,
+	}
+	counters.streams.Add(1)
+	counters.active.Add(1)
+	c.Writer = w
+	return func() {
+		counters.active.Add(-1)
+		if w.deadline {
+			// following writes of the connection are not limited
+			w.rc.SetWriteDeadline(time.Time{})
+		}
+		c.Writer = w.ResponseWriter
+	}
+}
+
+func (ctrl *mainController) adminStreamMetrics(c *gin.Context) {
+	bp := ctrl.backpressure
+	if bp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "backpressure not enabled"})
+		return
+	}
+	result := map[string]StreamMetrics{}
+	for source, sc := range bp.counters {
+		result[source] = StreamMetrics{
+			Streams:   sc.streams.Load(),
+			Active:    sc.active.Load(),
+			Bytes:     sc.bytes.Load(),
+			Stalls:    sc.stalls.Load(),
+			StallTime: float64(sc.stallNanos.Load()) / float64(time.Millisecond),
+			MaxStall:  float64(sc.maxStallNanos.Load()) / float64(time.Millisecond),
+			Timeouts:  sc.timeouts.Load(),
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,332 @@
+package rest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// bagNameRegexp restricts bag names to safe folder and file names, without leading dot
+var bagNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// bagEntryPath appends names to a folder of the bag. names must be safe like the bag name, so that collections,
+// signatures and derivatives cannot escape their folder. empty names are left out
+func bagEntryPath(folder string, names ...string) (string, error) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if !bagNameRegexp.MatchString(name) {
+			return "", errors.Errorf("invalid name '%s' in bag entry", name)
+		}
+		folder = folder + "/" + name
+	}
+	return folder, nil
+}
+
+type bagitItem struct {
+	Collection string `json:"collection"`
+	Signature  string `json:"signature"`
+}
+
+type bagitRequest struct {
+	Items []bagitItem `json:"items"`
+	// Derivatives is a list of "action/params" strings exported for every item
+	Derivatives []string `json:"derivatives"`
+	// Format is "zip" (default) or "tar"
+	Format string `json:"format"`
+	// Name of the bag folder
+	Name string `json:"name"`
+}
+
+// archiveWriter writes files of size bytes into an archive. size is -1 if it is not known in advance. WriteFile
+// returns the number of bytes written
+type archiveWriter interface {
+	WriteFile(name string, size int64, r io.Reader) (int64, error)
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (za *zipArchive) WriteFile(name string, _ int64, r io.Reader) (int64, error) {
+	fp, err := za.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot create %s", name)
+	}
+	n, err := io.Copy(fp, r)
+	if err != nil {
+		return n, errors.Wrapf(err, "cannot write %s", name)
+	}
+	return n, nil
+}
+
+func (za *zipArchive) Close() error {
+	return za.w.Close()
+}
+
+type tarArchive struct {
+	w *tar.Writer
+}
+
+// WriteFile needs the size for the header. files of unknown size are spooled to a temporary file first
+func (ta *tarArchive) WriteFile(name string, size int64, r io.Reader) (int64, error) {
+	if size < 0 {
+		tmp, err := os.CreateTemp("", "bagit-*")
+		if err != nil {
+			return 0, errors.Wrapf(err, "cannot create temporary file for %s", name)
+		}
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+		if size, err = io.Copy(tmp, r); err != nil {
+			return 0, errors.Wrapf(err, "cannot read %s", name)
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return 0, errors.Wrapf(err, "cannot rewind temporary file for %s", name)
+		}
+		r = tmp
+	}
+	if err := ta.w.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0o644, ModTime: time.Now(), Typeflag: tar.TypeReg}); err != nil {
+		return 0, errors.Wrapf(err, "cannot create %s", name)
+	}
+	n, err := io.CopyN(ta.w, r, size)
+	if err != nil {
+		return n, errors.Wrapf(err, "cannot write %s", name)
+	}
+	return n, nil
+}
+
+func (ta *tarArchive) Close() error {
+	return ta.w.Close()
+}
+
+// bag writes a bagit 1.0 bag with sha512 manifests into an archive
+type bag struct {
+	archive     archiveWriter
+	name        string
+	manifest    strings.Builder
+	tagManifest strings.Builder
+	oxumBytes   int64
+	oxumCount   int64
+	failures    []string
+	// err is the first error of the archive. the archive is broken afterwards, so nothing more is written
+	err error
+}
+
+func (b *bag) writeFile(name string, size int64, r io.Reader, tag bool) error {
+	if b.err != nil {
+		return b.err
+	}
+	h := sha512.New()
+	size, err := b.archive.WriteFile(path.Join(b.name, name), size, io.TeeReader(r, h))
+	if err != nil {
+		b.err = errors.WithStack(err)
+		return b.err
+	}
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	if tag {
+		b.tagManifest.WriteString(line)
+	} else {
+		b.manifest.WriteString(line)
+		b.oxumBytes += size
+		b.oxumCount++
+	}
+	return nil
+}
+
+func (b *bag) writeBytes(name string, data []byte, tag bool) error {
+	return b.writeFile(name, int64(len(data)), bytes.NewReader(data), tag)
+}
+
+func (b *bag) fail(format string, args ...any) {
+	b.failures = append(b.failures, fmt.Sprintf(format, args...))
+}
+
+func (b *bag) finish() error {
+	if err := b.writeBytes("bagit.txt", []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"), true); err != nil {
+		return errors.WithStack(err)
+	}
+	info := fmt.Sprintf("Bagging-Date: %s\nPayload-Oxum: %d.%d\nBag-Software-Agent: mediaservermain\n", time.Now().Format("2006-01-02"), b.oxumBytes, b.oxumCount)
+	if err := b.writeBytes("bag-info.txt", []byte(info), true); err != nil {
+		return errors.WithStack(err)
+	}
+	if len(b.failures) > 0 {
+		if err := b.writeBytes("export-errors.txt", []byte(strings.Join(b.failures, "\n")+"\n"), true); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := b.writeBytes("manifest-sha512.txt", []byte(b.manifest.String()), true); err != nil {
+		return errors.WithStack(err)
+	}
+	// the tag manifest does not list itself
+	tagManifest := []byte(b.tagManifest.String())
+	if _, err := b.archive.WriteFile(path.Join(b.name, "tagmanifest-sha512.txt"), int64(len(tagManifest)), bytes.NewReader(tagManifest)); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(b.archive.Close())
+}
+
+// cachePath resolves the vfs path of a cache entry
+func cachePath(metadata *mediaserverproto.CacheMetadata) (string, error) {
+	p := metadata.GetPath()
+	if isUrlRegexp.MatchString(p) {
+		return p, nil
+	}
+	stor := metadata.GetStorage()
+	if stor == nil {
+		return "", errors.Errorf("no storage defined for %s", p)
+	}
+	return stor.GetFilebase() + "/" + p, nil
+}
+
+// openCache opens the file of an existing derivative
+func (ctrl *mainController) openCache(item *mediaserverproto.Item, action, paramStr string) (fs.File, *mediaserverproto.CacheMetadata, error) {
+	var params = actionCache.ActionParams{}
+	if action != "item" && action != "master" {
+		allowedParams, err := ctrl.getParams(item.GetMetadata().GetType(), action)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot get params for %s::%s", item.GetMetadata().GetType(), action)
+		}
+		params.SetString(paramStr, allowedParams)
+	}
+	cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
+		Identifier: item.GetIdentifier(),
+		Action:     action,
+		Params:     params.String(),
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot get cache %s/%s", action, params.String())
+	}
+	fullpath, err := cachePath(cache.GetMetadata())
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if dataRegexp.MatchString(fullpath) {
+		return nil, nil, errors.Errorf("cache %s/%s is inline data", action, params.String())
+	}
+	fullpath = ctrl.mapVFS(item.GetIdentifier().GetCollection(), cache.GetMetadata().GetStorage().GetName(), fullpath)
+	fp, err := ctrl.vfs.Open(fullpath)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot open %s", fullpath)
+	}
+	return fp, cache.GetMetadata(), nil
+}
+
+func (ctrl *mainController) exportCache(b *bag, item *mediaserverproto.Item, action, paramStr, folder string) {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	fp, metadata, err := ctrl.openCache(item, action, paramStr)
+	if err != nil {
+		b.fail("%s/%s/%s/%s: %v", collection, signature, action, paramStr, err)
+		return
+	}
+	defer fp.Close()
+	// the size of the metadata may be outdated, without stat the size is determined while writing
+	var size int64 = -1
+	if stat, err := fp.Stat(); err == nil && stat.Mode().IsRegular() {
+		size = stat.Size()
+	}
+	name, err := bagEntryPath(folder, path.Base(metadata.GetPath()))
+	if err != nil {
+		b.fail("%s/%s/%s/%s: %v", collection, signature, action, paramStr, err)
+		return
+	}
+	if err := b.writeFile(name, size, fp, false); err != nil {
+		b.fail("%s/%s/%s/%s: cannot write %s: %v", collection, signature, action, paramStr, name, err)
+	}
+}
+
+func (ctrl *mainController) adminExportBagit(c *gin.Context) {
+	var req bagitRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if len(req.Items) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no items given"})
+		return
+	}
+	if req.Name == "" {
+		req.Name = fmt.Sprintf("mediaserver-%s", time.Now().Format("20060102T150405"))
+	}
+	if !bagNameRegexp.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid name '%s' - only letters, digits, '.', '_' and '-' are allowed, without leading '.'", req.Name)})
+		return
+	}
+	var archive archiveWriter
+	switch strings.ToLower(req.Format) {
+	case "", "zip":
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, req.Name))
+		archive = &zipArchive{w: zip.NewWriter(c.Writer)}
+	case "tar":
+		c.Header("Content-Type", "application/x-tar")
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar"`, req.Name))
+		archive = &tarArchive{w: tar.NewWriter(c.Writer)}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown format '%s'", req.Format)})
+		return
+	}
+	b := &bag{archive: archive, name: req.Name}
+	for _, it := range req.Items {
+		if b.err != nil {
+			break
+		}
+		item, err := ctrl.getItem(it.Collection, it.Signature)
+		if err != nil {
+			b.fail("%s/%s: cannot get item: %v", it.Collection, it.Signature, err)
+			continue
+		}
+		folder, err := bagEntryPath("data", it.Collection, it.Signature)
+		if err != nil {
+			b.fail("%s/%s: %v", it.Collection, it.Signature, err)
+			continue
+		}
+		ctrl.exportCache(b, item, "item", "", folder)
+		if metadata, err := ctrl.getItemMetadata(it.Collection, it.Signature); err == nil {
+			if err := b.writeBytes(path.Join(folder, "metadata.json"), []byte(metadata), false); err != nil {
+				b.fail("%s/%s: cannot write metadata: %v", it.Collection, it.Signature, err)
+			}
+		} else {
+			b.fail("%s/%s: cannot get metadata: %v", it.Collection, it.Signature, err)
+		}
+		for _, derivative := range req.Derivatives {
+			if b.err != nil {
+				break
+			}
+			action, paramStr, _ := strings.Cut(strings.Trim(derivative, "/"), "/")
+			derivativeFolder, err := bagEntryPath(folder, "derivatives", action, strings.ReplaceAll(paramStr, "/", "_"))
+			if err != nil {
+				b.fail("%s/%s/%s: %v", it.Collection, it.Signature, derivative, err)
+				continue
+			}
+			ctrl.exportCache(b, item, action, paramStr, derivativeFolder)
+		}
+	}
+	if err := b.finish(); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot finish bag %s", req.Name)
+		return
+	}
+	if len(b.failures) > 0 {
+		ctrl.logger.Warn().Msgf("bag %s exported with %d errors", req.Name, len(b.failures))
+	}
+}
@@ -0,0 +1,61 @@
+package rest
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBagEntryPath(t *testing.T) {
+	for _, tc := range []struct {
+		names    []string
+		expected string
+		invalid  bool
+	}{
+		{names: []string{"test", "image"}, expected: "data/test/image"},
+		{names: []string{"test", "image", "derivatives", "resize", "size32x24_formatpng"}, expected: "data/test/image/derivatives/resize/size32x24_formatpng"},
+		{names: []string{"test", "image", "derivatives", "item", ""}, expected: "data/test/image/derivatives/item"},
+		{names: []string{"test", "image.v2"}, expected: "data/test/image.v2"},
+		{names: []string{"test", ".."}, invalid: true},
+		{names: []string{"..", "image"}, invalid: true},
+		{names: []string{"test", "../../etc"}, invalid: true},
+		{names: []string{"test", "/etc/passwd"}, invalid: true},
+		{names: []string{"test", "a/b"}, invalid: true},
+		{names: []string{"test", ".hidden"}, invalid: true},
+		{names: []string{"test", `a\b`}, invalid: true},
+	} {
+		got, err := bagEntryPath("data", tc.names...)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("bagEntryPath(%q) = %q, expected an error", tc.names, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.expected {
+			t.Errorf("bagEntryPath(%q) = %q, %v, expected %q", tc.names, got, err, tc.expected)
+		}
+	}
+}
+
+func TestTarArchiveUnknownSize(t *testing.T) {
+	var buf bytes.Buffer
+	ta := &tarArchive{w: tar.NewWriter(&buf)}
+	n, err := ta.WriteFile("bag/data/file.txt", -1, strings.NewReader("content"))
+	if err != nil || n != 7 {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	if err := ta.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil || hdr.Size != 7 || string(data) != "content" {
+		t.Errorf("entry of size %d with %q: %v", hdr.Size, data, err)
+	}
+}
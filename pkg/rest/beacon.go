@@ -0,0 +1,197 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type BeaconConfig struct {
+	Enabled bool `toml:"enabled"`
+	// RateLimit is the number of beacons per second and client
+	RateLimit float64 `toml:"ratelimit"`
+	Burst     int     `toml:"burst"`
+	// BounceThreshold is the viewing time below which a view counts as bounce
+	BounceThreshold config.Duration `toml:"bouncethreshold"`
+}
+
+// maxBeaconSize limits the body of a beacon
+const maxBeaconSize = 4096
+
+var beaconEvents = []string{"view", "play", "pause", "seek", "zoom", "ended", "leave"}
+
+// beaconEvent is the only data accepted from viewers. client addresses and user agents are not recorded
+type beaconEvent struct {
+	Type       string  `json:"type"`
+	Collection string  `json:"collection"`
+	Signature  string  `json:"signature"`
+	Position   float64 `json:"position,omitempty"`
+	// Watched is the viewing time in seconds, sent with "leave" and "ended"
+	Watched float64 `json:"watched,omitempty"`
+}
+
+// ItemStats are the aggregated viewer events of an item
+type ItemStats struct {
+	Collection     string           `json:"collection"`
+	Signature      string           `json:"signature"`
+	Events         map[string]int64 `json:"events"`
+	Views          int64            `json:"views"`
+	Bounces        int64            `json:"bounces"`
+	WatchedSeconds float64          `json:"watchedseconds"`
+}
+
+type beacons struct {
+	sync.Mutex
+	stats           map[itemIdentifier]*ItemStats
+	clients         gcache.Cache
+	rate            float64
+	burst           int
+	bounceThreshold time.Duration
+}
+
+// WithBeacon enables the /beacon endpoint for viewer telemetry. statistics are available at GET /admin/stats
+func WithBeacon(conf *BeaconConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		b := &beacons{
+			stats:           map[itemIdentifier]*ItemStats{},
+			clients:         gcache.New(10000).LRU().Expiration(10 * time.Minute).Build(),
+			rate:            conf.RateLimit,
+			burst:           conf.Burst,
+			bounceThreshold: time.Duration(conf.BounceThreshold),
+		}
+		if b.rate <= 0 {
+			b.rate = 1
+		}
+		if b.bounceThreshold <= 0 {
+			b.bounceThreshold = 10 * time.Second
+		}
+		ctrl.beacons = b
+		return nil
+	}
+}
+
+// allow rate limits the beacons of a client. the address is only kept hashed
+func (b *beacons) allow(clientIP string) (bool, time.Duration) {
+	key := sha256.Sum256([]byte(clientIP))
+	limiterAny, err := b.clients.Get(key)
+	if err != nil {
+		limiterAny = newTokenBucket(b.rate, b.burst)
+		b.clients.Set(key, limiterAny)
+	}
+	return limiterAny.(*tokenBucket).take()
+}
+
+func (b *beacons) record(event *beaconEvent) {
+	b.Lock()
+	defer b.Unlock()
+	id := itemIdentifier{collection: event.Collection, signature: event.Signature}
+	stats, ok := b.stats[id]
+	if !ok {
+		stats = &ItemStats{Collection: event.Collection, Signature: event.Signature, Events: map[string]int64{}}
+		b.stats[id] = stats
+	}
+	stats.Events[event.Type]++
+	if event.Type == "leave" || event.Type == "ended" {
+		watched := math.Max(0, event.Watched)
+		stats.WatchedSeconds += watched
+		if time.Duration(watched*float64(time.Second)) < b.bounceThreshold {
+			stats.Bounces++
+		} else {
+			stats.Views++
+		}
+	}
+}
+
+// sameOrigin accepts only beacons from pages of this server
+func (ctrl *mainController) sameOrigin(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		origin = c.GetHeader("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	ext, err := url.Parse(ctrl.extAddr)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == ext.Scheme && u.Host == ext.Host
+}
+
+func (ctrl *mainController) beacon(c *gin.Context) {
+	if ctrl.beacons == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !ctrl.sameOrigin(c) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	if ok, retry := ctrl.beacons.allow(c.ClientIP()); !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		c.Status(http.StatusTooManyRequests)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBeaconSize))
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	event := &beaconEvent{}
+	if err := json.Unmarshal(data, event); err != nil || !slices.Contains(beaconEvents, event.Type) || event.Collection == "" || event.Signature == "" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	// only known items are counted
+	if _, err := ctrl.getItem(event.Collection, event.Signature); err != nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	ctrl.beacons.record(event)
+	c.Status(http.StatusNoContent)
+}
+
+func (ctrl *mainController) adminStats(c *gin.Context) {
+	if ctrl.beacons == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "beacon not enabled"})
+		return
+	}
+	collection := c.Query("collection")
+	ctrl.beacons.Lock()
+	var result = []ItemStats{}
+	for _, stats := range ctrl.beacons.stats {
+		if collection != "" && stats.Collection != collection {
+			continue
+		}
+		s := *stats
+		s.Events = map[string]int64{}
+		for k, v := range stats.Events {
+			s.Events[k] = v
+		}
+		result = append(result, s)
+	}
+	ctrl.beacons.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return fmt.Sprintf("%s/%s", result[i].Collection, result[i].Signature) < fmt.Sprintf("%s/%s", result[j].Collection, result[j].Signature)
+	})
+	c.JSON(http.StatusOK, result)
+}
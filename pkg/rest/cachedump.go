@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type cacheEntryStats struct {
+	loaded time.Time
+	hits   int64
+}
+
+// cacheStats tracks load time and hits of the entries of a gcache
+type cacheStats struct {
+	mutex   sync.Mutex
+	entries map[any]*cacheEntryStats
+}
+
+func newCacheStats() *cacheStats {
+	return &cacheStats{entries: map[any]*cacheEntryStats{}}
+}
+
+// added is the gcache AddedFunc
+func (cs *cacheStats) added(key, _ any) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.entries[key] = &cacheEntryStats{loaded: time.Now()}
+}
+
+// evicted is the gcache EvictedFunc
+func (cs *cacheStats) evicted(key, _ any) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.entries, key)
+}
+
+// access counts a hit if the entry was loaded before the lookup started
+func (cs *cacheStats) access(key any, start time.Time) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if entry, ok := cs.entries[key]; ok && entry.loaded.Before(start) {
+		entry.hits++
+	}
+}
+
+type CacheDumpEntry struct {
+	Key    string    `json:"key"`
+	Loaded time.Time `json:"loaded"`
+	Age    string    `json:"age"`
+	Hits   int64     `json:"hits"`
+}
+
+type CacheDump struct {
+	Size     int               `json:"size"`
+	HitCount uint64            `json:"hitcount"`
+	Misses   uint64            `json:"misscount"`
+	Entries  []*CacheDumpEntry `json:"entries"`
+}
+
+func dumpCache(cache gcache.Cache, stats *cacheStats) *CacheDump {
+	now := time.Now()
+	dump := &CacheDump{
+		HitCount: cache.HitCount(),
+		Misses:   cache.MissCount(),
+		Entries:  []*CacheDumpEntry{},
+	}
+	// only unexpired keys
+	keys := cache.Keys(true)
+	dump.Size = len(keys)
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	for _, key := range keys {
+		entry := &CacheDumpEntry{Key: fmt.Sprint(key)}
+		if it, ok := key.(itemIdentifier); ok {
+			entry.Key = it.collection + "/" + it.signature
+		}
+		if es, ok := stats.entries[key]; ok {
+			entry.Loaded = es.loaded
+			entry.Age = now.Sub(es.loaded).Round(time.Second).String()
+			entry.Hits = es.hits
+		}
+		dump.Entries = append(dump.Entries, entry)
+	}
+	sort.Slice(dump.Entries, func(i, j int) bool { return dump.Entries[i].Key < dump.Entries[j].Key })
+	return dump
+}
+
+func (ctrl *mainController) adminCacheDump(c *gin.Context) {
+	ctrl.actionParamsMutex.RLock()
+	actionParams := make(map[string][]string, len(ctrl.actionParams))
+	for sig, params := range ctrl.actionParams {
+		actionParams[sig.String()] = params
+	}
+	ctrl.actionParamsMutex.RUnlock()
+	tenants := map[string]gin.H{}
+	for name, t := range ctrl.tenants {
+		tenants[name] = gin.H{
+			"items":       dumpCache(t.partition.itemCache, t.partition.itemStats),
+			"metadata":    dumpCache(t.partition.metadataCache, t.partition.metadataStats),
+			"collections": dumpCache(t.partition.collectionCache, t.partition.collectionStats),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"items":        dumpCache(ctrl.itemCache, ctrl.itemStats),
+		"metadata":     dumpCache(ctrl.metadataCache, ctrl.metadataStats),
+		"collections":  dumpCache(ctrl.collectionCache, ctrl.collectionStats),
+		"tenants":      tenants,
+		"actionparams": actionParams,
+	})
+}
@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"strconv"
+	"strings"
+)
+
+// CacheControl are the Cache-Control headers of derivatives, an empty value keeps the header of the header policy
+type CacheControl struct {
+	// Public is used for responses without token, signature or per request access checks, e.g. "public, max-age=86400"
+	Public string `toml:"public"`
+	// Restricted is used for all other responses, e.g. "private, max-age=3600"
+	Restricted string `toml:"restricted"`
+}
+
+type CachePolicyConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Default applies to collections without entry in Collections
+	Default CacheControl `toml:"default"`
+	// Collections overrides the default per collection
+	Collections map[string]CacheControl `toml:"collections"`
+}
+
+var defaultCacheControl = CacheControl{
+	Public:     "public, max-age=86400",
+	Restricted: "private, max-age=3600",
+}
+
+func validCacheControl(value string) bool {
+	return !strings.ContainsAny(value, "\r\n")
+}
+
+// WithCachePolicy sets the Cache-Control header of derivatives per collection. restricted responses must not be
+// stored by shared caches, so their policy is separate
+func WithCachePolicy(conf *CachePolicyConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if conf.Default.Public == "" && conf.Default.Restricted == "" {
+			conf.Default = defaultCacheControl
+		}
+		if !validCacheControl(conf.Default.Public) || !validCacheControl(conf.Default.Restricted) {
+			return errors.Errorf("invalid default cache control %v", conf.Default)
+		}
+		for collection, cc := range conf.Collections {
+			if !validCacheControl(cc.Public) || !validCacheControl(cc.Restricted) {
+				return errors.Errorf("invalid cache control %v of collection %s", cc, collection)
+			}
+		}
+		ctrl.cachePolicy = conf
+		return nil
+	}
+}
+
+// cacheControlHeader sets the Cache-Control header of a derivative. access has to be checked before, public
+// responses are flagged by publicResponseKey
+func (ctrl *mainController) cacheControlHeader(c *gin.Context, collection string) {
+	if ctrl.cachePolicy == nil {
+		return
+	}
+	cc, ok := ctrl.cachePolicy.Collections[collection]
+	if !ok {
+		cc = ctrl.cachePolicy.Default
+	}
+	value := cc.Restricted
+	if c.GetString(publicResponseKey) != "" {
+		value = cc.Public
+	}
+	if value != "" {
+		c.Header("Cache-Control", value)
+	}
+}
+
+// derivativeETag identifies the content of a cache entry. the checksum of the master is used if known, otherwise
+// storage, path and size of the file with the modification time of the item, which invalidates the derivatives
+func derivativeETag(item *mediaserverproto.Item, metadata *mediaserverproto.CacheMetadata, sha512 string) string {
+	if len(sha512) >= 32 {
+		return `"` + sha512[:32] + `"`
+	}
+	bp := getKeyBuffer()
+	b := append(*bp, metadata.GetStorage().GetName()...)
+	b = append(b, '|')
+	b = append(b, metadata.GetPath()...)
+	b = append(b, '|')
+	b = strconv.AppendInt(b, metadata.GetSize(), 10)
+	b = append(b, '|')
+	b = strconv.AppendInt(b, itemLastModified(item).Unix(), 10)
+	etag := contentETag(b)
+	putKeyBuffer(bp, b)
+	return etag
+}
+
+// encodedETag is the etag of a precompressed variant, which differs from the etag of the identity encoding
+func encodedETag(etag, encoding string) string {
+	if etag == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
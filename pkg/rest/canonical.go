@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// normalizePath removes empty path segments, so that leading, trailing and double slashes do not matter
+func normalizePath(p string) string {
+	if cleanPath(p) {
+		return p
+	}
+	bp := getKeyBuffer()
+	b := appendPath(*bp, p)
+	s := string(b)
+	putKeyBuffer(bp, b)
+	return s
+}
+
+// CanonicalAction returns the "action/params" string used in the publicActions of an item.
+// keys are the params supported by the action, unknown params are dropped and the rest is sorted
+func CanonicalAction(action, paramStr string, keys []string) string {
+	ap := actionCache.ActionParams{}
+	ap.SetString(paramStr, keys)
+	return action + "/" + ap.String()
+}
+
+// AccessSubject returns the token subject granting access to an action of an item. the params are lower case
+// and sorted like in CanonicalAction, so that their order and empty segments in the url do not matter
+func AccessSubject(collection, signature, action, paramStr string) string {
+	bp := getKeyBuffer()
+	b := *bp
+	for _, p := range [...]string{collection, signature, strings.ToLower(action)} {
+		b = appendPath(b, p)
+	}
+	params := strings.Split(strings.ToLower(paramStr), "/")
+	slices.Sort(params)
+	for _, p := range params {
+		b = appendPath(b, p)
+	}
+	s := string(b)
+	putKeyBuffer(bp, b)
+	return s
+}
+
+// canonicalAction returns the canonical "action/params" string of an action for a media type
+func (ctrl *mainController) canonicalAction(mediaType, action, paramStr string) (string, error) {
+	actionParams, err := ctrl.getParams(mediaType, action)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get params for %s::%s", mediaType, action)
+	}
+	return CanonicalAction(action, paramStr, actionParams), nil
+}
+
+// accessSubject returns the token subject of an action built from its canonical form. actions without params
+// known to the action controller, like item or metadata, keep all their params
+func (ctrl *mainController) accessSubject(mediaType, collection, signature, action, paramStr string) string {
+	if canonical, err := ctrl.canonicalAction(mediaType, action, paramStr); err == nil {
+		action, paramStr, _ = strings.Cut(canonical, "/")
+	}
+	return AccessSubject(collection, signature, action, paramStr)
+}
+
+// canonicalSubject returns the canonical form of a token subject for an item of the media type
+func (ctrl *mainController) canonicalSubject(mediaType, subject string) string {
+	parts := strings.SplitN(normalizePath(subject), "/", 4)
+	if len(parts) < 3 {
+		return normalizePath(subject)
+	}
+	parts = append(parts, "")
+	return ctrl.accessSubject(mediaType, parts[0], parts[1], parts[2], parts[3])
+}
+
+// CanonicalRequest asks for the canonical form of an action string of an item
+type CanonicalRequest struct {
+	Collection string `json:"collection" binding:"required"`
+	Signature  string `json:"signature" binding:"required"`
+	// Action is "action/params" as used in urls
+	Action string `json:"action" binding:"required"`
+	// Subject is an optional jwt subject to check against the action
+	Subject string `json:"subject,omitempty"`
+}
+
+// CanonicalResponse tells whether an action string matches the public actions or a token subject
+type CanonicalResponse struct {
+	Canonical    string `json:"canonical"`
+	Subject      string `json:"subject"`
+	Public       bool   `json:"public"`
+	PublicAction bool   `json:"publicaction"`
+	SubjectMatch *bool  `json:"subjectmatch,omitempty"`
+}
+
+func (ctrl *mainController) adminCanonical(c *gin.Context) {
+	var req CanonicalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	item, err := ctrl.getItem(req.Collection, req.Signature)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s/%s not found", req.Collection, req.Signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", req.Collection, req.Signature, err)})
+		return
+	}
+	action, paramStr, _ := strings.Cut(normalizePath(req.Action), "/")
+	canonical, err := ctrl.canonicalAction(item.GetMetadata().GetType(), action, paramStr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("action '%s' not supported for type '%s'", action, item.GetMetadata().GetType())})
+		return
+	}
+	result := CanonicalResponse{
+		Canonical:    canonical,
+		Subject:      ctrl.accessSubject(item.GetMetadata().GetType(), req.Collection, req.Signature, action, paramStr),
+		Public:       item.GetPublic(),
+		PublicAction: slices.Contains(item.GetPublicActions(), canonical),
+	}
+	if req.Subject != "" {
+		match := ctrl.canonicalSubject(item.GetMetadata().GetType(), req.Subject) == result.Subject
+		result.SubjectMatch = &match
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,48 @@
+package rest
+
+import (
+	"testing"
+)
+
+func TestAccessSubject(t *testing.T) {
+	for _, tc := range []struct {
+		action, paramStr string
+		expected         string
+	}{
+		{action: "item", expected: "test/image/item"},
+		{action: "item", paramStr: "/", expected: "test/image/item"},
+		{action: "resize", paramStr: "size32x24/formatpng", expected: "test/image/resize/formatpng/size32x24"},
+		{action: "resize", paramStr: "formatpng/size32x24", expected: "test/image/resize/formatpng/size32x24"},
+		{action: "Resize", paramStr: "/FormatPNG//size32x24/", expected: "test/image/resize/formatpng/size32x24"},
+	} {
+		if got := AccessSubject("test", "image", tc.action, tc.paramStr); got != tc.expected {
+			t.Errorf("AccessSubject(%q, %q) = %q, expected %q", tc.action, tc.paramStr, got, tc.expected)
+		}
+	}
+}
+
+func TestCanonicalSubject(t *testing.T) {
+	ctrl := &mainController{actionParams: map[actionSignature][]string{
+		{mediaType: "image", action: "item"}:   nil,
+		{mediaType: "image", action: "resize"}: {"size", "format"},
+	}}
+	for _, tc := range []struct {
+		subject  string
+		expected string
+	}{
+		{subject: "test/image/item", expected: "test/image/item"},
+		{subject: "/test/image/item/", expected: "test/image/item"},
+		{subject: "test/image/resize/size32x24/formatpng", expected: "test/image/resize/formatpng/size32x24"},
+		{subject: "test/image/resize//formatPNG/size32x24", expected: "test/image/resize/formatpng/size32x24"},
+		// params unknown to the action are dropped on both sides
+		{subject: "test/image/resize/size32x24/formatpng/dummy1", expected: "test/image/resize/formatpng/size32x24"},
+		{subject: "test/image", expected: "test/image"},
+	} {
+		if got := ctrl.canonicalSubject("image", tc.subject); got != tc.expected {
+			t.Errorf("canonicalSubject(%q) = %q, expected %q", tc.subject, got, tc.expected)
+		}
+	}
+	if got, expected := ctrl.accessSubject("image", "test", "image", "resize", "size32x24/formatpng"), "test/image/resize/formatpng/size32x24"; got != expected {
+		t.Errorf("accessSubject = %q, expected %q", got, expected)
+	}
+}
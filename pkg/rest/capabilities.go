@@ -0,0 +1,107 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// defaultCapabilityActions are the actions probed for each media type
+var defaultCapabilityActions = map[string][]string{
+	"image": {"resize", "convert"},
+	"video": {"hls", "resize"},
+	"audio": {"hls"},
+}
+
+// WithCapabilities sets the actions probed at /:collection/:signature/capabilities per media type
+func WithCapabilities(actions map[string][]string) Option {
+	return func(ctrl *mainController) error {
+		if len(actions) > 0 {
+			ctrl.capabilityActions = actions
+		}
+		return nil
+	}
+}
+
+type capabilityAction struct {
+	Params []string `json:"params"`
+	// Public is true if the action may be used without token
+	Public bool `json:"public"`
+}
+
+type capabilities struct {
+	Collection string                       `json:"collection"`
+	Signature  string                       `json:"signature"`
+	Type       string                       `json:"type"`
+	MimeType   string                       `json:"mimetype"`
+	Public     bool                         `json:"public"`
+	Actions    map[string]*capabilityAction `json:"actions"`
+	// Delivery lists the available delivery modes, e.g. "progressive", "hls", "iiif"
+	Delivery []string `json:"delivery"`
+	// Formats are the image formats accepted by the client
+	Formats []string          `json:"formats,omitempty"`
+	IIIF    map[string]string `json:"iiif,omitempty"`
+}
+
+// acceptedImageFormats returns the image formats of the accept header in order of preference
+func acceptedImageFormats(accept string) []string {
+	var formats []string
+	for _, format := range []string{"avif", "webp"} {
+		if strings.Contains(accept, "image/"+format) {
+			formats = append(formats, format)
+		}
+	}
+	return append(formats, "jpeg", "png")
+}
+
+// capabilities answers /:collection/:signature/capabilities with the delivery modes of an item for the requesting client
+func (ctrl *mainController) capabilities(c *gin.Context, item *mediaserverproto.Item, collection, signature string) {
+	mediaType := item.GetMetadata().GetType()
+	result := &capabilities{
+		Collection: collection,
+		Signature:  signature,
+		Type:       mediaType,
+		MimeType:   item.GetMetadata().GetMimetype(),
+		Public:     item.GetPublic(),
+		Actions:    map[string]*capabilityAction{},
+		Delivery:   []string{"progressive"},
+	}
+	isPublic := func(action string) bool {
+		return item.GetPublic() || slices.ContainsFunc(item.GetPublicActions(), func(pa string) bool {
+			return pa == action || strings.HasPrefix(pa, action+"/")
+		})
+	}
+	for _, action := range ctrl.capabilityActions[mediaType] {
+		params, err := ctrl.getParams(mediaType, action)
+		if err != nil {
+			continue
+		}
+		result.Actions[action] = &capabilityAction{Params: params, Public: isPublic(action)}
+		if action == "hls" {
+			result.Delivery = append(result.Delivery, "hls")
+		}
+	}
+	for _, action := range []string{"item", "metadata", "info"} {
+		result.Actions[action] = &capabilityAction{Params: []string{}, Public: isPublic(action)}
+	}
+	if mediaType == "image" {
+		result.Formats = acceptedImageFormats(c.GetHeader("Accept"))
+		if ctrl.iiifBaseAction != "" {
+			result.Delivery = append(result.Delivery, "iiif")
+			result.IIIF = map[string]string{
+				"2": ctrl.externalURL("iiif", "2", collection, signature, "info.json"),
+				"3": ctrl.externalURL("iiif", "3", collection, signature, "info.json"),
+			}
+		}
+	}
+	if _, ok := ctrl.embedActions[mediaType]; ok {
+		result.Delivery = append(result.Delivery, "embed")
+	}
+	if mediaType == "video" && len(ctrl.audioRenditions) > 0 {
+		result.Delivery = append(result.Delivery, "audio")
+	}
+	c.Header("Vary", "Accept")
+	c.JSON(http.StatusOK, result)
+}
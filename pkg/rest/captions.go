@@ -0,0 +1,479 @@
+package rest
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"golang.org/x/text/language"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type CaptionsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Dir is a vfs folder for the caption files, which may also be written by the ingest as
+	// <dir>/<collection>/<signature>/captions.json with the tracks and one file per track. if empty, captions are kept in memory
+	Dir string `toml:"dir"`
+	// MaxSize is the maximum size of a caption file in bytes, default 4MiB
+	MaxSize int64 `toml:"maxsize"`
+}
+
+// CaptionTrack is a WebVTT or SRT caption file of a video or audio item
+type CaptionTrack struct {
+	Lang string `json:"lang"`
+	// Kind is "captions" or "subtitles"
+	Kind  string `json:"kind"`
+	Label string `json:"label,omitempty"`
+	// Format of the stored file, "vtt" or "srt". srt is converted to WebVTT on delivery
+	Format string `json:"format"`
+}
+
+func (t *CaptionTrack) file() string {
+	return fmt.Sprintf("%s-%s.%s", t.Kind, t.Lang, t.Format)
+}
+
+var captionKinds = []string{"captions", "subtitles"}
+
+type captions struct {
+	sync.RWMutex
+	dir     string
+	maxSize int64
+	// tracks and data hold the captions if there is no dir
+	tracks map[itemIdentifier][]*CaptionTrack
+	data   map[string][]byte
+}
+
+// WithCaptions manages caption tracks of video and audio items at /admin/items/:collection/:signature/captions
+// and delivers them as WebVTT at /:collection/:signature/captions
+func WithCaptions(conf *CaptionsConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		maxSize := conf.MaxSize
+		if maxSize <= 0 {
+			maxSize = 4 * 1024 * 1024
+		}
+		ctrl.captions = &captions{
+			dir:     conf.Dir,
+			maxSize: maxSize,
+			tracks:  map[itemIdentifier][]*CaptionTrack{},
+			data:    map[string][]byte{},
+		}
+		return nil
+	}
+}
+
+func (cs *captions) itemDir(collection, signature string) string {
+	return path.Join(cs.dir, collection, strings.ReplaceAll(signature, "/", "_"))
+}
+
+// captionTracks returns the caption tracks of an item
+func (ctrl *mainController) captionTracks(collection, signature string) ([]*CaptionTrack, error) {
+	cs := ctrl.captions
+	if cs.dir == "" {
+		cs.RLock()
+		defer cs.RUnlock()
+		return slices.Clone(cs.tracks[itemIdentifier{collection: collection, signature: signature}]), nil
+	}
+	name := path.Join(cs.itemDir(collection, signature), "captions.json")
+	data, err := fs.ReadFile(ctrl.vfs, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "cannot read %s", name)
+	}
+	var tracks []*CaptionTrack
+	if err := json.Unmarshal(data, &tracks); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal %s", name)
+	}
+	return tracks, nil
+}
+
+func (ctrl *mainController) writeCaptionFile(name string, data []byte) error {
+	fp, err := writefs.Create(ctrl.vfs, name)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", name)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", name)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", name)
+}
+
+// putCaption adds or replaces the track with the kind and language of track
+func (ctrl *mainController) putCaption(collection, signature string, track *CaptionTrack, data []byte) error {
+	cs := ctrl.captions
+	cs.Lock()
+	defer cs.Unlock()
+	dir := cs.itemDir(collection, signature)
+	var tracks []*CaptionTrack
+	if cs.dir == "" {
+		tracks = cs.tracks[itemIdentifier{collection: collection, signature: signature}]
+	} else {
+		var err error
+		if tracks, err = ctrl.captionTracks(collection, signature); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	var old *CaptionTrack
+	tracks = slices.DeleteFunc(slices.Clone(tracks), func(t *CaptionTrack) bool {
+		if t.Kind == track.Kind && t.Lang == track.Lang {
+			old = t
+			return true
+		}
+		return false
+	})
+	tracks = append(tracks, track)
+	if cs.dir == "" {
+		if old != nil {
+			delete(cs.data, path.Join(dir, old.file()))
+		}
+		cs.data[path.Join(dir, track.file())] = data
+		cs.tracks[itemIdentifier{collection: collection, signature: signature}] = tracks
+		return nil
+	}
+	if err := ctrl.writeCaptionFile(path.Join(dir, track.file()), data); err != nil {
+		return errors.WithStack(err)
+	}
+	index, err := json.Marshal(tracks)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal caption tracks")
+	}
+	if err := ctrl.writeCaptionFile(path.Join(dir, "captions.json"), index); err != nil {
+		return errors.WithStack(err)
+	}
+	if old != nil && old.file() != track.file() {
+		if err := writefs.Remove(ctrl.vfs, path.Join(dir, old.file())); err != nil {
+			ctrl.logger.Warn().Err(err).Msgf("cannot remove %s", path.Join(dir, old.file()))
+		}
+	}
+	return nil
+}
+
+// deleteCaption removes a track. if kind is empty, all tracks of the language are removed
+func (ctrl *mainController) deleteCaption(collection, signature, kind, lang string) error {
+	cs := ctrl.captions
+	cs.Lock()
+	defer cs.Unlock()
+	dir := cs.itemDir(collection, signature)
+	var tracks []*CaptionTrack
+	if cs.dir == "" {
+		tracks = cs.tracks[itemIdentifier{collection: collection, signature: signature}]
+	} else {
+		var err error
+		if tracks, err = ctrl.captionTracks(collection, signature); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	var removed []*CaptionTrack
+	tracks = slices.DeleteFunc(slices.Clone(tracks), func(t *CaptionTrack) bool {
+		if t.Lang == lang && (kind == "" || t.Kind == kind) {
+			removed = append(removed, t)
+			return true
+		}
+		return false
+	})
+	if len(removed) == 0 {
+		return fs.ErrNotExist
+	}
+	if cs.dir == "" {
+		for _, t := range removed {
+			delete(cs.data, path.Join(dir, t.file()))
+		}
+		cs.tracks[itemIdentifier{collection: collection, signature: signature}] = tracks
+		return nil
+	}
+	index, err := json.Marshal(tracks)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal caption tracks")
+	}
+	if err := ctrl.writeCaptionFile(path.Join(dir, "captions.json"), index); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, t := range removed {
+		if err := writefs.Remove(ctrl.vfs, path.Join(dir, t.file())); err != nil {
+			ctrl.logger.Warn().Err(err).Msgf("cannot remove %s", path.Join(dir, t.file()))
+		}
+	}
+	return nil
+}
+
+// captionVTT returns the track as WebVTT
+func (ctrl *mainController) captionVTT(collection, signature string, track *CaptionTrack) ([]byte, error) {
+	cs := ctrl.captions
+	name := path.Join(cs.itemDir(collection, signature), track.file())
+	var data []byte
+	if cs.dir == "" {
+		cs.RLock()
+		data = cs.data[name]
+		cs.RUnlock()
+		if data == nil {
+			return nil, fs.ErrNotExist
+		}
+	} else {
+		var err error
+		if data, err = fs.ReadFile(ctrl.vfs, name); err != nil {
+			return nil, errors.Wrapf(err, "cannot read %s", name)
+		}
+	}
+	if track.Format == "srt" {
+		return srtToVTT(data), nil
+	}
+	return data, nil
+}
+
+var srtTimingRegexp = regexp.MustCompile(`(?m)^(\d{2}:\d{2}:\d{2}),(\d{3})\s*-->\s*(\d{2}:\d{2}:\d{2}),(\d{3})`)
+
+// srtToVTT converts SubRip to WebVTT. cue numbers are kept as cue identifiers
+func srtToVTT(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = srtTimingRegexp.ReplaceAll(data, []byte("$1.$2 --> $3.$4"))
+	return append([]byte("WEBVTT\n\n"), bytes.TrimLeft(data, "\n")...)
+}
+
+// captionFormat detects the format of an uploaded caption file
+func captionFormat(contentType string, data []byte) (string, error) {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	switch strings.TrimSpace(contentType) {
+	case "text/vtt":
+		return "vtt", nil
+	case "application/x-subrip", "text/srt":
+		return "srt", nil
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	switch {
+	case bytes.HasPrefix(data, []byte("WEBVTT")):
+		return "vtt", nil
+	case srtTimingRegexp.Match(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))):
+		return "srt", nil
+	}
+	return "", errors.New("neither WebVTT nor SRT")
+}
+
+// findCaption returns the track of a language. if kind is empty, the first track of the language is used
+func findCaption(tracks []*CaptionTrack, lang, kind string) *CaptionTrack {
+	for _, t := range tracks {
+		if t.Lang == lang && (kind == "" || t.Kind == kind) {
+			return t
+		}
+	}
+	return nil
+}
+
+// captionAccess allows the captions to everybody who may access the media in the viewer or has a token for captions/<lang>
+func (ctrl *mainController) captionAccess(c *gin.Context, item *mediaserverproto.Item, lang, token string) error {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	if source, ok := ctrl.embedActions[item.GetMetadata().GetType()]; ok {
+		action, paramStr, _ := strings.Cut(normalizePath(source), "/")
+		if err := ctrl.checkAccess(c, collection, signature, action, paramStr, token); err == nil {
+			return nil
+		}
+	}
+	return errors.WithStack(ctrl.checkAccess(c, collection, signature, "captions", lang, token))
+}
+
+func (ctrl *mainController) captionURL(collection, signature string, track *CaptionTrack, token string) string {
+	u := ctrl.externalURL(collection, signature, "captions", track.Lang, track.Kind)
+	if token != "" {
+		u += "?token=" + token
+	}
+	return u
+}
+
+// serveCaptions answers /:collection/:signature/captions with the tracks and /captions/:lang[/:kind] with the WebVTT file
+func (ctrl *mainController) serveCaptions(c *gin.Context, item *mediaserverproto.Item, collection, signature, paramStr, token string) {
+	if ctrl.captions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "captions not enabled"})
+		return
+	}
+	tracks, err := ctrl.captionTracks(collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get captions of %s/%s", collection, signature)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get captions of %s/%s: %v", collection, signature, err)})
+		return
+	}
+	lang, kind, _ := strings.Cut(strings.Trim(paramStr, "/"), "/")
+	if lang == "" {
+		var result = []gin.H{}
+		for _, t := range tracks {
+			if ctrl.captionAccess(c, item, t.Lang, token) != nil {
+				continue
+			}
+			result = append(result, gin.H{"lang": t.Lang, "kind": t.Kind, "label": t.Label, "url": ctrl.captionURL(collection, signature, t, token)})
+		}
+		c.JSON(http.StatusOK, gin.H{"collection": collection, "signature": signature, "captions": result})
+		return
+	}
+	if err := ctrl.captionAccess(c, item, lang, token); err != nil {
+		ctrl.logger.Info().Err(err).Msgf("access denied for %s/%s/captions/%s", collection, signature, lang)
+		ctrl.errorResponse(c, http.StatusUnauthorized, collection, errors.Wrapf(err, "access denied for %s/%s/captions/%s", collection, signature, lang), "access_denied", collection+"/"+signature)
+		return
+	}
+	track := findCaption(tracks, lang, kind)
+	if track == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no captions %s for %s/%s", lang, collection, signature)})
+		return
+	}
+	data, err := ctrl.captionVTT(collection, signature, track)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get captions %s of %s/%s", track.file(), collection, signature)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get captions %s of %s/%s: %v", lang, collection, signature, err)})
+		return
+	}
+	if notModified(c, itemLastModified(item), contentETag(data)) {
+		return
+	}
+	c.Data(http.StatusOK, "text/vtt; charset=utf-8", data)
+}
+
+// captionAlternatives returns the caption tracks of an item as alternatives
+func (ctrl *mainController) captionAlternatives(c *gin.Context, item *mediaserverproto.Item, token string) []*alternative {
+	if ctrl.captions == nil {
+		return nil
+	}
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	tracks, err := ctrl.captionTracks(collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get captions of %s/%s", collection, signature)
+		return nil
+	}
+	var result []*alternative
+	for _, t := range tracks {
+		if ctrl.captionAccess(c, item, t.Lang, token) != nil {
+			continue
+		}
+		result = append(result, &alternative{
+			Kind:     t.Kind,
+			Lang:     t.Lang,
+			Label:    t.Label,
+			MimeType: "text/vtt",
+			Action:   normalizePath(path.Join("captions", t.Lang, t.Kind)),
+			URL:      ctrl.captionURL(collection, signature, t, token),
+		})
+	}
+	return result
+}
+
+func (ctrl *mainController) adminCaptions(c *gin.Context) {
+	if ctrl.captions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "captions not enabled"})
+		return
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	tracks, err := ctrl.captionTracks(collection, signature)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get captions of %s/%s: %v", collection, signature, err)})
+		return
+	}
+	if tracks == nil {
+		tracks = []*CaptionTrack{}
+	}
+	c.JSON(http.StatusOK, tracks)
+}
+
+// adminPutCaption stores the WebVTT or SRT body as track of the language, ?kind=subtitles&label=Deutsch
+func (ctrl *mainController) adminPutCaption(c *gin.Context) {
+	if ctrl.captions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "captions not enabled"})
+		return
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	tag, err := language.Parse(c.Param("lang"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid language '%s': %v", c.Param("lang"), err)})
+		return
+	}
+	kind := c.DefaultQuery("kind", "captions")
+	if !slices.Contains(captionKinds, kind) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid kind '%s' - should be one of %v", kind, captionKinds)})
+		return
+	}
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err)})
+		return
+	}
+	if mediaType := item.GetMetadata().GetType(); mediaType != "video" && mediaType != "audio" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("no captions for media type '%s'", mediaType)})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, ctrl.captions.maxSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot read body: %v", err)})
+		return
+	}
+	if int64(len(data)) > ctrl.captions.maxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("caption file larger than %d bytes", ctrl.captions.maxSize)})
+		return
+	}
+	format, err := captionFormat(c.ContentType(), data)
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": fmt.Sprintf("invalid caption file: %v", err)})
+		return
+	}
+	track := &CaptionTrack{Lang: tag.String(), Kind: kind, Label: c.Query("label"), Format: format}
+	if err := ctrl.putCaption(collection, signature, track, data); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot store captions %s of %s/%s", track.file(), collection, signature)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot store captions of %s/%s: %v", collection, signature, err)})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "captions").
+		Str("collection", collection).
+		Str("signature", signature).
+		Str("lang", track.Lang).
+		Str("kind", track.Kind).
+		Str("remote", c.ClientIP()).
+		Msg("captions stored")
+	ctrl.invalidateItem(collection, signature)
+	c.JSON(http.StatusOK, gin.H{"track": track, "url": ctrl.captionURL(collection, signature, track, "")})
+}
+
+// adminDeleteCaption removes the tracks of a language, ?kind= removes only the track of this kind
+func (ctrl *mainController) adminDeleteCaption(c *gin.Context) {
+	if ctrl.captions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "captions not enabled"})
+		return
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	lang := c.Param("lang")
+	if tag, err := language.Parse(lang); err == nil {
+		lang = tag.String()
+	}
+	if err := ctrl.deleteCaption(collection, signature, c.Query("kind"), lang); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no captions %s for %s/%s", lang, collection, signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot remove captions %s of %s/%s: %v", lang, collection, signature, err)})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "captions").
+		Str("collection", collection).
+		Str("signature", signature).
+		Str("lang", lang).
+		Str("remote", c.ClientIP()).
+		Msg("captions removed")
+	ctrl.invalidateItem(collection, signature)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+type CDNPurgeConfig struct {
+	// Type is one of fastly, varnish or cloudfront
+	Type string `toml:"type"`
+	// URL is the api base for fastly or the purge url for varnish
+	URL            string           `toml:"url"`
+	Method         string           `toml:"method"`
+	ServiceID      string           `toml:"serviceid"`
+	DistributionID string           `toml:"distributionid"`
+	APIKey         config.EnvString `toml:"apikey"`
+	Secret         config.EnvString `toml:"secret"`
+	Timeout        config.Duration  `toml:"timeout"`
+}
+
+type CDNConfig struct {
+	SurrogateHeader string            `toml:"surrogateheader"`
+	Purge           []*CDNPurgeConfig `toml:"purge"`
+}
+
+// Purger removes all cached responses of an item from a cdn
+type Purger interface {
+	Purge(ctx context.Context, collection, signature string) error
+}
+
+// WithCDN emits surrogate keys on all item responses and purges the configured cdns on invalidation
+func WithCDN(conf *CDNConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		ctrl.surrogateHeader = conf.SurrogateHeader
+		if ctrl.surrogateHeader == "" {
+			ctrl.surrogateHeader = "Surrogate-Key"
+		}
+		var purgers multiPurger
+		for _, pc := range conf.Purge {
+			p, err := newPurger(pc, ctrl.subpath)
+			if err != nil {
+				return errors.Wrapf(err, "cannot create %s purger", pc.Type)
+			}
+			purgers = append(purgers, p)
+		}
+		if len(purgers) > 0 {
+			ctrl.purger = purgers
+		}
+		return nil
+	}
+}
+
+func surrogateKeys(collection, signature string) []string {
+	return []string{collection, collection + "/" + signature}
+}
+
+// setSurrogateKeys tags the response with the item keys used for cdn purging
+func (ctrl *mainController) setSurrogateKeys(c *gin.Context, collection, signature string) {
+	if ctrl.surrogateHeader == "" {
+		return
+	}
+	c.Header(ctrl.surrogateHeader, strings.Join(surrogateKeys(collection, signature), " "))
+}
+
+func newPurger(conf *CDNPurgeConfig, subpath string) (Purger, error) {
+	timeout := time.Duration(conf.Timeout)
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	switch strings.ToLower(conf.Type) {
+	case "fastly":
+		if conf.ServiceID == "" {
+			return nil, errors.New("no fastly service id configured")
+		}
+		apiURL := conf.URL
+		if apiURL == "" {
+			apiURL = "https://api.fastly.com"
+		}
+		return &fastlyPurger{client: client, url: apiURL, serviceID: conf.ServiceID, apiKey: string(conf.APIKey)}, nil
+	case "varnish":
+		if conf.URL == "" {
+			return nil, errors.New("no varnish purge url configured")
+		}
+		method := conf.Method
+		if method == "" {
+			method = "PURGE"
+		}
+		return &varnishPurger{client: client, url: conf.URL, method: method}, nil
+	case "cloudfront":
+		if conf.DistributionID == "" {
+			return nil, errors.New("no cloudfront distribution id configured")
+		}
+		return &cloudfrontPurger{
+			client:          client,
+			distributionID:  conf.DistributionID,
+			accessKeyID:     string(conf.APIKey),
+			secretAccessKey: string(conf.Secret),
+			subpath:         subpath,
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown cdn type '%s'", conf.Type)
+	}
+}
+
+type multiPurger []Purger
+
+func (mp multiPurger) Purge(ctx context.Context, collection, signature string) error {
+	var errs []error
+	for _, p := range mp {
+		if err := p.Purge(ctx, collection, signature); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Combine(errs...)
+}
+
+func doPurgeRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "cannot %s %s", req.Method, req.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s %s: status %s: %s", req.Method, req.URL, resp.Status, string(body))
+	}
+	return nil
+}
+
+type fastlyPurger struct {
+	client    *http.Client
+	url       string
+	serviceID string
+	apiKey    string
+}
+
+func (fp *fastlyPurger) Purge(ctx context.Context, collection, signature string) error {
+	u, err := url.JoinPath(fp.url, "service", fp.serviceID, "purge")
+	if err != nil {
+		return errors.Wrapf(err, "cannot join url %s", fp.url)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create request %s", u)
+	}
+	req.Header.Set("Fastly-Key", fp.apiKey)
+	req.Header.Set("Surrogate-Key", collection+"/"+signature)
+	req.Header.Set("Accept", "application/json")
+	return doPurgeRequest(fp.client, req)
+}
+
+type varnishPurger struct {
+	client *http.Client
+	url    string
+	method string
+}
+
+func (vp *varnishPurger) Purge(ctx context.Context, collection, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, vp.method, vp.url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create request %s", vp.url)
+	}
+	req.Header.Set("xkey-purge", collection+"/"+signature)
+	return doPurgeRequest(vp.client, req)
+}
+
+type cloudfrontPurger struct {
+	client          *http.Client
+	distributionID  string
+	accessKeyID     string
+	secretAccessKey string
+	subpath         string
+}
+
+type cloudfrontInvalidationBatch struct {
+	XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+	CallerReference string   `xml:"CallerReference"`
+	Quantity        int      `xml:"Paths>Quantity"`
+	Paths           []string `xml:"Paths>Items>Path"`
+}
+
+// Purge creates an invalidation for all item paths. cloudfront has no surrogate keys, and only supports trailing wildcards
+func (cp *cloudfrontPurger) Purge(ctx context.Context, collection, signature string) error {
+	batch := &cloudfrontInvalidationBatch{
+		CallerReference: fmt.Sprintf("%s/%s/%d", collection, signature, time.Now().UnixNano()),
+		Paths: []string{
+			path.Join(cp.subpath, collection, signature) + "/*",
+			path.Join(cp.subpath, "iiif", "2", collection, signature) + "/*",
+			path.Join(cp.subpath, "iiif", "3", collection, signature) + "/*",
+		},
+	}
+	batch.Quantity = len(batch.Paths)
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal invalidation batch")
+	}
+	u := fmt.Sprintf("https://cloudfront.amazonaws.com/2020-05-31/distribution/%s/invalidation", url.PathEscape(cp.distributionID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "cannot create request %s", u)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	signAWSv4(req, body, cp.accessKeyID, cp.secretAccessKey, "us-east-1", "cloudfront", time.Now().UTC())
+	return doPurgeRequest(cp.client, req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signAWSv4 adds an aws signature version 4 authorization header to requests without query parameters
+func signAWSv4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + hex.EncodeToString(payloadHash[:]),
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,157 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	genericproto "github.com/je4/genericproto/v2/pkg/generic/proto"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io/fs"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// ChaosConfig injects faults into backend calls and vfs reads. never enable it in production
+type ChaosConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Collections limits fault injection to these collections. empty means all
+	Collections []string        `toml:"collections"`
+	Latency     config.Duration `toml:"latency"`
+	// LatencyRate is the fraction of calls delayed by Latency (0..1)
+	LatencyRate float64 `toml:"latencyrate"`
+	// ErrorRate is the fraction of calls failing with an unavailable error (0..1)
+	ErrorRate    float64         `toml:"errorrate"`
+	VFSLatency   config.Duration `toml:"vfslatency"`
+	VFSErrorRate float64         `toml:"vfserrorrate"`
+}
+
+// WithChaos wraps database, action and vfs access with fault injection
+func WithChaos(conf *ChaosConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		ctrl.logger.Warn().Msgf("chaos mode enabled: latency %v (%.2f), error rate %.2f, collections %v", time.Duration(conf.Latency), conf.LatencyRate, conf.ErrorRate, conf.Collections)
+		ch := &chaos{conf: conf}
+		ctrl.dbClient = &chaosDatabaseClient{Database: ctrl.dbClient, chaos: ch}
+		ctrl.actionControllerClient = &chaosActionClient{Actions: ctrl.actionControllerClient, chaos: ch}
+		ctrl.vfs = &chaosFS{FS: ctrl.vfs, chaos: ch}
+		return nil
+	}
+}
+
+type chaos struct {
+	conf *ChaosConfig
+}
+
+func (ch *chaos) affects(collection string) bool {
+	return len(ch.conf.Collections) == 0 || slices.Contains(ch.conf.Collections, collection)
+}
+
+// inject delays and fails calls for the collection according to the configured rates
+func (ch *chaos) inject(ctx context.Context, collection, call string) error {
+	if !ch.affects(collection) {
+		return nil
+	}
+	if ch.conf.Latency > 0 && rand.Float64() < ch.conf.LatencyRate {
+		select {
+		case <-time.After(time.Duration(ch.conf.Latency)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if rand.Float64() < ch.conf.ErrorRate {
+		return status.Errorf(codes.Unavailable, "chaos: injected error in %s", call)
+	}
+	return nil
+}
+
+type chaosDatabaseClient struct {
+	Database
+	chaos *chaos
+}
+
+func (c *chaosDatabaseClient) GetItem(ctx context.Context, in *mediaserverproto.ItemIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Item, error) {
+	if err := c.chaos.inject(ctx, in.GetCollection(), "GetItem"); err != nil {
+		return nil, err
+	}
+	return c.Database.GetItem(ctx, in, opts...)
+}
+
+func (c *chaosDatabaseClient) GetItemMetadata(ctx context.Context, in *mediaserverproto.ItemIdentifier, opts ...grpc.CallOption) (*wrapperspb.StringValue, error) {
+	if err := c.chaos.inject(ctx, in.GetCollection(), "GetItemMetadata"); err != nil {
+		return nil, err
+	}
+	return c.Database.GetItemMetadata(ctx, in, opts...)
+}
+
+func (c *chaosDatabaseClient) GetChildItems(ctx context.Context, in *mediaserverproto.ItemsRequest, opts ...grpc.CallOption) (*mediaserverproto.ItemsResult, error) {
+	if err := c.chaos.inject(ctx, in.GetIdentifier().GetCollection(), "GetChildItems"); err != nil {
+		return nil, err
+	}
+	return c.Database.GetChildItems(ctx, in, opts...)
+}
+
+func (c *chaosDatabaseClient) GetCache(ctx context.Context, in *mediaserverproto.CacheRequest, opts ...grpc.CallOption) (*mediaserverproto.Cache, error) {
+	if err := c.chaos.inject(ctx, in.GetIdentifier().GetCollection(), "GetCache"); err != nil {
+		return nil, err
+	}
+	return c.Database.GetCache(ctx, in, opts...)
+}
+
+func (c *chaosDatabaseClient) GetCollection(ctx context.Context, in *mediaserverproto.CollectionIdentifier, opts ...grpc.CallOption) (*mediaserverproto.Collection, error) {
+	if err := c.chaos.inject(ctx, in.GetCollection(), "GetCollection"); err != nil {
+		return nil, err
+	}
+	return c.Database.GetCollection(ctx, in, opts...)
+}
+
+type chaosActionClient struct {
+	Actions
+	chaos *chaos
+}
+
+// GetParams has no collection, faults apply to all collections
+func (c *chaosActionClient) GetParams(ctx context.Context, in *mediaserverproto.ParamsParam, opts ...grpc.CallOption) (*genericproto.StringList, error) {
+	if len(c.chaos.conf.Collections) == 0 {
+		if err := c.chaos.inject(ctx, "", "GetParams"); err != nil {
+			return nil, err
+		}
+	}
+	return c.Actions.GetParams(ctx, in, opts...)
+}
+
+func (c *chaosActionClient) Action(ctx context.Context, in *mediaserverproto.ActionParam, opts ...grpc.CallOption) (*mediaserverproto.Cache, error) {
+	if err := c.chaos.inject(ctx, in.GetItem().GetIdentifier().GetCollection(), "Action"); err != nil {
+		return nil, err
+	}
+	return c.Actions.Action(ctx, in, opts...)
+}
+
+// chaosFS has no collection information, vfs faults apply to all reads
+type chaosFS struct {
+	fs.FS
+	chaos *chaos
+}
+
+func (cfs *chaosFS) Open(name string) (fs.File, error) {
+	if cfs.chaos.conf.VFSLatency > 0 && rand.Float64() < cfs.chaos.conf.LatencyRate {
+		time.Sleep(time.Duration(cfs.chaos.conf.VFSLatency))
+	}
+	if rand.Float64() < cfs.chaos.conf.VFSErrorRate {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("chaos: injected vfs error")}
+	}
+	return cfs.FS.Open(name)
+}
+
+func (cfs *chaosFS) String() string {
+	if s, ok := cfs.FS.(interface{ String() string }); ok {
+		return "chaos:" + s.String()
+	}
+	return "chaos:vfs"
+}
@@ -0,0 +1,111 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type ClientHintsConfig struct {
+	// Actions maps "type::action" to the size parameter which gets "<width>x" from the client hints if the request
+	// has no size, e.g. "image::resize" = "size"
+	Actions map[string]string `toml:"actions"`
+	// Widths are the derivative widths, the hinted width is rounded up to the next one. the largest is the maximum
+	Widths []int `toml:"widths"`
+}
+
+var defaultClientHintWidths = []int{320, 640, 960, 1280, 1920, 2560}
+
+// acceptCH are the client hints requested from browsers
+const acceptCH = "Sec-CH-Width, Sec-CH-DPR, Sec-CH-Viewport-Width"
+
+type clientHints struct {
+	actions map[string]string
+	widths  []int
+}
+
+// WithClientHints selects the size of image derivatives without explicit size from the Sec-CH-Width, Sec-CH-DPR and
+// Sec-CH-Viewport-Width client hints
+func WithClientHints(conf *ClientHintsConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || len(conf.Actions) == 0 {
+			return nil
+		}
+		for action, param := range conf.Actions {
+			if !strings.Contains(action, "::") || param == "" {
+				return errors.Errorf("invalid client hints action '%s' = '%s' - should be \"type::action\" = \"param\"", action, param)
+			}
+		}
+		widths := conf.Widths
+		if len(widths) == 0 {
+			widths = defaultClientHintWidths
+		}
+		widths = slices.Sorted(slices.Values(widths))
+		if widths[0] <= 0 {
+			return errors.Errorf("invalid client hints width %d", widths[0])
+		}
+		ctrl.clientHints = &clientHints{actions: conf.Actions, widths: widths}
+		return nil
+	}
+}
+
+// hintValue returns the first of the headers as positive number
+func hintValue(c *gin.Context, headers ...string) float64 {
+	for _, header := range headers {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(c.GetHeader(header)), 64); err == nil && v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+// hintedWidth returns the width in device pixels from the client hints, rounded up to the configured widths
+func (ch *clientHints) hintedWidth(c *gin.Context) int {
+	width := hintValue(c, "Sec-CH-Width", "Width")
+	if width == 0 {
+		dpr := hintValue(c, "Sec-CH-DPR", "DPR")
+		if dpr == 0 {
+			dpr = 1
+		}
+		width = hintValue(c, "Sec-CH-Viewport-Width", "Viewport-Width") * dpr
+	}
+	if width == 0 {
+		return 0
+	}
+	w := int(math.Ceil(width))
+	for _, step := range ch.widths {
+		if step >= w {
+			return step
+		}
+	}
+	return ch.widths[len(ch.widths)-1]
+}
+
+// advertiseClientHints asks browsers for the client hints. browsers only honor Accept-CH of documents
+func (ctrl *mainController) advertiseClientHints(c *gin.Context) {
+	if ctrl.clientHints != nil {
+		c.Header("Accept-CH", acceptCH)
+	}
+}
+
+// applyClientHints sets the size of an action request without size from the client hints
+func (ctrl *mainController) applyClientHints(c *gin.Context, mediaType, action string, params actionCache.ActionParams) {
+	if ctrl.clientHints == nil {
+		return
+	}
+	param, ok := ctrl.clientHints.actions[mediaType+"::"+action]
+	if !ok || params.Has(param) {
+		return
+	}
+	// images opened directly are documents as well
+	ctrl.advertiseClientHints(c)
+	c.Writer.Header().Add("Vary", acceptCH)
+	if width := ctrl.clientHints.hintedWidth(c); width > 0 {
+		params.Set(param, strconv.Itoa(width)+"x")
+		traceDecision(c, "clienthints", "%s%s", param, params.Get(param))
+	}
+}
@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+var collectionNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// CollectionInfo is a collection without its secrets
+type CollectionInfo struct {
+	Name            string                    `json:"name"`
+	Description     string                    `json:"description"`
+	SignaturePrefix string                    `json:"signatureprefix"`
+	Public          string                    `json:"public"`
+	Storage         *mediaserverproto.Storage `json:"storage,omitempty"`
+	HasJWTKey       bool                      `json:"hasjwtkey"`
+}
+
+func newCollectionInfo(coll *mediaserverproto.Collection) *CollectionInfo {
+	return &CollectionInfo{
+		Name:            coll.GetName(),
+		Description:     coll.GetDescription(),
+		SignaturePrefix: coll.GetSignaturePrefix(),
+		Public:          coll.GetPublic(),
+		Storage:         coll.GetStorage(),
+		HasJWTKey:       coll.GetJwtkey() != "",
+	}
+}
+
+func (ctrl *mainController) adminCollections(c *gin.Context) {
+	stream, err := ctrl.dbClient.GetCollections(c.Request.Context(), &emptypb.Empty{})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("cannot get collections: %v", err)})
+		return
+	}
+	var result = []*CollectionInfo{}
+	for {
+		coll, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("cannot get collections: %v", err)})
+			return
+		}
+		result = append(result, newCollectionInfo(coll))
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (ctrl *mainController) adminCollection(c *gin.Context) {
+	collection := c.Param("collection")
+	coll, err := ctrl.dbClient.GetCollection(c.Request.Context(), &mediaserverproto.CollectionIdentifier{Collection: collection})
+	if err != nil {
+		if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("collection '%s' not found", collection)})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": fmt.Sprintf("cannot get collection '%s': %v", collection, err)})
+		return
+	}
+	c.JSON(http.StatusOK, newCollectionInfo(coll))
+}
@@ -0,0 +1,72 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// itemLastModified returns the update time of an item, or its creation time if never updated
+func itemLastModified(item *mediaserverproto.Item) time.Time {
+	if updated := item.GetUpdated(); updated != nil && updated.IsValid() && updated.GetSeconds() > 0 {
+		return updated.AsTime()
+	}
+	if created := item.GetCreated(); created != nil && created.IsValid() && created.GetSeconds() > 0 {
+		return created.AsTime()
+	}
+	return time.Time{}
+}
+
+func contentETag(data []byte) string {
+	h := sha256.Sum256(data)
+	var out [34]byte
+	out[0], out[33] = '"', '"'
+	hex.Encode(out[1:33], h[:16])
+	return string(out[:])
+}
+
+func etagMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets Last-Modified and ETag headers and answers conditional requests (rfc 9110 section 13.2.2).
+// returns true if a 304 response has been sent
+func notModified(c *gin.Context, lastModified time.Time, etag string) bool {
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return false
+	}
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		if etag == "" || !etagMatch(inm, etag) {
+			return false
+		}
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return true
+	}
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil || lastModified.Truncate(time.Second).After(t) {
+			return false
+		}
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// darkCollections are not delivered at all, regardless of item flags and tokens (e.g. material under legal hold).
+// only the admin and status endpoints respond for their items
+type darkCollections struct {
+	sync.RWMutex
+	collections map[string]bool
+}
+
+func (d *darkCollections) is(collection string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.collections[collection]
+}
+
+func (d *darkCollections) set(collection string, dark bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.collections == nil {
+		d.collections = map[string]bool{}
+	}
+	if dark {
+		d.collections[collection] = true
+	} else {
+		delete(d.collections, collection)
+	}
+}
+
+func (d *darkCollections) list() []string {
+	d.RLock()
+	defer d.RUnlock()
+	var result = []string{}
+	for collection := range d.collections {
+		result = append(result, collection)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// WithDarkCollections sets the collections without public delivery. collections can be changed per instance at
+// /admin/dark/:collection
+func WithDarkCollections(collections []string) Option {
+	return func(ctrl *mainController) error {
+		for _, collection := range collections {
+			if !collectionNameRegexp.MatchString(collection) {
+				return errors.Errorf("invalid dark collection name '%s'", collection)
+			}
+			ctrl.dark.set(collection, true)
+		}
+		return nil
+	}
+}
+
+// darkArchive answers all public requests for items of dark collections as not found.
+// copies in a cdn are not purged and have to be removed separately
+func (ctrl *mainController) darkArchive(c *gin.Context) {
+	collection := c.Param("collection")
+	if collection == "" || !ctrl.dark.is(collection) {
+		c.Next()
+		return
+	}
+	traceDecision(c, "dark", "%s", collection)
+	c.Header("Cache-Control", "no-store")
+	ctrl.errorResponse(c, http.StatusNotFound, collection, nil, "item_not_found", collection+"/"+c.Param("signature"))
+}
+
+// darkScope tells admin clients that the dark state is held by each instance. it is lost on restart and has to be
+// set on every replica behind a load balancer
+const darkScope = "instance"
+
+func (ctrl *mainController) adminDark(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"collections": ctrl.dark.list(), "scope": darkScope, "persisted": false})
+}
+
+// adminSetDark flags (PUT) or releases (DELETE) a dark collection on this instance. the change is not persisted,
+// the configuration has to be updated as well
+func (ctrl *mainController) adminSetDark(c *gin.Context) {
+	collection := c.Param("collection")
+	if !collectionNameRegexp.MatchString(collection) || slices.Contains(ctrl.reservedCollections(), collection) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid collection name '%s'", collection)})
+		return
+	}
+	dark := c.Request.Method == http.MethodPut
+	ctrl.dark.set(collection, dark)
+	ctrl.logger.Info().
+		Str("audit", "dark").
+		Str("collection", collection).
+		Bool("dark", dark).
+		Str("remote", c.ClientIP()).
+		Msg("dark archive changed")
+	c.JSON(http.StatusOK, gin.H{"collection": collection, "dark": dark, "scope": darkScope, "persisted": false})
+}
@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WithDataSaver sets the params used for requests with "Save-Data: on" or ?quality=low per "type::action" or action,
+// e.g. "image::resize" = "size800x800/quality60" or "video::hls" = "bitrate400". numeric values and sizes only
+// reduce the requested values, other values replace them. the access is checked against the requested params
+func WithDataSaver(actions map[string]string) Option {
+	return func(ctrl *mainController) error {
+		for action, params := range actions {
+			if strings.Trim(params, "/") == "" {
+				return errors.Errorf("empty data saver params for %s", action)
+			}
+		}
+		ctrl.dataSaverParams = actions
+		return nil
+	}
+}
+
+// saveData reports whether the client asks for reduced data usage
+func saveData(c *gin.Context) bool {
+	return strings.EqualFold(strings.TrimSpace(c.GetHeader("Save-Data")), "on") || c.Query("quality") == "low"
+}
+
+var dataSaverValueRegexp = regexp.MustCompile(`^([0-9]*)(x([0-9]*))?$`)
+
+// smallerValue returns the smaller of two numeric or "<width>x<height>" values. empty dimensions are unbounded
+func smallerValue(requested, limit string) string {
+	r := dataSaverValueRegexp.FindStringSubmatch(requested)
+	l := dataSaverValueRegexp.FindStringSubmatch(limit)
+	if r == nil || l == nil || (r[2] == "") != (l[2] == "") {
+		return limit
+	}
+	smaller := func(a, b string) string {
+		ai, errA := strconv.Atoi(a)
+		bi, errB := strconv.Atoi(b)
+		switch {
+		case errA != nil:
+			return b
+		case errB != nil || ai < bi:
+			return a
+		default:
+			return b
+		}
+	}
+	if r[2] == "" {
+		return smaller(r[1], l[1])
+	}
+	return smaller(r[1], l[1]) + "x" + smaller(r[3], l[3])
+}
+
+// applyDataSaver reduces the params of an action request for clients asking for reduced data usage
+func (ctrl *mainController) applyDataSaver(c *gin.Context, mediaType, action string, params actionCache.ActionParams, allowedParams []string) {
+	override, ok := ctrl.dataSaverParams[mediaType+"::"+action]
+	if !ok {
+		override, ok = ctrl.dataSaverParams[action]
+	}
+	if !ok {
+		return
+	}
+	c.Writer.Header().Add("Vary", "Save-Data")
+	if !saveData(c) {
+		return
+	}
+	limits := actionCache.ActionParams{}
+	limits.SetString(override, allowedParams)
+	for key, limit := range limits {
+		if requested, ok := params[key]; ok {
+			params.Set(key, smallerValue(requested, limit))
+		} else {
+			params.Set(key, limit)
+		}
+	}
+	traceDecision(c, "datasaver", "%s", params.String())
+}
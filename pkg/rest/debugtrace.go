@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"strings"
+)
+
+const debugKey = "mediaserver.debug"
+
+// decision is a step of the decision path of a request, e.g. "item" "hit"
+type decision struct {
+	step   string
+	result string
+}
+
+// traceDecision records a step of the decision path for requests with ?debug=1
+func traceDecision(c *gin.Context, step, format string, args ...any) {
+	if !c.GetBool(debugKey) {
+		return
+	}
+	trace := getTrace(c)
+	if trace == nil {
+		return
+	}
+	trace.Lock()
+	defer trace.Unlock()
+	trace.decisions = append(trace.decisions, decision{step: step, result: fmt.Sprintf(format, args...)})
+}
+
+func debugTraceValue(decisions []decision) string {
+	var parts []string
+	for _, d := range decisions {
+		parts = append(parts, d.step+"="+strings.NewReplacer(";", ",", "\n", " ").Replace(d.result))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// traceItemCache records whether an item is served from the item cache. must be called before the lookup
+func (ctrl *mainController) traceItemCache(c *gin.Context, collection, signature string) {
+	if !c.GetBool(debugKey) {
+		return
+	}
+	if _, ok := ctrl.items.(*cachedItemService); !ok {
+		traceDecision(c, "item", "custom item service")
+		return
+	}
+	if ctrl.partition(collection).itemCache.Has(itemIdentifier{collection: collection, signature: signature}) {
+		traceDecision(c, "item", "cache hit")
+	} else {
+		traceDecision(c, "item", "cache miss")
+	}
+}
+
+// traceAccess records the rule which granted or denied access
+func traceAccess(c *gin.Context, item *mediaserverproto.Item, signed bool, token string, err error) {
+	switch {
+	case err != nil:
+		traceDecision(c, "access", "denied: %v", err)
+	case signed:
+		traceDecision(c, "access", "signed request")
+	case token != "":
+		traceDecision(c, "access", "token")
+	case item.GetPublic():
+		traceDecision(c, "access", "public item")
+	default:
+		traceDecision(c, "access", "public action")
+	}
+}
+
+// traceStorage records the storage and the vfs path of the delivered file
+func traceStorage(c *gin.Context, metadata *mediaserverproto.CacheMetadata, path string) {
+	traceDecision(c, "storage", "%s %s", metadata.GetStorage().GetName(), path)
+}
+
+// debugWriter adds the decisions recorded so far before the header is written
+type debugWriter struct {
+	gin.ResponseWriter
+	trace    *requestTrace
+	injected bool
+}
+
+func (w *debugWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *debugWriter) inject() {
+	if w.injected {
+		return
+	}
+	w.injected = true
+	w.trace.Lock()
+	value := debugTraceValue(w.trace.decisions)
+	w.trace.Unlock()
+	w.Header().Set("X-Debug-Trace", value)
+	// traced responses must not end up in shared caches
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Add("Trailer", "X-Debug-Trace")
+}
+
+func (w *debugWriter) WriteHeader(code int) {
+	w.inject()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *debugWriter) WriteHeaderNow() {
+	w.inject()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *debugWriter) Write(data []byte) (int, error) {
+	w.inject()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *debugWriter) WriteString(s string) (int, error) {
+	w.inject()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// isAdminToken checks for a token signed with the admin key and subject "admin"
+func (ctrl *mainController) isAdminToken(token string) bool {
+	if ctrl.adminKey == "" || token == "" {
+		return false
+	}
+	jwtToken, err := ctrl.parseToken(token, ctrl.jwtAlgs, &jwtKey{secret: []byte(ctrl.adminKey)})
+	if err != nil {
+		return false
+	}
+	subject, err := jwtToken.Claims.GetSubject()
+	return err == nil && subject == AdminSubject
+}
+
+// debugMiddleware traces the decision path of requests with ?debug=1 in the X-Debug-Trace header.
+// the admin token is taken from the Authorization header, the token query parameter remains the access token.
+// the complete trace including delivery is sent as trailer for chunked responses
+func (ctrl *mainController) debugMiddleware(c *gin.Context) {
+	if c.Query("debug") != "1" {
+		c.Next()
+		return
+	}
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || !ctrl.isAdminToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "debug needs an admin token in the Authorization header"})
+		return
+	}
+	trace := getTrace(c)
+	if trace == nil {
+		c.Next()
+		return
+	}
+	c.Set(debugKey, true)
+	ctrl.logger.Info().
+		Str("audit", "debug").
+		Str("path", c.Request.URL.Path).
+		Str("remote", c.ClientIP()).
+		Msg("debug trace")
+	w := &debugWriter{ResponseWriter: c.Writer, trace: trace}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if w.injected {
+		trace.Lock()
+		value := debugTraceValue(trace.decisions)
+		trace.Unlock()
+		c.Writer.Header().Set("X-Debug-Trace", value)
+	}
+}
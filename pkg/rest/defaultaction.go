@@ -0,0 +1,62 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// iiifDefaultAction redirects to the iiif image information
+const iiifDefaultAction = "iiif"
+
+// WithDefaultActions sets the action for requests without action per media type, e.g. image = "iiif" or video = "viewer".
+// the "*" entry applies to all other types. actions may contain parameters ("resize/size1024x768/formatwebp")
+func WithDefaultActions(actions map[string]string) Option {
+	return func(ctrl *mainController) error {
+		for mediaType, action := range actions {
+			if strings.Trim(action, "/") == "" {
+				return errors.Errorf("empty default action for media type %s", mediaType)
+			}
+		}
+		ctrl.defaultActions = actions
+		return nil
+	}
+}
+
+// defaultAction redirects /:collection/:signature to the default action of the media type
+func (ctrl *mainController) defaultAction(c *gin.Context) {
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get item %s/%s", collection, signature)
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_not_found", collection+"/"+signature)
+		} else {
+			ctrl.errorResponse(c, http.StatusInternalServerError, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_error", collection+"/"+signature)
+		}
+		return
+	}
+	mediaType := item.GetMetadata().GetType()
+	action, ok := ctrl.defaultActions[mediaType]
+	if !ok {
+		action, ok = ctrl.defaultActions["*"]
+	}
+	if !ok {
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Errorf("no default action for %s/%s of type '%s'", collection, signature, mediaType), "no_default_action", collection+"/"+signature)
+		return
+	}
+	var target string
+	if action = strings.Trim(action, "/"); action == iiifDefaultAction {
+		target = ctrl.externalURL("iiif", "3", collection, signature, "info.json")
+	} else {
+		target = ctrl.externalURL(collection, signature, action)
+	}
+	if c.Request.URL.RawQuery != "" {
+		target = fmt.Sprintf("%s?%s", target, c.Request.URL.RawQuery)
+	}
+	c.Redirect(http.StatusFound, target)
+}
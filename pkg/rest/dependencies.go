@@ -0,0 +1,88 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"strings"
+)
+
+// WithActionDependencies declares derivatives which must exist before an action runs, e.g. "image::iiif" needs
+// ["pyramid/formatwebp"]. keys without media type ("iiif") apply to all types without own entry.
+// dependencies are generated in order on demand, their results are cached like every other derivative
+func WithActionDependencies(deps map[string][]string) Option {
+	return func(ctrl *mainController) error {
+		types := map[string]bool{"": true}
+		for key, actions := range deps {
+			mediaType, action, ok := strings.Cut(key, "::")
+			if !ok {
+				mediaType, action = "", key
+			}
+			if action == "" {
+				return errors.Errorf("empty action in dependency '%s'", key)
+			}
+			types[mediaType] = true
+			for _, dep := range actions {
+				if strings.Trim(dep, "/") == "" {
+					return errors.Errorf("empty dependency of '%s'", key)
+				}
+			}
+		}
+		ctrl.actionDeps = deps
+		for mediaType := range types {
+			for key := range deps {
+				_, action, ok := strings.Cut(key, "::")
+				if !ok {
+					action = key
+				}
+				if err := ctrl.checkDependencyCycle(mediaType, action, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// dependencies returns the derivatives needed by the action as "<action>/<params>"
+func (ctrl *mainController) dependencies(mediaType, action string) []string {
+	if deps, ok := ctrl.actionDeps[mediaType+"::"+action]; ok {
+		return deps
+	}
+	return ctrl.actionDeps[action]
+}
+
+// checkDependencyCycle fails if an action depends on itself, which would block its generation forever
+func (ctrl *mainController) checkDependencyCycle(mediaType, action string, chain []string) error {
+	for _, a := range chain {
+		if a == action {
+			return errors.Errorf("cyclic action dependency for type '%s': %s -> %s", mediaType, strings.Join(chain, " -> "), action)
+		}
+	}
+	chain = append(chain, action)
+	for _, dep := range ctrl.dependencies(mediaType, action) {
+		depAction, _, _ := strings.Cut(strings.Trim(dep, "/"), "/")
+		if err := ctrl.checkDependencyCycle(mediaType, depAction, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateDependencies makes sure the derivatives needed by the action exist. failed dependencies are recorded by
+// their own generation
+func (ctrl *mainController) generateDependencies(ctx context.Context, param *mediaserverproto.ActionParam) error {
+	collection := param.GetItem().GetIdentifier().GetCollection()
+	signature := param.GetItem().GetIdentifier().GetSignature()
+	for _, dep := range ctrl.dependencies(param.GetItem().GetMetadata().GetType(), param.GetAction()) {
+		action, paramStr, _ := strings.Cut(strings.Trim(dep, "/"), "/")
+		generated, err := ctrl.prewarm(ctx, collection, signature, action, paramStr)
+		if err != nil {
+			return errors.Wrapf(err, "cannot generate dependency %s of %s", dep, param.GetAction())
+		}
+		if generated {
+			ctrl.logger.Debug().Msgf("dependency %s of %s/%s/%s generated", dep, collection, signature, param.GetAction())
+		}
+	}
+	return nil
+}
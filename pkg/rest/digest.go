@@ -0,0 +1,21 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+)
+
+// setDigest adds Repr-Digest (rfc 9530) and the legacy Digest (rfc 3230) header for a hex encoded sha512 checksum
+func setDigest(c *gin.Context, sha512 string) {
+	if sha512 == "" {
+		return
+	}
+	sum, err := hex.DecodeString(sha512)
+	if err != nil || len(sum) != 64 {
+		return
+	}
+	b64 := base64.StdEncoding.EncodeToString(sum)
+	c.Header("Repr-Digest", "sha-512=:"+b64+":")
+	c.Header("Digest", "SHA-512="+b64)
+}
@@ -0,0 +1,132 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	disconnectContinue = "continue"
+	disconnectCancel   = "cancel"
+)
+
+type DisconnectConfig struct {
+	// Default is "continue" (default, the derivative is cached for the next request) or "cancel"
+	Default string `toml:"default"`
+	// Actions overrides the default per action, keys are "<action>" or "<type>::<action>", e.g. resize = "cancel"
+	Actions map[string]string `toml:"actions"`
+}
+
+// DisconnectStats counts the generations whose clients disconnected
+type DisconnectStats struct {
+	Action string `json:"action"`
+	// Warmed generations were continued and cached
+	Warmed int64 `json:"warmed"`
+	// Failed generations were continued without result
+	Failed int64 `json:"failed"`
+	// Canceled generations were stopped, unless other requests waited for them
+	Canceled int64 `json:"canceled"`
+}
+
+type disconnects struct {
+	sync.Mutex
+	def     string
+	actions map[string]string
+	stats   map[string]*DisconnectStats
+}
+
+// WithDisconnectPolicy decides per action whether generations are continued or canceled if the client disconnects
+func WithDisconnectPolicy(conf *DisconnectConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		for key, policy := range conf.Actions {
+			if policy != disconnectContinue && policy != disconnectCancel {
+				return errors.Errorf("invalid disconnect policy '%s' for %s - should be continue or cancel", policy, key)
+			}
+		}
+		switch conf.Default {
+		case "":
+			ctrl.disconnects.def = disconnectContinue
+		case disconnectContinue, disconnectCancel:
+			ctrl.disconnects.def = conf.Default
+		default:
+			return errors.Errorf("invalid default disconnect policy '%s' - should be continue or cancel", conf.Default)
+		}
+		ctrl.disconnects.actions = conf.Actions
+		return nil
+	}
+}
+
+func (d *disconnects) policy(mediaType, action string) string {
+	if policy, ok := d.actions[mediaType+"::"+action]; ok {
+		return policy
+	}
+	if policy, ok := d.actions[action]; ok {
+		return policy
+	}
+	if d.def == "" {
+		return disconnectContinue
+	}
+	return d.def
+}
+
+// record counts the outcome of a generation after the client disconnected
+func (d *disconnects) record(action, policy string, err error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stats == nil {
+		d.stats = map[string]*DisconnectStats{}
+	}
+	stats, ok := d.stats[action]
+	if !ok {
+		stats = &DisconnectStats{Action: action}
+		d.stats[action] = stats
+	}
+	switch {
+	case policy == disconnectCancel && errors.Is(err, context.Canceled):
+		stats.Canceled++
+	case err != nil:
+		stats.Failed++
+	default:
+		stats.Warmed++
+	}
+}
+
+// generateFor generates a derivative for a request. the disconnect policy of the action decides whether the
+// generation goes on without client
+func (ctrl *mainController) generateFor(c *gin.Context, param *mediaserverproto.ActionParam) (*mediaserverproto.Cache, error) {
+	policy := ctrl.disconnects.policy(param.GetItem().GetMetadata().GetType(), param.GetAction())
+	ctx := c.Request.Context()
+	if policy == disconnectContinue {
+		ctx = context.WithoutCancel(ctx)
+	}
+	cache, err := ctrl.generate(ctx, param)
+	if c.Request.Context().Err() != nil {
+		traceDecision(c, "disconnect", "%s %s", policy, param.GetAction())
+		ctrl.disconnects.record(param.GetAction(), policy, err)
+		ctrl.logger.Debug().Err(err).Msgf("client disconnected during generation of %s (%s)", generationKey(param), policy)
+	}
+	return cache, err
+}
+
+func (ctrl *mainController) adminDisconnects(c *gin.Context) {
+	d := &ctrl.disconnects
+	d.Lock()
+	var result = []DisconnectStats{}
+	for _, stats := range d.stats {
+		result = append(result, *stats)
+	}
+	d.Unlock()
+	slices.SortFunc(result, func(a, b DisconnectStats) int {
+		return strings.Compare(a.Action, b.Action)
+	})
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,152 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"html/template"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// actionCatalogTTL limits how long the discovered actions are kept, new action workers show up after it
+const actionCatalogTTL = 5 * time.Minute
+
+// WithActionCatalog lists the actions at /actions from the action dispatcher. without catalog the capability actions
+// of each media type are probed with GetParams
+func WithActionCatalog(catalog ActionCatalog) Option {
+	return func(ctrl *mainController) error {
+		ctrl.actionCatalog = catalog
+		return nil
+	}
+}
+
+// DiscoveredAction is an action of a media type with its parameters
+type DiscoveredAction struct {
+	Action string `json:"action"`
+	// Params are appended to the url as name and value, e.g. "size240x240"
+	Params []string `json:"params"`
+	// URL is the address pattern of the action
+	URL string `json:"url"`
+}
+
+// ActionDiscovery lists the actions per media type. Source is "catalog" if the action dispatcher was asked,
+// "probe" otherwise
+type ActionDiscovery struct {
+	Source  string                        `json:"source"`
+	Created time.Time                     `json:"created"`
+	Types   map[string][]DiscoveredAction `json:"types"`
+}
+
+type discoveredActions struct {
+	sync.Mutex
+	discovery *ActionDiscovery
+}
+
+// discoverActions returns the actions per media type. results are cached for actionCatalogTTL
+func (ctrl *mainController) discoverActions(ctx context.Context) *ActionDiscovery {
+	ctrl.discovered.Lock()
+	defer ctrl.discovered.Unlock()
+	if d := ctrl.discovered.discovery; d != nil && time.Since(d.Created) < actionCatalogTTL {
+		return d
+	}
+	actions := map[string]map[string][]string{}
+	source := "probe"
+	if ctrl.actionCatalog != nil {
+		resp, err := ctrl.actionCatalog.GetActions(ctx, &emptypb.Empty{})
+		if err != nil {
+			ctrl.logger.Warn().Err(err).Msg("cannot get actions from catalog, probing capability actions")
+		} else {
+			source = "catalog"
+			for mediaType, list := range resp.GetActions() {
+				actions[mediaType] = map[string][]string{}
+				for action, params := range list.GetValues() {
+					actions[mediaType][action] = params.GetValues()
+					// the params are the same GetParams would return
+					ctrl.actionParamsMutex.Lock()
+					ctrl.actionParams[actionSignature{mediaType: mediaType, action: action}] = params.GetValues()
+					ctrl.actionParamsMutex.Unlock()
+				}
+			}
+		}
+	}
+	if source == "probe" {
+		for mediaType, list := range ctrl.capabilityActions {
+			actions[mediaType] = map[string][]string{}
+			for _, action := range list {
+				params, err := ctrl.getParams(mediaType, action)
+				if err != nil {
+					ctrl.logger.Debug().Err(err).Msgf("action %s::%s not available", mediaType, action)
+					continue
+				}
+				actions[mediaType][action] = params
+			}
+		}
+	}
+	d := &ActionDiscovery{Source: source, Created: time.Now(), Types: map[string][]DiscoveredAction{}}
+	for mediaType, list := range actions {
+		var result = []DiscoveredAction{}
+		for _, action := range slices.Sorted(maps.Keys(list)) {
+			params := slices.Clone(list[action])
+			slices.Sort(params)
+			result = append(result, DiscoveredAction{Action: action, Params: params, URL: ctrl.externalURL(":collection", ":signature", action)})
+		}
+		if len(result) > 0 {
+			d.Types[mediaType] = result
+		}
+	}
+	ctrl.discovered.discovery = d
+	return d
+}
+
+var actionsPageTemplate = template.Must(template.New("actions").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Labels.Title}}</title>
+<link rel="alternate" type="application/json" href="{{.JSONURL}}">
+</head>
+<body>
+<h1>{{.Labels.Title}}</h1>
+{{range $type, $actions := .Discovery.Types}}<h2>{{$type}}</h2>
+<table>
+<tr><th>{{$.Labels.Action}}</th><th>{{$.Labels.Params}}</th><th>{{$.Labels.URL}}</th></tr>
+{{range $actions}}<tr><td>{{.Action}}</td><td>{{range $i, $p := .Params}}{{if $i}}, {{end}}{{$p}}{{end}}</td><td><code>{{.URL}}</code></td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// actions answers /actions with the actions of all media types, as html page for browsers or ?format=html
+func (ctrl *mainController) actions(c *gin.Context) {
+	d := ctrl.discoverActions(c.Request.Context())
+	c.Header("Vary", "Accept, Accept-Language")
+	format := c.Query("format")
+	if format == "json" || (format != "html" && !strings.Contains(c.GetHeader("Accept"), "text/html")) {
+		c.JSON(http.StatusOK, d)
+		return
+	}
+	tag, _ := ctrl.requestLanguage(c, "")
+	buf := &bytes.Buffer{}
+	if err := actionsPageTemplate.Execute(buf, map[string]any{
+		"Lang":      tag.String(),
+		"Discovery": d,
+		"JSONURL":   ctrl.externalURL("actions") + "?format=json",
+		"Labels": map[string]string{
+			"Title":  ctrl.translate(c, "", "actions_title"),
+			"Action": ctrl.translate(c, "", "actions_action"),
+			"Params": ctrl.translate(c, "", "actions_params"),
+			"URL":    ctrl.translate(c, "", "actions_url"),
+		},
+	}); err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot execute actions template")
+		ctrl.errorResponse(c, http.StatusInternalServerError, "", err, "internal_error")
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
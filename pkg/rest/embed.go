@@ -0,0 +1,204 @@
+package rest
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+type EmbedConfig struct {
+	// FrameAncestors are the origins allowed to embed the viewer, e.g. "https://partner.example.org". default "*"
+	FrameAncestors []string `toml:"frameancestors"`
+	// Actions maps the media type to the "action/params" shown in the viewer
+	Actions map[string]string `toml:"actions"`
+}
+
+var defaultEmbedActions = map[string]string{
+	"image": "resize/size2048x2048/formatjpeg",
+	"video": "item",
+	"audio": "item",
+}
+
+// WithEmbed configures the embeddable viewer at /embed/:collection/:signature
+func WithEmbed(conf *EmbedConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		if len(conf.FrameAncestors) > 0 {
+			for _, origin := range conf.FrameAncestors {
+				if strings.ContainsAny(origin, " ;,") {
+					return errors.Errorf("invalid frame ancestor '%s'", origin)
+				}
+			}
+			ctrl.embedFrameAncestors = conf.FrameAncestors
+		}
+		if len(conf.Actions) > 0 {
+			ctrl.embedActions = conf.Actions
+		}
+		return nil
+	}
+}
+
+// the viewer accepts {type: "load", collection, signature}, {type: "seek", time} and {type: "zoom", level}
+// and posts {type: "ready" | "loaded" | "timeupdate" | "zoom" | "error"} to the parent window
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Collection}}/{{.Signature}}</title>
+<style>
+html, body { margin: 0; height: 100%; background: #000; overflow: hidden; }
+#media { width: 100%; height: 100%; object-fit: contain; transform-origin: center; }
+#rights { position: absolute; right: 0.5em; bottom: 0.5em; padding: 0.1em 0.4em; background: rgba(0, 0, 0, 0.6); color: #fff; font: 12px sans-serif; text-decoration: none; }
+</style>
+</head>
+<body>
+{{if eq .Type "video"}}<video id="media" src="{{.SourceURL}}" controls playsinline preload="metadata">{{range .Tracks}}
+<track kind="{{.Kind}}" src="{{.Src}}"{{if .Lang}} srclang="{{.Lang}}"{{end}}{{if .Label}} label="{{.Label}}"{{end}}>{{end}}</video>
+{{else if eq .Type "audio"}}<audio id="media" src="{{.SourceURL}}" controls preload="metadata">{{range .Tracks}}
+<track kind="{{.Kind}}" src="{{.Src}}"{{if .Lang}} srclang="{{.Lang}}"{{end}}{{if .Label}} label="{{.Label}}"{{end}}>{{end}}</audio>
+{{else}}<img id="media" src="{{.SourceURL}}" alt="{{.Collection}}/{{.Signature}}">
+{{end}}{{if .Rights}}<a id="rights" href="{{.Rights}}" rel="license" target="_blank" title="{{.RightsTitle}}">{{.RightsLabel}}</a>
+{{end}}<script>
+(function () {
+	var origins = {{.Origins}};
+	var embedURL = {{.EmbedURL}};
+	var media = document.getElementById("media");
+	var beaconURL = {{.BeaconURL}};
+	var zoom = 1;
+	var watched = 0, lastTime = null, loadedAt = null;
+	function beacon(type, extra) {
+		if (!beaconURL || !navigator.sendBeacon) { return; }
+		var msg = {type: type, collection: {{.Collection}}, signature: {{.Signature}}};
+		for (var key in extra || {}) { msg[key] = extra[key]; }
+		navigator.sendBeacon(beaconURL, new Blob([JSON.stringify(msg)], {type: "application/json"}));
+	}
+	function viewingTime() {
+		if (media.tagName === "IMG") { return loadedAt ? (Date.now() - loadedAt) / 1000 : 0; }
+		return watched;
+	}
+	function post(msg) {
+		msg.collection = {{.Collection}};
+		msg.signature = {{.Signature}};
+		if (window.parent === window) { return; }
+		if (origins.indexOf("*") >= 0) { window.parent.postMessage(msg, "*"); return; }
+		origins.forEach(function (origin) { window.parent.postMessage(msg, origin); });
+	}
+	window.addEventListener("message", function (event) {
+		if (origins.indexOf("*") < 0 && origins.indexOf(event.origin) < 0) { return; }
+		var msg = event.data || {};
+		switch (msg.type) {
+		case "load":
+			if (msg.collection && msg.signature) {
+				window.location.href = embedURL + encodeURIComponent(msg.collection) + "/" + encodeURIComponent(msg.signature);
+			}
+			break;
+		case "seek":
+			if (typeof media.currentTime === "number" && typeof msg.time === "number") { media.currentTime = msg.time; lastTime = null; }
+			break;
+		case "zoom":
+			if (typeof msg.level === "number" && msg.level > 0) {
+				zoom = msg.level;
+				media.style.transform = "scale(" + zoom + ")";
+				post({type: "zoom", level: zoom});
+				beacon("zoom");
+			}
+			break;
+		}
+	});
+	media.addEventListener(media.tagName === "IMG" ? "load" : "loadedmetadata", function () {
+		loadedAt = Date.now();
+		post({type: "loaded"});
+		beacon("view");
+	});
+	media.addEventListener("error", function () { post({type: "error"}); });
+	media.addEventListener("timeupdate", function () {
+		if (lastTime !== null && !media.paused && media.currentTime > lastTime) { watched += media.currentTime - lastTime; }
+		lastTime = media.currentTime;
+		post({type: "timeupdate", time: media.currentTime});
+	});
+	media.addEventListener("play", function () { lastTime = media.currentTime; beacon("play", {position: media.currentTime}); });
+	media.addEventListener("pause", function () { beacon("pause", {position: media.currentTime}); });
+	media.addEventListener("seeked", function () { lastTime = media.currentTime; beacon("seek", {position: media.currentTime}); });
+	media.addEventListener("ended", function () { beacon("ended", {watched: viewingTime()}); watched = 0; });
+	window.addEventListener("pagehide", function () { beacon("leave", {watched: viewingTime()}); });
+	post({type: "ready"});
+})();
+</script>
+</body>
+</html>
+`))
+
+// embed renders a reduced viewer which may be framed by the configured origins
+func (ctrl *mainController) embed(c *gin.Context) {
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	token := c.Query("token")
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get item %s/%s", collection, signature)
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_not_found", collection+"/"+signature)
+		} else {
+			ctrl.errorResponse(c, http.StatusInternalServerError, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_error", collection+"/"+signature)
+		}
+		return
+	}
+	mediaType := item.GetMetadata().GetType()
+	source, ok := ctrl.embedActions[mediaType]
+	if !ok {
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Errorf("no embed action for %s/%s of type '%s'", collection, signature, mediaType), "no_default_action", collection+"/"+signature)
+		return
+	}
+	action, paramStr, _ := strings.Cut(normalizePath(source), "/")
+	if err := ctrl.checkAccess(c, collection, signature, action, paramStr, token); err != nil {
+		if ctrl.limitResponse(c, collection, signature, err) {
+			return
+		}
+		ctrl.logger.Info().Err(err).Msgf("access denied for %s/%s/%s/%s", collection, signature, action, paramStr)
+		ctrl.errorResponse(c, http.StatusUnauthorized, collection, errors.Wrapf(err, "access denied for %s/%s/%s/%s", collection, signature, action, paramStr), "access_denied", collection+"/"+signature)
+		return
+	}
+	sourceURL := ctrl.externalURL(collection, signature, action, paramStr)
+	if token != "" {
+		sourceURL += "?token=" + token
+	}
+	var beaconURL string
+	if ctrl.beacons != nil {
+		beaconURL = ctrl.externalURL("beacon")
+	}
+	rightsURI := ctrl.itemRights(collection, signature)
+	tag, _ := ctrl.requestLanguage(c, collection)
+	buf := &bytes.Buffer{}
+	if err := embedTemplate.Execute(buf, map[string]any{
+		"Lang":        tag.String(),
+		"Collection":  collection,
+		"Signature":   signature,
+		"Type":        mediaType,
+		"SourceURL":   sourceURL,
+		"EmbedURL":    ctrl.externalURL("embed") + "/",
+		"Origins":     ctrl.embedFrameAncestors,
+		"BeaconURL":   beaconURL,
+		"Tracks":      ctrl.embedTracks(c, item, token),
+		"Rights":      rightsURI,
+		"RightsLabel": rightsLabel(rightsURI),
+		"RightsTitle": ctrl.translate(c, collection, "rights_label"),
+	}); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot execute template %s", embedTemplate.Name())
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "internal_error")
+		return
+	}
+	ctrl.typeHeaders(c, item)
+	ctrl.rightsHeader(c, collection, signature)
+	setHeaders(c, ctrl.headerPolicy.embed)
+	c.Header("Content-Security-Policy", "frame-ancestors "+strings.Join(ctrl.embedFrameAncestors, " "))
+	c.Header("Vary", "Accept-Language")
+	ctrl.advertiseClientHints(c)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
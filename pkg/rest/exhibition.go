@@ -0,0 +1,242 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ExhibitionConfig struct {
+	Enabled bool `toml:"enabled"`
+	// File keeps the windows in the vfs, e.g. "vfs://testcache/exhibitions.json". if empty, windows are kept in memory
+	File string `toml:"file"`
+}
+
+// ExhibitionWindow makes items of a collection public between Start and End
+type ExhibitionWindow struct {
+	ID         string `json:"id"`
+	Title      string `json:"title,omitempty"`
+	Collection string `json:"collection"`
+	// Signatures of the exhibited items, the whole collection if empty
+	Signatures []string `json:"signatures,omitempty"`
+	// Actions are the public actions, e.g. ["iiif", "embed"], all actions if empty
+	Actions []string  `json:"actions,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+func (w *ExhibitionWindow) open(collection, signature, action string, now time.Time) bool {
+	return w.Collection == collection &&
+		!now.Before(w.Start) && now.Before(w.End) &&
+		(len(w.Signatures) == 0 || slices.Contains(w.Signatures, signature)) &&
+		(len(w.Actions) == 0 || slices.Contains(w.Actions, action))
+}
+
+type exhibitions struct {
+	sync.RWMutex
+	file    string
+	windows map[string]*ExhibitionWindow
+}
+
+// WithExhibitions enables public access windows for temporary online exhibitions, managed at /admin/exhibitions.
+// responses of exhibited items are neither stored in the response cache nor marked public, so no cache keeps them
+// after the window
+func WithExhibitions(conf *ExhibitionConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		ex := &exhibitions{
+			file:    conf.File,
+			windows: map[string]*ExhibitionWindow{},
+		}
+		if ex.file != "" {
+			data, err := fs.ReadFile(ctrl.vfs, ex.file)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Wrapf(err, "cannot read %s", ex.file)
+			}
+			if err == nil {
+				var windows []*ExhibitionWindow
+				if err := json.Unmarshal(data, &windows); err != nil {
+					return errors.Wrapf(err, "cannot unmarshal %s", ex.file)
+				}
+				for _, w := range windows {
+					ex.windows[w.ID] = w
+				}
+			}
+		}
+		ctrl.exhibitions = ex
+		return nil
+	}
+}
+
+// exhibited reports whether an exhibition window grants public access to the action of an item
+func (ctrl *mainController) exhibited(collection, signature, action string) bool {
+	ex := ctrl.exhibitions
+	if ex == nil {
+		return false
+	}
+	now := time.Now()
+	ex.RLock()
+	defer ex.RUnlock()
+	for _, w := range ex.windows {
+		if w.open(collection, signature, action, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the windows ordered by start. the lock must be held
+func (ex *exhibitions) list() []*ExhibitionWindow {
+	var result = []*ExhibitionWindow{}
+	for _, w := range ex.windows {
+		result = append(result, w)
+	}
+	slices.SortFunc(result, func(a, b *ExhibitionWindow) int {
+		if c := a.Start.Compare(b.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return result
+}
+
+// save writes the windows to the file. the lock must be held
+func (ctrl *mainController) saveExhibitions() error {
+	ex := ctrl.exhibitions
+	if ex.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(ex.list())
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal exhibitions")
+	}
+	fp, err := writefs.Create(ctrl.vfs, ex.file)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", ex.file)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", ex.file)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", ex.file)
+}
+
+type exhibitionWindowStatus struct {
+	*ExhibitionWindow
+	Active bool `json:"active"`
+}
+
+func (ctrl *mainController) adminExhibitions(c *gin.Context) {
+	ex := ctrl.exhibitions
+	if ex == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exhibitions not enabled"})
+		return
+	}
+	now := time.Now()
+	ex.RLock()
+	var result = []exhibitionWindowStatus{}
+	for _, w := range ex.list() {
+		result = append(result, exhibitionWindowStatus{ExhibitionWindow: w, Active: !now.Before(w.Start) && now.Before(w.End)})
+	}
+	ex.RUnlock()
+	c.JSON(http.StatusOK, result)
+}
+
+func (ctrl *mainController) adminPutExhibition(c *gin.Context) {
+	ex := ctrl.exhibitions
+	if ex == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exhibitions not enabled"})
+		return
+	}
+	id := c.Param("id")
+	if !collectionNameRegexp.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid exhibition id '%s'", id)})
+		return
+	}
+	var w ExhibitionWindow
+	if err := c.ShouldBindJSON(&w); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	w.ID = id
+	if _, err := ctrl.getCollection(w.Collection); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown collection '%s'", w.Collection)})
+		return
+	}
+	if w.Start.IsZero() || !w.End.After(w.Start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must be after start"})
+		return
+	}
+	ex.Lock()
+	old := ex.windows[id]
+	ex.windows[id] = &w
+	err := ctrl.saveExhibitions()
+	if err != nil {
+		if old != nil {
+			ex.windows[id] = old
+		} else {
+			delete(ex.windows, id)
+		}
+	}
+	ex.Unlock()
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot save exhibition %s", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "exhibition").
+		Str("id", id).
+		Str("collection", w.Collection).
+		Strs("signatures", w.Signatures).
+		Time("start", w.Start).
+		Time("end", w.End).
+		Str("remote", c.ClientIP()).
+		Msg("exhibition window set")
+	c.JSON(http.StatusOK, &w)
+}
+
+func (ctrl *mainController) adminDeleteExhibition(c *gin.Context) {
+	ex := ctrl.exhibitions
+	if ex == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "exhibitions not enabled"})
+		return
+	}
+	id := c.Param("id")
+	ex.Lock()
+	old, ok := ex.windows[id]
+	var err error
+	if ok {
+		delete(ex.windows, id)
+		if err = ctrl.saveExhibitions(); err != nil {
+			ex.windows[id] = old
+		}
+	}
+	ex.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("exhibition '%s' not found", id)})
+		return
+	}
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot save exhibitions after deleting %s", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "exhibition").
+		Str("id", id).
+		Str("collection", old.Collection).
+		Str("remote", c.ClientIP()).
+		Msg("exhibition window deleted")
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type FallbackConfig struct {
+	// Param is the size parameter of the actions, default "size"
+	Param string `toml:"param"`
+	// Sizes are the values of the size parameter tried as fallback, e.g. ["1024x1024", "240x240"]
+	Sizes []string `toml:"sizes"`
+}
+
+// WithDerivativeFallback serves the nearest smaller existing derivative if a derivative cannot be generated
+func WithDerivativeFallback(conf *FallbackConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || len(conf.Sizes) == 0 {
+			return nil
+		}
+		if conf.Param == "" {
+			conf.Param = "size"
+		}
+		for _, size := range conf.Sizes {
+			if _, ok := sizeArea(size); !ok {
+				return errors.Errorf("invalid fallback size '%s'", size)
+			}
+		}
+		ctrl.fallback = conf
+		return nil
+	}
+}
+
+// sizeArea parses "<width>x<height>". missing dimensions count as 1
+func sizeArea(size string) (int64, bool) {
+	w, h, _ := strings.Cut(strings.ToLower(size), "x")
+	if w == "" && h == "" {
+		return 0, false
+	}
+	var area int64 = 1
+	for _, d := range []string{w, h} {
+		if d == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(d, 10, 64)
+		if err != nil || v <= 0 {
+			return 0, false
+		}
+		area *= v
+	}
+	return area, true
+}
+
+// fallbackCache looks for an existing derivative with the same params but a smaller size, the largest first
+func (ctrl *mainController) fallbackCache(c *gin.Context, collection, signature, action string, params actionCache.ActionParams) (*mediaserverproto.Cache, bool) {
+	if ctrl.fallback == nil || !params.Has(ctrl.fallback.Param) {
+		return nil, false
+	}
+	requested, ok := sizeArea(params.Get(ctrl.fallback.Param))
+	if !ok {
+		return nil, false
+	}
+	var candidates []string
+	for _, size := range ctrl.fallback.Sizes {
+		if area, _ := sizeArea(size); area < requested {
+			candidates = append(candidates, size)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ai, _ := sizeArea(candidates[i])
+		aj, _ := sizeArea(candidates[j])
+		return ai > aj
+	})
+	for _, size := range candidates {
+		fallbackParams := actionCache.ActionParams{}
+		for k, v := range params {
+			fallbackParams.Set(k, v)
+		}
+		fallbackParams.Set(ctrl.fallback.Param, size)
+		cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
+			Identifier: &mediaserverproto.ItemIdentifier{
+				Collection: collection,
+				Signature:  signature,
+			},
+			Action: action,
+			Params: fallbackParams.String(),
+		})
+		if err != nil || cache == nil {
+			continue
+		}
+		ctrl.logger.Warn().Msgf("serving %s/%s/%s/%s instead of %s", collection, signature, action, fallbackParams.String(), params.String())
+		c.Header("Warning", fmt.Sprintf(`199 - "nearest derivative %s/%s served"`, action, fallbackParams.String()))
+		// the client should get the requested derivative as soon as it is available
+		c.Header("Cache-Control", "no-store")
+		return cache, true
+	}
+	return nil, false
+}
@@ -0,0 +1,164 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type FastPathConfig struct {
+	// Enabled serves hits of the response cache for iiif requests without gin. requests with query, Cache-Control,
+	// X-Priority or of collections with response filters, as well as all requests if tenants, server timing or
+	// custom middlewares are configured, take the regular route. cached tiles are not subject to load shedding
+	Enabled bool `toml:"enabled"`
+}
+
+// WithFastPath serves cached iiif tiles from a plain http.Handler in front of the router
+func WithFastPath(conf *FastPathConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		ctrl.fastPath = &fastPath{}
+		return nil
+	}
+}
+
+type fastPath struct {
+	// hits were served by the fast path, passed went through the router
+	hits, passed atomic.Int64
+}
+
+// fastWriter records status and size of fast path responses. it keeps io.ReaderFrom for sendfile
+type fastWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+var fastWriterPool = sync.Pool{
+	New: func() any { return &fastWriter{} },
+}
+
+func (w *fastWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *fastWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.size += n
+	return n, err
+}
+
+func (w *fastWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.size += int(n)
+	return n, err
+}
+
+// iiifFastPathRoute is the route of the access log, as logged by gin
+func (ctrl *mainController) iiifFastPathRoute() string {
+	return strings.TrimSuffix(ctrl.subpath, "/") + "/iiif/:version/:collection/:signature/*params"
+}
+
+// fastPathCollection returns the collection of an iiif request eligible for the fast path
+func (ctrl *mainController) fastPathCollection(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet || r.URL.RawQuery != "" || r.Header.Get("Cache-Control") != "" || r.Header.Get("X-Priority") != "" {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, strings.TrimSuffix(ctrl.subpath, "/")+"/iiif/")
+	if !ok {
+		return "", false
+	}
+	// version/collection/signature/params
+	_, rest, ok = strings.Cut(rest, "/")
+	if !ok {
+		return "", false
+	}
+	collection, rest, ok := strings.Cut(rest, "/")
+	if !ok || collection == "" || !strings.Contains(rest, "/") {
+		return "", false
+	}
+	if ctrl.dark.is(collection) || len(ctrl.responseFilters[collection]) > 0 {
+		return "", false
+	}
+	return collection, true
+}
+
+// fastPathHandler serves hits of the response cache for iiif requests and hands everything else to the router
+func (ctrl *mainController) fastPathHandler(next http.Handler) http.Handler {
+	fp := ctrl.fastPath
+	if fp == nil || ctrl.responseCache == nil {
+		return next
+	}
+	route := ctrl.iiifFastPathRoute()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the features below need the gin context
+		if ctrl.serverTiming || len(ctrl.tenants) > 0 || len(ctrl.middlewares) > 0 || len(ctrl.groupMiddleware[GroupIIIF]) > 0 {
+			fp.passed.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		collection, ok := ctrl.fastPathCollection(r)
+		if !ok {
+			fp.passed.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry, ok := ctrl.responseCache.lookup(r)
+		if !ok {
+			fp.passed.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		trace := &requestTrace{start: time.Now()}
+		fw := fastWriterPool.Get().(*fastWriter)
+		fw.ResponseWriter, fw.status, fw.size = w, 0, 0
+		defer func() {
+			fw.ResponseWriter = nil
+			fastWriterPool.Put(fw)
+		}()
+		// cors.Default of the iiif group allows all origins
+		if r.Header.Get("Origin") != "" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		if !ctrl.responseCache.serveHTTP(fw, r, entry) {
+			fp.passed.Add(1)
+			next.ServeHTTP(w, r)
+			return
+		}
+		fp.hits.Add(1)
+		if ctrl.accounting != nil {
+			ctrl.accountRequest(collection, fw.status, fw.size)
+		}
+		ctrl.logRequest(r, route, fw.status, fw.size, trace)
+	})
+}
+
+func (ctrl *mainController) adminFastPath(c *gin.Context) {
+	fp := ctrl.fastPath
+	if fp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "fast path not enabled"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"hits": fp.hits.Load(), "passed": fp.passed.Load()})
+}
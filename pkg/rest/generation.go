@@ -0,0 +1,312 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generationCall is a running generation, concurrent requests for the same derivative wait for its result
+type generationCall struct {
+	done    chan struct{}
+	cache   *mediaserverproto.Cache
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type generationFlights struct {
+	sync.Mutex
+	calls map[string]*generationCall
+}
+
+// do runs fn once per key. callers arriving during the run get the same result.
+// the context of fn is canceled when the contexts of all waiting callers are done
+func (gf *generationFlights) do(ctx context.Context, key string, fn func(ctx context.Context) (*mediaserverproto.Cache, error)) (*mediaserverproto.Cache, error) {
+	gf.Lock()
+	call, ok := gf.calls[key]
+	if !ok {
+		if gf.calls == nil {
+			gf.calls = map[string]*generationCall{}
+		}
+		genCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &generationCall{done: make(chan struct{}), cancel: cancel}
+		gf.calls[key] = call
+		go func() {
+			defer cancel()
+			cache, err := fn(genCtx)
+			gf.Lock()
+			if gf.calls[key] == call {
+				delete(gf.calls, key)
+			}
+			call.cache, call.err = cache, err
+			gf.Unlock()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	gf.Unlock()
+	select {
+	case <-call.done:
+		return call.cache, call.err
+	case <-ctx.Done():
+		gf.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// later requests start a new generation instead of getting the canceled one
+			call.cancel()
+			if gf.calls[key] == call {
+				delete(gf.calls, key)
+			}
+		}
+		gf.Unlock()
+		return nil, errors.WithStack(ctx.Err())
+	}
+}
+
+func generationKey(param *mediaserverproto.ActionParam) string {
+	return AccessSubject(param.GetItem().GetIdentifier().GetCollection(), param.GetItem().GetIdentifier().GetSignature(),
+		param.GetAction(), actionCache.ActionParams(param.GetParams()).String())
+}
+
+type GenerationPeersConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Peers are the external addresses of all frontends including this one, e.g. "http://mediaserver-0:8080/media".
+	// peers call each other at <peer>/admin/generate with a token of the shared admin key
+	Peers []string `toml:"peers"`
+	// Self is the address of this instance in Peers
+	Self string `toml:"self"`
+	// Replicas is the number of points per peer on the hash ring, default 100
+	Replicas int `toml:"replicas"`
+	// Timeout of forwarded generations, default 5m
+	Timeout config.Duration `toml:"timeout"`
+}
+
+var errPeerUnavailable = errors.New("generation peer unavailable")
+
+type ringPoint struct {
+	hash uint64
+	peer string
+}
+
+// generationPeers assigns every item to one frontend, so derivatives of an item are generated by one instance only
+type generationPeers struct {
+	self   string
+	ring   []ringPoint
+	client *http.Client
+}
+
+// ringHash spreads similar names like "peer#1" and "peer#2" evenly
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// WithGenerationPeers forwards generations to the frontend selected by consistent hashing of the item
+func WithGenerationPeers(conf *GenerationPeersConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if !slices.Contains(conf.Peers, conf.Self) {
+			return errors.Errorf("own address '%s' not in generation peers %v", conf.Self, conf.Peers)
+		}
+		replicas := conf.Replicas
+		if replicas <= 0 {
+			replicas = 100
+		}
+		timeout := time.Duration(conf.Timeout)
+		if timeout <= 0 {
+			timeout = 5 * time.Minute
+		}
+		gp := &generationPeers{self: conf.Self, client: &http.Client{Timeout: timeout}}
+		for _, peer := range conf.Peers {
+			if _, err := url.Parse(peer); err != nil {
+				return errors.Wrapf(err, "invalid generation peer '%s'", peer)
+			}
+			for i := 0; i < replicas; i++ {
+				gp.ring = append(gp.ring, ringPoint{hash: ringHash(peer + "#" + strconv.Itoa(i)), peer: peer})
+			}
+		}
+		slices.SortFunc(gp.ring, func(a, b ringPoint) int {
+			if a.hash < b.hash {
+				return -1
+			}
+			if a.hash > b.hash {
+				return 1
+			}
+			return strings.Compare(a.peer, b.peer)
+		})
+		ctrl.generationPeers = gp
+		return nil
+	}
+}
+
+// owner returns the peer of an item, the first point on the ring at or after the hash of the item
+func (gp *generationPeers) owner(collection, signature string) string {
+	h := ringHash(collection + "/" + signature)
+	i, _ := slices.BinarySearchFunc(gp.ring, h, func(p ringPoint, h uint64) int {
+		if p.hash < h {
+			return -1
+		}
+		if p.hash > h {
+			return 1
+		}
+		return 0
+	})
+	if i == len(gp.ring) {
+		i = 0
+	}
+	return gp.ring[i].peer
+}
+
+// generationPeer returns the peer generating the derivatives of the item if it is not this instance
+func (ctrl *mainController) generationPeer(item *mediaserverproto.Item) (string, bool) {
+	gp := ctrl.generationPeers
+	if gp == nil {
+		return "", false
+	}
+	owner := gp.owner(item.GetIdentifier().GetCollection(), item.GetIdentifier().GetSignature())
+	return owner, owner != gp.self
+}
+
+// GenerateRequest asks a peer to generate a derivative
+type GenerateRequest struct {
+	Collection string            `json:"collection"`
+	Signature  string            `json:"signature"`
+	Action     string            `json:"action"`
+	Params     map[string]string `json:"params"`
+}
+
+// generationErrors are passed between peers by reason, so responses are the same on every instance
+var generationErrors = map[string]error{
+	"read_only":      errReadOnly,
+	"quota_exceeded": errQuotaExceeded,
+	"quarantined":    errQuarantined,
+	"over_budget":    errOverBudget,
+}
+
+// forwardGeneration lets the peer generate the derivative. errPeerUnavailable is returned if the peer cannot be reached
+func (ctrl *mainController) forwardGeneration(ctx context.Context, peer string, param *mediaserverproto.ActionParam) (*mediaserverproto.Cache, error) {
+	if ctrl.adminKey == "" {
+		return nil, errors.Wrap(errPeerUnavailable, "no admin key for generation peers")
+	}
+	alg := "HS256"
+	for _, a := range ctrl.jwtAlgs {
+		if strings.HasPrefix(a, "HS") {
+			alg = a
+			break
+		}
+	}
+	token, err := MintToken(ctrl.adminKey, alg, AdminSubject, time.Minute)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot mint peer token")
+	}
+	data, err := json.Marshal(GenerateRequest{
+		Collection: param.GetItem().GetIdentifier().GetCollection(),
+		Signature:  param.GetItem().GetIdentifier().GetSignature(),
+		Action:     param.GetAction(),
+		Params:     param.GetParams(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal generate request")
+	}
+	u, err := url.JoinPath(peer, "admin", "generate")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot join url '%s'", peer)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create request for %s", u)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := ctrl.generationPeers.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(errPeerUnavailable, "%s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(errPeerUnavailable, "cannot read response of %s: %v", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(body, &result)
+		if sentinel, ok := generationErrors[result.Reason]; ok {
+			return nil, errors.Wrapf(sentinel, "peer %s: %s", peer, result.Error)
+		}
+		if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusUnauthorized {
+			return nil, errors.Wrapf(errPeerUnavailable, "%s returned %s: %s", u, resp.Status, result.Error)
+		}
+		return nil, errors.Errorf("generation at peer %s failed: %s", peer, result.Error)
+	}
+	cache := &mediaserverproto.Cache{}
+	if err := protojson.Unmarshal(body, cache); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal cache from %s", u)
+	}
+	return cache, nil
+}
+
+// adminGenerate generates a derivative for a peer. it is never forwarded again
+func (ctrl *mainController) adminGenerate(c *gin.Context) {
+	var req GenerateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	item, err := ctrl.getItem(req.Collection, req.Signature)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("item %s/%s not found", req.Collection, req.Signature)})
+		return
+	}
+	coll, err := ctrl.getCollection(req.Collection)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("collection %s not found", req.Collection)})
+		return
+	}
+	param := &mediaserverproto.ActionParam{
+		Item:    item,
+		Action:  req.Action,
+		Params:  req.Params,
+		Storage: coll.GetStorage(),
+	}
+	cache, err := ctrl.generateChecked(c.Request.Context(), param, false)
+	if err != nil {
+		for reason, sentinel := range generationErrors {
+			if errors.Is(err, sentinel) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "reason": reason})
+				return
+			}
+		}
+		ctrl.logger.Error().Err(err).Msgf("cannot generate %s for peer", generationKey(param))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := protojson.Marshal(cache)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot marshal cache: %v", err)})
+		return
+	}
+	c.Data(http.StatusOK, "application/json", data)
+}
@@ -0,0 +1,184 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type KeepaliveConfig struct {
+	// Time is the idle time after which the client pings the server
+	Time config.Duration `toml:"time"`
+	// Timeout is the time to wait for the ping ack before the connection is closed
+	Timeout             config.Duration `toml:"timeout"`
+	PermitWithoutStream bool            `toml:"permitwithoutstream"`
+}
+
+// GRPCClientConfig tunes the connections to the database and action services
+type GRPCClientConfig struct {
+	Keepalive *KeepaliveConfig `toml:"keepalive"`
+	// MaxRecvMsgSize and MaxSendMsgSize are the message limits in bytes. grpc default is 4MiB for receiving
+	MaxRecvMsgSize int `toml:"maxrecvmsgsize"`
+	MaxSendMsgSize int `toml:"maxsendmsgsize"`
+	// InitialWindowSize and InitialConnWindowSize are the flow control windows per stream and connection in bytes
+	InitialWindowSize     int32 `toml:"initialwindowsize"`
+	InitialConnWindowSize int32 `toml:"initialconnwindowsize"`
+	// LoadBalancing is the policy across the addresses of a resolver target: "pick_first" or "round_robin"
+	LoadBalancing string `toml:"loadbalancing"`
+	// Metrics enables the per target statistics at GET /admin/grpc/metrics
+	Metrics bool `toml:"metrics"`
+}
+
+var loadBalancingPolicies = []string{"pick_first", "round_robin"}
+
+// GRPCDialOptions returns the dial options of the configuration. metrics may be nil
+func GRPCDialOptions(conf *GRPCClientConfig, metrics *RPCMetrics) ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if metrics != nil {
+		opts = append(opts,
+			grpc.WithChainUnaryInterceptor(metrics.unaryInterceptor),
+			grpc.WithChainStreamInterceptor(metrics.streamInterceptor),
+		)
+	}
+	if conf == nil {
+		return opts, nil
+	}
+	if ka := conf.Keepalive; ka != nil {
+		if time.Duration(ka.Time) < 10*time.Second {
+			return nil, errors.Errorf("keepalive time %v below the minimum of 10s", time.Duration(ka.Time))
+		}
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(ka.Time),
+			Timeout:             time.Duration(ka.Timeout),
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}))
+	}
+	var callOpts []grpc.CallOption
+	if conf.MaxRecvMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallRecvMsgSize(conf.MaxRecvMsgSize))
+	}
+	if conf.MaxSendMsgSize > 0 {
+		callOpts = append(callOpts, grpc.MaxCallSendMsgSize(conf.MaxSendMsgSize))
+	}
+	if len(callOpts) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(callOpts...))
+	}
+	if conf.InitialWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialWindowSize(conf.InitialWindowSize))
+	}
+	if conf.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.WithInitialConnWindowSize(conf.InitialConnWindowSize))
+	}
+	if conf.LoadBalancing != "" {
+		if !slices.Contains(loadBalancingPolicies, conf.LoadBalancing) {
+			return nil, errors.Errorf("unknown load balancing policy '%s' - should be one of %v", conf.LoadBalancing, loadBalancingPolicies)
+		}
+		opts = append(opts, grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, conf.LoadBalancing)))
+	}
+	return opts, nil
+}
+
+// RPCStats are the aggregated calls of a grpc method on a target
+type RPCStats struct {
+	Target string           `json:"target"`
+	Method string           `json:"method"`
+	Calls  int64            `json:"calls"`
+	Errors int64            `json:"errors"`
+	Codes  map[string]int64 `json:"codes"`
+	// TotalDuration and MaxDuration are in milliseconds. for streams only the setup is measured
+	TotalDuration float64 `json:"totalduration"`
+	MaxDuration   float64 `json:"maxduration"`
+}
+
+// RPCMetrics collects per target statistics of outgoing grpc calls
+type RPCMetrics struct {
+	sync.Mutex
+	stats map[string]*RPCStats
+}
+
+func NewRPCMetrics() *RPCMetrics {
+	return &RPCMetrics{stats: map[string]*RPCStats{}}
+}
+
+func (m *RPCMetrics) record(target, method string, duration time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	key := target + " " + method
+	s, ok := m.stats[key]
+	if !ok {
+		s = &RPCStats{Target: target, Method: method, Codes: map[string]int64{}}
+		m.stats[key] = s
+	}
+	s.Calls++
+	if err != nil {
+		s.Errors++
+	}
+	s.Codes[status.Code(err).String()]++
+	ms := float64(duration) / float64(time.Millisecond)
+	s.TotalDuration += ms
+	if ms > s.MaxDuration {
+		s.MaxDuration = ms
+	}
+}
+
+func (m *RPCMetrics) unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	m.record(cc.Target(), method, time.Since(start), err)
+	return err
+}
+
+func (m *RPCMetrics) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	m.record(cc.Target(), method, time.Since(start), err)
+	return stream, err
+}
+
+// Snapshot returns a copy of the statistics ordered by target and method
+func (m *RPCMetrics) Snapshot() []RPCStats {
+	m.Lock()
+	defer m.Unlock()
+	var result = []RPCStats{}
+	for _, s := range m.stats {
+		c := *s
+		c.Codes = map[string]int64{}
+		for k, v := range s.Codes {
+			c.Codes[k] = v
+		}
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Target != result[j].Target {
+			return result[i].Target < result[j].Target
+		}
+		return result[i].Method < result[j].Method
+	})
+	return result
+}
+
+// WithRPCMetrics exposes the statistics of the grpc clients at GET /admin/grpc/metrics
+func WithRPCMetrics(metrics *RPCMetrics) Option {
+	return func(ctrl *mainController) error {
+		ctrl.rpcMetrics = metrics
+		return nil
+	}
+}
+
+func (ctrl *mainController) adminRPCMetrics(c *gin.Context) {
+	if ctrl.rpcMetrics == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "grpc metrics not configured"})
+		return
+	}
+	c.JSON(http.StatusOK, ctrl.rpcMetrics.Snapshot())
+}
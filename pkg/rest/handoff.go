@@ -0,0 +1,149 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// environment variables used to pass listeners from the old to the new process
+const (
+	handoffAddrsEnv = "MEDIASERVER_HANDOFF_ADDRS"
+	handoffReadyEnv = "MEDIASERVER_HANDOFF_READY"
+)
+
+// first file descriptor of exec.Cmd.ExtraFiles
+const handoffFirstFD = 3
+
+// inheritedListener returns the listener for addr passed by a parent process during handoff
+func inheritedListener(addr string) (net.Listener, bool, error) {
+	addrs := os.Getenv(handoffAddrsEnv)
+	if addrs == "" {
+		return nil, false, nil
+	}
+	for i, a := range strings.Split(addrs, ",") {
+		if a != addr {
+			continue
+		}
+		f := os.NewFile(uintptr(handoffFirstFD+i), addr)
+		if f == nil {
+			return nil, false, errors.Errorf("inherited file descriptor %d for %s not available", handoffFirstFD+i, addr)
+		}
+		defer f.Close()
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "cannot use inherited listener for %s", addr)
+		}
+		return l, true, nil
+	}
+	return nil, false, nil
+}
+
+// HandoffReady tells the parent process that the listeners have been taken over
+func HandoffReady() error {
+	fdStr := os.Getenv(handoffReadyEnv)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(handoffReadyEnv)
+	os.Unsetenv(handoffAddrsEnv)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid handoff ready descriptor '%s'", fdStr)
+	}
+	f := os.NewFile(uintptr(fd), "handoff-ready")
+	if f == nil {
+		return errors.Errorf("handoff ready descriptor %d not available", fd)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{1}); err != nil {
+		return errors.Wrap(err, "cannot signal handoff readiness")
+	}
+	return nil
+}
+
+// Handoff starts a new instance of the current binary which takes over the listening sockets.
+// it returns after the new process has signaled readiness. the caller should gracefully stop the
+// server afterwards, so that running streams are finished by the old process
+func (ctrl *mainController) Handoff(timeout time.Duration) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot determine executable")
+	}
+	ctrl.listenerMutex.Lock()
+	defer ctrl.listenerMutex.Unlock()
+
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for addr, l := range ctrl.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, errors.Errorf("listener %s cannot be passed to another process", addr)
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			// the socket file is needed by the new process
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get file of listener %s", addr)
+		}
+		addrs = append(addrs, addr)
+		files = append(files, f)
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create handoff pipe")
+	}
+	defer readyRead.Close()
+	files = append(files, readyWrite)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", handoffAddrsEnv, strings.Join(addrs, ",")),
+		fmt.Sprintf("%s=%d", handoffReadyEnv, handoffFirstFD+len(files)-1),
+	)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "cannot start %s", exe)
+	}
+	// only the child should hold the write end, so that a dying child closes the pipe
+	readyWrite.Close()
+	files = files[:len(files)-1]
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := io.ReadFull(readyRead, buf)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			// wait reaps the process, which must not be left as zombie
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, errors.Wrap(err, "new process exited before taking over")
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.Errorf("new process not ready after %s", timeout)
+	}
+	ctrl.logger.Info().Msgf("listeners %v handed off to process %d", addrs, cmd.Process.Pid)
+	return cmd.Process, nil
+}
@@ -0,0 +1,117 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// HeaderPolicyConfig sets response headers depending on the media type. configured headers replace the defaults,
+// an empty value removes a default header
+type HeaderPolicyConfig struct {
+	// Types maps the media type of the item, "*" for all types, to the headers of its responses
+	Types map[string]map[string]string `toml:"types"`
+	// IIIF are the headers of iiif responses, e.g. tiles loaded by viewers of other origins
+	IIIF map[string]string `toml:"iiif"`
+	// Embed are the headers of the embeddable viewer. framing is restricted by the frame ancestors of [embed]
+	Embed map[string]string `toml:"embed"`
+}
+
+var defaultHeaderPolicy = HeaderPolicyConfig{
+	Types: map[string]map[string]string{
+		"video": {"Accept-Ranges": "bytes"},
+		"audio": {"Accept-Ranges": "bytes"},
+	},
+	IIIF: map[string]string{"Cross-Origin-Resource-Policy": "cross-origin"},
+	// the viewer is framed by design, frame-ancestors of the content security policy replaces X-Frame-Options
+	Embed: map[string]string{"X-Frame-Options": ""},
+}
+
+// headerPolicy holds the headers per media type with the "*" entries merged in
+type headerPolicy struct {
+	types map[string]map[string]string
+	all   map[string]string
+	iiif  map[string]string
+	embed map[string]string
+}
+
+func mergeHeaders(dst map[string]string, src map[string]string) (map[string]string, error) {
+	result := maps.Clone(dst)
+	if result == nil {
+		result = map[string]string{}
+	}
+	for name, value := range src {
+		if name == "" || strings.ContainsAny(name, " :\t\r\n") || strings.ContainsAny(value, "\r\n") {
+			return nil, errors.Errorf("invalid header '%s: %s'", name, value)
+		}
+		result[http.CanonicalHeaderKey(name)] = value
+	}
+	return result, nil
+}
+
+func newHeaderPolicy(conf *HeaderPolicyConfig) (*headerPolicy, error) {
+	if conf == nil {
+		conf = &HeaderPolicyConfig{}
+	}
+	hp := &headerPolicy{types: map[string]map[string]string{}}
+	var err error
+	if hp.all, err = mergeHeaders(defaultHeaderPolicy.Types["*"], conf.Types["*"]); err != nil {
+		return nil, errors.Wrap(err, "invalid headers of type *")
+	}
+	for _, types := range []map[string]map[string]string{defaultHeaderPolicy.Types, conf.Types} {
+		for mediaType := range types {
+			if mediaType == "*" || hp.types[mediaType] != nil {
+				continue
+			}
+			headers, err := mergeHeaders(hp.all, defaultHeaderPolicy.Types[mediaType])
+			if err == nil {
+				headers, err = mergeHeaders(headers, conf.Types[mediaType])
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid headers of type %s", mediaType)
+			}
+			hp.types[mediaType] = headers
+		}
+	}
+	if hp.iiif, err = mergeHeaders(defaultHeaderPolicy.IIIF, conf.IIIF); err != nil {
+		return nil, errors.Wrap(err, "invalid iiif headers")
+	}
+	if hp.embed, err = mergeHeaders(defaultHeaderPolicy.Embed, conf.Embed); err != nil {
+		return nil, errors.Wrap(err, "invalid embed headers")
+	}
+	return hp, nil
+}
+
+// WithHeaderPolicy sets the default headers per media type, for iiif responses and the embeddable viewer
+func WithHeaderPolicy(conf *HeaderPolicyConfig) Option {
+	return func(ctrl *mainController) error {
+		hp, err := newHeaderPolicy(conf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ctrl.headerPolicy = hp
+		return nil
+	}
+}
+
+func setHeaders(c *gin.Context, headers map[string]string) {
+	for name, value := range headers {
+		if value == "" {
+			c.Writer.Header().Del(name)
+			continue
+		}
+		c.Header(name, value)
+	}
+}
+
+// typeHeaders sets the headers of the media type of the item
+func (ctrl *mainController) typeHeaders(c *gin.Context, item *mediaserverproto.Item) {
+	headers, ok := ctrl.headerPolicy.types[item.GetMetadata().GetType()]
+	if !ok {
+		headers = ctrl.headerPolicy.all
+	}
+	setHeaders(c, headers)
+}
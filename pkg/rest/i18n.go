@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaservermain/v2/pkg/rest/locales"
+	"golang.org/x/text/language"
+	"html/template"
+	"io/fs"
+	"strings"
+)
+
+// WithCollectionLanguages sets the default language of collections, used if the client sends no matching Accept-Language
+func WithCollectionLanguages(languages map[string]string) Option {
+	return func(ctrl *mainController) error {
+		for collection, lang := range languages {
+			if _, err := language.Parse(lang); err != nil {
+				return errors.Wrapf(err, "invalid language '%s' for collection %s", lang, collection)
+			}
+		}
+		ctrl.collectionLanguages = languages
+		return nil
+	}
+}
+
+type catalog struct {
+	tags     []language.Tag
+	messages []map[string]string
+	matcher  language.Matcher
+}
+
+// loadCatalog reads all <lang>.json message files. english is the fallback and comes first
+func loadCatalog(fsys fs.FS) (*catalog, error) {
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cat := &catalog{}
+	for _, name := range append([]string{"en.json"}, files...) {
+		tag := language.Make(strings.TrimSuffix(name, ".json"))
+		if len(cat.tags) > 0 && (name == "en.json" || tag == language.Und) {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read %s", name)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal %s", name)
+		}
+		cat.tags = append(cat.tags, tag)
+		cat.messages = append(cat.messages, messages)
+	}
+	cat.matcher = language.NewMatcher(cat.tags)
+	return cat, nil
+}
+
+var messages = func() *catalog {
+	cat, err := loadCatalog(locales.FS)
+	if err != nil {
+		panic(fmt.Sprintf("cannot load message catalog: %v", err))
+	}
+	return cat
+}()
+
+// requestLanguage negotiates the catalog language from Accept-Language and the collection default
+func (ctrl *mainController) requestLanguage(c *gin.Context, collection string) (language.Tag, int) {
+	prefs, _, _ := language.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	if lang, ok := ctrl.collectionLanguages[collection]; ok {
+		prefs = append(prefs, language.Make(lang))
+	}
+	_, idx, _ := messages.matcher.Match(prefs...)
+	return messages.tags[idx], idx
+}
+
+// translate returns the message in the best language for the request
+func (ctrl *mainController) translate(c *gin.Context, collection, key string, args ...any) string {
+	_, idx := ctrl.requestLanguage(c, collection)
+	msg, ok := messages.messages[idx][key]
+	if !ok {
+		if msg, ok = messages.messages[0][key]; !ok {
+			msg = key
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><title>{{.Title}} {{.Status}}</title></head>
+<body><h1>{{.Title}} {{.Status}}</h1><p>{{.Message}}</p></body>
+</html>
+`))
+
+// errorResponse sends a localized error. browsers get an html page, api clients json with the technical error
+func (ctrl *mainController) errorResponse(c *gin.Context, httpStatus int, collection string, err error, key string, args ...any) {
+	msg := ctrl.translate(c, collection, key, args...)
+	if strings.Contains(c.GetHeader("Accept"), "text/html") {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(httpStatus)
+		tag, _ := ctrl.requestLanguage(c, collection)
+		if err := errorPageTemplate.Execute(c.Writer, map[string]any{
+			"Lang":    tag.String(),
+			"Title":   ctrl.translate(c, collection, "error_title"),
+			"Status":  httpStatus,
+			"Message": msg,
+		}); err != nil {
+			ctrl.logger.Error().Err(err).Msg("cannot execute error page template")
+		}
+		c.Abort()
+		return
+	}
+	result := gin.H{"message": msg}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	c.AbortWithStatusJSON(httpStatus, result)
+}
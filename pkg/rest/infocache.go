@@ -0,0 +1,104 @@
+package rest
+
+import (
+	"bytes"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type InfoCacheConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Size is the number of info.json documents kept, default 10000
+	Size int `toml:"size"`
+	// TTL of the documents, default 24h. they are removed earlier with the item at POST /admin/invalidate
+	TTL config.Duration `toml:"ttl"`
+}
+
+// iiifVersions are the iiif image api versions served at /iiif/:version
+var iiifVersions = []string{"2", "3"}
+
+type infoCacheKey struct {
+	collection, signature, version string
+}
+
+type infoCacheEntry struct {
+	body        []byte
+	contentType string
+	etag        string
+}
+
+// WithInfoCache keeps the info.json documents of the iiif server, so viewer sessions start without asking the
+// database for the base derivative and without a request to the iiif server
+func WithInfoCache(conf *InfoCacheConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		size := conf.Size
+		if size <= 0 {
+			size = 10000
+		}
+		ttl := time.Duration(conf.TTL)
+		if ttl <= 0 {
+			ttl = 24 * time.Hour
+		}
+		ctrl.infoCache = gcache.New(size).LRU().Expiration(ttl).Build()
+		return nil
+	}
+}
+
+// serveCachedInfo answers an info.json request from the cache. it returns false if the document is not cached
+func (ctrl *mainController) serveCachedInfo(c *gin.Context, item *mediaserverproto.Item, collection, signature, version string) bool {
+	if ctrl.infoCache == nil {
+		return false
+	}
+	entryAny, err := ctrl.infoCache.GetIFPresent(infoCacheKey{collection: collection, signature: signature, version: version})
+	if err != nil {
+		return false
+	}
+	entry := entryAny.(*infoCacheEntry)
+	traceDecision(c, "infocache", "hit %s/%s v%s", collection, signature, version)
+	if ctrl.tileHints != nil {
+		if linksAny, err := ctrl.tileHints.links.GetIFPresent(tileHintsKey{collection: collection, signature: signature, version: version}); err == nil {
+			c.Writer.Header().Add("Link", linksAny.(*tileHintsEntry).linkHeader())
+		}
+	}
+	if notModified(c, itemLastModified(item), entry.etag) {
+		return true
+	}
+	c.Header("Content-Length", strconv.Itoa(len(entry.body)))
+	c.Data(http.StatusOK, entry.contentType, entry.body)
+	return true
+}
+
+// cacheInfo stores the info.json document read from body. documents above maxInfoSize are passed through
+func (ctrl *mainController) cacheInfo(collection, signature, version, contentType string, body io.Reader) io.Reader {
+	data, err := io.ReadAll(io.LimitReader(body, maxInfoSize+1))
+	if err != nil || len(data) > maxInfoSize {
+		return io.MultiReader(bytes.NewReader(data), body)
+	}
+	if err := ctrl.infoCache.Set(infoCacheKey{collection: collection, signature: signature, version: version}, &infoCacheEntry{
+		body:        data,
+		contentType: contentType,
+		etag:        contentETag(data),
+	}); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot cache info.json of %s/%s", collection, signature)
+	}
+	return bytes.NewReader(data)
+}
+
+// removeInfo removes the cached info.json documents of an item
+func (ctrl *mainController) removeInfo(collection, signature string) {
+	if ctrl.infoCache == nil {
+		return
+	}
+	for _, version := range iiifVersions {
+		ctrl.infoCache.Remove(infoCacheKey{collection: collection, signature: signature, version: version})
+	}
+}
@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type InfoPageConfig struct {
+	// ThumbnailAction is the "action/params" of the preview image, e.g. "resize/size240x240/formatjpeg"
+	ThumbnailAction string `toml:"thumbnailaction"`
+	// Template is the path of a custom html template in the vfs
+	Template string `toml:"template"`
+}
+
+// WithInfoPage configures the landing page at /:collection/:signature/info
+func WithInfoPage(conf *InfoPageConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		ctrl.infoThumbnailAction = conf.ThumbnailAction
+		if conf.Template != "" {
+			ctrl.infoTemplatePath = conf.Template
+		}
+		return nil
+	}
+}
+
+var infoPageTemplate = template.Must(template.New("info").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Collection}}/{{.Signature}}</title>
+<link rel="alternate" type="application/json" href="{{.MetadataURL}}">
+{{if .Rights}}<link rel="license" href="{{.Rights}}">
+{{end}}</head>
+<body>
+<h1>{{.Collection}}/{{.Signature}}</h1>
+{{if .ThumbnailURL}}<img src="{{.ThumbnailURL}}" alt="{{.Collection}}/{{.Signature}}">{{end}}
+<h2>{{.Labels.Metadata}}</h2>
+<table>
+<tr><th>URN</th><td>{{.Item.GetUrn}}</td></tr>
+<tr><th>Type</th><td>{{.Item.GetMetadata.GetType}}/{{.Item.GetMetadata.GetSubtype}}</td></tr>
+<tr><th>Mimetype</th><td>{{.Item.GetMetadata.GetMimetype}}</td></tr>
+{{if .Rights}}<tr><th>{{.Labels.Rights}}</th><td><a href="{{.Rights}}" rel="license">{{.RightsLabel}}</a></td></tr>
+{{end}}{{range $key, $value := .Fields}}<tr><th>{{$key}}</th><td>{{$value}}</td></tr>
+{{end}}</table>
+<h2>{{.Labels.Actions}}</h2>
+<ul>
+{{range .Actions}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+<h2>{{.Labels.Citation}}</h2>
+<p>{{.Citation}}</p>
+</body>
+</html>
+`))
+
+type infoAction struct {
+	Name string
+	URL  string
+}
+
+// infoFields returns the top level scalar values of the descriptive metadata
+func infoFields(metadata string) map[string]string {
+	var data map[string]any
+	if err := json.Unmarshal([]byte(metadata), &data); err != nil {
+		return nil
+	}
+	fields := map[string]string{}
+	for key, value := range data {
+		switch v := value.(type) {
+		case string, float64, bool:
+			fields[key] = fmt.Sprint(v)
+		}
+	}
+	return fields
+}
+
+func (ctrl *mainController) infoTemplate() (*template.Template, error) {
+	if ctrl.infoTemplatePath == "" {
+		return infoPageTemplate, nil
+	}
+	if tplAny, err := ctrl.actionTemplates.Get(ctrl.infoTemplatePath); err == nil {
+		if tpl, ok := tplAny.(*template.Template); ok {
+			return tpl, nil
+		}
+	}
+	data, err := fs.ReadFile(ctrl.vfs, ctrl.infoTemplatePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read template %s", ctrl.infoTemplatePath)
+	}
+	tpl, err := template.New("info").Parse(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse template %s", ctrl.infoTemplatePath)
+	}
+	ctrl.actionTemplates.Set(ctrl.infoTemplatePath, tpl)
+	return tpl, nil
+}
+
+// info renders the landing page of an item for linking from catalogs
+func (ctrl *mainController) info(c *gin.Context, item *mediaserverproto.Item, collection, signature string) {
+	metadata, err := ctrl.getItemMetadata(collection, signature)
+	if err != nil {
+		// the page is useful without descriptive metadata
+		ctrl.logger.Info().Err(err).Msgf("no metadata for %s/%s", collection, signature)
+	}
+	itemURL := ctrl.externalURL(collection, signature)
+	var actions = []infoAction{
+		{Name: "metadata", URL: ctrl.externalURL(collection, signature, "metadata")},
+	}
+	if item.GetMetadata().GetType() == "image" && ctrl.iiifBaseAction != "" {
+		actions = append(actions, infoAction{Name: "iiif", URL: ctrl.externalURL("iiif", "3", collection, signature, "info.json")})
+	}
+	for _, action := range item.GetPublicActions() {
+		actions = append(actions, infoAction{Name: action, URL: ctrl.externalURL(collection, signature, action)})
+	}
+	var thumbnailURL string
+	// the token of the landing page is not valid for the thumbnail, so it is shown only if public
+	if ctrl.infoThumbnailAction != "" && (item.GetPublic() || slices.Contains(item.GetPublicActions(), ctrl.infoThumbnailAction)) {
+		thumbnailURL = ctrl.externalURL(collection, signature, ctrl.infoThumbnailAction)
+	}
+	rightsURI := ctrl.itemRights(collection, signature)
+	tag, _ := ctrl.requestLanguage(c, collection)
+	data := map[string]any{
+		"Lang":         tag.String(),
+		"BaseURL":      ctrl.externalURL(),
+		"StaticURL":    ctrl.externalURL("static"),
+		"Collection":   collection,
+		"Signature":    signature,
+		"Item":         item,
+		"Metadata":     metadata,
+		"Fields":       infoFields(metadata),
+		"MetadataURL":  ctrl.externalURL(collection, signature, "metadata"),
+		"ThumbnailURL": thumbnailURL,
+		"Actions":      actions,
+		"Rights":       rightsURI,
+		"RightsLabel":  rightsLabel(rightsURI),
+		"Citation":     fmt.Sprintf("%s, %s. %s (%s %s)", collection, signature, itemURL, ctrl.translate(c, collection, "info_accessed"), time.Now().Format("2006-01-02")),
+		"Labels": map[string]string{
+			"Metadata": ctrl.translate(c, collection, "info_metadata"),
+			"Actions":  ctrl.translate(c, collection, "info_actions"),
+			"Citation": ctrl.translate(c, collection, "info_citation"),
+			"Rights":   ctrl.translate(c, collection, "rights_label"),
+		},
+	}
+	tpl, err := ctrl.infoTemplate()
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot load info template")
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "internal_error")
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := tpl.Execute(buf, data); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot execute template %s", tpl.Name())
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "internal_error")
+		return
+	}
+	c.Header("Vary", "Accept-Language")
+	ctrl.advertiseClientHints(c)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
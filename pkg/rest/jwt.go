@@ -0,0 +1,238 @@
+package rest
+
+import (
+	"crypto"
+	"emperror.dev/errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/je4/utils/v2/pkg/config"
+	"slices"
+	"strings"
+	"time"
+)
+
+type CollectionJWTConfig struct {
+	// Algs restricts or extends the global algorithm list
+	Algs []string `toml:"algs"`
+	// Mode is "restrict" (default, only algorithms in both lists) or "extend" (algorithms of both lists)
+	Mode string `toml:"mode"`
+	// PublicKey is a pem encoded key for asymmetric algorithms. if empty, the collection jwtkey is used if it is pem encoded
+	PublicKey config.EnvString `toml:"publickey"`
+	// MaxTTL is the maximum accepted lifetime (exp - iat) of tokens. minted tokens are limited to it
+	MaxTTL config.Duration `toml:"maxttl"`
+	// DefaultTTL is the lifetime of minted tokens if none is requested
+	DefaultTTL config.Duration `toml:"defaultttl"`
+	// ClockSkew is the accepted clock difference for exp, nbf and iat
+	ClockSkew config.Duration `toml:"clockskew"`
+}
+
+// WithCollectionJWT sets per collection overrides of the jwt verification
+func WithCollectionJWT(conf map[string]*CollectionJWTConfig) Option {
+	return func(ctrl *mainController) error {
+		for name, cc := range conf {
+			switch strings.ToLower(cc.Mode) {
+			case "", "restrict", "extend":
+			default:
+				return errors.Errorf("invalid jwt mode '%s' for collection %s", cc.Mode, name)
+			}
+			if err := validateAlgs(cc.Algs); err != nil {
+				return errors.Wrapf(err, "invalid jwt algs for collection %s", name)
+			}
+			if len(cc.Algs) > 0 && strings.ToLower(cc.Mode) != "extend" && !slices.ContainsFunc(cc.Algs, func(alg string) bool {
+				return slices.Contains(ctrl.jwtAlgs, alg)
+			}) {
+				return errors.Errorf("jwt algs %v of collection %s have nothing in common with jwtalg %v", cc.Algs, name, ctrl.jwtAlgs)
+			}
+			if cc.MaxTTL > 0 && cc.DefaultTTL > cc.MaxTTL {
+				return errors.Errorf("defaultttl %v exceeds maxttl %v for collection %s", time.Duration(cc.DefaultTTL), time.Duration(cc.MaxTTL), name)
+			}
+			if cc.PublicKey != "" {
+				if _, err := parsePublicKey(string(cc.PublicKey)); err != nil {
+					return errors.Wrapf(err, "invalid public key for collection %s", name)
+				}
+			}
+		}
+		ctrl.collectionJWT = conf
+		return nil
+	}
+}
+
+// jwtKey holds the verification keys of a collection
+type jwtKey struct {
+	secret []byte
+	public crypto.PublicKey
+}
+
+func parsePublicKey(pemStr string) (crypto.PublicKey, error) {
+	data := []byte(pemStr)
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	key, err := jwt.ParseEdPublicKeyFromPEM(data)
+	if err != nil {
+		return nil, errors.New("no rsa, ecdsa or ed25519 public key found")
+	}
+	return key, nil
+}
+
+func newJWTKey(secret, publicKey string) (*jwtKey, error) {
+	key := &jwtKey{}
+	if publicKey == "" && strings.HasPrefix(strings.TrimSpace(secret), "-----BEGIN") {
+		publicKey = secret
+		secret = ""
+	}
+	key.secret = []byte(secret)
+	if publicKey != "" {
+		pub, err := parsePublicKey(publicKey)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		key.public = pub
+	}
+	return key, nil
+}
+
+// verificationKey returns the key matching the algorithm family
+func (k *jwtKey) verificationKey(method jwt.SigningMethod) (any, error) {
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		if len(k.secret) == 0 {
+			return nil, errors.Errorf("no symmetric key for alg %s", method.Alg())
+		}
+		return k.secret, nil
+	}
+	if k.public == nil {
+		return nil, errors.Errorf("no public key for alg %s", method.Alg())
+	}
+	return k.public, nil
+}
+
+// collectionAlgs computes the allowed algorithms of a collection. the list is empty if a restriction leaves no
+// algorithm, parseToken rejects all tokens then
+func (ctrl *mainController) collectionAlgs(collection string) []string {
+	cc, ok := ctrl.collectionJWT[collection]
+	if !ok || len(cc.Algs) == 0 {
+		return ctrl.jwtAlgs
+	}
+	if strings.ToLower(cc.Mode) == "extend" {
+		algs := slices.Clone(ctrl.jwtAlgs)
+		for _, alg := range cc.Algs {
+			if !slices.Contains(algs, alg) {
+				algs = append(algs, alg)
+			}
+		}
+		return algs
+	}
+	var algs []string
+	for _, alg := range cc.Algs {
+		if slices.Contains(ctrl.jwtAlgs, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// collectionKey returns the verification keys of a collection
+func (ctrl *mainController) collectionKey(collection, jwtkey string) (*jwtKey, error) {
+	var publicKey string
+	if cc, ok := ctrl.collectionJWT[collection]; ok {
+		publicKey = string(cc.PublicKey)
+	}
+	if jwtkey == "" && publicKey == "" {
+		return nil, errors.New("no jwt key in collection configured. please ask administrator")
+	}
+	key, err := newJWTKey(jwtkey, publicKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid jwt key for collection %s", collection)
+	}
+	return key, nil
+}
+
+// tokenPolicy returns the maximum token lifetime and the clock skew of a collection
+func (ctrl *mainController) tokenPolicy(collection string) (maxTTL, clockSkew time.Duration) {
+	if cc, ok := ctrl.collectionJWT[collection]; ok {
+		return time.Duration(cc.MaxTTL), time.Duration(cc.ClockSkew)
+	}
+	return 0, 0
+}
+
+// checkTokenLifetime rejects tokens valid for longer than maxTTL
+func checkTokenLifetime(token *jwt.Token, maxTTL, clockSkew time.Duration) error {
+	if maxTTL <= 0 {
+		return nil
+	}
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return errors.Errorf("token without expiration not allowed, max lifetime %v", maxTTL)
+	}
+	issued := time.Now()
+	if iat, err := token.Claims.GetIssuedAt(); err == nil && iat != nil {
+		issued = iat.Time
+	}
+	if lifetime := exp.Sub(issued); lifetime > maxTTL+clockSkew {
+		return errors.Errorf("token lifetime %v exceeds maximum of %v", lifetime.Round(time.Second), maxTTL)
+	}
+	return nil
+}
+
+// minimum hmac key sizes in bytes (rfc 7518 section 3.2)
+var hmacMinKeySize = map[string]int{
+	"HS256": 32,
+	"HS384": 48,
+	"HS512": 64,
+}
+
+// WithWeakJWTKeys accepts hmac keys shorter than the hash size. only for legacy installations
+func WithWeakJWTKeys(allow bool) Option {
+	return func(ctrl *mainController) error {
+		ctrl.jwtAllowWeakKeys = allow
+		return nil
+	}
+}
+
+// validateAlgs checks that all algorithms are known and none of them is "none"
+func validateAlgs(algs []string) error {
+	for _, alg := range algs {
+		if strings.EqualFold(alg, "none") {
+			return errors.New("jwt alg 'none' is not allowed")
+		}
+		if jwt.GetSigningMethod(alg) == nil {
+			return errors.Errorf("unknown jwt alg '%s'", alg)
+		}
+	}
+	return nil
+}
+
+// parseToken verifies the signature of a jwt token with one of the allowed algorithms
+func (ctrl *mainController) parseToken(token string, algs []string, key *jwtKey, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	// the parser does not check the algorithm without list
+	if len(algs) == 0 {
+		return nil, errors.New("no jwt algorithm allowed")
+	}
+	jwtToken, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+		k, err := key.verificationKey(token.Method)
+		if err != nil {
+			return nil, err
+		}
+		if secret, ok := k.([]byte); ok && len(secret) < hmacMinKeySize[token.Method.Alg()] {
+			if !ctrl.jwtAllowWeakKeys {
+				return nil, errors.Errorf("key too short for alg %s: %d bytes, need %d", token.Method.Alg(), len(secret), hmacMinKeySize[token.Method.Alg()])
+			}
+			ctrl.logger.Warn().Msgf("weak key used for alg %s", token.Method.Alg())
+		}
+		return k, nil
+	}, append([]jwt.ParserOption{jwt.WithValidMethods(algs)}, opts...)...)
+	if err != nil {
+		alg := "unknown"
+		if unverified, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{}); err == nil {
+			alg = unverified.Method.Alg()
+		}
+		ctrl.logger.Warn().Err(err).Msgf("jwt token rejected: alg %s, allowed %v", alg, algs)
+		return nil, errors.Wrapf(err, "cannot parse jwt token '%s'", token)
+	}
+	if !jwtToken.Valid {
+		return nil, errors.Errorf("invalid jwt token '%s'", token)
+	}
+	return jwtToken, nil
+}
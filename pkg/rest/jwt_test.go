@@ -0,0 +1,86 @@
+package rest
+
+import (
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+func testJWTController(t *testing.T, collectionJWT map[string]*CollectionJWTConfig) *mainController {
+	t.Helper()
+	logger := zerolog.Nop()
+	ctrl := &mainController{jwtAlgs: []string{"HS256", "HS384"}, logger: &logger}
+	ctrl.collectionJWT = collectionJWT
+	return ctrl
+}
+
+func testJWTToken(t *testing.T, alg string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.GetSigningMethod(alg), jwt.RegisteredClaims{
+		Subject:   "test/item/item",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatalf("cannot sign token: %v", err)
+	}
+	return token
+}
+
+func TestCollectionAlgs(t *testing.T) {
+	ctrl := testJWTController(t, map[string]*CollectionJWTConfig{
+		"restricted": {Algs: []string{"HS384", "RS256"}},
+		"extended":   {Algs: []string{"RS256"}, Mode: "extend"},
+		"disjoint":   {Algs: []string{"RS256"}},
+	})
+	for collection, want := range map[string][]string{
+		"other":      {"HS256", "HS384"},
+		"restricted": {"HS384"},
+		"extended":   {"HS256", "HS384", "RS256"},
+		"disjoint":   nil,
+	} {
+		got := ctrl.collectionAlgs(collection)
+		if len(got) != len(want) {
+			t.Errorf("collectionAlgs(%s) = %v, want %v", collection, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("collectionAlgs(%s) = %v, want %v", collection, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseTokenEmptyAlgs(t *testing.T) {
+	ctrl := testJWTController(t, map[string]*CollectionJWTConfig{
+		"disjoint": {Algs: []string{"RS256"}},
+	})
+	key := &jwtKey{secret: []byte(testJWTSecret)}
+	token := testJWTToken(t, "HS256")
+	if _, err := ctrl.parseToken(token, ctrl.collectionAlgs("default"), key); err != nil {
+		t.Fatalf("token with allowed alg rejected: %v", err)
+	}
+	if _, err := ctrl.parseToken(token, ctrl.collectionAlgs("disjoint"), key); err == nil {
+		t.Error("token accepted although no alg is allowed for the collection")
+	}
+	if _, err := ctrl.parseToken(token, nil, key); err == nil {
+		t.Error("token accepted without alg list")
+	}
+	if _, err := ctrl.parseToken(testJWTToken(t, "HS512"), ctrl.jwtAlgs, key); err == nil {
+		t.Error("token with alg not in the list accepted")
+	}
+}
+
+func TestWithCollectionJWTDisjointAlgs(t *testing.T) {
+	ctrl := testJWTController(t, nil)
+	if err := WithCollectionJWT(map[string]*CollectionJWTConfig{"disjoint": {Algs: []string{"RS256"}}})(ctrl); err == nil {
+		t.Error("restriction without common alg accepted")
+	}
+	if err := WithCollectionJWT(map[string]*CollectionJWTConfig{"extended": {Algs: []string{"RS256"}, Mode: "extend"}})(ctrl); err != nil {
+		t.Errorf("extension rejected: %v", err)
+	}
+}
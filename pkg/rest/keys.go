@@ -0,0 +1,75 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// actionSignature identifies the params of an action of a media type. as map key it needs no string per lookup
+type actionSignature struct {
+	mediaType, action string
+}
+
+func (as actionSignature) String() string {
+	return as.mediaType + "::" + as.action
+}
+
+// keyBuffers hold the bytes of keys built per request. only the resulting string is allocated
+var keyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+func getKeyBuffer() *[]byte {
+	bp := keyBuffers.Get().(*[]byte)
+	*bp = (*bp)[:0]
+	return bp
+}
+
+func putKeyBuffer(bp *[]byte, b []byte) {
+	// large keys are rare, their buffers are not kept
+	if cap(b) > 4096 {
+		return
+	}
+	*bp = b
+	keyBuffers.Put(bp)
+}
+
+// appendPath appends the non-empty segments of p, separated by slashes
+func appendPath(dst []byte, p string) []byte {
+	for p != "" {
+		var seg string
+		seg, p, _ = strings.Cut(p, "/")
+		if seg == "" {
+			continue
+		}
+		if len(dst) > 0 {
+			dst = append(dst, '/')
+		}
+		dst = append(dst, seg...)
+	}
+	return dst
+}
+
+// cleanPath reports whether p has no empty segments
+func cleanPath(p string) bool {
+	return p == "" || (p[0] != '/' && p[len(p)-1] != '/' && !strings.Contains(p, "//"))
+}
+
+// hashKey returns the hex encoded sha256 of the parts
+func hashKey(parts ...string) string {
+	bp := getKeyBuffer()
+	b := *bp
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	h := sha256.Sum256(b)
+	putKeyBuffer(bp, b)
+	var out [sha256.Size * 2]byte
+	hex.Encode(out[:], h[:])
+	return string(out[:])
+}
@@ -0,0 +1,88 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestAppendPath(t *testing.T) {
+	for p, expected := range map[string]string{
+		"":                  "",
+		"item":              "item",
+		"/resize//size32/":  "resize/size32",
+		"//a/b///c//":       "a/b/c",
+		"size32x24/formatx": "size32x24/formatx",
+	} {
+		if got := string(appendPath(nil, p)); got != expected {
+			t.Errorf("appendPath(%q) = %q, expected %q", p, got, expected)
+		}
+	}
+	if got := string(appendPath([]byte("test"), "/image/")); got != "test/image" {
+		t.Errorf("appendPath to prefix = %q, expected %q", got, "test/image")
+	}
+}
+
+func TestAppendPathAllocs(t *testing.T) {
+	buf := make([]byte, 0, 256)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = appendPath(buf[:0], "/iiif//test/image/0,0,32,32/32,/0/default.jpg")
+	})
+	if allocs != 0 {
+		t.Errorf("appendPath allocates %v times, expected 0", allocs)
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	sum := sha256.Sum256([]byte("GET /test/image/item"))
+	if got, expected := hashKey("GET", " ", "/test/image/item"), hex.EncodeToString(sum[:]); got != expected {
+		t.Errorf("hashKey = %s, expected %s", got, expected)
+	}
+}
+
+func TestHashKeyAllocs(t *testing.T) {
+	// only the resulting string is allocated, the buffer comes from the pool
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = hashKey("GET", " ", "/test/image/resize/size32x24/formatpng")
+	})
+	if allocs > 1 {
+		t.Errorf("hashKey allocates %v times, expected 1", allocs)
+	}
+}
+
+func TestActionSignatureAllocs(t *testing.T) {
+	params := map[actionSignature][]string{{mediaType: "image", action: "resize"}: {"size", "format"}}
+	mediaType, action := "image", "resize"
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, ok := params[actionSignature{mediaType: mediaType, action: action}]; !ok {
+			t.Fatal("action signature not found")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("action signature lookup allocates %v times, expected 0", allocs)
+	}
+}
+
+func BenchmarkAppendPath(b *testing.B) {
+	buf := make([]byte, 0, 256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = appendPath(buf[:0], "/iiif//test/image/0,0,32,32/32,/0/default.jpg")
+	}
+}
+
+func BenchmarkHashKey(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = hashKey("GET", " ", "/test/image/resize/size32x24/formatpng")
+	}
+}
+
+func BenchmarkActionSignature(b *testing.B) {
+	params := map[actionSignature][]string{{mediaType: "image", action: "resize"}: {"size", "format"}}
+	mediaType, action := "image", "resize"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = params[actionSignature{mediaType: mediaType, action: action}]
+	}
+}
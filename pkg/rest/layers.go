@@ -0,0 +1,309 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+type LayersConfig struct {
+	// Field of the item metadata listing the registered images of the item, default "layers", e.g.
+	// "layers": [{"signature": "ms12_v_uv365", "label": "UV 365nm"}]. layers belong to the collection of the item
+	Field string `toml:"field"`
+	// ViewerAction is the "action/params" of the layer images in the viewer, default "resize/size2048x2048/formatjpeg"
+	ViewerAction string `toml:"vieweraction"`
+}
+
+// WithLayers configures the images registered to an item, e.g. multispectral captures or watermark images,
+// at /:collection/:signature/layers (iiif canvas with choice) and /:collection/:signature/layers/viewer
+func WithLayers(conf *LayersConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		if conf.Field != "" {
+			ctrl.layersField = conf.Field
+		}
+		if action := strings.Trim(conf.ViewerAction, "/"); action != "" {
+			ctrl.layersViewerAction = action
+		}
+		return nil
+	}
+}
+
+type itemLayer struct {
+	Signature string `json:"signature"`
+	Label     string `json:"label"`
+}
+
+// layer is a registered image of an item with its master dimensions
+type layer struct {
+	itemLayer
+	item          *mediaserverproto.Item
+	width, height int64
+}
+
+// iiifLabel is a language map, layers are labeled without language
+type iiifLabel map[string][]string
+
+type iiifService struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Profile string `json:"profile"`
+}
+
+type iiifResource struct {
+	ID     string `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Format string `json:"format,omitempty"`
+	Width  int64  `json:"width,omitempty"`
+	Height int64  `json:"height,omitempty"`
+	// Duration of audio and video in seconds
+	Duration float64        `json:"duration,omitempty"`
+	Label    iiifLabel      `json:"label,omitempty"`
+	Service  []iiifService  `json:"service,omitempty"`
+	Items    []iiifResource `json:"items,omitempty"`
+}
+
+type iiifAnnotation struct {
+	ID         string       `json:"id"`
+	Type       string       `json:"type"`
+	Motivation string       `json:"motivation"`
+	Target     string       `json:"target"`
+	Body       iiifResource `json:"body"`
+}
+
+type iiifAnnotationPage struct {
+	ID    string           `json:"id"`
+	Type  string           `json:"type"`
+	Items []iiifAnnotation `json:"items,omitempty"`
+}
+
+// iiifCanvas is a canvas of the iiif presentation api 3
+type iiifCanvas struct {
+	Context  string               `json:"@context,omitempty"`
+	ID       string               `json:"id"`
+	Type     string               `json:"type"`
+	Label    iiifLabel            `json:"label,omitempty"`
+	Width    int64                `json:"width,omitempty"`
+	Height   int64                `json:"height,omitempty"`
+	Duration float64              `json:"duration,omitempty"`
+	Rights   string               `json:"rights,omitempty"`
+	Items    []iiifAnnotationPage `json:"items"`
+	// Annotations references the pages of non painting annotations
+	Annotations []iiifAnnotationPage `json:"annotations,omitempty"`
+}
+
+// itemLayers returns the images registered in the metadata of an item. the item itself is the first layer unless
+// it is listed. layers without access for the token are left out
+func (ctrl *mainController) itemLayers(item *mediaserverproto.Item, token string) ([]*layer, error) {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	var registered []itemLayer
+	if metadata, err := ctrl.getItemMetadata(collection, signature); err == nil {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(metadata), &fields); err == nil {
+			if raw, ok := fields[ctrl.layersField]; ok {
+				if err := json.Unmarshal(raw, &registered); err != nil {
+					return nil, errors.Wrapf(err, "invalid %s in metadata of %s/%s", ctrl.layersField, collection, signature)
+				}
+			}
+		}
+	}
+	listed := false
+	for _, l := range registered {
+		if l.Signature == signature {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		registered = append([]itemLayer{{Signature: signature, Label: signature}}, registered...)
+	}
+	var result []*layer
+	for _, l := range registered {
+		if l.Label == "" {
+			l.Label = l.Signature
+		}
+		layerItem := item
+		if l.Signature != signature {
+			var err error
+			if layerItem, err = ctrl.getItem(collection, l.Signature); err != nil {
+				ctrl.logger.Warn().Err(err).Msgf("layer %s of %s/%s not found", l.Signature, collection, signature)
+				continue
+			}
+			// the images are requested with the full checks, seats and view quotas are not counted for the list
+			if !ctrl.exhibited(collection, l.Signature, "iiif") {
+				if err := ctrl.access.CheckAccess(collection, l.Signature, "iiif", "", token); err != nil {
+					continue
+				}
+			}
+		}
+		ly := &layer{itemLayer: l, item: layerItem}
+		if cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
+			Identifier: layerItem.GetIdentifier(),
+			Action:     "item",
+		}); err == nil {
+			ly.width, ly.height = cache.GetMetadata().GetWidth(), cache.GetMetadata().GetHeight()
+		}
+		result = append(result, ly)
+	}
+	return result, nil
+}
+
+// layerImage returns the painting body of a layer, an image service if the iiif server is configured
+func (ctrl *mainController) layerImage(ly *layer) iiifResource {
+	collection := ly.item.GetIdentifier().GetCollection()
+	signature := ly.item.GetIdentifier().GetSignature()
+	resource := iiifResource{
+		Type:   "Image",
+		Width:  ly.width,
+		Height: ly.height,
+		Label:  iiifLabel{"none": {ly.Label}},
+	}
+	if ctrl.iiifBaseAction == "" {
+		resource.ID = ctrl.externalURL(append([]string{collection, signature}, strings.Split(ctrl.layersViewerAction, "/")...)...)
+		return resource
+	}
+	service := ctrl.externalURL("iiif", "3", collection, signature)
+	resource.ID = service + "/full/max/0/default.jpg"
+	resource.Format = "image/jpeg"
+	resource.Service = []iiifService{{ID: service, Type: "ImageService3", Profile: "level2"}}
+	return resource
+}
+
+// layerCanvas builds the canvas of an item. several layers are painted as choice
+func (ctrl *mainController) layerCanvas(id string, layers []*layer) *iiifCanvas {
+	canvas := &iiifCanvas{ID: id, Type: "Canvas"}
+	var body iiifResource
+	if len(layers) == 1 {
+		body = ctrl.layerImage(layers[0])
+	} else {
+		body = iiifResource{Type: "Choice"}
+		for _, ly := range layers {
+			body.Items = append(body.Items, ctrl.layerImage(ly))
+		}
+	}
+	if len(layers) > 0 {
+		canvas.Width, canvas.Height = layers[0].width, layers[0].height
+	}
+	canvas.Items = []iiifAnnotationPage{{
+		ID:   id + "/page",
+		Type: "AnnotationPage",
+		Items: []iiifAnnotation{{
+			ID:         id + "/annotation",
+			Type:       "Annotation",
+			Motivation: "painting",
+			Target:     id,
+			Body:       body,
+		}},
+	}}
+	return canvas
+}
+
+var layersViewerTemplate = template.Must(template.New("layers").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Collection}}/{{.Signature}}</title>
+<link rel="alternate" type="application/ld+json" href="{{.CanvasURL}}">
+<style>
+html, body { margin: 0; height: 100%; background: #000; color: #fff; font-family: sans-serif; }
+#layers { position: absolute; top: 0.5em; left: 0.5em; z-index: 1; }
+#media { width: 100%; height: 100%; object-fit: contain; }
+</style>
+</head>
+<body>
+<label id="layers">{{.Labels.Layer}}
+<select id="layer">{{range .Layers}}
+<option value="{{.URL}}">{{.Label}}</option>{{end}}
+</select>
+</label>
+{{with index .Layers 0}}<img id="media" src="{{.URL}}" alt="{{.Label}}">{{end}}
+<script>
+(function () {
+	var select = document.getElementById("layer");
+	var media = document.getElementById("media");
+	select.addEventListener("change", function () {
+		media.src = select.value;
+		media.alt = select.options[select.selectedIndex].text;
+	});
+})();
+</script>
+</body>
+</html>
+`))
+
+type layerLink struct {
+	Label string
+	URL   string
+}
+
+// layers answers /:collection/:signature/layers with the iiif canvas of the item and /layers/viewer with a page
+// switching between its layers
+func (ctrl *mainController) layers(c *gin.Context, item *mediaserverproto.Item, collection, signature, paramStr, token string) {
+	layers, err := ctrl.itemLayers(item, token)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get layers of %s/%s", collection, signature)
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "item_error", collection+"/"+signature)
+		return
+	}
+	canvasURL := ctrl.canvasURL(collection, signature)
+	switch strings.Trim(paramStr, "/") {
+	case "":
+		canvas := ctrl.layerCanvas(canvasURL, layers)
+		canvas.Context = "http://iiif.io/api/presentation/3/context.json"
+		canvas.Label = iiifLabel{"none": {collection + "/" + signature}}
+		canvas.Rights = ctrl.itemRights(collection, signature)
+		if ctrl.annotations != nil {
+			canvas.Annotations = []iiifAnnotationPage{{ID: ctrl.annotationPageURL(collection, signature), Type: "AnnotationPage"}}
+		}
+		data, err := json.Marshal(canvas)
+		if err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot marshal canvas of %s/%s", collection, signature)
+			ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "internal_error")
+			return
+		}
+		if notModified(c, itemLastModified(item), contentETag(data)) {
+			return
+		}
+		c.Data(http.StatusOK, `application/ld+json;profile="http://iiif.io/api/presentation/3/context.json"`, data)
+	case "viewer":
+		var links []layerLink
+		for _, ly := range layers {
+			u := ctrl.externalURL(append([]string{collection, ly.Signature}, strings.Split(ctrl.layersViewerAction, "/")...)...)
+			if token != "" {
+				u += "?token=" + token
+			}
+			links = append(links, layerLink{Label: ly.Label, URL: u})
+		}
+		tag, _ := ctrl.requestLanguage(c, collection)
+		buf := &bytes.Buffer{}
+		if err := layersViewerTemplate.Execute(buf, map[string]any{
+			"Lang":       tag.String(),
+			"Collection": collection,
+			"Signature":  signature,
+			"CanvasURL":  canvasURL,
+			"Layers":     links,
+			"Labels": map[string]string{
+				"Layer": ctrl.translate(c, collection, "layers_layer"),
+			},
+		}); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot execute template %s", layersViewerTemplate.Name())
+			ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "internal_error")
+			return
+		}
+		c.Header("Vary", "Accept-Language")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	default:
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Errorf("unknown layers view '%s'", paramStr), "invalid_request", fmt.Sprintf("layers%s", paramStr))
+	}
+}
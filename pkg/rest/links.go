@@ -0,0 +1,24 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+type link struct {
+	rel  string
+	href string
+}
+
+// setLinkHeader emits an rfc 8288 Link header
+func setLinkHeader(c *gin.Context, links ...link) {
+	if len(links) == 0 {
+		return
+	}
+	parts := make([]string, 0, len(links))
+	for _, l := range links {
+		parts = append(parts, fmt.Sprintf(`<%s>; rel="%s"`, l.href, l.rel))
+	}
+	c.Header("Link", strings.Join(parts, ", "))
+}
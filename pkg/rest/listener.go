@@ -0,0 +1,54 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// WithListenAddrs replaces the single listen address by a list of addresses.
+// addresses may be prefixed with the network: "unix:/run/mediaserver.sock", "tcp4:0.0.0.0:8443", "tcp6:[::]:8443".
+// addresses without prefix are tcp addresses
+func WithListenAddrs(addrs ...string) Option {
+	return func(ctrl *mainController) error {
+		if len(addrs) > 0 {
+			ctrl.addrs = addrs
+		}
+		return nil
+	}
+}
+
+func splitListenAddr(addr string) (network, address string) {
+	for _, n := range []string{"unix", "tcp4", "tcp6", "tcp"} {
+		if strings.HasPrefix(addr, n+":") {
+			return n, strings.TrimPrefix(addr, n+":")
+		}
+	}
+	return "tcp", addr
+}
+
+func listen(addr string) (net.Listener, error) {
+	network, address := splitListenAddr(addr)
+	if network == "unix" {
+		// remove stale socket of a previous run
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "cannot remove socket %s", address)
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen on %s:%s", network, address)
+	}
+	return l, nil
+}
+
+// remoteHost returns the host part of the remote address. unix socket connections have no host
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,107 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"path"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LoadShedConfig struct {
+	Enabled bool `toml:"enabled"`
+	// MaxGoroutines, MaxHeapBytes and MaxGenerations are the pressure thresholds. 0 disables a threshold
+	MaxGoroutines  int    `toml:"maxgoroutines"`
+	MaxHeapBytes   uint64 `toml:"maxheapbytes"`
+	MaxGenerations int64  `toml:"maxgenerations"`
+	// RetryAfter is the Retry-After value of shed requests in seconds
+	RetryAfter int `toml:"retryafter"`
+}
+
+// WithLoadShedding rejects low priority requests with 503 while the system is overloaded
+func WithLoadShedding(conf *LoadShedConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		ctrl.loadShed = &loadShedder{conf: conf, generations: &ctrl.generations}
+		return nil
+	}
+}
+
+type loadShedder struct {
+	conf        *LoadShedConfig
+	generations *atomic.Int64
+	mutex       sync.Mutex
+	lastSample  time.Time
+	overloaded  bool
+	reason      string
+}
+
+var heapMetric = []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+
+// pressure samples the system state at most twice a second
+func (ls *loadShedder) pressure() (bool, string) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	if time.Since(ls.lastSample) < 500*time.Millisecond {
+		return ls.overloaded, ls.reason
+	}
+	ls.lastSample = time.Now()
+	ls.overloaded, ls.reason = false, ""
+	if ls.conf.MaxGoroutines > 0 && runtime.NumGoroutine() > ls.conf.MaxGoroutines {
+		ls.overloaded, ls.reason = true, "goroutines"
+		return ls.overloaded, ls.reason
+	}
+	if ls.conf.MaxHeapBytes > 0 {
+		samples := make([]metrics.Sample, len(heapMetric))
+		copy(samples, heapMetric)
+		metrics.Read(samples)
+		if samples[0].Value.Kind() == metrics.KindUint64 && samples[0].Value.Uint64() > ls.conf.MaxHeapBytes {
+			ls.overloaded, ls.reason = true, "memory"
+			return ls.overloaded, ls.reason
+		}
+	}
+	if ls.conf.MaxGenerations > 0 && ls.generations.Load() > ls.conf.MaxGenerations {
+		ls.overloaded, ls.reason = true, "generations"
+	}
+	return ls.overloaded, ls.reason
+}
+
+// lowPriority identifies requests which may be shed by their route: explicit prewarm requests and downloads of
+// masters, ranges included. the admin api is never shed
+func (ctrl *mainController) lowPriority(c *gin.Context) bool {
+	route := c.FullPath()
+	if admin := path.Join(ctrl.subpath, "admin"); route == admin || strings.HasPrefix(route, admin+"/") {
+		return false
+	}
+	if strings.EqualFold(c.GetHeader("X-Priority"), "low") || c.Query("prewarm") != "" {
+		return true
+	}
+	if !strings.HasSuffix(route, "/:action") && !strings.HasSuffix(route, "/:action/*params") {
+		return false
+	}
+	action := c.Param("action")
+	return action == "item" || action == "master"
+}
+
+func (ctrl *mainController) loadShedMiddleware(c *gin.Context) {
+	if !ctrl.lowPriority(c) {
+		c.Next()
+		return
+	}
+	if overloaded, reason := ctrl.loadShed.pressure(); overloaded {
+		ctrl.logger.Warn().Msgf("shedding %s: overloaded (%s)", c.Request.URL.Path, reason)
+		if ctrl.loadShed.conf.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(ctrl.loadShed.conf.RetryAfter))
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server overloaded, please retry later"})
+		return
+	}
+	c.Next()
+}
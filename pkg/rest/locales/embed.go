@@ -0,0 +1,6 @@
+package locales
+
+import "embed"
+
+//go:embed *.json mail/*.txt
+var FS embed.FS
@@ -0,0 +1,387 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/rest/locales"
+	"github.com/je4/utils/v2/pkg/config"
+	"golang.org/x/text/language"
+	"io/fs"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Mailer sends notifications, e.g. signed links or alerts
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// WithMailer sets a custom mailer for notifications
+func WithMailer(mailer Mailer) Option {
+	return func(ctrl *mainController) error {
+		if mailer == nil {
+			return errors.New("no mailer")
+		}
+		ctrl.mailer = mailer
+		return nil
+	}
+}
+
+type MailerConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Type is "smtp" (default) or "api"
+	Type string `toml:"type"`
+	// Host and Port of the smtp server, default port 587 with starttls
+	Host string `toml:"host"`
+	Port int    `toml:"port"`
+	// TLS connects with implicit tls, usually port 465
+	TLS      bool             `toml:"tls"`
+	Username string           `toml:"username"`
+	Password config.EnvString `toml:"password"`
+	// URL of the mail api, which gets a json post with from, to, subject and text
+	URL string `toml:"url"`
+	// Token is sent as bearer token to the mail api
+	Token config.EnvString `toml:"token"`
+	From  string           `toml:"from"`
+	// Templates is a vfs folder with <name>.<lang>.txt files replacing the built-in messages
+	Templates string `toml:"templates"`
+	// Admins receive alerts, e.g. exhausted storage quotas or failed storages
+	Admins []string `toml:"admins"`
+	// AdminLang is the language of alerts, default en
+	AdminLang string          `toml:"adminlang"`
+	Timeout   config.Duration `toml:"timeout"`
+}
+
+// WithMailerConfig sends notifications with smtp or a mail api
+func WithMailerConfig(conf *MailerConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		from, err := mail.ParseAddress(conf.From)
+		if err != nil {
+			return errors.Wrapf(err, "invalid sender '%s'", conf.From)
+		}
+		for _, admin := range conf.Admins {
+			if _, err := mail.ParseAddress(admin); err != nil {
+				return errors.Wrapf(err, "invalid admin address '%s'", admin)
+			}
+		}
+		timeout := time.Duration(conf.Timeout)
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		switch conf.Type {
+		case "", "smtp":
+			if conf.Host == "" {
+				return errors.New("no smtp host")
+			}
+			port := conf.Port
+			if port == 0 {
+				port = 587
+			}
+			m := &smtpMailer{
+				addr:        net.JoinHostPort(conf.Host, strconv.Itoa(port)),
+				host:        conf.Host,
+				from:        from,
+				implicitTLS: conf.TLS,
+				timeout:     timeout,
+			}
+			if conf.Username != "" {
+				m.auth = smtp.PlainAuth("", conf.Username, string(conf.Password), conf.Host)
+			}
+			ctrl.mailer = m
+		case "api":
+			if conf.URL == "" {
+				return errors.New("no mail api url")
+			}
+			ctrl.mailer = &apiMailer{
+				url:    conf.URL,
+				token:  string(conf.Token),
+				from:   from.String(),
+				client: &http.Client{Timeout: timeout},
+			}
+		default:
+			return errors.Errorf("unknown mailer type '%s'", conf.Type)
+		}
+		if conf.Templates != "" {
+			if ctrl.mailTemplates, err = loadMailTemplates(ctrl.vfs, conf.Templates); err != nil {
+				return errors.Wrapf(err, "cannot load mail templates from %s", conf.Templates)
+			}
+		}
+		ctrl.mailConfig = conf
+		return nil
+	}
+}
+
+// mailTemplates maps "<name>.<lang>" to the template
+type mailTemplates map[string]*template.Template
+
+var mailFuncs = template.FuncMap{
+	"bytes": formatBytes,
+}
+
+// formatBytes returns a size with binary unit, e.g. "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// loadMailTemplates parses the <name>.<lang>.txt files of a folder. the first line is the subject, e.g. "Subject: Access to {{.Collection}}"
+func loadMailTemplates(fsys fs.FS, dir string) (mailTemplates, error) {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	templates := mailTemplates{}
+	for _, name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read %s", name)
+		}
+		key := strings.TrimSuffix(path.Base(name), ".txt")
+		tpl, err := template.New(key).Option("missingkey=zero").Funcs(mailFuncs).Parse(string(data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse %s", name)
+		}
+		templates[key] = tpl
+	}
+	return templates, nil
+}
+
+var builtinMailTemplates = func() mailTemplates {
+	templates, err := loadMailTemplates(locales.FS, "mail")
+	if err != nil {
+		panic(fmt.Sprintf("cannot load mail templates: %v", err))
+	}
+	return templates
+}()
+
+// mailTemplate returns the template in the best catalog language. templates of the configured folder come first
+func (ctrl *mainController) mailTemplate(name, lang string) (*template.Template, error) {
+	_, idx, _ := messages.matcher.Match(language.Make(lang))
+	for _, key := range []string{name + "." + messages.tags[idx].String(), name + ".en"} {
+		if tpl, ok := ctrl.mailTemplates[key]; ok {
+			return tpl, nil
+		}
+		if tpl, ok := builtinMailTemplates[key]; ok {
+			return tpl, nil
+		}
+	}
+	return nil, errors.Errorf("no mail template %s", name)
+}
+
+// renderTemplate returns subject and body of a templated message
+func (ctrl *mainController) renderTemplate(lang, name string, data any) (string, string, error) {
+	tpl, err := ctrl.mailTemplate(name, lang)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", "", errors.Wrapf(err, "cannot execute mail template %s", name)
+	}
+	first, body, _ := strings.Cut(buf.String(), "\n")
+	subject, ok := strings.CutPrefix(first, "Subject:")
+	if !ok {
+		return "", "", errors.Errorf("mail template %s does not start with a subject", name)
+	}
+	return strings.TrimSpace(subject), strings.TrimLeft(body, "\r\n"), nil
+}
+
+// sendTemplate sends a templated message. without mailer the message is only logged and false is returned
+func (ctrl *mainController) sendTemplate(ctx context.Context, to, lang, name string, data any) (bool, error) {
+	subject, body, err := ctrl.renderTemplate(lang, name, data)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	if ctrl.mailer == nil {
+		ctrl.logger.Warn().Msgf("no mailer configured, message '%s' to %s not sent", subject, to)
+		return false, nil
+	}
+	if err := ctrl.mailer.Send(ctx, to, subject, body); err != nil {
+		return false, errors.Wrapf(err, "cannot send '%s' to %s", subject, to)
+	}
+	ctrl.logger.Info().Str("audit", "mail").Str("template", name).Str("to", to).Msgf("sent '%s'", subject)
+	return true, nil
+}
+
+// alert sends a templated alert_<kind> message to the admins
+func (ctrl *mainController) alert(kind string, data any) {
+	if ctrl.mailConfig == nil || len(ctrl.mailConfig.Admins) == 0 {
+		return
+	}
+	timeout := time.Duration(ctrl.mailConfig.Timeout)
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	for _, admin := range ctrl.mailConfig.Admins {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if _, err := ctrl.sendTemplate(ctx, admin, ctrl.mailConfig.AdminLang, "alert_"+kind, data); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot send %s alert to %s", kind, admin)
+		}
+		cancel()
+	}
+}
+
+// storageAlert notifies the admins about failed and recovered storages
+func (ctrl *mainController) storageAlert(name string, healthy bool, err error) {
+	data := map[string]any{"Name": name, "Healthy": healthy, "Error": ""}
+	if err != nil {
+		data["Error"] = err.Error()
+	}
+	go ctrl.alert("storage", data)
+}
+
+// composeMail creates a plain text utf-8 message
+func composeMail(from *mail.Address, to, subject, body string) ([]byte, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_, domain, _ := strings.Cut(from.Address, "@")
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+type smtpMailer struct {
+	addr        string
+	host        string
+	from        *mail.Address
+	auth        smtp.Auth
+	implicitTLS bool
+	timeout     time.Duration
+}
+
+// Send delivers the message with starttls, if offered by the server. plain auth is refused without tls
+func (m *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return errors.Wrapf(err, "invalid recipient '%s'", to)
+	}
+	msg, err := composeMail(m.from, rcpt.String(), subject, body)
+	if err != nil {
+		return errors.Wrap(err, "cannot compose mail")
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	if m.implicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: m.host}}).DialContext(ctx, "tcp", m.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", m.addr)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "cannot connect to %s", m.addr)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "cannot start smtp session with %s", m.addr)
+	}
+	defer client.Close()
+	if !m.implicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+				return errors.Wrapf(err, "cannot start tls with %s", m.addr)
+			}
+		}
+	}
+	if m.auth != nil {
+		if err := client.Auth(m.auth); err != nil {
+			return errors.Wrapf(err, "cannot authenticate at %s", m.addr)
+		}
+	}
+	if err := client.Mail(m.from.Address); err != nil {
+		return errors.Wrapf(err, "sender %s refused", m.from.Address)
+	}
+	if err := client.Rcpt(rcpt.Address); err != nil {
+		return errors.Wrapf(err, "recipient %s refused", rcpt.Address)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "cannot start data")
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return errors.Wrap(err, "cannot write message")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "message refused")
+	}
+	return errors.WithStack(client.Quit())
+}
+
+type apiMailer struct {
+	url    string
+	token  string
+	from   string
+	client *http.Client
+}
+
+// Send posts the message as json {"from", "to", "subject", "text"}
+func (m *apiMailer) Send(ctx context.Context, to, subject, body string) error {
+	data, err := json.Marshal(map[string]string{"from": m.from, "to": to, "subject": subject, "text": body})
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal mail")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "cannot create request for %s", m.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.token)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "cannot post mail to %s", m.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("mail api %s returned %s", m.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"time"
+)
+
+type ManifestConfig struct {
+	// LabelField of the item metadata with the label of the manifest and its canvases, default "title"
+	LabelField string `toml:"labelfield"`
+	// SummaryField of the item metadata with the summary of the manifest, default "description"
+	SummaryField string `toml:"summaryfield"`
+	// AttributionField of the item metadata shown as required statement, default "attribution"
+	AttributionField string `toml:"attributionfield"`
+	// Fields of the item metadata listed as metadata of the manifest, e.g. ["creator", "date"]
+	Fields []string `toml:"fields"`
+}
+
+var defaultManifestConfig = ManifestConfig{
+	LabelField:       "title",
+	SummaryField:     "description",
+	AttributionField: "attribution",
+}
+
+// WithManifest configures the metadata fields used in the iiif manifests at /:collection/:signature/manifest.json
+func WithManifest(conf *ManifestConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		if conf.LabelField != "" {
+			ctrl.manifest.LabelField = conf.LabelField
+		}
+		if conf.SummaryField != "" {
+			ctrl.manifest.SummaryField = conf.SummaryField
+		}
+		if conf.AttributionField != "" {
+			ctrl.manifest.AttributionField = conf.AttributionField
+		}
+		if len(conf.Fields) > 0 {
+			ctrl.manifest.Fields = conf.Fields
+		}
+		return nil
+	}
+}
+
+type iiifMetadataEntry struct {
+	Label iiifLabel `json:"label"`
+	Value iiifLabel `json:"value"`
+}
+
+type iiifReference struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// iiifManifest is a manifest of the iiif presentation api 3
+type iiifManifest struct {
+	Context           string              `json:"@context"`
+	ID                string              `json:"id"`
+	Type              string              `json:"type"`
+	Label             iiifLabel           `json:"label"`
+	Summary           iiifLabel           `json:"summary,omitempty"`
+	Metadata          []iiifMetadataEntry `json:"metadata,omitempty"`
+	RequiredStatement *iiifMetadataEntry  `json:"requiredStatement,omitempty"`
+	Rights            string              `json:"rights,omitempty"`
+	Thumbnail         []iiifResource      `json:"thumbnail,omitempty"`
+	SeeAlso           []iiifResource      `json:"seeAlso,omitempty"`
+	Rendering         []iiifResource      `json:"rendering,omitempty"`
+	Start             *iiifReference      `json:"start,omitempty"`
+	Items             []*iiifCanvas       `json:"items"`
+}
+
+// metadataText returns the values of a metadata field as text, a value per list entry
+func metadataText(fields map[string]any, field string) []string {
+	switch v := fields[field].(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case float64, bool:
+		return []string{fmt.Sprint(v)}
+	case []any:
+		var values []string
+		for _, value := range v {
+			switch value.(type) {
+			case string, float64, bool:
+				values = append(values, fmt.Sprint(value))
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// itemFields returns the fields of the item metadata, empty if missing or invalid
+func (ctrl *mainController) itemFields(collection, signature string) map[string]any {
+	var fields map[string]any
+	if metadata, err := ctrl.getItemMetadata(collection, signature); err == nil {
+		if err := json.Unmarshal([]byte(metadata), &fields); err != nil {
+			ctrl.logger.Debug().Err(err).Msgf("invalid metadata of %s/%s", collection, signature)
+		}
+	}
+	return fields
+}
+
+// manifestLabel is the label of an item, its signature without label field
+func (ctrl *mainController) manifestLabel(fields map[string]any, signature string) iiifLabel {
+	if values := metadataText(fields, ctrl.manifest.LabelField); len(values) > 0 {
+		return iiifLabel{"none": values}
+	}
+	return iiifLabel{"none": {signature}}
+}
+
+// manifestPages returns the canvases of a manifest: the child items, the items sharing the parent or the item
+// itself. the bool reports, whether the item is one of several pages and thus the start canvas
+func (ctrl *mainController) manifestPages(item *mediaserverproto.Item) ([]*mediaserverproto.Item, bool, error) {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	children, err := ctrl.getChildItems(collection, signature)
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	if len(children) > 0 {
+		return children, false, nil
+	}
+	if parent := item.GetParent(); parent.GetSignature() != "" {
+		siblings, err := ctrl.getChildItems(parent.GetCollection(), parent.GetSignature())
+		if err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+		if len(siblings) > 1 {
+			return siblings, true, nil
+		}
+	}
+	return []*mediaserverproto.Item{item}, false, nil
+}
+
+// pageAccess checks the access to a page of a manifest like the iiif requests for its images do, seats and view
+// quotas are not counted for the list
+func (ctrl *mainController) pageAccess(page *mediaserverproto.Item, token string) bool {
+	if page.GetDisabled() {
+		return false
+	}
+	collection := page.GetIdentifier().GetCollection()
+	signature := page.GetIdentifier().GetSignature()
+	if ctrl.exhibited(collection, signature, "iiif") {
+		return true
+	}
+	return ctrl.access.CheckAccess(collection, signature, "iiif", "", token) == nil
+}
+
+// avCanvas builds the canvas of an audio or video item painted with its master file
+func (ctrl *mainController) avCanvas(id string, page *mediaserverproto.Item) *iiifCanvas {
+	canvas := &iiifCanvas{ID: id, Type: "Canvas"}
+	body := iiifResource{
+		ID:     ctrl.externalURL(page.GetIdentifier().GetCollection(), page.GetIdentifier().GetSignature(), "item"),
+		Type:   "Sound",
+		Format: page.GetMetadata().GetMimetype(),
+	}
+	if cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
+		Identifier: page.GetIdentifier(),
+		Action:     "item",
+	}); err == nil {
+		body.Duration = float64(cache.GetMetadata().GetDuration())
+		if page.GetMetadata().GetType() == "video" {
+			body.Type = "Video"
+			body.Width, body.Height = cache.GetMetadata().GetWidth(), cache.GetMetadata().GetHeight()
+		}
+	}
+	canvas.Width, canvas.Height, canvas.Duration = body.Width, body.Height, body.Duration
+	canvas.Items = []iiifAnnotationPage{{
+		ID:   id + "/page",
+		Type: "AnnotationPage",
+		Items: []iiifAnnotation{{
+			ID:         id + "/annotation",
+			Type:       "Annotation",
+			Motivation: "painting",
+			Target:     id,
+			Body:       body,
+		}},
+	}}
+	return canvas
+}
+
+// buildManifest creates the manifest of an item. images are painted with their layers, audio and video with the
+// master file, other pages are offered as rendering
+func (ctrl *mainController) buildManifest(item *mediaserverproto.Item, pages []*mediaserverproto.Item, start bool, token string) (*iiifManifest, time.Time, error) {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	fields := ctrl.itemFields(collection, signature)
+	manifest := &iiifManifest{
+		Context: "http://iiif.io/api/presentation/3/context.json",
+		ID:      ctrl.externalURL(collection, signature, "manifest.json"),
+		Type:    "Manifest",
+		Label:   ctrl.manifestLabel(fields, signature),
+		Rights:  ctrl.itemRights(collection, signature),
+		Items:   []*iiifCanvas{},
+		SeeAlso: []iiifResource{{ID: ctrl.externalURL(collection, signature, "metadata"), Type: "Dataset", Format: "application/json"}},
+	}
+	if summary := metadataText(fields, ctrl.manifest.SummaryField); len(summary) > 0 {
+		manifest.Summary = iiifLabel{"none": summary}
+	}
+	for _, field := range ctrl.manifest.Fields {
+		if values := metadataText(fields, field); len(values) > 0 {
+			manifest.Metadata = append(manifest.Metadata, iiifMetadataEntry{Label: iiifLabel{"none": {field}}, Value: iiifLabel{"none": values}})
+		}
+	}
+	if attribution := metadataText(fields, ctrl.manifest.AttributionField); len(attribution) > 0 {
+		manifest.RequiredStatement = &iiifMetadataEntry{Label: iiifLabel{"none": {ctrl.manifest.AttributionField}}, Value: iiifLabel{"none": attribution}}
+	}
+	lastModified := itemLastModified(item)
+	for _, page := range pages {
+		pageCollection := page.GetIdentifier().GetCollection()
+		pageSignature := page.GetIdentifier().GetSignature()
+		// the item was checked by the request
+		if (pageCollection != collection || pageSignature != signature) && !ctrl.pageAccess(page, token) {
+			continue
+		}
+		if modified := itemLastModified(page); modified.After(lastModified) {
+			lastModified = modified
+		}
+		canvasURL := ctrl.canvasURL(pageCollection, pageSignature)
+		var canvas *iiifCanvas
+		switch page.GetMetadata().GetType() {
+		case "image":
+			layers, err := ctrl.itemLayers(page, token)
+			if err != nil {
+				return nil, time.Time{}, errors.WithStack(err)
+			}
+			canvas = ctrl.layerCanvas(canvasURL, layers)
+			if len(manifest.Thumbnail) == 0 {
+				manifest.Thumbnail = []iiifResource{{ID: ctrl.externalURL(pageCollection, pageSignature, "preview"), Type: "Image"}}
+			}
+		case "audio", "video":
+			canvas = ctrl.avCanvas(canvasURL, page)
+		default:
+			manifest.Rendering = append(manifest.Rendering, iiifResource{
+				ID:     ctrl.externalURL(pageCollection, pageSignature, "item"),
+				Type:   "Text",
+				Format: page.GetMetadata().GetMimetype(),
+				Label:  iiifLabel{"none": {pageSignature}},
+			})
+			continue
+		}
+		if len(pages) == 1 {
+			canvas.Label = manifest.Label
+		} else {
+			canvas.Label = ctrl.manifestLabel(ctrl.itemFields(pageCollection, pageSignature), pageSignature)
+		}
+		if ctrl.annotations != nil {
+			canvas.Annotations = []iiifAnnotationPage{{ID: ctrl.annotationPageURL(pageCollection, pageSignature), Type: "AnnotationPage"}}
+		}
+		if start && pageCollection == collection && pageSignature == signature {
+			manifest.Start = &iiifReference{ID: canvasURL, Type: "Canvas"}
+		}
+		manifest.Items = append(manifest.Items, canvas)
+	}
+	return manifest, lastModified, nil
+}
+
+// serveManifest answers /:collection/:signature/manifest.json with the iiif presentation 3 manifest of the item
+// for viewers like mirador and universal viewer
+func (ctrl *mainController) serveManifest(c *gin.Context, item *mediaserverproto.Item, collection, signature, token string) {
+	pages, start, err := ctrl.manifestPages(item)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get pages of %s/%s", collection, signature)
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "item_error", collection+"/"+signature)
+		return
+	}
+	manifest, lastModified, err := ctrl.buildManifest(item, pages, start, token)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot build manifest of %s/%s", collection, signature)
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "item_error", collection+"/"+signature)
+		return
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot marshal manifest of %s/%s", collection, signature)
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, err, "internal_error")
+		return
+	}
+	if notModified(c, lastModified, contentETag(data)) {
+		return
+	}
+	c.Data(http.StatusOK, `application/ld+json;profile="http://iiif.io/api/presentation/3/context.json"`, data)
+}
@@ -0,0 +1,218 @@
+package rest
+
+import (
+	"archive/zip"
+	"emperror.dev/errors"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WithMETS sets the "action/params" of the derivative delivering ALTO fulltext for mets export
+func WithMETS(altoAction string) Option {
+	return func(ctrl *mainController) error {
+		ctrl.metsALTOAction = strings.Trim(altoAction, "/")
+		return nil
+	}
+}
+
+type metsFLocat struct {
+	LocType string `xml:"LOCTYPE,attr"`
+	Href    string `xml:"xlink:href,attr"`
+}
+
+type metsFile struct {
+	ID       string     `xml:"ID,attr"`
+	MimeType string     `xml:"MIMETYPE,attr,omitempty"`
+	FLocat   metsFLocat `xml:"mets:FLocat"`
+}
+
+type metsFileGrp struct {
+	Use   string      `xml:"USE,attr"`
+	Files []*metsFile `xml:"mets:file"`
+}
+
+type metsFptr struct {
+	FileID string `xml:"FILEID,attr"`
+}
+
+type metsDiv struct {
+	ID    string     `xml:"ID,attr"`
+	Type  string     `xml:"TYPE,attr"`
+	Order int        `xml:"ORDER,attr,omitempty"`
+	Label string     `xml:"LABEL,attr,omitempty"`
+	Fptrs []metsFptr `xml:"mets:fptr"`
+	Divs  []*metsDiv `xml:"mets:div"`
+}
+
+type metsAgent struct {
+	Role      string `xml:"ROLE,attr"`
+	Type      string `xml:"TYPE,attr"`
+	OtherType string `xml:"OTHERTYPE,attr"`
+	Name      string `xml:"mets:name"`
+}
+
+type metsHdr struct {
+	CreateDate string    `xml:"CREATEDATE,attr"`
+	Agent      metsAgent `xml:"mets:agent"`
+}
+
+type mets struct {
+	XMLName    xml.Name       `xml:"mets:mets"`
+	XMLNSMets  string         `xml:"xmlns:mets,attr"`
+	XMLNSXlink string         `xml:"xmlns:xlink,attr"`
+	ObjID      string         `xml:"OBJID,attr"`
+	Hdr        metsHdr        `xml:"mets:metsHdr"`
+	FileGrps   []*metsFileGrp `xml:"mets:fileSec>mets:fileGrp"`
+	StructMap  struct {
+		Type string   `xml:"TYPE,attr"`
+		Div  *metsDiv `xml:"mets:div"`
+	} `xml:"mets:structMap"`
+}
+
+func altoBundleName(item *mediaserverproto.Item) string {
+	return "alto/" + strings.ReplaceAll(item.GetIdentifier().GetSignature(), "/", "_") + ".xml"
+}
+
+// buildMETS creates the mets document of an item. the pages are the child items or the item itself
+func (ctrl *mainController) buildMETS(item *mediaserverproto.Item, pages []*mediaserverproto.Item, bundle bool) *mets {
+	doc := &mets{
+		XMLNSMets:  "http://www.loc.gov/METS/",
+		XMLNSXlink: "http://www.w3.org/1999/xlink",
+		ObjID:      item.GetUrn(),
+		Hdr: metsHdr{
+			CreateDate: time.Now().UTC().Format(time.RFC3339),
+			Agent:      metsAgent{Role: "CREATOR", Type: "OTHER", OtherType: "SOFTWARE", Name: "mediaservermain"},
+		},
+	}
+	defaultGrp := &metsFileGrp{Use: "DEFAULT"}
+	doc.FileGrps = append(doc.FileGrps, defaultGrp)
+	var altoGrp *metsFileGrp
+	if ctrl.metsALTOAction != "" {
+		altoGrp = &metsFileGrp{Use: "FULLTEXT"}
+		doc.FileGrps = append(doc.FileGrps, altoGrp)
+	}
+	doc.StructMap.Type = "PHYSICAL"
+	doc.StructMap.Div = &metsDiv{ID: "PHYS_0000", Type: "physSequence", Label: item.GetIdentifier().GetSignature()}
+	for i, page := range pages {
+		id := page.GetIdentifier()
+		div := &metsDiv{ID: fmt.Sprintf("PHYS_%04d", i+1), Type: "page", Order: i + 1, Label: id.GetSignature()}
+		file := &metsFile{
+			ID:       fmt.Sprintf("FILE_%04d_DEFAULT", i+1),
+			MimeType: page.GetMetadata().GetMimetype(),
+			FLocat:   metsFLocat{LocType: "URL", Href: ctrl.externalURL(id.GetCollection(), id.GetSignature(), "item")},
+		}
+		defaultGrp.Files = append(defaultGrp.Files, file)
+		div.Fptrs = append(div.Fptrs, metsFptr{FileID: file.ID})
+		if altoGrp != nil {
+			href := ctrl.externalURL(append([]string{id.GetCollection(), id.GetSignature()}, strings.Split(ctrl.metsALTOAction, "/")...)...)
+			locType := "URL"
+			if bundle {
+				href = altoBundleName(page)
+				locType = "OTHER"
+			}
+			altoFile := &metsFile{
+				ID:       fmt.Sprintf("FILE_%04d_FULLTEXT", i+1),
+				MimeType: "text/xml",
+				FLocat:   metsFLocat{LocType: locType, Href: href},
+			}
+			altoGrp.Files = append(altoGrp.Files, altoFile)
+			div.Fptrs = append(div.Fptrs, metsFptr{FileID: altoFile.ID})
+		}
+		doc.StructMap.Div.Divs = append(doc.StructMap.Div.Divs, div)
+	}
+	return doc
+}
+
+// altoPages returns the pages whose alto the request may read. the pages are checked like requests for their alto
+func (ctrl *mainController) altoPages(c *gin.Context, pages []*mediaserverproto.Item, token string) []*mediaserverproto.Item {
+	altoAction, altoParams, _ := strings.Cut(ctrl.metsALTOAction, "/")
+	var result []*mediaserverproto.Item
+	for _, page := range pages {
+		id := page.GetIdentifier()
+		if err := ctrl.checkAccess(c, id.GetCollection(), id.GetSignature(), altoAction, altoParams, token); err != nil {
+			ctrl.logger.Debug().Err(err).Msgf("alto of %s/%s left out of mets bundle", id.GetCollection(), id.GetSignature())
+			continue
+		}
+		result = append(result, page)
+	}
+	return result
+}
+
+// mets answers /:collection/:signature/mets with a mets document. /mets/zip bundles it with the alto files of the
+// pages accessible for the request
+func (ctrl *mainController) mets(c *gin.Context, item *mediaserverproto.Item, collection, signature, paramStr, token string) {
+	bundle := strings.Trim(paramStr, "/") == "zip"
+	pages, err := ctrl.getChildItems(collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get child items of %s/%s", collection, signature)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("cannot get child items of %s/%s: %v", collection, signature, err),
+		})
+		return
+	}
+	if len(pages) == 0 {
+		pages = []*mediaserverproto.Item{item}
+	}
+	if bundle && ctrl.metsALTOAction != "" {
+		pages = ctrl.altoPages(c, pages, token)
+	}
+	doc := ctrl.buildMETS(item, pages, bundle)
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot marshal mets for %s/%s", collection, signature)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("cannot marshal mets for %s/%s: %v", collection, signature, err),
+		})
+		return
+	}
+	data = append([]byte(xml.Header), data...)
+	if !bundle {
+		c.Data(http.StatusOK, "application/xml", data)
+		return
+	}
+	if ctrl.metsALTOAction == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no alto action configured"})
+		return
+	}
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, strings.ReplaceAll(signature, "/", "_")))
+	zw := zip.NewWriter(c.Writer)
+	if err := ctrl.writeMETSBundle(zw, data, pages); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot write mets bundle for %s/%s", collection, signature)
+	}
+}
+
+func (ctrl *mainController) writeMETSBundle(zw *zip.Writer, metsData []byte, pages []*mediaserverproto.Item) error {
+	fp, err := zw.Create("mets.xml")
+	if err != nil {
+		return errors.Wrap(err, "cannot create mets.xml")
+	}
+	if _, err := fp.Write(metsData); err != nil {
+		return errors.Wrap(err, "cannot write mets.xml")
+	}
+	altoAction, altoParams, _ := strings.Cut(ctrl.metsALTOAction, "/")
+	for _, page := range pages {
+		src, _, err := ctrl.openCache(page, altoAction, altoParams)
+		if err != nil {
+			ctrl.logger.Warn().Err(err).Msgf("no alto for %s/%s", page.GetIdentifier().GetCollection(), page.GetIdentifier().GetSignature())
+			continue
+		}
+		dst, err := zw.Create(altoBundleName(page))
+		if err != nil {
+			src.Close()
+			return errors.Wrapf(err, "cannot create %s", altoBundleName(page))
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			return errors.Wrapf(err, "cannot write %s", altoBundleName(page))
+		}
+	}
+	return errors.WithStack(zw.Close())
+}
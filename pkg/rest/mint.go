@@ -0,0 +1,55 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+// parseSigningKey returns the hmac secret or the parsed pem encoded private key for the signing method
+func parseSigningKey(method jwt.SigningMethod, key string) (any, error) {
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		pk, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse rsa private key")
+		}
+		return pk, nil
+	case *jwt.SigningMethodECDSA:
+		pk, err := jwt.ParseECPrivateKeyFromPEM([]byte(key))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse ecdsa private key")
+		}
+		return pk, nil
+	case *jwt.SigningMethodEd25519:
+		pk, err := jwt.ParseEdPrivateKeyFromPEM([]byte(key))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse ed25519 private key")
+		}
+		return pk, nil
+	}
+	return []byte(key), nil
+}
+
+// MintToken creates a token for the subject, valid for ttl. key is the hmac secret or a pem encoded private key
+func MintToken(key, alg, subject string, ttl time.Duration) (string, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return "", errors.Errorf("unknown jwt alg '%s'", alg)
+	}
+	signingKey, err := parseSigningKey(method, key)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(signingKey)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot sign token for '%s'", subject)
+	}
+	return token, nil
+}
@@ -0,0 +1,36 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/je4/utils/v2/pkg/zLogger"
+)
+
+// Option configures optional features of the main controller
+type Option func(ctrl *mainController) error
+
+// WithAdminKey sets the key used to verify admin tokens.
+// admin endpoints are disabled if no key is set
+func WithAdminKey(key string) Option {
+	return func(ctrl *mainController) error {
+		ctrl.adminKey = key
+		return nil
+	}
+}
+
+// ValidateOptions checks the jwt algorithms and options without starting a controller
+func ValidateOptions(jwtAlgs []string, logger zLogger.ZLogger, opts ...Option) error {
+	if len(jwtAlgs) == 0 {
+		return errors.New("no jwt algorithms configured")
+	}
+	if err := validateAlgs(jwtAlgs); err != nil {
+		return errors.WithStack(err)
+	}
+	ctrl := &mainController{jwtAlgs: jwtAlgs, logger: logger}
+	var errs []error
+	for _, opt := range opts {
+		if err := opt(ctrl); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Combine(errs...)
+}
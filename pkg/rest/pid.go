@@ -0,0 +1,373 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type PIDConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Patterns resolve identifiers without registration. the named groups "collection" and "signature" select the item,
+	// e.g. `^ark:/12345/(?P<collection>[a-z]+)-(?P<signature>.+)$`. patterns are matched against the normalized identifier
+	Patterns []string `toml:"patterns"`
+	// Fields are the metadata fields holding identifiers, e.g. ["doi", "handle", "ark"]. if set, pattern matches
+	// are only resolved if one of the fields of the item contains the identifier
+	Fields []string `toml:"fields"`
+	// Dir is a vfs folder for registered identifiers shared by all instances. if empty, registrations are kept in memory
+	Dir string `toml:"dir"`
+	// CacheSize is the number of registered identifiers from Dir kept in memory
+	CacheSize int `toml:"cachesize"`
+}
+
+// PIDTarget is the item of a persistent identifier
+type PIDTarget struct {
+	Identifier string `json:"identifier"`
+	Collection string `json:"collection"`
+	Signature  string `json:"signature"`
+	URL        string `json:"url,omitempty"`
+}
+
+type pids struct {
+	sync.RWMutex
+	patterns []*regexp.Regexp
+	fields   []string
+	dir      string
+	cache    gcache.Cache
+	// registered holds the registrations if there is no dir
+	registered map[string]*PIDTarget
+}
+
+// WithPIDs resolves persistent identifiers (handles, DOIs, ARKs) at /resolve/*identifier
+func WithPIDs(conf *PIDConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		size := conf.CacheSize
+		if size <= 0 {
+			size = 10000
+		}
+		p := &pids{
+			fields:     conf.Fields,
+			dir:        conf.Dir,
+			cache:      gcache.New(size).LRU().Build(),
+			registered: map[string]*PIDTarget{},
+		}
+		for _, pattern := range conf.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "invalid pid pattern '%s'", pattern)
+			}
+			if re.SubexpIndex("signature") < 0 {
+				return errors.Errorf("pid pattern '%s' has no group 'signature'", pattern)
+			}
+			if re.SubexpIndex("collection") < 0 {
+				return errors.Errorf("pid pattern '%s' has no group 'collection'", pattern)
+			}
+			p.patterns = append(p.patterns, re)
+		}
+		ctrl.pids = p
+		return nil
+	}
+}
+
+var pidResolverPrefixes = []string{
+	"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/",
+	"https://hdl.handle.net/", "http://hdl.handle.net/",
+	"https://n2t.net/", "http://n2t.net/",
+	"doi:", "hdl:",
+}
+
+// normalizePID removes resolver urls and scheme prefixes. DOIs are case-insensitive and returned in lower case
+func normalizePID(identifier string) string {
+	identifier = strings.TrimSpace(strings.TrimPrefix(identifier, "/"))
+	for _, prefix := range pidResolverPrefixes {
+		if len(identifier) >= len(prefix) && strings.EqualFold(identifier[:len(prefix)], prefix) {
+			identifier = identifier[len(prefix):]
+			break
+		}
+	}
+	if strings.HasPrefix(identifier, "10.") {
+		identifier = strings.ToLower(identifier)
+	}
+	return identifier
+}
+
+func (p *pids) file(identifier string) string {
+	h := sha256.Sum256([]byte(identifier))
+	id := hex.EncodeToString(h[:])
+	return path.Join(p.dir, id[:2], id+".json")
+}
+
+// registerPID stores the item of an identifier. registrations take precedence over patterns
+func (ctrl *mainController) registerPID(identifier, collection, signature string) error {
+	p := ctrl.pids
+	if p == nil {
+		return errors.New("pid resolution not enabled")
+	}
+	target := &PIDTarget{Identifier: normalizePID(identifier), Collection: collection, Signature: signature}
+	if target.Identifier == "" {
+		return errors.New("empty identifier")
+	}
+	if p.dir == "" {
+		p.Lock()
+		defer p.Unlock()
+		p.registered[target.Identifier] = target
+		return nil
+	}
+	data, err := json.Marshal(target)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal pid")
+	}
+	name := p.file(target.Identifier)
+	fp, err := writefs.Create(ctrl.vfs, name)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", name)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", name)
+	}
+	if err := fp.Close(); err != nil {
+		return errors.Wrapf(err, "cannot close %s", name)
+	}
+	return errors.WithStack(p.cache.Set(target.Identifier, target))
+}
+
+// unregisterPID removes a registered identifier
+func (ctrl *mainController) unregisterPID(identifier string) error {
+	p := ctrl.pids
+	identifier = normalizePID(identifier)
+	if p.dir == "" {
+		p.Lock()
+		defer p.Unlock()
+		if _, ok := p.registered[identifier]; !ok {
+			return gcache.KeyNotFoundError
+		}
+		delete(p.registered, identifier)
+		return nil
+	}
+	p.cache.Remove(identifier)
+	if err := writefs.Remove(ctrl.vfs, p.file(identifier)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return gcache.KeyNotFoundError
+		}
+		return errors.Wrapf(err, "cannot remove %s", p.file(identifier))
+	}
+	return nil
+}
+
+// registeredPID returns a registration from memory or from the shared folder
+func (ctrl *mainController) registeredPID(identifier string) (*PIDTarget, error) {
+	p := ctrl.pids
+	if p.dir == "" {
+		p.RLock()
+		defer p.RUnlock()
+		if target, ok := p.registered[identifier]; ok {
+			return target, nil
+		}
+		return nil, gcache.KeyNotFoundError
+	}
+	if targetAny, err := p.cache.Get(identifier); err == nil {
+		return targetAny.(*PIDTarget), nil
+	}
+	data, err := fs.ReadFile(ctrl.vfs, p.file(identifier))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, gcache.KeyNotFoundError
+		}
+		return nil, errors.Wrapf(err, "cannot read %s", p.file(identifier))
+	}
+	target := &PIDTarget{}
+	if err := json.Unmarshal(data, target); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal %s", p.file(identifier))
+	}
+	if err := p.cache.Set(identifier, target); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot cache pid %s", identifier)
+	}
+	return target, nil
+}
+
+// metadataHasPID checks the identifier fields of the item metadata
+func (ctrl *mainController) metadataHasPID(collection, signature, identifier string) (bool, error) {
+	metadata, err := ctrl.getItemMetadata(collection, signature)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(metadata), &fields); err != nil {
+		return false, errors.Wrapf(err, "cannot unmarshal metadata of %s/%s", collection, signature)
+	}
+	for _, field := range ctrl.pids.fields {
+		var values []any
+		switch v := fields[field].(type) {
+		case string:
+			values = []any{v}
+		case []any:
+			values = v
+		}
+		for _, value := range values {
+			if str, ok := value.(string); ok && normalizePID(str) == identifier {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// lookupPID resolves a normalized identifier by registration or pattern
+func (ctrl *mainController) lookupPID(identifier string) (*PIDTarget, error) {
+	target, err := ctrl.registeredPID(identifier)
+	if err == nil {
+		return target, nil
+	}
+	if !errors.Is(err, gcache.KeyNotFoundError) {
+		return nil, errors.WithStack(err)
+	}
+	for _, re := range ctrl.pids.patterns {
+		matches := re.FindStringSubmatch(identifier)
+		if matches == nil {
+			continue
+		}
+		collection, signature := matches[re.SubexpIndex("collection")], matches[re.SubexpIndex("signature")]
+		// the database lookup fails for unknown items
+		if _, err := ctrl.getItem(collection, signature); err != nil {
+			if errors.Is(err, gcache.KeyNotFoundError) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+		if len(ctrl.pids.fields) > 0 {
+			ok, err := ctrl.metadataHasPID(collection, signature, identifier)
+			if err != nil && !errors.Is(err, gcache.KeyNotFoundError) {
+				return nil, errors.WithStack(err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		return &PIDTarget{Identifier: identifier, Collection: collection, Signature: signature}, nil
+	}
+	return nil, gcache.KeyNotFoundError
+}
+
+// resolvePID redirects a persistent identifier to the canonical item url. clients accepting json get the target
+func (ctrl *mainController) resolvePID(c *gin.Context) {
+	if ctrl.pids == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pid resolution not enabled"})
+		return
+	}
+	identifier := normalizePID(c.Param("identifier"))
+	if identifier == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no identifier"})
+		return
+	}
+	target, err := ctrl.lookupPID(identifier)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("identifier '%s' not found", identifier)})
+			return
+		}
+		ctrl.logger.Error().Err(err).Msgf("cannot resolve identifier %s", identifier)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot resolve identifier '%s': %v", identifier, err)})
+		return
+	}
+	result := *target
+	result.URL = ctrl.externalURL(target.Collection, target.Signature)
+	c.Header("Vary", "Accept")
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, result.URL)
+}
+
+func (ctrl *mainController) adminPID(c *gin.Context) {
+	if ctrl.pids == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pid resolution not enabled"})
+		return
+	}
+	identifier := normalizePID(c.Param("identifier"))
+	target, err := ctrl.lookupPID(identifier)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("identifier '%s' not found", identifier)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot resolve identifier '%s': %v", identifier, err)})
+		return
+	}
+	c.JSON(http.StatusOK, target)
+}
+
+// adminPutPID registers an identifier for an existing item
+func (ctrl *mainController) adminPutPID(c *gin.Context) {
+	if ctrl.pids == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pid resolution not enabled"})
+		return
+	}
+	identifier := normalizePID(c.Param("identifier"))
+	var req PIDTarget
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if req.Collection == "" || req.Signature == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "collection and signature required"})
+		return
+	}
+	if _, err := ctrl.getItem(req.Collection, req.Signature); err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s/%s not found", req.Collection, req.Signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", req.Collection, req.Signature, err)})
+		return
+	}
+	if err := ctrl.registerPID(identifier, req.Collection, req.Signature); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot register identifier '%s': %v", identifier, err)})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "pid").
+		Str("identifier", identifier).
+		Str("collection", req.Collection).
+		Str("signature", req.Signature).
+		Str("remote", c.ClientIP()).
+		Msg("identifier registered")
+	c.JSON(http.StatusOK, &PIDTarget{Identifier: identifier, Collection: req.Collection, Signature: req.Signature, URL: ctrl.externalURL(req.Collection, req.Signature)})
+}
+
+func (ctrl *mainController) adminDeletePID(c *gin.Context) {
+	if ctrl.pids == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pid resolution not enabled"})
+		return
+	}
+	identifier := normalizePID(c.Param("identifier"))
+	if err := ctrl.unregisterPID(identifier); err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("identifier '%s' not registered", identifier)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot remove identifier '%s': %v", identifier, err)})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "pid").
+		Str("identifier", identifier).
+		Str("remote", c.ClientIP()).
+		Msg("identifier removed")
+	c.Status(http.StatusNoContent)
+}
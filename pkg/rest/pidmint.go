@@ -0,0 +1,224 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type PIDMintConfig struct {
+	// URL of the minting api, a template with .Collection, .Signature and .URL (the canonical item url),
+	// e.g. "https://ezid.cdlib.org/shoulder/ark:/99999/fk4" or "https://hdl.example.org/api/handles/20.500.12345/{{.Collection}}.{{.Signature}}"
+	URL    string `toml:"url"`
+	Method string `toml:"method"`
+	// Body is a template of the request body with the same fields as URL
+	Body        string            `toml:"body"`
+	ContentType string            `toml:"contenttype"`
+	Header      map[string]string `toml:"header"`
+	// Username and Password are used for basic authentication if set
+	Username string           `toml:"username"`
+	Password config.EnvString `toml:"password"`
+	// IdentifierField is the field of a json response holding the identifier, e.g. "handle".
+	// if empty, the text response is used after removing ResponsePrefix
+	IdentifierField string `toml:"identifierfield"`
+	// ResponsePrefix is removed from text responses, e.g. "success: " for ezid
+	ResponsePrefix string `toml:"responseprefix"`
+	// IdentifierPrefix is prepended to the minted identifier, e.g. "hdl:"
+	IdentifierPrefix string `toml:"identifierprefix"`
+	// Field is the metadata field for the identifier, e.g. "ark"
+	Field   string          `toml:"field"`
+	Timeout config.Duration `toml:"timeout"`
+}
+
+// PIDMinter creates a persistent identifier for an item
+type PIDMinter interface {
+	Mint(ctx context.Context, collection, signature, itemURL string) (string, error)
+}
+
+type pidMinting struct {
+	minter PIDMinter
+	field  string
+}
+
+// WithPIDMinting mints identifiers with a rest api (ezid, handle server) at POST /admin/items/:collection/:signature/pid
+func WithPIDMinting(conf *PIDMintConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || conf.URL == "" {
+			return nil
+		}
+		minter, err := newRESTMinter(conf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		ctrl.pidMinting = &pidMinting{minter: minter, field: conf.Field}
+		return nil
+	}
+}
+
+// WithPIDMinter uses a custom minting service. field is the metadata field for the identifier
+func WithPIDMinter(minter PIDMinter, field string) Option {
+	return func(ctrl *mainController) error {
+		if minter == nil {
+			return errors.New("no pid minter")
+		}
+		ctrl.pidMinting = &pidMinting{minter: minter, field: field}
+		return nil
+	}
+}
+
+type restMinter struct {
+	client *http.Client
+	url    *template.Template
+	body   *template.Template
+	conf   *PIDMintConfig
+}
+
+func newRESTMinter(conf *PIDMintConfig) (*restMinter, error) {
+	timeout := time.Duration(conf.Timeout)
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	urlTpl, err := template.New("url").Parse(conf.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pid minting url '%s'", conf.URL)
+	}
+	bodyTpl, err := template.New("body").Parse(conf.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid pid minting body")
+	}
+	return &restMinter{client: &http.Client{Timeout: timeout}, url: urlTpl, body: bodyTpl, conf: conf}, nil
+}
+
+func (m *restMinter) Mint(ctx context.Context, collection, signature, itemURL string) (string, error) {
+	data := map[string]string{"Collection": collection, "Signature": signature, "URL": itemURL}
+	u := &strings.Builder{}
+	if err := m.url.Execute(u, data); err != nil {
+		return "", errors.Wrap(err, "cannot build minting url")
+	}
+	body := &bytes.Buffer{}
+	if err := m.body.Execute(body, data); err != nil {
+		return "", errors.Wrap(err, "cannot build minting body")
+	}
+	method := m.conf.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot create request %s %s", method, u.String())
+	}
+	if m.conf.ContentType != "" {
+		req.Header.Set("Content-Type", m.conf.ContentType)
+	}
+	for k, v := range m.conf.Header {
+		req.Header.Set(k, v)
+	}
+	if m.conf.Username != "" {
+		req.SetBasicAuth(m.conf.Username, string(m.conf.Password))
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot %s %s", method, u.String())
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot read response of %s", u.String())
+	}
+	if resp.StatusCode >= 300 {
+		return "", errors.Errorf("%s %s: status %s: %s", method, u.String(), resp.Status, string(respBody))
+	}
+	var identifier string
+	if m.conf.IdentifierField != "" {
+		var result map[string]any
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return "", errors.Wrapf(err, "cannot unmarshal response of %s", u.String())
+		}
+		identifier, _ = result[m.conf.IdentifierField].(string)
+	} else {
+		identifier = strings.TrimPrefix(strings.TrimSpace(string(respBody)), m.conf.ResponsePrefix)
+		// ezid appends the shadow ark after a pipe
+		identifier, _, _ = strings.Cut(identifier, " | ")
+	}
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return "", errors.Errorf("no identifier in response of %s: %s", u.String(), string(respBody))
+	}
+	return m.conf.IdentifierPrefix + identifier, nil
+}
+
+// PIDMintResponse is returned after minting. MetadataPatch is the json merge patch which stores the identifier
+// in the item metadata
+type PIDMintResponse struct {
+	PIDTarget
+	Registered    bool           `json:"registered"`
+	MetadataPatch map[string]any `json:"metadatapatch,omitempty"`
+}
+
+// mintPID is the minting hook for ingest. the identifier is registered for /resolve if pid resolution is enabled
+func (ctrl *mainController) mintPID(ctx context.Context, collection, signature string) (*PIDMintResponse, error) {
+	itemURL := ctrl.externalURL(collection, signature)
+	identifier, err := ctrl.pidMinting.minter.Mint(ctx, collection, signature, itemURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot mint identifier for %s/%s", collection, signature)
+	}
+	result := &PIDMintResponse{PIDTarget: PIDTarget{Identifier: identifier, Collection: collection, Signature: signature, URL: itemURL}}
+	if ctrl.pidMinting.field != "" {
+		result.MetadataPatch = map[string]any{ctrl.pidMinting.field: identifier}
+	}
+	if ctrl.pids != nil {
+		if err := ctrl.registerPID(identifier, collection, signature); err != nil {
+			return result, errors.Wrapf(err, "cannot register identifier %s", identifier)
+		}
+		result.Registered = true
+	}
+	return result, nil
+}
+
+// adminMintPID mints an identifier for an existing item. the database service has no rpc to write metadata yet,
+// so the identifier is returned with the metadata patch for the caller to store
+func (ctrl *mainController) adminMintPID(c *gin.Context) {
+	if ctrl.pidMinting == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pid minting not configured"})
+		return
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	if _, err := ctrl.getItem(collection, signature); err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s/%s not found", collection, signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err)})
+		return
+	}
+	result, err := ctrl.mintPID(c.Request.Context(), collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot mint identifier for %s/%s", collection, signature)
+		if result == nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		// the identifier exists, do not lose it
+		c.JSON(http.StatusCreated, gin.H{"error": err.Error(), "identifier": result.Identifier, "metadatapatch": result.MetadataPatch})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "pid").
+		Str("identifier", result.Identifier).
+		Str("collection", collection).
+		Str("signature", signature).
+		Str("remote", c.ClientIP()).
+		Msg("identifier minted, not stored in metadata: database service cannot update metadata")
+	c.JSON(http.StatusCreated, result)
+}
@@ -0,0 +1,416 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccessPolicyConfig struct {
+	// Script is a starlark script evaluated after the regular access check of every delivery. its function decide(req)
+	// returns the decision: "allow", "deny <reason>" or None to keep the result of the regular check, e.g.
+	//	def decide(req):
+	//	    if count(req.session, "24h") >= 20:
+	//	        return "deny max 20 pages per day"
+	Script string `toml:"script"`
+	// File is a vfs file holding the script
+	File string `toml:"file"`
+	// CounterSize is the number of counters kept for count, default 100000
+	CounterSize int `toml:"countersize"`
+	// MaxSteps limits the execution steps of a decision, default 100000
+	MaxSteps uint64 `toml:"maxsteps"`
+}
+
+// PolicyRequest is the data available to access policies
+type PolicyRequest struct {
+	Collection string
+	Signature  string
+	Action     string
+	Params     string
+	Item       *mediaserverproto.Item
+	// Allowed is the result of the regular access check, Denial its error
+	Allowed bool
+	Denial  string
+	// Subject and Claims of a valid token
+	Subject string
+	Claims  map[string]any
+	// Session is the sid or jti claim of a valid token, empty without token
+	Session   string
+	ClientIP  string
+	Method    string
+	Path      string
+	Referer   string
+	UserAgent string
+	Now       time.Time
+	// counts are the counters read by the policy, incremented after a successful delivery
+	counts []policyCount
+}
+
+type PolicyDecision int
+
+const (
+	// PolicyDefault keeps the result of the regular access check
+	PolicyDefault PolicyDecision = iota
+	PolicyAllow
+	PolicyDeny
+)
+
+// AccessPolicy decides on the access of a collection after the regular check. the reason is reported for denials
+type AccessPolicy interface {
+	Decide(req *PolicyRequest) (PolicyDecision, string, error)
+}
+
+// DeliveryCounter is implemented by access policies counting deliveries. Delivered is called after the successful
+// delivery of a request allowed by the policy. HEAD requests, revalidations and range requests not starting at
+// the beginning are no deliveries
+type DeliveryCounter interface {
+	Delivered(req *PolicyRequest)
+}
+
+// WithAccessPolicies sets starlark access policies per collection
+func WithAccessPolicies(policies map[string]*AccessPolicyConfig) Option {
+	return func(ctrl *mainController) error {
+		for collection, conf := range policies {
+			script := conf.Script
+			if conf.File != "" {
+				data, err := fs.ReadFile(ctrl.vfs, conf.File)
+				if err != nil {
+					return errors.Wrapf(err, "cannot read policy %s of collection %s", conf.File, collection)
+				}
+				script = string(data)
+			}
+			policy, err := newStarlarkPolicy(collection, script, conf.CounterSize, conf.MaxSteps)
+			if err != nil {
+				return errors.Wrapf(err, "invalid policy of collection %s", collection)
+			}
+			if err := WithAccessPolicy(collection, policy)(ctrl); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	}
+}
+
+// WithAccessPolicy sets a custom access policy for a collection, e.g. a wasm runtime
+func WithAccessPolicy(collection string, policy AccessPolicy) Option {
+	return func(ctrl *mainController) error {
+		if policy == nil {
+			return errors.Errorf("no access policy for collection %s", collection)
+		}
+		if ctrl.accessPolicies == nil {
+			ctrl.accessPolicies = map[string]AccessPolicy{}
+		}
+		ctrl.accessPolicies[collection] = policy
+		return nil
+	}
+}
+
+// policyCounter counts the deliveries for a key within its window
+type policyCounter struct {
+	count int
+}
+
+// policyCount is a counter read by a decision
+type policyCount struct {
+	key    string
+	window time.Duration
+}
+
+const policyCountsLocal = "mediaserver.policy.counts"
+
+type starlarkPolicy struct {
+	sync.Mutex
+	decide   starlark.Callable
+	maxSteps uint64
+	counters gcache.Cache
+}
+
+func newStarlarkPolicy(collection, script string, counterSize int, maxSteps uint64) (*starlarkPolicy, error) {
+	if strings.TrimSpace(script) == "" {
+		return nil, errors.New("empty policy script")
+	}
+	if counterSize <= 0 {
+		counterSize = 100000
+	}
+	if maxSteps == 0 {
+		maxSteps = 100000
+	}
+	sp := &starlarkPolicy{maxSteps: maxSteps, counters: gcache.New(counterSize).LRU().Build()}
+	thread := &starlark.Thread{Name: collection}
+	thread.SetMaxExecutionSteps(maxSteps)
+	globals, err := starlark.ExecFile(thread, collection+".star", script, starlark.StringDict{
+		"count": starlark.NewBuiltin("count", sp.count),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load policy script")
+	}
+	decide, ok := globals["decide"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("policy script does not define decide(req)")
+	}
+	sp.decide = decide
+	return sp, nil
+}
+
+// count returns the number of deliveries for key within the window. the counter starts with the first delivery and
+// expires after the window. keys must not be empty, requests without session cannot be counted
+func (sp *starlarkPolicy) count(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var key, window string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 2, &key, &window); err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, errors.New("count: empty key")
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return nil, errors.Errorf("count: invalid window '%s'", window)
+	}
+	if counts, ok := thread.Local(policyCountsLocal).(*[]policyCount); ok {
+		*counts = append(*counts, policyCount{key: key, window: d})
+	}
+	sp.Lock()
+	defer sp.Unlock()
+	if counterAny, err := sp.counters.Get(key); err == nil {
+		return starlark.MakeInt(counterAny.(*policyCounter).count), nil
+	}
+	return starlark.MakeInt(0), nil
+}
+
+// Delivered increments the counters read for the request
+func (sp *starlarkPolicy) Delivered(req *PolicyRequest) {
+	sp.Lock()
+	defer sp.Unlock()
+	for _, pc := range req.counts {
+		if counterAny, err := sp.counters.Get(pc.key); err == nil {
+			counterAny.(*policyCounter).count++
+			continue
+		}
+		_ = sp.counters.SetWithExpire(pc.key, &policyCounter{count: 1}, pc.window)
+	}
+}
+
+func (sp *starlarkPolicy) Decide(req *PolicyRequest) (PolicyDecision, string, error) {
+	var counts []policyCount
+	thread := &starlark.Thread{Name: req.Collection}
+	thread.SetMaxExecutionSteps(sp.maxSteps)
+	thread.SetLocal(policyCountsLocal, &counts)
+	result, err := starlark.Call(thread, sp.decide, starlark.Tuple{policyValue(req)}, nil)
+	if err != nil {
+		return PolicyDeny, "", errors.Wrap(err, "cannot execute policy script")
+	}
+	req.counts = counts
+	var output string
+	switch v := result.(type) {
+	case starlark.NoneType:
+	case starlark.String:
+		output = string(v)
+	default:
+		return PolicyDeny, "", errors.Errorf("invalid policy result of type %s", result.Type())
+	}
+	decision, reason, _ := strings.Cut(strings.TrimSpace(output), " ")
+	switch decision {
+	case "":
+		return PolicyDefault, "", nil
+	case "allow":
+		return PolicyAllow, "", nil
+	case "deny":
+		return PolicyDeny, strings.TrimSpace(reason), nil
+	default:
+		return PolicyDeny, "", errors.Errorf("invalid policy decision '%s'", decision)
+	}
+}
+
+// policyValue returns the request as starlark struct
+func policyValue(req *PolicyRequest) starlark.Value {
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"collection": starlark.String(req.Collection),
+		"signature":  starlark.String(req.Signature),
+		"action":     starlark.String(req.Action),
+		"params":     starlark.String(req.Params),
+		"public":     starlark.Bool(req.Item.GetPublic()),
+		"type":       starlark.String(req.Item.GetMetadata().GetType()),
+		"allowed":    starlark.Bool(req.Allowed),
+		"denial":     starlark.String(req.Denial),
+		"subject":    starlark.String(req.Subject),
+		"claims":     starlarkValue(req.Claims),
+		"session":    starlark.String(req.Session),
+		"client_ip":  starlark.String(req.ClientIP),
+		"method":     starlark.String(req.Method),
+		"path":       starlark.String(req.Path),
+		"referer":    starlark.String(req.Referer),
+		"user_agent": starlark.String(req.UserAgent),
+		"now":        starlark.MakeInt64(req.Now.Unix()),
+	})
+}
+
+// starlarkValue converts decoded json values, e.g. token claims
+func starlarkValue(v any) starlark.Value {
+	switch v := v.(type) {
+	case string:
+		return starlark.String(v)
+	case bool:
+		return starlark.Bool(v)
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case []any:
+		list := make([]starlark.Value, 0, len(v))
+		for _, e := range v {
+			list = append(list, starlarkValue(e))
+		}
+		return starlark.NewList(list)
+	case map[string]any:
+		dict := starlark.NewDict(len(v))
+		for k, e := range v {
+			_ = dict.SetKey(starlark.String(k), starlarkValue(e))
+		}
+		return dict
+	case jwt.MapClaims:
+		return starlarkValue(map[string]any(v))
+	default:
+		return starlark.None
+	}
+}
+
+func (ctrl *mainController) hasPolicy(collection string) bool {
+	_, ok := ctrl.accessPolicies[collection]
+	return ok
+}
+
+// policyRequest collects the request data. claims are only added for tokens verified with the collection keys
+func (ctrl *mainController) policyRequest(c *gin.Context, item *mediaserverproto.Item, action, paramStr, token string, accessErr error) *PolicyRequest {
+	req := &PolicyRequest{
+		Collection: item.GetIdentifier().GetCollection(),
+		Signature:  item.GetIdentifier().GetSignature(),
+		Action:     action,
+		Params:     paramStr,
+		Item:       item,
+		Allowed:    accessErr == nil,
+		ClientIP:   c.ClientIP(),
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Referer:    c.Request.Referer(),
+		UserAgent:  c.Request.UserAgent(),
+		Now:        time.Now(),
+	}
+	if accessErr != nil {
+		req.Denial = accessErr.Error()
+	}
+	req.Subject, req.Claims = ctrl.verifiedClaims(req.Collection, token)
+	// client address and user agent are chosen by the client, counting needs an identity of a valid token
+	req.Session = tokenSession(req.Claims)
+	return req
+}
+
+// verifiedClaims returns the subject and claims of a token verified with the collection keys
+func (ctrl *mainController) verifiedClaims(collection, token string) (string, map[string]any) {
+	if token == "" {
+		return "", nil
+	}
+	subject, err := ctrl.tokenSubject(collection, token)
+	if err != nil {
+		return "", nil
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return "", nil
+	}
+	return subject, claims
+}
+
+// tokenSession is the sid or jti claim of a token, empty if there is none
+func tokenSession(claims map[string]any) string {
+	for _, claim := range []string{"sid", "jti"} {
+		if s, ok := claims[claim].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// requestSession is the session of the token, or a hash of client address and user agent
+func requestSession(c *gin.Context, claims map[string]any) string {
+	if session := tokenSession(claims); session != "" {
+		return session
+	}
+	sum := sha256.Sum256([]byte(c.ClientIP() + "\x00" + c.Request.UserAgent()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// applyPolicy evaluates the policy of the collection for requests. checks without request (e.g. listings) are not evaluated
+func (ctrl *mainController) applyPolicy(c *gin.Context, collection, signature, action, paramStr, token string, accessErr error) error {
+	policy, ok := ctrl.accessPolicies[collection]
+	if !ok {
+		return accessErr
+	}
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
+	}
+	req := ctrl.policyRequest(c, item, action, paramStr, token, accessErr)
+	decision, reason, err := policy.Decide(req)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("policy of collection %s failed for %s/%s/%s", collection, signature, action, paramStr)
+		return errors.Wrapf(err, "policy of collection %s failed", collection)
+	}
+	switch decision {
+	case PolicyAllow:
+		traceDecision(c, "policy", "allow")
+		accessErr = nil
+	case PolicyDeny:
+		traceDecision(c, "policy", "deny %s", reason)
+		return errors.Errorf("denied by policy of collection %s: %s", collection, reason)
+	}
+	if accessErr == nil {
+		if counter, ok := policy.(DeliveryCounter); ok {
+			c.Set(policyDeliveryKey, func() { counter.Delivered(req) })
+		}
+	}
+	return accessErr
+}
+
+const policyDeliveryKey = "mediaserver.policy.delivery"
+
+// policyHandler reports successful deliveries to the policies counting them
+func (ctrl *mainController) policyHandler() gin.HandlerFunc {
+	if len(ctrl.accessPolicies) == 0 {
+		return nil
+	}
+	return func(c *gin.Context) {
+		c.Next()
+		delivered, ok := c.Get(policyDeliveryKey)
+		if !ok || !fullDelivery(c) {
+			return
+		}
+		delivered.(func())()
+	}
+}
+
+// fullDelivery reports whether the response delivered the content from its beginning
+func fullDelivery(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet {
+		return false
+	}
+	switch c.Writer.Status() {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		return strings.HasPrefix(c.Writer.Header().Get("Content-Range"), "bytes 0-")
+	default:
+		return false
+	}
+}
@@ -0,0 +1,155 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testPolicyScript = `
+def decide(req):
+    if req.action == "master":
+        return "deny no masters"
+    if req.claims.get("role") == "staff":
+        return "allow"
+    if not req.allowed:
+        return None
+    if not req.session:
+        return "deny login required"
+    if count(req.session, "24h") >= 2:
+        return "deny max 2 pages per day"
+`
+
+func TestStarlarkPolicyDecide(t *testing.T) {
+	policy, err := newStarlarkPolicy("test", testPolicyScript, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		req      PolicyRequest
+		decision PolicyDecision
+		reason   string
+	}{
+		{name: "master", req: PolicyRequest{Action: "master", Allowed: true, Session: "s"}, decision: PolicyDeny, reason: "no masters"},
+		{name: "staff", req: PolicyRequest{Action: "item", Claims: map[string]any{"role": "staff"}}, decision: PolicyAllow},
+		{name: "denied", req: PolicyRequest{Action: "item"}, decision: PolicyDefault},
+		{name: "no session", req: PolicyRequest{Action: "item", Allowed: true}, decision: PolicyDeny, reason: "login required"},
+		{name: "session", req: PolicyRequest{Action: "item", Allowed: true, Session: "s"}, decision: PolicyDefault},
+	} {
+		decision, reason, err := policy.Decide(&tc.req)
+		if err != nil || decision != tc.decision || reason != tc.reason {
+			t.Errorf("%s: decision %d '%s' (%v), expected %d '%s'", tc.name, decision, reason, err, tc.decision, tc.reason)
+		}
+	}
+}
+
+func TestStarlarkPolicyCount(t *testing.T) {
+	policy, err := newStarlarkPolicy("test", testPolicyScript, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decide := func() PolicyDecision {
+		req := &PolicyRequest{Action: "item", Allowed: true, Session: "s"}
+		decision, _, err := policy.Decide(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision == PolicyDefault && len(req.counts) != 1 {
+			t.Fatalf("%d counters read, expected 1", len(req.counts))
+		}
+		return decision
+	}
+	// decisions without delivery, e.g. head requests, are not counted
+	for i := 0; i < 5; i++ {
+		if decision := decide(); decision != PolicyDefault {
+			t.Fatalf("decision %d without deliveries", decision)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		req := &PolicyRequest{Action: "item", Allowed: true, Session: "s"}
+		if decision, _, err := policy.Decide(req); err != nil || decision != PolicyDefault {
+			t.Fatalf("delivery %d: decision %d: %v", i, decision, err)
+		}
+		policy.Delivered(req)
+	}
+	if decision := decide(); decision != PolicyDeny {
+		t.Errorf("decision %d after 2 deliveries, expected deny", decision)
+	}
+	req := &PolicyRequest{Action: "item", Allowed: true, Session: "other"}
+	if decision, _, err := policy.Decide(req); err != nil || decision != PolicyDefault {
+		t.Errorf("other session: decision %d: %v", decision, err)
+	}
+}
+
+func TestStarlarkPolicyInvalid(t *testing.T) {
+	for name, script := range map[string]string{
+		"empty":     "",
+		"syntax":    "def decide(req)\n    return None\n",
+		"no decide": "x = 1\n",
+		"load":      "load(\"os\", \"system\")\ndef decide(req):\n    return None\n",
+		"endless":   "def loop():\n    x = 0\n    for i in range(1000000000):\n        x += i\nloop()\ndef decide(req):\n    return None\n",
+	} {
+		if _, err := newStarlarkPolicy("test", script, 0, 1000); err == nil {
+			t.Errorf("%s: script accepted", name)
+		}
+	}
+	policy, err := newStarlarkPolicy("test", "def decide(req):\n    for i in range(1000000000):\n        pass\n", 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision, _, err := policy.Decide(&PolicyRequest{}); err == nil || decision != PolicyDeny {
+		t.Errorf("endless decision %d: %v", decision, err)
+	}
+	policy, err = newStarlarkPolicy("test", "def decide(req):\n    return 1\n", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := policy.Decide(&PolicyRequest{}); err == nil {
+		t.Error("decision of type int accepted")
+	}
+}
+
+func TestPolicyHandler(t *testing.T) {
+	policy, err := newStarlarkPolicy("test", testPolicyScript, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := &mainController{accessPolicies: map[string]AccessPolicy{"test": policy}}
+	for _, tc := range []struct {
+		method       string
+		status       int
+		contentRange string
+		counted      bool
+	}{
+		{method: http.MethodGet, status: http.StatusOK, counted: true},
+		{method: http.MethodHead, status: http.StatusOK},
+		{method: http.MethodGet, status: http.StatusNotModified},
+		{method: http.MethodGet, status: http.StatusPartialContent, contentRange: "bytes 0-99/1000", counted: true},
+		{method: http.MethodGet, status: http.StatusPartialContent, contentRange: "bytes 100-199/1000"},
+		{method: http.MethodGet, status: http.StatusInternalServerError},
+	} {
+		session := tc.method + tc.contentRange + http.StatusText(tc.status)
+		router := gin.New()
+		router.Use(ctrl.policyHandler())
+		router.Handle(tc.method, "/:collection/:signature", func(c *gin.Context) {
+			req := &PolicyRequest{Action: "item", Allowed: true, Session: session, Item: &mediaserverproto.Item{}}
+			if _, _, err := policy.Decide(req); err != nil {
+				t.Fatal(err)
+			}
+			c.Set(policyDeliveryKey, func() { policy.Delivered(req) })
+			if tc.contentRange != "" {
+				c.Header("Content-Range", tc.contentRange)
+			}
+			c.Status(tc.status)
+		})
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tc.method, "/test/image", strings.NewReader("")))
+		_, err := policy.counters.Get(session)
+		if counted := err == nil; counted != tc.counted {
+			t.Errorf("%s %d %s: counted %v, expected %v", tc.method, tc.status, tc.contentRange, counted, tc.counted)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// file extensions of pre-compressed variants per content coding
+var precompressedExtensions = map[string]string{
+	"zstd": ".zst",
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// WithPrecompressed serves pre-compressed variants next to text derivatives (e.g. "ocr.xml.br").
+// encodings are tried in the given order, supported are "zstd", "br" and "gzip"
+func WithPrecompressed(encodings []string) Option {
+	return func(ctrl *mainController) error {
+		for _, enc := range encodings {
+			if _, ok := precompressedExtensions[enc]; !ok {
+				return errors.Errorf("unsupported pre-compressed encoding '%s'", enc)
+			}
+		}
+		ctrl.precompressed = encodings
+		return nil
+	}
+}
+
+// compressibleMime reports whether pre-compressed variants are looked up for the mime type
+func compressibleMime(mime string) bool {
+	mime, _, _ = strings.Cut(mime, ";")
+	mime = strings.TrimSpace(mime)
+	return strings.HasPrefix(mime, "text/") ||
+		strings.HasSuffix(mime, "/json") || strings.HasSuffix(mime, "+json") ||
+		strings.HasSuffix(mime, "/xml") || strings.HasSuffix(mime, "+xml") ||
+		mime == "application/javascript"
+}
+
+// acceptedEncodings parses Accept-Encoding into the codings with q > 0
+func acceptedEncodings(header string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		accepted[coding] = q > 0
+	}
+	return accepted
+}
+
+// openPrecompressed opens the best pre-compressed variant accepted by the client
+func (ctrl *mainController) openPrecompressed(c *gin.Context, path, mime string) (fs.File, string, bool) {
+	if len(ctrl.precompressed) == 0 || !compressibleMime(mime) {
+		return nil, "", false
+	}
+	c.Writer.Header().Add("Vary", "Accept-Encoding")
+	accepted := acceptedEncodings(c.GetHeader("Accept-Encoding"))
+	for _, enc := range ctrl.precompressed {
+		ok, found := accepted[enc]
+		if !found {
+			ok = accepted["*"]
+		}
+		if !ok {
+			continue
+		}
+		f, err := ctrl.vfs.Open(path + precompressedExtensions[enc])
+		if err != nil {
+			continue
+		}
+		return f, enc, true
+	}
+	return nil, "", false
+}
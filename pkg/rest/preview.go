@@ -0,0 +1,147 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type PreviewConfig struct {
+	// Actions are the thumbnail "action/params" per media type, e.g. video = "frame/size240x240/formatjpeg"
+	Actions map[string]string `toml:"actions"`
+	// Params name the action parameter which selects the frame or page per media type, e.g. video = "time", pdf = "page"
+	Params map[string]string `toml:"params"`
+	// Field is the metadata field with the selected frame (seconds) or page, default "preview"
+	Field string `toml:"field"`
+}
+
+// WithPreview redirects /:collection/:signature/preview to the thumbnail action, using the frame or page
+// selected in the item metadata
+func WithPreview(conf *PreviewConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || len(conf.Actions) == 0 {
+			return nil
+		}
+		for mediaType, action := range conf.Actions {
+			if strings.Trim(action, "/") == "" {
+				return errors.Errorf("empty preview action for media type %s", mediaType)
+			}
+		}
+		field := conf.Field
+		if field == "" {
+			field = "preview"
+		}
+		ctrl.preview = &PreviewConfig{Actions: conf.Actions, Params: conf.Params, Field: field}
+		return nil
+	}
+}
+
+var previewSelectionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// previewSelection returns the selected frame or page from the item metadata
+func (ctrl *mainController) previewSelection(collection, signature string) (string, error) {
+	metadata, err := ctrl.getItemMetadata(collection, signature)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			return "", nil
+		}
+		return "", errors.WithStack(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(metadata), &fields); err != nil {
+		return "", errors.Wrapf(err, "cannot unmarshal metadata of %s/%s", collection, signature)
+	}
+	var selection string
+	switch v := fields[ctrl.preview.Field].(type) {
+	case string:
+		selection = v
+	case float64:
+		selection = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if !previewSelectionRegexp.MatchString(selection) {
+		return "", nil
+	}
+	return selection, nil
+}
+
+// previewAction returns the canonical thumbnail action of a media type with the selected frame or page
+func (ctrl *mainController) previewAction(mediaType, selection string) (string, error) {
+	base, ok := ctrl.preview.Actions[mediaType]
+	if !ok {
+		return "", errors.Errorf("no preview action for media type '%s'", mediaType)
+	}
+	action, paramStr, _ := strings.Cut(normalizePath(base), "/")
+	if param := ctrl.preview.Params[mediaType]; param != "" && selection != "" {
+		// the first occurrence of a parameter wins, so the selection overrides the configured default
+		paramStr = param + selection + "/" + paramStr
+	}
+	canonical, err := ctrl.canonicalAction(mediaType, action, paramStr)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return canonical, nil
+}
+
+// previewRedirect answers /:collection/:signature/preview. access is checked by the thumbnail action
+func (ctrl *mainController) previewRedirect(c *gin.Context, item *mediaserverproto.Item, collection, signature string) {
+	if ctrl.preview == nil {
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.New("preview not configured"), "no_preview", collection+"/"+signature)
+		return
+	}
+	selection, err := ctrl.previewSelection(collection, signature)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get preview selection of %s/%s", collection, signature)
+	}
+	action, err := ctrl.previewAction(item.GetMetadata().GetType(), selection)
+	if err != nil {
+		ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Wrapf(err, "no preview for %s/%s", collection, signature), "no_preview", collection+"/"+signature)
+		return
+	}
+	target := ctrl.externalURL(collection, signature, action)
+	if c.Request.URL.RawQuery != "" {
+		target = fmt.Sprintf("%s?%s", target, c.Request.URL.RawQuery)
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+func (ctrl *mainController) adminPreview(c *gin.Context) {
+	if ctrl.preview == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "preview not configured"})
+		return
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s/%s not found", collection, signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err)})
+		return
+	}
+	selection, err := ctrl.previewSelection(collection, signature)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get preview selection of %s/%s: %v", collection, signature, err)})
+		return
+	}
+	action, err := ctrl.previewAction(item.GetMetadata().GetType(), selection)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"collection": collection,
+		"signature":  signature,
+		"selection":  selection,
+		"action":     action,
+		"url":        ctrl.externalURL(collection, signature, action),
+	})
+}
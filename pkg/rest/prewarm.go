@@ -0,0 +1,110 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strings"
+)
+
+// PrewarmRequest lists derivatives to be generated ahead of the first access.
+// actions are given as "<action>/<params>", e.g. "resize/size240x240/formatwebp"
+type PrewarmRequest struct {
+	Items   []string `json:"items"`
+	Actions []string `json:"actions"`
+}
+
+type PrewarmResult struct {
+	Item      string `json:"item"`
+	Action    string `json:"action"`
+	Generated bool   `json:"generated"`
+	Error     string `json:"error,omitempty"`
+}
+
+// prewarm makes sure the derivative of an item exists. it returns true if it had to be generated
+func (ctrl *mainController) prewarm(ctx context.Context, collection, signature, action, paramStr string) (bool, error) {
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
+	}
+	var params = actionCache.ActionParams{}
+	if action != "item" && action != "master" {
+		allowedParams, err := ctrl.getParams(item.GetMetadata().GetType(), action)
+		if err != nil {
+			return false, errors.Wrapf(err, "cannot get params for %s::%s", item.GetMetadata().GetType(), action)
+		}
+		params.SetString(paramStr, allowedParams)
+	}
+	_, err = ctrl.dbClient.GetCache(ctx, &mediaserverproto.CacheRequest{
+		Identifier: &mediaserverproto.ItemIdentifier{
+			Collection: collection,
+			Signature:  signature,
+		},
+		Action: action,
+		Params: params.String(),
+	})
+	if err == nil {
+		return false, nil
+	}
+	if stat, ok := status.FromError(err); !ok || stat.Code() != codes.NotFound {
+		return false, errors.Wrapf(err, "cannot get cache for %s/%s/%s", collection, signature, action)
+	}
+	coll, err := ctrl.getCollection(collection)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot get collection %s", collection)
+	}
+	if _, err := ctrl.generate(ctx, &mediaserverproto.ActionParam{
+		Item:    item,
+		Action:  action,
+		Params:  params,
+		Storage: coll.GetStorage(),
+	}); err != nil {
+		return false, errors.Wrapf(err, "cannot create cache for %s/%s/%s", collection, signature, action)
+	}
+	return true, nil
+}
+
+func (ctrl *mainController) adminPrewarm(c *gin.Context) {
+	var req PrewarmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if len(req.Items) == 0 || len(req.Actions) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no items or actions given"})
+		return
+	}
+	var results = []PrewarmResult{}
+	var failed bool
+	for _, itemStr := range req.Items {
+		collection, signature, ok := strings.Cut(strings.Trim(itemStr, "/"), "/")
+		if !ok {
+			results = append(results, PrewarmResult{Item: itemStr, Error: "item must be <collection>/<signature>"})
+			failed = true
+			continue
+		}
+		for _, actionStr := range req.Actions {
+			action, paramStr, _ := strings.Cut(strings.Trim(actionStr, "/"), "/")
+			result := PrewarmResult{Item: itemStr, Action: actionStr}
+			generated, err := ctrl.prewarm(c.Request.Context(), collection, signature, action, paramStr)
+			if err != nil {
+				ctrl.logger.Error().Err(err).Msgf("cannot prewarm %s/%s", itemStr, actionStr)
+				result.Error = err.Error()
+				failed = true
+			}
+			result.Generated = generated
+			results = append(results, result)
+		}
+	}
+	statusCode := http.StatusOK
+	if failed {
+		statusCode = http.StatusMultiStatus
+	}
+	c.JSON(statusCode, results)
+}
@@ -0,0 +1,361 @@
+package rest
+
+import (
+	"crypto/rand"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"github.com/je4/utils/v2/pkg/config"
+	"io/fs"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PrintRequestConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Actions maps the media type to the "action/params" of the print derivative, e.g. "image" = "resize/size6000x6000/formattiff"
+	Actions map[string]string `toml:"actions"`
+	// File keeps the requests in the vfs, e.g. "vfs://testcache/printrequests.json". if empty, requests are kept in memory
+	File string `toml:"file"`
+	// TTL is the lifetime of the signed url of approved requests, default 168h
+	TTL config.Duration `toml:"ttl"`
+	// MaxPending limits the open requests per email address, default 10
+	MaxPending int `toml:"maxpending"`
+}
+
+const (
+	PrintRequestPending  = "pending"
+	PrintRequestApproved = "approved"
+	PrintRequestRejected = "rejected"
+)
+
+// PrintRequest is a request for a print derivative of an item
+type PrintRequest struct {
+	ID         string    `json:"id"`
+	Collection string    `json:"collection"`
+	Signature  string    `json:"signature"`
+	Action     string    `json:"action"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email"`
+	Purpose    string    `json:"purpose"`
+	Lang       string    `json:"lang,omitempty"`
+	Status     string    `json:"status"`
+	Created    time.Time `json:"created"`
+	Decided    time.Time `json:"decided"`
+	Reason     string    `json:"reason,omitempty"`
+	// Expires is the end of the signed url of an approved request. the url itself is not kept
+	Expires time.Time `json:"expires"`
+}
+
+type printRequests struct {
+	sync.Mutex
+	conf     *PrintRequestConfig
+	ttl      time.Duration
+	requests map[string]*PrintRequest
+}
+
+// WithPrintRequests enables requests for print derivatives at POST /print/:collection/:signature. requests are approved
+// or rejected at /admin/printrequests, approved requests get a signed url by mail
+func WithPrintRequests(conf *PrintRequestConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if len(conf.Actions) == 0 {
+			return errors.New("no print actions configured")
+		}
+		pr := &printRequests{
+			conf:     conf,
+			ttl:      time.Duration(conf.TTL),
+			requests: map[string]*PrintRequest{},
+		}
+		if pr.ttl <= 0 {
+			pr.ttl = 7 * 24 * time.Hour
+		}
+		if pr.ttl > maxMintTTL {
+			return errors.Errorf("print request ttl %s exceeds maximum of %s", pr.ttl, maxMintTTL)
+		}
+		if conf.MaxPending <= 0 {
+			conf.MaxPending = 10
+		}
+		if conf.File != "" {
+			data, err := fs.ReadFile(ctrl.vfs, conf.File)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Wrapf(err, "cannot read %s", conf.File)
+			}
+			if err == nil {
+				var requests []*PrintRequest
+				if err := json.Unmarshal(data, &requests); err != nil {
+					return errors.Wrapf(err, "cannot unmarshal %s", conf.File)
+				}
+				for _, r := range requests {
+					pr.requests[r.ID] = r
+				}
+			}
+		}
+		ctrl.printRequests = pr
+		return nil
+	}
+}
+
+// list returns the requests with status, all if empty, oldest first. the lock must be held
+func (pr *printRequests) list(status string) []*PrintRequest {
+	var result = []*PrintRequest{}
+	for _, r := range pr.requests {
+		if status == "" || r.Status == status {
+			result = append(result, r)
+		}
+	}
+	slices.SortFunc(result, func(a, b *PrintRequest) int { return a.Created.Compare(b.Created) })
+	return result
+}
+
+// savePrintRequests writes the requests to the file. the lock must be held
+func (ctrl *mainController) savePrintRequests() error {
+	pr := ctrl.printRequests
+	if pr.conf.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(pr.list(""))
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal print requests")
+	}
+	fp, err := writefs.Create(ctrl.vfs, pr.conf.File)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", pr.conf.File)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", pr.conf.File)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", pr.conf.File)
+}
+
+type printRequestBody struct {
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Purpose string `json:"purpose"`
+	Lang    string `json:"lang"`
+}
+
+// maxPrintRequestField limits the free text of requests
+const maxPrintRequestField = 2000
+
+func (ctrl *mainController) printRequest(c *gin.Context) {
+	pr := ctrl.printRequests
+	if pr == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	var req printRequestBody
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid email '%s'", req.Email)})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || len(req.Name) > maxPrintRequestField || len(req.Purpose) > maxPrintRequestField {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required, name and purpose are limited to 2000 characters"})
+		return
+	}
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("item %s/%s not found", collection, signature)})
+		return
+	}
+	source, ok := pr.conf.Actions[item.GetMetadata().GetType()]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no print derivative for %s/%s", collection, signature)})
+		return
+	}
+	action, paramStr, _ := strings.Cut(normalizePath(source), "/")
+	canonical, err := ctrl.canonicalAction(item.GetMetadata().GetType(), action, paramStr)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("invalid print action %s for %s/%s", source, collection, signature)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("invalid print action for %s/%s", collection, signature)})
+		return
+	}
+	// the requester gets the notification in the language of the request
+	lang := req.Lang
+	if lang == "" {
+		tag, _ := ctrl.requestLanguage(c, collection)
+		lang = tag.String()
+	}
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot create request id"})
+		return
+	}
+	r := &PrintRequest{
+		ID:         shortLinkEncoding.EncodeToString(buf),
+		Collection: collection,
+		Signature:  signature,
+		Action:     canonical,
+		Name:       strings.TrimSpace(req.Name),
+		Email:      addr.Address,
+		Purpose:    strings.TrimSpace(req.Purpose),
+		Lang:       lang,
+		Status:     PrintRequestPending,
+		Created:    time.Now(),
+	}
+	pr.Lock()
+	pending := 0
+	for _, other := range pr.requests {
+		if other.Status == PrintRequestPending && strings.EqualFold(other.Email, r.Email) {
+			pending++
+		}
+	}
+	if pending >= pr.conf.MaxPending {
+		pr.Unlock()
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("%d open requests for %s", pending, r.Email)})
+		return
+	}
+	pr.requests[r.ID] = r
+	if err = ctrl.savePrintRequests(); err != nil {
+		delete(pr.requests, r.ID)
+	}
+	pr.Unlock()
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot save print requests")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot save request"})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "printrequest").
+		Str("id", r.ID).
+		Str("collection", collection).
+		Str("signature", signature).
+		Str("action", canonical).
+		Str("remote", c.ClientIP()).
+		Msg("print request received")
+	c.JSON(http.StatusAccepted, gin.H{"id": r.ID, "status": r.Status})
+}
+
+func (ctrl *mainController) adminPrintRequests(c *gin.Context) {
+	pr := ctrl.printRequests
+	if pr == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "print requests not enabled"})
+		return
+	}
+	pr.Lock()
+	var result = []PrintRequest{}
+	for _, r := range pr.list(c.Query("status")) {
+		result = append(result, *r)
+	}
+	pr.Unlock()
+	c.JSON(http.StatusOK, result)
+}
+
+type printDecision struct {
+	// TTL of the signed url, default from the configuration
+	TTL    string `json:"ttl"`
+	Reason string `json:"reason"`
+}
+
+// adminDecidePrintRequest approves or rejects a pending request. approvals mint a signed url which is mailed to the
+// requester and returned, so it can be forwarded manually if the mail fails
+func (ctrl *mainController) adminDecidePrintRequest(c *gin.Context) {
+	pr := ctrl.printRequests
+	if pr == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "print requests not enabled"})
+		return
+	}
+	id := c.Param("id")
+	decision := c.Param("decision")
+	if decision != "approve" && decision != "reject" {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown decision '%s'", decision)})
+		return
+	}
+	var req printDecision
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+			return
+		}
+	}
+	ttl := pr.ttl
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 || ttl > maxMintTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid ttl '%s'", req.TTL)})
+			return
+		}
+	}
+	pr.Lock()
+	r, ok := pr.requests[id]
+	if !ok {
+		pr.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("print request '%s' not found", id)})
+		return
+	}
+	if r.Status != PrintRequestPending {
+		pr.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("print request '%s' is %s", id, r.Status)})
+		return
+	}
+	old := *r
+	var signedURL, message string
+	now := time.Now()
+	if decision == "approve" {
+		action, paramStr, _ := strings.Cut(r.Action, "/")
+		tokenSubject := AccessSubject(r.Collection, r.Signature, action, paramStr)
+		token, err := ctrl.mintCollectionToken(r.Collection, tokenSubject, ttl)
+		if err != nil {
+			pr.Unlock()
+			ctrl.logger.Error().Err(err).Msgf("cannot mint token for %s", tokenSubject)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot mint token for %s: %v", tokenSubject, err)})
+			return
+		}
+		signedURL = ctrl.externalURL(tokenSubject) + "?token=" + token
+		r.Status, r.Expires = PrintRequestApproved, now.Add(ttl)
+		message = "print_approved"
+	} else {
+		r.Status, r.Reason = PrintRequestRejected, req.Reason
+		message = "print_rejected"
+	}
+	r.Decided = now
+	if err := ctrl.savePrintRequests(); err != nil {
+		*r = old
+		pr.Unlock()
+		ctrl.logger.Error().Err(err).Msg("cannot save print requests")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot save request"})
+		return
+	}
+	ctrl.logger.Info().
+		Str("audit", "printrequest").
+		Str("id", r.ID).
+		Str("collection", r.Collection).
+		Str("signature", r.Signature).
+		Str("status", r.Status).
+		Str("remote", c.ClientIP()).
+		Msg("print request decided")
+	decided := *r
+	pr.Unlock()
+	mailed, err := ctrl.sendTemplate(c.Request.Context(), decided.Email, decided.Lang, message, map[string]any{
+		"Collection": decided.Collection,
+		"Signature":  decided.Signature,
+		"Name":       decided.Name,
+		"Reason":     decided.Reason,
+		"Expires":    decided.Expires.UTC().Format(time.RFC1123),
+		"URL":        signedURL,
+	})
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot notify print request %s", decided.ID)
+	}
+	result := gin.H{"request": decided, "mailed": mailed}
+	if signedURL != "" {
+		result["url"] = signedURL
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,94 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type ProgressiveConfig struct {
+	Enabled bool `toml:"enabled"`
+	// FirstScan is the number of bytes of progressive images flushed before the rest of the file, so viewers render
+	// the first scans immediately. default 16KiB
+	FirstScan int `toml:"firstscan"`
+	// MimeTypes are the progressive formats, default image/jpeg
+	MimeTypes []string `toml:"mimetypes"`
+	// TileAlign widens range requests of tiled formats to blocks of this size, so viewers and caches reuse whole tiles.
+	// 0 keeps the requested ranges
+	TileAlign int `toml:"tilealign"`
+	// TiledMimeTypes are the tiled formats, default image/tiff
+	TiledMimeTypes []string `toml:"tiledmimetypes"`
+}
+
+// WithProgressiveDelivery delivers progressive images scan first and aligns range requests of tiled images
+func WithProgressiveDelivery(conf *ProgressiveConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if conf.FirstScan < 0 || conf.TileAlign < 0 {
+			return errors.Errorf("invalid progressive delivery sizes %d/%d", conf.FirstScan, conf.TileAlign)
+		}
+		if conf.FirstScan == 0 {
+			conf.FirstScan = 16 << 10
+		}
+		if len(conf.MimeTypes) == 0 {
+			conf.MimeTypes = []string{"image/jpeg"}
+		}
+		if len(conf.TiledMimeTypes) == 0 {
+			conf.TiledMimeTypes = []string{"image/tiff"}
+		}
+		ctrl.progressive = conf
+		return nil
+	}
+}
+
+// firstScan returns the number of bytes flushed first for full responses of the mime type, 0 for none
+func (ctrl *mainController) firstScan(mime string) int64 {
+	pc := ctrl.progressive
+	if pc == nil {
+		return 0
+	}
+	mime, _, _ = strings.Cut(mime, ";")
+	if !slices.Contains(pc.MimeTypes, strings.TrimSpace(mime)) {
+		return 0
+	}
+	return int64(pc.FirstScan)
+}
+
+// alignRange widens a single "bytes=first-last" range of a tiled mime type to the tile alignment. open and suffix
+// ranges only get their start aligned. multiple ranges are not changed
+func (ctrl *mainController) alignRange(rangeHeader, mime string) string {
+	pc := ctrl.progressive
+	if pc == nil || pc.TileAlign == 0 {
+		return rangeHeader
+	}
+	mime, _, _ = strings.Cut(mime, ";")
+	if !slices.Contains(pc.TiledMimeTypes, strings.TrimSpace(mime)) {
+		return rangeHeader
+	}
+	r, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok || strings.Contains(r, ",") {
+		return rangeHeader
+	}
+	firstStr, lastStr, ok := strings.Cut(strings.TrimSpace(r), "-")
+	if !ok || firstStr == "" {
+		return rangeHeader
+	}
+	first, err := strconv.ParseInt(firstStr, 10, 64)
+	if err != nil {
+		return rangeHeader
+	}
+	align := int64(pc.TileAlign)
+	if lastStr == "" {
+		return fmt.Sprintf("bytes=%d-", first-first%align)
+	}
+	last, err := strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first {
+		return rangeHeader
+	}
+	// http.ServeContent limits the end to the size of the file
+	return fmt.Sprintf("bytes=%d-%d", first-first%align, (last/align+1)*align-1)
+}
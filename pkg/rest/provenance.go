@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type provenanceMaster struct {
+	URN      string     `json:"urn"`
+	Type     string     `json:"type,omitempty"`
+	Subtype  string     `json:"subtype,omitempty"`
+	MimeType string     `json:"mimetype,omitempty"`
+	SHA512   string     `json:"sha512,omitempty"`
+	Created  *time.Time `json:"created,omitempty"`
+	Updated  *time.Time `json:"updated,omitempty"`
+}
+
+// provenanceDerivative contains everything the cache metadata knows about a derivative.
+// generation time, worker and checksum are not recorded by the database service
+type provenanceDerivative struct {
+	Action   string `json:"action"`
+	Params   string `json:"params"`
+	MimeType string `json:"mimetype"`
+	Width    int64  `json:"width,omitempty"`
+	Height   int64  `json:"height,omitempty"`
+	Duration int64  `json:"duration,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Path     string `json:"path"`
+	Storage  string `json:"storage,omitempty"`
+}
+
+type provenance struct {
+	Collection string                `json:"collection"`
+	Signature  string                `json:"signature"`
+	Master     *provenanceMaster     `json:"master"`
+	Derivative *provenanceDerivative `json:"derivative"`
+	URL        string                `json:"url"`
+}
+
+func timestampPtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// provenance answers /:collection/:signature/provenance/<action>/<params> with the origin of an existing derivative
+func (ctrl *mainController) provenance(c *gin.Context, item *mediaserverproto.Item, collection, signature, paramStr string) {
+	parts := strings.SplitN(strings.Trim(paramStr, "/"), "/", 2)
+	derivateAction := parts[0]
+	if derivateAction == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no action given. use provenance/<action>/<params>"})
+		return
+	}
+	var derivateParamStr string
+	if len(parts) > 1 {
+		derivateParamStr = parts[1]
+	}
+	var params = actionCache.ActionParams{}
+	if derivateAction != "item" && derivateAction != "master" {
+		allowedParams, err := ctrl.getParams(item.GetMetadata().GetType(), derivateAction)
+		if err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot get params for %s::%s", item.GetMetadata().GetType(), derivateAction)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("cannot get params for %s::%s: %v", item.GetMetadata().GetType(), derivateAction, err),
+			})
+			return
+		}
+		params.SetString(derivateParamStr, allowedParams)
+	}
+	cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
+		Identifier: &mediaserverproto.ItemIdentifier{
+			Collection: collection,
+			Signature:  signature,
+		},
+		Action: derivateAction,
+		Params: params.String(),
+	})
+	if err != nil {
+		if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("no derivative %s/%s for %s/%s", derivateAction, params.String(), collection, signature),
+			})
+			return
+		}
+		ctrl.logger.Error().Err(err).Msgf("cannot get cache for %s/%s/%s", collection, signature, derivateAction)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("cannot get cache for %s/%s/%s: %v", collection, signature, derivateAction, err),
+		})
+		return
+	}
+	metadata := cache.GetMetadata()
+	itemMetadata := item.GetMetadata()
+	result := &provenance{
+		Collection: collection,
+		Signature:  signature,
+		Master: &provenanceMaster{
+			URN:      item.GetUrn(),
+			Type:     itemMetadata.GetType(),
+			Subtype:  itemMetadata.GetSubtype(),
+			MimeType: itemMetadata.GetMimetype(),
+			SHA512:   itemMetadata.GetSha512(),
+			Created:  timestampPtr(item.GetCreated().AsTime()),
+			Updated:  timestampPtr(itemLastModified(item)),
+		},
+		Derivative: &provenanceDerivative{
+			Action:   metadata.GetAction(),
+			Params:   metadata.GetParams(),
+			MimeType: metadata.GetMimeType(),
+			Width:    metadata.GetWidth(),
+			Height:   metadata.GetHeight(),
+			Duration: metadata.GetDuration(),
+			Size:     metadata.GetSize(),
+			Path:     metadata.GetPath(),
+			Storage:  metadata.GetStorage().GetName(),
+		},
+		URL: ctrl.externalURL(collection, signature, derivateAction, params.String()),
+	}
+	if item.GetCreated() == nil {
+		result.Master.Created = nil
+	}
+	c.JSON(http.StatusOK, result)
+}
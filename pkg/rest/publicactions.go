@@ -0,0 +1,86 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// PublicActionsRequest is the public flag and the public actions of an item to validate
+type PublicActionsRequest struct {
+	Public        *bool    `json:"public,omitempty"`
+	PublicActions []string `json:"publicactions"`
+}
+
+func (ctrl *mainController) adminPublicActions(c *gin.Context) {
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s/%s not found", collection, signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"collection":    collection,
+		"signature":     signature,
+		"type":          item.GetMetadata().GetType(),
+		"public":        item.GetPublic(),
+		"publicactions": item.GetPublicActions(),
+	})
+}
+
+// adminValidatePublicActions validates the public actions of an item against the actions supported for its media
+// type and returns them in the canonical form to store in the database. nothing is changed, the database service
+// has no rpc to update items
+func (ctrl *mainController) adminValidatePublicActions(c *gin.Context) {
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	var req PublicActionsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s/%s not found", collection, signature)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err)})
+		return
+	}
+	mediaType := item.GetMetadata().GetType()
+	var publicActions = []string{}
+	var errs = map[string]string{}
+	for _, pa := range req.PublicActions {
+		action, paramStr, _ := strings.Cut(normalizePath(pa), "/")
+		canonical, err := ctrl.canonicalAction(mediaType, action, paramStr)
+		if err != nil {
+			errs[pa] = fmt.Sprintf("action '%s' not supported for type '%s'", action, mediaType)
+			continue
+		}
+		publicActions = append(publicActions, canonical)
+	}
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid public actions", "actions": errs})
+		return
+	}
+	public := item.GetPublic()
+	if req.Public != nil {
+		public = *req.Public
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"collection":    collection,
+		"signature":     signature,
+		"type":          mediaType,
+		"public":        public,
+		"publicactions": publicActions,
+	})
+}
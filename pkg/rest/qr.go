@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaservermain/v2/pkg/qrcode"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxQRScale limits the pixels per module of rendered qr codes
+const maxQRScale = 32
+
+// qrCode renders /qr/<path>?format=png|svg&scale=<n> as qr code of the external url of <path>.
+// all other query parameters, e.g. a token, are part of the encoded url
+func (ctrl *mainController) qrCode(c *gin.Context) {
+	query := c.Request.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	scale := 8
+	if s := query.Get("scale"); s != "" {
+		var err error
+		if scale, err = strconv.Atoi(s); err != nil || scale < 1 || scale > maxQRScale {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid scale '%s', allowed 1-%d", s, maxQRScale)})
+			return
+		}
+	}
+	query.Del("format")
+	query.Del("scale")
+	path := normalizePath(c.Param("path"))
+	if path == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no path given. use /qr/<path>"})
+		return
+	}
+	u := ctrl.externalURL(strings.Split(path, "/")...)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	code, err := qrcode.Encode([]byte(u))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("cannot encode '%s': %v. use a short link", u, err)})
+		return
+	}
+	if query.Has("token") || query.Has("sig") {
+		c.Header("Cache-Control", "private, no-store")
+	} else {
+		c.Header("Cache-Control", "public, max-age=86400")
+	}
+	switch format {
+	case "png":
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, code.Image(scale)); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot encode png for %s", u)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot encode png: %v", err)})
+			return
+		}
+		c.Data(http.StatusOK, "image/png", buf.Bytes())
+	case "svg":
+		c.Data(http.StatusOK, "image/svg+xml", []byte(code.SVG(scale)))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid format '%s', use png or svg", format)})
+	}
+}
@@ -0,0 +1,341 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type QuarantineConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Failures of generations of an item within Window which quarantine the item, default 5 within 1h
+	Failures int             `toml:"failures"`
+	Window   config.Duration `toml:"window"`
+	// Duration of automatic quarantines, 0 until released at DELETE /admin/quarantine/:collection/:signature
+	Duration config.Duration `toml:"duration"`
+	// File keeps the quarantined items in the vfs across restarts, e.g. "vfs://testcache/quarantine.json"
+	File string `toml:"file"`
+	// Placeholders maps the media type to a vfs file served instead of derivatives of quarantined items
+	Placeholders map[string]string `toml:"placeholders"`
+}
+
+var errQuarantined = errors.New("item quarantined")
+
+// QuarantinedItem is an item whose derivatives are not generated
+type QuarantinedItem struct {
+	Collection string    `json:"collection"`
+	Signature  string    `json:"signature"`
+	Since      time.Time `json:"since"`
+	// Until is the end of the quarantine, zero until released
+	Until     time.Time `json:"until"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lasterror,omitempty"`
+	// Manual quarantines were set by an admin
+	Manual bool `json:"manual"`
+}
+
+type itemFailures struct {
+	count int
+	since time.Time
+}
+
+type quarantine struct {
+	sync.Mutex
+	conf     *QuarantineConfig
+	window   time.Duration
+	items    map[itemIdentifier]*QuarantinedItem
+	failures map[itemIdentifier]*itemFailures
+}
+
+// WithQuarantine stops the generation of derivatives for items which fail repeatedly, e.g. corrupt masters crashing
+// the workers. requests get a placeholder or an error until the item is released
+func WithQuarantine(conf *QuarantineConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if conf.Failures <= 0 {
+			conf.Failures = 5
+		}
+		q := &quarantine{
+			conf:     conf,
+			window:   time.Duration(conf.Window),
+			items:    map[itemIdentifier]*QuarantinedItem{},
+			failures: map[itemIdentifier]*itemFailures{},
+		}
+		if q.window <= 0 {
+			q.window = time.Hour
+		}
+		for mediaType, placeholder := range conf.Placeholders {
+			if _, err := fs.Stat(ctrl.vfs, placeholder); err != nil {
+				return errors.Wrapf(err, "cannot stat placeholder %s for %s", placeholder, mediaType)
+			}
+		}
+		if conf.File != "" {
+			data, err := fs.ReadFile(ctrl.vfs, conf.File)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return errors.Wrapf(err, "cannot read %s", conf.File)
+			}
+			if err == nil {
+				var items []*QuarantinedItem
+				if err := json.Unmarshal(data, &items); err != nil {
+					return errors.Wrapf(err, "cannot unmarshal %s", conf.File)
+				}
+				for _, qi := range items {
+					q.items[itemIdentifier{collection: qi.Collection, signature: qi.Signature}] = qi
+				}
+			}
+		}
+		ctrl.quarantine = q
+		return nil
+	}
+}
+
+// poisonError reports whether a failure counts for the quarantine. outages and saturation of the action pool are
+// no fault of the item
+func poisonError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Canceled:
+		return false
+	}
+	return true
+}
+
+// quarantined returns the quarantine of an item. expired quarantines are removed. the lock must be held
+func (q *quarantine) quarantined(key itemIdentifier, now time.Time) (*QuarantinedItem, bool) {
+	qi, ok := q.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !qi.Until.IsZero() && !now.Before(qi.Until) {
+		delete(q.items, key)
+		return nil, false
+	}
+	return qi, true
+}
+
+// checkQuarantine returns errQuarantined for quarantined items
+func (ctrl *mainController) checkQuarantine(item *mediaserverproto.Item) error {
+	q := ctrl.quarantine
+	if q == nil {
+		return nil
+	}
+	key := itemIdentifier{collection: item.GetIdentifier().GetCollection(), signature: item.GetIdentifier().GetSignature()}
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.quarantined(key, time.Now()); ok {
+		return errors.Wrapf(errQuarantined, "%s/%s", key.collection, key.signature)
+	}
+	return nil
+}
+
+// countFailure counts a failed generation and quarantines the item above the limit
+func (ctrl *mainController) countFailure(item *mediaserverproto.Item, err error) {
+	q := ctrl.quarantine
+	if q == nil || !poisonError(err) {
+		return
+	}
+	key := itemIdentifier{collection: item.GetIdentifier().GetCollection(), signature: item.GetIdentifier().GetSignature()}
+	now := time.Now()
+	q.Lock()
+	defer q.Unlock()
+	f, ok := q.failures[key]
+	if !ok || now.Sub(f.since) > q.window {
+		f = &itemFailures{since: now}
+		q.failures[key] = f
+	}
+	f.count++
+	if f.count < q.conf.Failures {
+		return
+	}
+	delete(q.failures, key)
+	qi := &QuarantinedItem{Collection: key.collection, Signature: key.signature, Since: now, Failures: f.count, LastError: err.Error()}
+	if q.conf.Duration > 0 {
+		qi.Until = now.Add(time.Duration(q.conf.Duration))
+	}
+	q.items[key] = qi
+	ctrl.logger.Warn().Str("audit", "quarantine").Str("collection", key.collection).Str("signature", key.signature).
+		Msgf("item quarantined after %d failures within %s", f.count, q.window)
+	ctrl.stopActionRetries(key)
+	if err := ctrl.saveQuarantine(); err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot save quarantine")
+	}
+}
+
+// resetFailures forgets the failures of an item after a successful generation
+func (ctrl *mainController) resetFailures(item *mediaserverproto.Item) {
+	q := ctrl.quarantine
+	if q == nil {
+		return
+	}
+	q.Lock()
+	delete(q.failures, itemIdentifier{collection: item.GetIdentifier().GetCollection(), signature: item.GetIdentifier().GetSignature()})
+	q.Unlock()
+}
+
+// stopActionRetries ends the automatic retries of the failed generations of an item
+func (ctrl *mainController) stopActionRetries(key itemIdentifier) {
+	ae := ctrl.actionErrors
+	if ae == nil {
+		return
+	}
+	ae.Lock()
+	defer ae.Unlock()
+	for _, e := range ae.entries {
+		if e.Collection == key.collection && e.Signature == key.signature && !e.NextRetry.IsZero() {
+			e.NextRetry = time.Time{}
+			ae.dirty = true
+		}
+	}
+}
+
+// list returns copies of the current quarantines. the lock must be held
+func (q *quarantine) list(now time.Time) []QuarantinedItem {
+	var result = []QuarantinedItem{}
+	for key := range q.items {
+		if qi, ok := q.quarantined(key, now); ok {
+			result = append(result, *qi)
+		}
+	}
+	slices.SortFunc(result, func(a, b QuarantinedItem) int {
+		return strings.Compare(a.Collection+"/"+a.Signature, b.Collection+"/"+b.Signature)
+	})
+	return result
+}
+
+// saveQuarantine writes the quarantined items to the file. the lock must be held
+func (ctrl *mainController) saveQuarantine() error {
+	q := ctrl.quarantine
+	if q.conf.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.list(time.Now()))
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal quarantine")
+	}
+	fp, err := writefs.Create(ctrl.vfs, q.conf.File)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", q.conf.File)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", q.conf.File)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", q.conf.File)
+}
+
+// quarantineResponse serves the placeholder of the media type or a localized error. neither may be cached
+func (ctrl *mainController) quarantineResponse(c *gin.Context, item *mediaserverproto.Item, err error) {
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	traceDecision(c, "quarantine", "%s/%s", collection, signature)
+	c.Header("Cache-Control", "no-store")
+	if placeholder, ok := ctrl.quarantine.conf.Placeholders[item.GetMetadata().GetType()]; ok {
+		ctrl.serveFile(c, placeholder, mime.TypeByExtension(path.Ext(placeholder)), "")
+		return
+	}
+	ctrl.errorResponse(c, http.StatusServiceUnavailable, collection, err, "quarantined", collection+"/"+signature)
+}
+
+func (ctrl *mainController) adminQuarantine(c *gin.Context) {
+	q := ctrl.quarantine
+	if q == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quarantine not enabled"})
+		return
+	}
+	q.Lock()
+	result := q.list(time.Now())
+	q.Unlock()
+	c.JSON(http.StatusOK, result)
+}
+
+type quarantineRequest struct {
+	// Duration of the quarantine, e.g. "24h". until released if empty
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// adminSetQuarantine quarantines (PUT) or releases (DELETE) an item
+func (ctrl *mainController) adminSetQuarantine(c *gin.Context) {
+	q := ctrl.quarantine
+	if q == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quarantine not enabled"})
+		return
+	}
+	key := itemIdentifier{collection: c.Param("collection"), signature: c.Param("signature")}
+	now := time.Now()
+	var qi *QuarantinedItem
+	if c.Request.Method == http.MethodPut {
+		var req quarantineRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+				return
+			}
+		}
+		if _, err := ctrl.getItem(key.collection, key.signature); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("item %s/%s not found", key.collection, key.signature)})
+			return
+		}
+		qi = &QuarantinedItem{Collection: key.collection, Signature: key.signature, Since: now, LastError: req.Reason, Manual: true}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid duration '%s'", req.Duration)})
+				return
+			}
+			qi.Until = now.Add(d)
+		}
+	}
+	q.Lock()
+	old, wasQuarantined := q.quarantined(key, now)
+	if qi != nil {
+		q.items[key] = qi
+	} else {
+		delete(q.items, key)
+	}
+	delete(q.failures, key)
+	err := ctrl.saveQuarantine()
+	if err != nil {
+		if wasQuarantined {
+			q.items[key] = old
+		} else {
+			delete(q.items, key)
+		}
+	}
+	q.Unlock()
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot save quarantine of %s/%s", key.collection, key.signature)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if qi != nil {
+		ctrl.stopActionRetries(key)
+	}
+	ctrl.logger.Info().
+		Str("audit", "quarantine").
+		Str("collection", key.collection).
+		Str("signature", key.signature).
+		Bool("quarantined", qi != nil).
+		Str("remote", c.ClientIP()).
+		Msg("quarantine changed")
+	if qi == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, qi)
+}
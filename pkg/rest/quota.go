@@ -0,0 +1,218 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"io/fs"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StorageQuotaConfig struct {
+	// Quotas maps the collection to the maximum storage usage in bytes
+	Quotas map[string]int64 `toml:"quotas"`
+	// Paths maps a collection to the vfs folder which is walked for the usage, default is the filebase of the
+	// collection storage. collections sharing a storage need their own folders
+	Paths map[string]string `toml:"paths"`
+	// Interval between the walks, default 1h. derivatives created in between are added to the usage
+	Interval config.Duration `toml:"interval"`
+}
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// StorageUsage is the storage usage of a collection
+type StorageUsage struct {
+	Collection string    `json:"collection"`
+	Path       string    `json:"path,omitempty"`
+	Quota      int64     `json:"quota"`
+	Bytes      int64     `json:"bytes"`
+	Files      int64     `json:"files"`
+	Scanned    time.Time `json:"scanned,omitempty"`
+	LastError  string    `json:"lasterror,omitempty"`
+	alerted    bool
+}
+
+type storageQuota struct {
+	sync.Mutex
+	conf     *StorageQuotaConfig
+	interval time.Duration
+	usage    map[string]*StorageUsage
+	scan     chan struct{}
+}
+
+// WithStorageQuota refuses the generation of derivatives for collections above their storage quota
+func WithStorageQuota(conf *StorageQuotaConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || len(conf.Quotas) == 0 {
+			return nil
+		}
+		sq := &storageQuota{
+			conf:     conf,
+			interval: time.Duration(conf.Interval),
+			usage:    map[string]*StorageUsage{},
+			scan:     make(chan struct{}, 1),
+		}
+		if sq.interval <= 0 {
+			sq.interval = time.Hour
+		}
+		for collection, quota := range conf.Quotas {
+			if quota <= 0 {
+				return errors.Errorf("invalid storage quota %d for collection %s", quota, collection)
+			}
+			sq.usage[collection] = &StorageUsage{Collection: collection, Quota: quota}
+		}
+		ctrl.storageQuota = sq
+		return nil
+	}
+}
+
+// quotaPath returns the vfs folder of a collection
+func (ctrl *mainController) quotaPath(collection string) (string, error) {
+	if p, ok := ctrl.storageQuota.conf.Paths[collection]; ok {
+		return p, nil
+	}
+	coll, err := ctrl.getCollection(collection)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get collection %s", collection)
+	}
+	stor := coll.GetStorage()
+	if stor.GetFilebase() == "" {
+		return "", errors.Errorf("no storage for collection %s", collection)
+	}
+	return ctrl.mapVFS(collection, stor.GetName(), stor.GetFilebase()), nil
+}
+
+// scanQuota walks the folder of a collection
+func (ctrl *mainController) scanQuota(ctx context.Context, collection string) {
+	sq := ctrl.storageQuota
+	var bytes, files int64
+	p, err := ctrl.quotaPath(collection)
+	if err == nil {
+		err = fs.WalkDir(ctrl.vfs, p, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return errors.Wrapf(err, "cannot stat %s", name)
+			}
+			bytes += info.Size()
+			files++
+			return nil
+		})
+	}
+	sq.Lock()
+	defer sq.Unlock()
+	usage := sq.usage[collection]
+	usage.Path = p
+	usage.Scanned = time.Now()
+	if err != nil {
+		// keep the last known usage
+		ctrl.logger.Error().Err(err).Msgf("cannot scan storage usage of collection %s", collection)
+		usage.LastError = err.Error()
+		return
+	}
+	usage.Bytes, usage.Files, usage.LastError = bytes, files, ""
+	ctrl.quotaAlert(usage)
+	ctrl.accountStorage(collection, bytes)
+}
+
+func (ctrl *mainController) runStorageQuota(ctx context.Context) {
+	sq := ctrl.storageQuota
+	ticker := time.NewTicker(sq.interval)
+	defer ticker.Stop()
+	for {
+		for collection := range sq.conf.Quotas {
+			ctrl.scanQuota(ctx, collection)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sq.scan:
+		}
+	}
+}
+
+// checkQuota returns errQuotaExceeded if the collection of the item is at or above its quota
+func (ctrl *mainController) checkQuota(item *mediaserverproto.Item) error {
+	sq := ctrl.storageQuota
+	if sq == nil {
+		return nil
+	}
+	collection := item.GetIdentifier().GetCollection()
+	sq.Lock()
+	defer sq.Unlock()
+	usage, ok := sq.usage[collection]
+	if !ok || usage.Bytes < usage.Quota {
+		return nil
+	}
+	return errors.Wrapf(errQuotaExceeded, "collection %s uses %d of %d bytes", collection, usage.Bytes, usage.Quota)
+}
+
+// addQuotaUsage adds a new derivative to the usage until the next walk
+func (ctrl *mainController) addQuotaUsage(item *mediaserverproto.Item, cache *mediaserverproto.Cache) {
+	sq := ctrl.storageQuota
+	if sq == nil || cache == nil {
+		return
+	}
+	sq.Lock()
+	defer sq.Unlock()
+	if usage, ok := sq.usage[item.GetIdentifier().GetCollection()]; ok {
+		usage.Bytes += cache.GetMetadata().GetSize()
+		usage.Files++
+		ctrl.quotaAlert(usage)
+	}
+}
+
+// quotaAlert notifies the admins once when the usage reaches the quota. the lock must be held
+func (ctrl *mainController) quotaAlert(usage *StorageUsage) {
+	exceeded := usage.Bytes >= usage.Quota
+	if exceeded && !usage.alerted {
+		go ctrl.alert("quota", *usage)
+	}
+	usage.alerted = exceeded
+}
+
+func (ctrl *mainController) adminQuota(c *gin.Context) {
+	sq := ctrl.storageQuota
+	if sq == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "storage quota not configured"})
+		return
+	}
+	sq.Lock()
+	var result = []StorageUsage{}
+	for _, usage := range sq.usage {
+		result = append(result, *usage)
+	}
+	sq.Unlock()
+	slices.SortFunc(result, func(a, b StorageUsage) int { return strings.Compare(a.Collection, b.Collection) })
+	c.JSON(http.StatusOK, result)
+}
+
+// adminQuotaScan starts a walk of all collections with quota
+func (ctrl *mainController) adminQuotaScan(c *gin.Context) {
+	sq := ctrl.storageQuota
+	if sq == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "storage quota not configured"})
+		return
+	}
+	select {
+	case sq.scan <- struct{}{}:
+	default:
+	}
+	c.JSON(http.StatusAccepted, gin.H{"scan": fmt.Sprintf("%d collections", len(sq.conf.Quotas))})
+}
@@ -0,0 +1,98 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"net/http"
+)
+
+var errReadOnly = errors.New("derivative generation disabled in read-only mode")
+
+// WithReadOnly starts the controller in read-only mode. it can be toggled with POST /admin/readonly
+func WithReadOnly(readOnly bool) Option {
+	return func(ctrl *mainController) error {
+		ctrl.readOnly.Store(readOnly)
+		return nil
+	}
+}
+
+// generate creates a derivative unless the server is read-only, the collection is above its storage quota or the item
+// is quarantined.
+// derivatives above the size budget may be refused
+func (ctrl *mainController) generate(ctx context.Context, param *mediaserverproto.ActionParam) (*mediaserverproto.Cache, error) {
+	return ctrl.generateChecked(ctx, param, true)
+}
+
+// generateChecked generates the derivative and its dependencies once for concurrent requests. with forward, items of
+// other generation peers are generated by their peer
+func (ctrl *mainController) generateChecked(ctx context.Context, param *mediaserverproto.ActionParam, forward bool) (*mediaserverproto.Cache, error) {
+	if ctrl.readOnly.Load() {
+		return nil, errReadOnly
+	}
+	if err := ctrl.checkQuota(param.GetItem()); err != nil {
+		return nil, err
+	}
+	if err := ctrl.checkQuarantine(param.GetItem()); err != nil {
+		return nil, err
+	}
+	if peer, ok := ctrl.generationPeer(param.GetItem()); ok && forward {
+		cache, err := ctrl.forwardGeneration(ctx, peer, param)
+		if !errors.Is(err, errPeerUnavailable) {
+			return cache, err
+		}
+		ctrl.logger.Warn().Err(err).Msgf("generating %s locally", generationKey(param))
+	}
+	return ctrl.generationFlights.do(ctx, generationKey(param), func(ctx context.Context) (*mediaserverproto.Cache, error) {
+		if err := ctrl.generateDependencies(ctx, param); err != nil {
+			return nil, err
+		}
+		ctrl.generations.Add(1)
+		defer ctrl.generations.Add(-1)
+		cache, err := ctrl.actionControllerClient.Action(ctx, param)
+		if err != nil {
+			ctrl.recordActionError(param, err)
+			ctrl.countFailure(param.GetItem(), err)
+			return nil, err
+		}
+		ctrl.clearActionError(param)
+		ctrl.resetFailures(param.GetItem())
+		ctrl.addQuotaUsage(param.GetItem(), cache)
+		ctrl.accountDerivative(param.GetItem(), cache)
+		if err := ctrl.checkSizeBudget(param.GetItem(), cache); err != nil {
+			return nil, err
+		}
+		if err := ctrl.verifyMetadataEmbed(param, cache); err != nil {
+			// the derivative is delivered, the failure is listed for a retry after fixing the action
+			ctrl.logger.Error().Err(err).Msgf("cannot verify embedded metadata of %s", generationKey(param))
+			ctrl.recordActionError(param, err)
+		}
+		return cache, nil
+	})
+}
+
+// denyReadOnly rejects mutating admin requests in read-only mode
+func (ctrl *mainController) denyReadOnly(c *gin.Context) {
+	if ctrl.readOnly.Load() {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "server is in read-only mode"})
+		return
+	}
+	c.Next()
+}
+
+type readOnlyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (ctrl *mainController) adminReadOnly(c *gin.Context) {
+	var req readOnlyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	ctrl.readOnly.Store(req.Enabled)
+	ctrl.logger.Info().Msgf("read-only mode: %v", req.Enabled)
+	c.JSON(http.StatusOK, gin.H{"readonly": req.Enabled})
+}
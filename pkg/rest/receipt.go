@@ -0,0 +1,124 @@
+package rest
+
+import (
+	"crypto/sha512"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ReceiptConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Alg is the jws algorithm of the receipts
+	Alg string `toml:"alg"`
+	// Key is the hmac secret or a pem encoded private key
+	Key config.EnvString `toml:"key"`
+}
+
+type receiptSigner struct {
+	method jwt.SigningMethod
+	key    any
+}
+
+// WithReceipts enables signed delivery receipts at /:collection/:signature/receipt/<action>/<params>
+func WithReceipts(conf *ReceiptConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if err := validateAlgs([]string{conf.Alg}); err != nil {
+			return errors.Wrap(err, "invalid receipt alg")
+		}
+		method := jwt.GetSigningMethod(conf.Alg)
+		key, err := parseSigningKey(method, string(conf.Key))
+		if err != nil {
+			return errors.Wrap(err, "invalid receipt key")
+		}
+		ctrl.receiptSigner = &receiptSigner{method: method, key: key}
+		return nil
+	}
+}
+
+type receiptClaims struct {
+	jwt.RegisteredClaims
+	URL       string `json:"url"`
+	SHA512    string `json:"sha512"`
+	Size      int64  `json:"size,omitempty"`
+	MimeType  string `json:"mimetype,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// setReceiptLink announces the receipt of a delivery
+func (ctrl *mainController) setReceiptLink(c *gin.Context, collection, signature, action, paramStr string) {
+	if ctrl.receiptSigner == nil {
+		return
+	}
+	c.Writer.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"receipt\"", ctrl.externalURL(collection, signature, "receipt", action, paramStr)))
+}
+
+// receipt answers /:collection/:signature/receipt/<action>/<params> with a jws over the checksum of the delivered file
+func (ctrl *mainController) receipt(c *gin.Context, item *mediaserverproto.Item, collection, signature, paramStr, token string) {
+	if ctrl.receiptSigner == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "receipts not enabled"})
+		return
+	}
+	derivateAction, derivateParamStr, _ := strings.Cut(normalizePath(paramStr), "/")
+	if derivateAction == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no action given. use receipt/<action>/<params>"})
+		return
+	}
+	fp, metadata, err := ctrl.openCache(item, derivateAction, derivateParamStr)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot open %s/%s/%s/%s", collection, signature, derivateAction, derivateParamStr)
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("no derivative %s/%s for %s/%s: %v", derivateAction, derivateParamStr, collection, signature, err),
+		})
+		return
+	}
+	defer fp.Close()
+	checksum := item.GetMetadata().GetSha512()
+	size := metadata.GetSize()
+	if derivateAction != "item" && derivateAction != "master" || checksum == "" {
+		h := sha512.New()
+		if size, err = io.Copy(h, fp); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot read %s/%s/%s/%s", collection, signature, derivateAction, derivateParamStr)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("cannot read %s/%s/%s/%s: %v", collection, signature, derivateAction, derivateParamStr, err),
+			})
+			return
+		}
+		checksum = hex.EncodeToString(h.Sum(nil))
+	}
+	claims := receiptClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   ctrl.externalURL(),
+			Subject:  AccessSubject(collection, signature, metadata.GetAction(), metadata.GetParams()),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		},
+		URL:      ctrl.externalURL(collection, signature, metadata.GetAction(), metadata.GetParams()),
+		SHA512:   checksum,
+		Size:     size,
+		MimeType: metadata.GetMimeType(),
+	}
+	if token != "" {
+		if subject, err := ctrl.tokenSubject(collection, token); err == nil {
+			claims.Recipient = subject
+		}
+	}
+	receipt, err := jwt.NewWithClaims(ctrl.receiptSigner.method, claims).SignedString(ctrl.receiptSigner.key)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot sign receipt for %s", claims.Subject)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot sign receipt for %s: %v", claims.Subject, err)})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/jose", []byte(receipt))
+}
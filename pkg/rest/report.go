@@ -0,0 +1,230 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"net/http"
+	"net/mail"
+	"path"
+	"slices"
+	"time"
+)
+
+type ReportConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Schedule is "monthly" (default, the previous month on the first day), "weekly" (mondays) or "daily".
+	// weekly and daily reports cover the month to date
+	Schedule string `toml:"schedule"`
+	// Hour of the day (utc) the reports are created
+	Hour int `toml:"hour"`
+	// Dir is a vfs folder, reports are written to <dir>/<collection>/<name>.txt and .json
+	Dir string `toml:"dir"`
+	// Recipients get the reports of their collections by mail
+	Recipients map[string][]string `toml:"recipients"`
+	// Collections are reported in addition to the collections of the recipients and those with usage
+	Collections []string `toml:"collections"`
+	// Lang of the reports, default en
+	Lang string `toml:"lang"`
+}
+
+// Report is the summary of a collection. the storage usage is the one at the creation of the report
+type Report struct {
+	Collection string            `json:"collection"`
+	Name       string            `json:"name"`
+	Month      string            `json:"month"`
+	Created    time.Time         `json:"created"`
+	Usage      *AccountingRecord `json:"usage,omitempty"`
+	Storage    *StorageUsage     `json:"storage,omitempty"`
+}
+
+// WithReports creates periodic reports of usage, errors and storage per collection
+func WithReports(conf *ReportConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		switch conf.Schedule {
+		case "":
+			conf.Schedule = "monthly"
+		case "monthly", "weekly", "daily":
+		default:
+			return errors.Errorf("invalid report schedule '%s' - should be monthly, weekly or daily", conf.Schedule)
+		}
+		if conf.Hour < 0 || conf.Hour > 23 {
+			return errors.Errorf("invalid report hour %d", conf.Hour)
+		}
+		if conf.Dir == "" && len(conf.Recipients) == 0 {
+			return errors.New("reports need a folder or recipients")
+		}
+		for collection, recipients := range conf.Recipients {
+			for _, recipient := range recipients {
+				if _, err := mail.ParseAddress(recipient); err != nil {
+					return errors.Wrapf(err, "invalid report recipient '%s' for collection %s", recipient, collection)
+				}
+			}
+		}
+		ctrl.reports = conf
+		return nil
+	}
+}
+
+// due reports whether reports are created on the day of t
+func (rc *ReportConfig) due(t time.Time) bool {
+	switch rc.Schedule {
+	case "weekly":
+		return t.Weekday() == time.Monday
+	case "daily":
+		return true
+	default:
+		return t.Day() == 1
+	}
+}
+
+// next returns the first report time after now
+func (rc *ReportConfig) next(now time.Time) time.Time {
+	now = now.UTC()
+	t := time.Date(now.Year(), now.Month(), now.Day(), rc.Hour, 0, 0, 0, time.UTC)
+	for !t.After(now) || !rc.due(t) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// period returns the accounting month and the name of the reports created at t. reports cover the day before
+func (rc *ReportConfig) period(t time.Time) (string, string) {
+	day := t.UTC().AddDate(0, 0, -1)
+	month := accountingMonth(day)
+	if rc.Schedule == "monthly" {
+		return month, month
+	}
+	return month, day.Format(time.DateOnly)
+}
+
+// buildReports collects the reports created at t
+func (ctrl *mainController) buildReports(t time.Time) []*Report {
+	rc := ctrl.reports
+	month, name := rc.period(t)
+	collections := slices.Clone(rc.Collections)
+	for collection := range rc.Recipients {
+		collections = append(collections, collection)
+	}
+	usage := map[string]*AccountingRecord{}
+	if ctrl.accounting != nil {
+		for _, r := range ctrl.accounting.export(month) {
+			usage[r.Collection] = &r
+			collections = append(collections, r.Collection)
+		}
+	}
+	storage := map[string]*StorageUsage{}
+	if sq := ctrl.storageQuota; sq != nil {
+		sq.Lock()
+		for collection, u := range sq.usage {
+			su := *u
+			storage[collection] = &su
+			collections = append(collections, collection)
+		}
+		sq.Unlock()
+	}
+	slices.Sort(collections)
+	var result = []*Report{}
+	for _, collection := range slices.Compact(collections) {
+		result = append(result, &Report{
+			Collection: collection,
+			Name:       name,
+			Month:      month,
+			Created:    t,
+			Usage:      usage[collection],
+			Storage:    storage[collection],
+		})
+	}
+	return result
+}
+
+// deliverReport writes the report to the folder and mails it to the recipients of the collection
+func (ctrl *mainController) deliverReport(ctx context.Context, r *Report) error {
+	rc := ctrl.reports
+	var errs []error
+	if rc.Dir != "" {
+		_, body, err := ctrl.renderTemplate(rc.Lang, "report", r)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return errors.Wrap(err, "cannot marshal report")
+		}
+		for ext, content := range map[string][]byte{".txt": []byte(body), ".json": data} {
+			name := path.Join(rc.Dir, r.Collection, r.Name+ext)
+			fp, err := writefs.Create(ctrl.vfs, name)
+			if err != nil {
+				errs = append(errs, errors.Wrapf(err, "cannot create %s", name))
+				continue
+			}
+			if _, err := fp.Write(content); err != nil {
+				fp.Close()
+				errs = append(errs, errors.Wrapf(err, "cannot write %s", name))
+				continue
+			}
+			errs = append(errs, errors.Wrapf(fp.Close(), "cannot close %s", name))
+		}
+	}
+	for _, recipient := range rc.Recipients[r.Collection] {
+		if _, err := ctrl.sendTemplate(ctx, recipient, rc.Lang, "report", r); err != nil {
+			errs = append(errs, errors.WithStack(err))
+		}
+	}
+	return errors.Combine(errs...)
+}
+
+func (ctrl *mainController) runReports(ctx context.Context) {
+	rc := ctrl.reports
+	for {
+		next := rc.next(time.Now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		for _, r := range ctrl.buildReports(next) {
+			if err := ctrl.deliverReport(ctx, r); err != nil {
+				ctrl.logger.Error().Err(err).Msgf("cannot deliver report %s of collection %s", r.Name, r.Collection)
+			}
+		}
+		ctrl.logger.Info().Msgf("reports %s created", next.Format(time.DateOnly))
+	}
+}
+
+// adminReports returns the reports created at ?date=2006-01-02, default today. POST delivers them again
+func (ctrl *mainController) adminReports(c *gin.Context) {
+	rc := ctrl.reports
+	if rc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "reports not enabled"})
+		return
+	}
+	t := time.Now().UTC()
+	if date := c.Query("date"); date != "" {
+		var err error
+		if t, err = time.Parse(time.DateOnly, date); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid date '%s' - should be YYYY-MM-DD", date)})
+			return
+		}
+	}
+	reports := ctrl.buildReports(t)
+	if c.Request.Method == http.MethodPost {
+		for _, r := range reports {
+			if err := ctrl.deliverReport(c.Request.Context(), r); err != nil {
+				ctrl.logger.Error().Err(err).Msgf("cannot deliver report %s of collection %s", r.Name, r.Collection)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot deliver report of collection %s: %v", r.Collection, err)})
+				return
+			}
+		}
+		ctrl.logger.Info().Str("audit", "reports").Str("date", t.Format(time.DateOnly)).Str("remote", c.ClientIP()).Msg("reports delivered")
+	}
+	c.JSON(http.StatusOK, reports)
+}
@@ -0,0 +1,408 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// context key holding "collection/signature" if a response is deliverable without access token
+const publicResponseKey = "mediaserver.public"
+
+type ResponseCacheConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Dir is the folder for cached response bodies
+	Dir string `toml:"dir"`
+	// MaxSize is the maximum size of all cached bodies in bytes
+	MaxSize int64 `toml:"maxsize"`
+	// MaxObjectSize is the maximum size of a single cached body in bytes
+	MaxObjectSize int64 `toml:"maxobjectsize"`
+	// DefaultTTL is used if the response carries no explicit freshness information
+	DefaultTTL config.Duration `toml:"defaultttl"`
+}
+
+// WithResponseCache enables the disk backed response cache for public responses
+func WithResponseCache(conf *ResponseCacheConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		rc, err := newResponseCache(conf, ctrl.logger)
+		if err != nil {
+			return errors.Wrap(err, "cannot create response cache")
+		}
+		ctrl.responseCache = rc
+		return nil
+	}
+}
+
+type responseCacheEntry struct {
+	Key        string            `json:"key"`
+	Item       string            `json:"item"`
+	Status     int               `json:"status"`
+	Header     http.Header       `json:"header"`
+	Vary       map[string]string `json:"vary"`
+	Stored     time.Time         `json:"stored"`
+	Expires    time.Time         `json:"expires"`
+	Size       int64             `json:"size"`
+	lastAccess time.Time
+}
+
+type responseCache struct {
+	sync.Mutex
+	dir           string
+	maxSize       int64
+	maxObjectSize int64
+	defaultTTL    time.Duration
+	size          int64
+	entries       map[string]*responseCacheEntry
+	logger        zLogger.ZLogger
+}
+
+func newResponseCache(conf *ResponseCacheConfig, logger zLogger.ZLogger) (*responseCache, error) {
+	if conf.Dir == "" {
+		return nil, errors.New("no response cache folder configured")
+	}
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "cannot create folder %s", conf.Dir)
+	}
+	rc := &responseCache{
+		dir:           conf.Dir,
+		maxSize:       conf.MaxSize,
+		maxObjectSize: conf.MaxObjectSize,
+		defaultTTL:    time.Duration(conf.DefaultTTL),
+		entries:       map[string]*responseCacheEntry{},
+		logger:        logger,
+	}
+	if rc.maxSize <= 0 {
+		rc.maxSize = 1 << 30
+	}
+	if rc.maxObjectSize <= 0 {
+		rc.maxObjectSize = 64 << 20
+	}
+	if rc.defaultTTL <= 0 {
+		rc.defaultTTL = time.Hour
+	}
+	if err := rc.load(); err != nil {
+		return nil, errors.Wrapf(err, "cannot load response cache from %s", conf.Dir)
+	}
+	return rc, nil
+}
+
+// load rebuilds the index from the metadata files of a previous run
+func (rc *responseCache) load() error {
+	metaFiles, err := filepath.Glob(filepath.Join(rc.dir, "*.json"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	now := time.Now()
+	for _, metaFile := range metaFiles {
+		data, err := os.ReadFile(metaFile)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read %s", metaFile)
+		}
+		entry := &responseCacheEntry{}
+		if err := json.Unmarshal(data, entry); err != nil || entry.Expires.Before(now) {
+			rc.removeFiles(strings.TrimSuffix(filepath.Base(metaFile), ".json"))
+			continue
+		}
+		entry.lastAccess = entry.Stored
+		rc.entries[entry.Key] = entry
+		rc.size += entry.Size
+	}
+	return nil
+}
+
+func (rc *responseCache) bodyFile(key string) string {
+	return filepath.Join(rc.dir, key+".body")
+}
+
+func (rc *responseCache) metaFile(key string) string {
+	return filepath.Join(rc.dir, key+".json")
+}
+
+func (rc *responseCache) removeFiles(key string) {
+	os.Remove(rc.bodyFile(key))
+	os.Remove(rc.metaFile(key))
+}
+
+// remove deletes an entry, caller must hold the lock
+func (rc *responseCache) remove(key string) {
+	if entry, ok := rc.entries[key]; ok {
+		rc.size -= entry.Size
+		delete(rc.entries, key)
+	}
+	rc.removeFiles(key)
+}
+
+// evict removes least recently used entries until size fits, caller must hold the lock
+func (rc *responseCache) evict(needed int64) {
+	if rc.size+needed <= rc.maxSize {
+		return
+	}
+	entries := make([]*responseCacheEntry, 0, len(rc.entries))
+	for _, entry := range rc.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastAccess.Before(entries[j].lastAccess) })
+	for _, entry := range entries {
+		if rc.size+needed <= rc.maxSize {
+			return
+		}
+		rc.remove(entry.Key)
+	}
+}
+
+// removeItem deletes all cached responses of an item
+func (rc *responseCache) removeItem(collection, signature string) {
+	rc.Lock()
+	defer rc.Unlock()
+	for key, entry := range rc.entries {
+		if entry.Item == collection+"/"+signature {
+			rc.remove(key)
+		}
+	}
+}
+
+func responseCacheKey(r *http.Request) string {
+	return hashKey(r.Method, " ", r.URL.RequestURI())
+}
+
+// cacheControl parses a Cache-Control header into directives
+func cacheControl(header string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return directives
+}
+
+// freshness computes the expiry of a response according to rfc 9111 section 4.2.1
+func (rc *responseCache) freshness(header http.Header, now time.Time) (time.Time, bool) {
+	cc := cacheControl(header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := cc[d]; ok {
+			return time.Time{}, false
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || secs <= 0 {
+				return time.Time{}, false
+			}
+			return now.Add(time.Duration(secs) * time.Second), true
+		}
+	}
+	if exp := header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil || !t.After(now) {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	return now.Add(rc.defaultTTL), true
+}
+
+func (rc *responseCache) lookup(r *http.Request) (*responseCacheEntry, bool) {
+	key := responseCacheKey(r)
+	rc.Lock()
+	defer rc.Unlock()
+	entry, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.Expires) {
+		rc.remove(key)
+		return nil, false
+	}
+	for name, value := range entry.Vary {
+		if r.Header.Get(name) != value {
+			return nil, false
+		}
+	}
+	entry.lastAccess = time.Now()
+	return entry, true
+}
+
+// serve delivers a stored response. ranges and conditional requests are handled by http.ServeContent
+func (rc *responseCache) serve(c *gin.Context, entry *responseCacheEntry) bool {
+	return rc.serveHTTP(c.Writer, c.Request, entry)
+}
+
+func (rc *responseCache) serveHTTP(w http.ResponseWriter, r *http.Request, entry *responseCacheEntry) bool {
+	fp, err := os.Open(rc.bodyFile(entry.Key))
+	if err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot open cached response %s", entry.Key)
+		return false
+	}
+	defer fp.Close()
+	header := w.Header()
+	for k, v := range entry.Header {
+		header[k] = v
+	}
+	header.Set("Age", strconv.FormatInt(int64(time.Since(entry.Stored).Seconds()), 10))
+	header.Set("X-Cache", "HIT")
+	if entry.Status != http.StatusOK {
+		w.WriteHeader(entry.Status)
+		if _, err := fp.WriteTo(w); err != nil {
+			rc.logger.Error().Err(err).Msgf("cannot write cached response %s", entry.Key)
+		}
+		return true
+	}
+	http.ServeContent(w, r, "", entry.Stored, fp)
+	return true
+}
+
+type responseCacheWriter struct {
+	gin.ResponseWriter
+	fp       *os.File
+	written  int64
+	maxSize  int64
+	overflow bool
+}
+
+func (w *responseCacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseCacheWriter) tee(data []byte) {
+	if w.overflow || w.fp == nil {
+		return
+	}
+	if w.written+int64(len(data)) > w.maxSize {
+		w.overflow = true
+		return
+	}
+	n, err := w.fp.Write(data)
+	w.written += int64(n)
+	if err != nil {
+		w.overflow = true
+	}
+}
+
+func (w *responseCacheWriter) Write(data []byte) (int, error) {
+	w.tee(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseCacheWriter) WriteString(s string) (int, error) {
+	w.tee([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// middleware serves fresh public responses from disk and stores new ones
+func (rc *responseCache) middleware(c *gin.Context) {
+	if c.Request.Method != http.MethodGet {
+		c.Next()
+		return
+	}
+	reqCC := cacheControl(c.GetHeader("Cache-Control"))
+	_, noCache := reqCC["no-cache"]
+	_, noStore := reqCC["no-store"]
+	if !noCache {
+		if entry, ok := rc.lookup(c.Request); ok {
+			traceDecision(c, "responsecache", "hit, stored %s", entry.Stored.Format(time.RFC3339))
+			if rc.serve(c, entry) {
+				c.Abort()
+				return
+			}
+		} else {
+			traceDecision(c, "responsecache", "miss")
+		}
+	} else {
+		traceDecision(c, "responsecache", "bypass (no-cache)")
+	}
+	// partial and traced responses are not stored
+	if noStore || c.GetHeader("Range") != "" || c.GetBool(debugKey) {
+		c.Next()
+		return
+	}
+	key := responseCacheKey(c.Request)
+	tmp, err := os.CreateTemp(rc.dir, "tmp-*")
+	if err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot create temp file in %s", rc.dir)
+		c.Next()
+		return
+	}
+	defer os.Remove(tmp.Name())
+	w := &responseCacheWriter{ResponseWriter: c.Writer, fp: tmp, maxSize: rc.maxObjectSize}
+	c.Writer = w
+	c.Header("X-Cache", "MISS")
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	item := c.GetString(publicResponseKey)
+	if w.overflow || item == "" || w.Status() != http.StatusOK {
+		return
+	}
+	now := time.Now()
+	header := w.Header().Clone()
+	expires, ok := rc.freshness(header, now)
+	if !ok {
+		return
+	}
+	entry := &responseCacheEntry{
+		Key:        key,
+		Item:       item,
+		Status:     w.Status(),
+		Header:     header,
+		Vary:       map[string]string{},
+		Stored:     now,
+		Expires:    expires,
+		Size:       w.written,
+		lastAccess: now,
+	}
+	// per request headers
+	for _, name := range []string{"X-Cache", "Server-Timing", "X-Debug-Trace", "Trailer"} {
+		header.Del(name)
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				entry.Vary[name] = c.GetHeader(name)
+			}
+		}
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot marshal response cache entry %s", key)
+		return
+	}
+	rc.Lock()
+	defer rc.Unlock()
+	rc.remove(key)
+	rc.evict(entry.Size)
+	if err := os.Rename(tmp.Name(), rc.bodyFile(key)); err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot store cached response %s", key)
+		return
+	}
+	if err := os.WriteFile(rc.metaFile(key), meta, 0o644); err != nil {
+		rc.logger.Error().Err(err).Msgf("cannot store cached response metadata %s", key)
+		os.Remove(rc.bodyFile(key))
+		return
+	}
+	rc.entries[key] = entry
+	rc.size += entry.Size
+}
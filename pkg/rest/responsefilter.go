@@ -0,0 +1,268 @@
+package rest
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ResponseFilter changes the responses of a collection. Filter is called once before the status is sent. it may modify
+// the header and return a writer wrapping the body, which is closed after the handler, or nil to keep the body
+type ResponseFilter interface {
+	Filter(c *gin.Context, status int, header http.Header, body io.Writer) io.WriteCloser
+}
+
+// ResponseFilterFactory creates a filter of a custom type from its configuration
+type ResponseFilterFactory func(conf *ResponseFilterConfig) (ResponseFilter, error)
+
+type ResponseFilterConfig struct {
+	// Type is "header", "rewrite" or a type added with WithResponseFilterType
+	Type string `toml:"type"`
+	// Actions limits the filter to actions, e.g. ["metadata", "iiif", "embed"]. all requests if empty
+	Actions []string `toml:"actions"`
+	// Headers are set by "header" filters. {collection} and {signature} are replaced
+	Headers map[string]string `toml:"headers"`
+	// From is replaced by To in textual bodies by "rewrite" filters, e.g. the external address for mirrors
+	From string `toml:"from"`
+	To   string `toml:"to"`
+	// MaxSize is the largest body rewritten, default 16MiB. larger bodies are sent unchanged
+	MaxSize int64 `toml:"maxsize"`
+	// Options of custom filter types
+	Options map[string]string `toml:"options"`
+}
+
+const defaultRewriteMaxSize = 16 << 20
+
+var responseFilterTypes = map[string]ResponseFilterFactory{
+	"header":  newHeaderFilter,
+	"rewrite": newRewriteFilter,
+}
+
+type configuredFilter struct {
+	actions []string
+	filter  ResponseFilter
+}
+
+// WithResponseFilters sets the response filters per collection. filters run in the given order
+func WithResponseFilters(filters map[string][]*ResponseFilterConfig) Option {
+	return func(ctrl *mainController) error {
+		ctrl.responseFilterConfig = filters
+		return nil
+	}
+}
+
+// WithResponseFilterType adds a custom filter type for the configuration of WithResponseFilters
+func WithResponseFilterType(name string, factory ResponseFilterFactory) Option {
+	return func(ctrl *mainController) error {
+		if name == "" || factory == nil {
+			return errors.New("no response filter type name or factory")
+		}
+		if ctrl.responseFilterTypes == nil {
+			ctrl.responseFilterTypes = map[string]ResponseFilterFactory{}
+		}
+		ctrl.responseFilterTypes[name] = factory
+		return nil
+	}
+}
+
+// initResponseFilters creates the configured filters after all options, so custom types may be added in any order
+func (ctrl *mainController) initResponseFilters() error {
+	if len(ctrl.responseFilterConfig) == 0 {
+		return nil
+	}
+	ctrl.responseFilters = map[string][]*configuredFilter{}
+	for collection, confs := range ctrl.responseFilterConfig {
+		for _, conf := range confs {
+			factory, ok := ctrl.responseFilterTypes[conf.Type]
+			if !ok {
+				factory, ok = responseFilterTypes[conf.Type]
+			}
+			if !ok {
+				return errors.Errorf("unknown response filter type '%s' for collection %s", conf.Type, collection)
+			}
+			filter, err := factory(conf)
+			if err != nil {
+				return errors.Wrapf(err, "cannot create response filter '%s' for collection %s", conf.Type, collection)
+			}
+			ctrl.responseFilters[collection] = append(ctrl.responseFilters[collection], &configuredFilter{actions: conf.Actions, filter: filter})
+		}
+	}
+	return nil
+}
+
+// requestAction returns the action name of media, iiif and embed requests
+func requestAction(c *gin.Context) string {
+	if action := c.Param("action"); action != "" {
+		return action
+	}
+	if c.Param("version") != "" {
+		return "iiif"
+	}
+	if strings.Contains(c.FullPath(), "/embed/") {
+		return "embed"
+	}
+	return ""
+}
+
+// filterWriter starts the filters with the first write or the status
+type filterWriter struct {
+	gin.ResponseWriter
+	c       *gin.Context
+	filters []ResponseFilter
+	body    io.Writer
+	closers []io.Closer
+	started bool
+}
+
+func (w *filterWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *filterWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	header := w.ResponseWriter.Header()
+	status := w.ResponseWriter.Status()
+	w.body = w.ResponseWriter
+	// the first filter gets the body of the handler
+	for i := len(w.filters) - 1; i >= 0; i-- {
+		if wrapped := w.filters[i].Filter(w.c, status, header, w.body); wrapped != nil {
+			header.Del("Content-Length")
+			w.body = wrapped
+			w.closers = append(w.closers, wrapped)
+		}
+	}
+}
+
+func (w *filterWriter) Write(data []byte) (int, error) {
+	w.start()
+	return w.body.Write(data)
+}
+
+func (w *filterWriter) WriteString(s string) (int, error) {
+	w.start()
+	return io.WriteString(w.body, s)
+}
+
+func (w *filterWriter) WriteHeaderNow() {
+	w.start()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *filterWriter) finish() error {
+	w.start()
+	var errs []error
+	for i := len(w.closers) - 1; i >= 0; i-- {
+		errs = append(errs, w.closers[i].Close())
+	}
+	return errors.Combine(errs...)
+}
+
+// responseFilter applies the filters of the collection to the response
+func (ctrl *mainController) responseFilter(c *gin.Context) {
+	configured := ctrl.responseFilters[c.Param("collection")]
+	if len(configured) == 0 {
+		c.Next()
+		return
+	}
+	action := requestAction(c)
+	var filters []ResponseFilter
+	for _, cf := range configured {
+		if len(cf.actions) == 0 || slices.Contains(cf.actions, action) {
+			filters = append(filters, cf.filter)
+		}
+	}
+	if len(filters) == 0 {
+		c.Next()
+		return
+	}
+	orig := c.Writer
+	fw := &filterWriter{ResponseWriter: orig, c: c, filters: filters}
+	c.Writer = fw
+	c.Next()
+	if err := fw.finish(); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot finish response filters of %s", c.Request.URL.Path)
+	}
+	c.Writer = orig
+}
+
+// headerFilter sets fixed headers, e.g. provenance information
+type headerFilter struct {
+	headers map[string]string
+}
+
+func newHeaderFilter(conf *ResponseFilterConfig) (ResponseFilter, error) {
+	if len(conf.Headers) == 0 {
+		return nil, errors.New("no headers")
+	}
+	return &headerFilter{headers: conf.Headers}, nil
+}
+
+func (hf *headerFilter) Filter(c *gin.Context, _ int, header http.Header, _ io.Writer) io.WriteCloser {
+	r := strings.NewReplacer("{collection}", c.Param("collection"), "{signature}", c.Param("signature"))
+	for name, value := range hf.headers {
+		header.Set(name, r.Replace(value))
+	}
+	return nil
+}
+
+// rewriteFilter replaces a string in successful textual responses, e.g. the urls in manifests for mirrors
+type rewriteFilter struct {
+	from, to []byte
+	maxSize  int64
+}
+
+func newRewriteFilter(conf *ResponseFilterConfig) (ResponseFilter, error) {
+	if conf.From == "" {
+		return nil, errors.New("no rewrite source")
+	}
+	maxSize := conf.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultRewriteMaxSize
+	}
+	return &rewriteFilter{from: []byte(conf.From), to: []byte(conf.To), maxSize: maxSize}, nil
+}
+
+func (rf *rewriteFilter) Filter(_ *gin.Context, status int, header http.Header, body io.Writer) io.WriteCloser {
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" || !compressibleMime(header.Get("Content-Type")) {
+		return nil
+	}
+	return &rewriteWriter{filter: rf, out: body}
+}
+
+// rewriteWriter buffers the body up to the maximum size. larger bodies are passed through unchanged
+type rewriteWriter struct {
+	filter      *rewriteFilter
+	out         io.Writer
+	buf         bytes.Buffer
+	passThrough bool
+}
+
+func (rw *rewriteWriter) Write(data []byte) (int, error) {
+	if rw.passThrough {
+		return rw.out.Write(data)
+	}
+	if int64(rw.buf.Len()+len(data)) > rw.filter.maxSize {
+		rw.passThrough = true
+		if _, err := rw.out.Write(rw.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		rw.buf.Reset()
+		return rw.out.Write(data)
+	}
+	return rw.buf.Write(data)
+}
+
+func (rw *rewriteWriter) Close() error {
+	if rw.passThrough {
+		return nil
+	}
+	_, err := rw.out.Write(bytes.ReplaceAll(rw.buf.Bytes(), rw.filter.from, rw.filter.to))
+	return err
+}
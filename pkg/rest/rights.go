@@ -0,0 +1,149 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+type RightsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Fields of the item metadata with the rights statement or license uri, the first valid uri is used.
+	// default ["rights", "license"]
+	Fields []string `toml:"fields"`
+	// Default is the uri of items without rights in their metadata
+	Default string `toml:"default"`
+	// Collections overrides the default per collection
+	Collections map[string]string `toml:"collections"`
+}
+
+// rightsHosts are the hosts of rights uris allowed by the iiif presentation api 3
+var rightsHosts = []string{"rightsstatements.org", "creativecommons.org"}
+
+type rights struct {
+	conf  *RightsConfig
+	cache gcache.Cache
+}
+
+// validRightsURI checks for a rightsstatements.org or creative commons uri
+func validRightsURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return slices.Contains(rightsHosts, strings.TrimPrefix(u.Hostname(), "www."))
+}
+
+// WithRights announces the rights statement or license of items from their metadata in Link rel="license" headers,
+// iiif canvases and the viewers
+func WithRights(conf *RightsConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if len(conf.Fields) == 0 {
+			conf.Fields = []string{"rights", "license"}
+		}
+		if conf.Default != "" && !validRightsURI(conf.Default) {
+			return errors.Errorf("invalid default rights '%s' - should be a rightsstatements.org or creativecommons.org uri", conf.Default)
+		}
+		for collection, uri := range conf.Collections {
+			if !validRightsURI(uri) {
+				return errors.Errorf("invalid rights '%s' of collection %s - should be a rightsstatements.org or creativecommons.org uri", uri, collection)
+			}
+		}
+		r := &rights{conf: conf}
+		r.cache = gcache.New(10000).LRU().Expiration(time.Hour).LoaderFunc(func(key any) (any, error) {
+			it, ok := key.(itemIdentifier)
+			if !ok {
+				return nil, errors.Errorf("invalid key type %T", key)
+			}
+			return ctrl.loadRights(it.collection, it.signature), nil
+		}).Build()
+		ctrl.rights = r
+		return nil
+	}
+}
+
+// loadRights returns the first valid rights uri of the metadata fields or the default of the collection
+func (ctrl *mainController) loadRights(collection, signature string) string {
+	conf := ctrl.rights.conf
+	if metadata, err := ctrl.getItemMetadata(collection, signature); err == nil {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(metadata), &fields); err == nil {
+			for _, field := range conf.Fields {
+				var values []any
+				switch v := fields[field].(type) {
+				case string:
+					values = []any{v}
+				case []any:
+					values = v
+				}
+				for _, value := range values {
+					if uri, ok := value.(string); ok && validRightsURI(uri) {
+						return uri
+					}
+					ctrl.logger.Debug().Msgf("ignoring rights '%v' of %s/%s", value, collection, signature)
+				}
+			}
+		}
+	}
+	if uri, ok := conf.Collections[collection]; ok {
+		return uri
+	}
+	return conf.Default
+}
+
+// itemRights returns the rights uri of an item, empty if unknown
+func (ctrl *mainController) itemRights(collection, signature string) string {
+	if ctrl.rights == nil {
+		return ""
+	}
+	uriAny, err := ctrl.rights.cache.Get(itemIdentifier{collection: collection, signature: signature})
+	if err != nil {
+		return ""
+	}
+	return uriAny.(string)
+}
+
+// removeRights deletes the cached rights of an item
+func (ctrl *mainController) removeRights(collection, signature string) {
+	if ctrl.rights == nil {
+		return
+	}
+	ctrl.rights.cache.Remove(itemIdentifier{collection: collection, signature: signature})
+}
+
+// rightsHeader adds the Link rel="license" header of an item. other links of the response are kept
+func (ctrl *mainController) rightsHeader(c *gin.Context, collection, signature string) {
+	if uri := ctrl.itemRights(collection, signature); uri != "" {
+		c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="license"`, uri))
+	}
+}
+
+// rightsLabel is the short name of a rights uri, e.g. "CC BY-SA 4.0" or "InC 1.0"
+func rightsLabel(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case strings.HasSuffix(u.Hostname(), "rightsstatements.org") && len(parts) >= 3 && parts[0] == "vocab":
+		return parts[1] + " " + parts[2]
+	case strings.HasSuffix(u.Hostname(), "creativecommons.org") && len(parts) >= 3 && parts[0] == "licenses":
+		return "CC " + strings.ToUpper(parts[1]) + " " + parts[2]
+	case strings.HasSuffix(u.Hostname(), "creativecommons.org") && len(parts) >= 3 && parts[0] == "publicdomain":
+		if parts[1] == "zero" {
+			return "CC0 " + parts[2]
+		}
+		return "Public Domain Mark " + parts[2]
+	}
+	return uri
+}
@@ -0,0 +1,175 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaservermain/v2/data/web/static"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// route groups, each with its own middleware chain
+const (
+	GroupStatic   = "static"
+	GroupMedia    = "media"
+	GroupMetadata = "metadata"
+	GroupIIIF     = "iiif"
+	GroupViewer   = "viewer"
+	GroupAdmin    = "admin"
+)
+
+var routeGroups = []string{GroupStatic, GroupMedia, GroupMetadata, GroupIIIF, GroupViewer, GroupAdmin}
+
+// WithGroupMiddleware appends handlers to the middleware chain of a route group.
+// they run after the built-in middleware of the group (cors, rate limit, authentication)
+func WithGroupMiddleware(group string, handlers ...gin.HandlerFunc) Option {
+	return func(ctrl *mainController) error {
+		if !slices.Contains(routeGroups, group) {
+			return errors.Errorf("unknown route group '%s' - should be one of %v", group, routeGroups)
+		}
+		if ctrl.groupMiddleware == nil {
+			ctrl.groupMiddleware = map[string][]gin.HandlerFunc{}
+		}
+		ctrl.groupMiddleware[group] = append(ctrl.groupMiddleware[group], handlers...)
+		return nil
+	}
+}
+
+// cacheHeader sets a fixed Cache-Control header
+func cacheHeader(value string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", value)
+		c.Next()
+	}
+}
+
+// middleware composes the chain of a route group from the given handlers and the custom middleware of the group
+func (ctrl *mainController) middleware(group string, handlers ...gin.HandlerFunc) []gin.HandlerFunc {
+	var chain []gin.HandlerFunc
+	for _, h := range handlers {
+		if h != nil {
+			chain = append(chain, h)
+		}
+	}
+	return append(chain, ctrl.groupMiddleware[group]...)
+}
+
+func (ctrl *mainController) initRoutes() {
+	// all routes live below the path of the external address (reverse proxy deployments)
+	base := ctrl.router.Group(ctrl.subpath)
+	if ctrl.subpath != "/" {
+		ctrl.router.GET(ctrl.subpath, func(c *gin.Context) {
+			c.Redirect(http.StatusMovedPermanently, ctrl.subpath+"/")
+		})
+	}
+	base.GET("/readyz", ctrl.readyz)
+
+	corsHandler := cors.Default()
+	// preflight requests do not match any other route
+	base.OPTIONS("/*path", corsHandler)
+	var rateLimit gin.HandlerFunc
+	if len(ctrl.tenants) > 0 {
+		rateLimit = ctrl.tenantMiddleware
+	}
+
+	ctrl.initStatic(base.Group("/static", ctrl.middleware(GroupStatic, corsHandler, cacheHeader("public, max-age=3600"))...))
+	ctrl.initViewer(base.Group("", ctrl.middleware(GroupViewer, ctrl.accountingHandler(), ctrl.policyHandler(), ctrl.darkArchive, ctrl.responseFilter, rateLimit)...))
+	ctrl.initAdmin(base.Group("/admin", ctrl.middleware(GroupAdmin, ctrl.adminAuth)...))
+	ctrl.initMetadata(base.Group("", ctrl.middleware(GroupMetadata, corsHandler, rateLimit)...))
+	ctrl.initIIIF(base.Group("/iiif", ctrl.middleware(GroupIIIF, ctrl.accountingHandler(), ctrl.policyHandler(), corsHandler, ctrl.darkArchive, ctrl.responseFilter, rateLimit)...))
+	ctrl.initMedia(base.Group("", ctrl.middleware(GroupMedia, ctrl.accountingHandler(), ctrl.policyHandler(), corsHandler, ctrl.darkArchive, ctrl.responseFilter, rateLimit)...))
+}
+
+// reservedCollections returns the first path segments of fixed routes. collections with these names would be
+// shadowed by the routes
+func (ctrl *mainController) reservedCollections() []string {
+	var names []string
+	for _, route := range ctrl.router.Routes() {
+		p := strings.TrimPrefix(strings.TrimPrefix(route.Path, ctrl.subpath), "/")
+		name, _, _ := strings.Cut(p, "/")
+		if name == "" || name[0] == ':' || name[0] == '*' || slices.Contains(names, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// checkCollectionNames fails if a collection of the database is shadowed by a route. the check is skipped if the
+// database cannot list the collections
+func (ctrl *mainController) checkCollectionNames(ctx context.Context) error {
+	stream, err := ctrl.dbClient.GetCollections(ctx, &emptypb.Empty{})
+	if err != nil {
+		ctrl.logger.Warn().Err(err).Msg("cannot list collections to check for reserved names")
+		return nil
+	}
+	reserved := ctrl.reservedCollections()
+	var errs []error
+	for {
+		coll, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				ctrl.logger.Warn().Err(err).Msg("cannot list collections to check for reserved names")
+			}
+			break
+		}
+		if slices.Contains(reserved, coll.GetName()) {
+			errs = append(errs, errors.Errorf("collection '%s' is shadowed by the route /%s", coll.GetName(), coll.GetName()))
+		}
+	}
+	return errors.Combine(errs...)
+}
+
+func (ctrl *mainController) initStatic(group *gin.RouterGroup) {
+	group.StaticFS("/", http.FS(static.FS))
+}
+
+// initViewer registers the endpoints used by viewers and link sharing. beacons are same-origin only, so there is no cors
+func (ctrl *mainController) initViewer(group *gin.RouterGroup) {
+	group.GET("/s/:id", ctrl.resolveShortLink)
+	group.GET("/resolve/*identifier", ctrl.resolvePID)
+	group.GET("/qr/*path", ctrl.qrCode)
+	group.GET("/embed/:collection/:signature", ctrl.embed)
+	group.POST("/beacon", ctrl.beacon)
+	group.POST("/seats/:collection/:signature", ctrl.seatLease)
+	group.PUT("/seats/:collection/:signature", ctrl.seatLease)
+	group.DELETE("/seats/:collection/:signature", ctrl.seatRelease)
+	group.POST("/print/:collection/:signature", ctrl.printRequest)
+	group.GET("/annotations/:collection/:signature", ctrl.listAnnotations)
+	group.POST("/annotations/:collection/:signature", ctrl.denyReadOnly, ctrl.createAnnotation)
+	group.GET("/annotations/:collection/:signature/:id", ctrl.getAnnotation)
+	group.DELETE("/annotations/:collection/:signature/:id", ctrl.denyReadOnly, ctrl.deleteAnnotation)
+	group.POST("/transcriptions/:collection/:signature", ctrl.denyReadOnly, ctrl.submitTranscription)
+}
+
+func (ctrl *mainController) initMetadata(group *gin.RouterGroup) {
+	group.GET("/actions", ctrl.actions)
+	ctrl.initActivity(group)
+}
+
+// cacheHandlers returns the response cache middleware for generated content
+func (ctrl *mainController) cacheHandlers() []gin.HandlerFunc {
+	if ctrl.responseCache == nil {
+		return nil
+	}
+	return []gin.HandlerFunc{ctrl.responseCache.middleware}
+}
+
+func (ctrl *mainController) initIIIF(group *gin.RouterGroup) {
+	cached := group.Group("", ctrl.cacheHandlers()...)
+	cached.GET("/:version/:collection/:signature/*params", ctrl.iiifAction)
+}
+
+func (ctrl *mainController) initMedia(group *gin.RouterGroup) {
+	// the default action only redirects and is not cached
+	group.GET("/:collection/:signature", ctrl.defaultAction)
+	cached := group.Group("", ctrl.cacheHandlers()...)
+	cached.GET("/:collection/:signature/:action", ctrl.action)
+	cached.GET("/:collection/:signature/:action/*params", ctrl.action)
+}
@@ -0,0 +1,85 @@
+package rest
+
+import (
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// RuntimeStats are the process figures and the sizes of caches and internal maps, sampled to find slow leaks
+type RuntimeStats struct {
+	Time        time.Time `json:"time"`
+	Goroutines  int       `json:"goroutines"`
+	HeapAlloc   uint64    `json:"heapalloc"`
+	HeapObjects uint64    `json:"heapobjects"`
+	NumGC       uint32    `json:"numgc"`
+	// Sizes are the number of entries including expired ones. bounded caches level off, bookkeeping like the
+	// ".stats" of a cache follows its cache
+	Sizes map[string]int `json:"sizes"`
+}
+
+func (cs *cacheStats) len() int {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return len(cs.entries)
+}
+
+func partitionSizes(sizes map[string]int, prefix string, p *cachePartition) {
+	for name, cache := range map[string]gcache.Cache{"items": p.itemCache, "metadata": p.metadataCache, "collections": p.collectionCache} {
+		sizes[prefix+name] = cache.Len(false)
+	}
+	sizes[prefix+"items.stats"] = p.itemStats.len()
+	sizes[prefix+"metadata.stats"] = p.metadataStats.len()
+	sizes[prefix+"collections.stats"] = p.collectionStats.len()
+}
+
+func (ctrl *mainController) runtimeStats() *RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := &RuntimeStats{
+		Time:        time.Now(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   ms.HeapAlloc,
+		HeapObjects: ms.HeapObjects,
+		NumGC:       ms.NumGC,
+		Sizes:       map[string]int{},
+	}
+	partitionSizes(stats.Sizes, "", ctrl.cachePartition)
+	for name, t := range ctrl.tenants {
+		partitionSizes(stats.Sizes, "tenant."+name+".", t.partition)
+	}
+	for name, cache := range map[string]gcache.Cache{"templates": ctrl.actionTemplates, "tokens": ctrl.tokenCache, "access": ctrl.accessCache} {
+		if cache != nil {
+			stats.Sizes[name] = cache.Len(false)
+		}
+	}
+	ctrl.actionParamsMutex.RLock()
+	stats.Sizes["actionparams"] = len(ctrl.actionParams)
+	ctrl.actionParamsMutex.RUnlock()
+	ctrl.generationFlights.Lock()
+	stats.Sizes["generations"] = len(ctrl.generationFlights.calls)
+	ctrl.generationFlights.Unlock()
+	if rc := ctrl.responseCache; rc != nil {
+		rc.Lock()
+		stats.Sizes["responsecache"] = len(rc.entries)
+		rc.Unlock()
+	}
+	if s := ctrl.seats; s != nil {
+		s.Lock()
+		stats.Sizes["seats"] = len(s.pools)
+		s.Unlock()
+	}
+	if tr := ctrl.transcriptions; tr != nil {
+		tr.Lock()
+		stats.Sizes["transcriptions.clients"] = len(tr.clients)
+		tr.Unlock()
+	}
+	return stats
+}
+
+// adminRuntime returns the runtime figures, compared over time by the soak test
+func (ctrl *mainController) adminRuntime(c *gin.Context) {
+	c.JSON(http.StatusOK, ctrl.runtimeStats())
+}
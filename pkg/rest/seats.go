@@ -0,0 +1,280 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SeatConfig struct {
+	// Seats is the number of sessions which may use an item at the same time (library copies)
+	Seats int `toml:"seats"`
+	// Items overrides Seats per signature, 0 removes the limit of an item
+	Items map[string]int `toml:"items"`
+	// Shared counts the sessions of all items of the collection together
+	Shared bool `toml:"shared"`
+	// Lease is the time a seat is kept without delivery or heartbeat, default 5m
+	Lease config.Duration `toml:"lease"`
+	// IncludePublic limits public items as well
+	IncludePublic bool `toml:"includepublic"`
+}
+
+var errNoSeat = errors.New("all seats taken")
+
+// seatPool holds the leases of an item or a shared collection by session
+type seatPool struct {
+	leases map[string]time.Time
+}
+
+// expire removes the leases which ended before now
+func (sp *seatPool) expire(now time.Time) {
+	for session, expires := range sp.leases {
+		if !now.Before(expires) {
+			delete(sp.leases, session)
+		}
+	}
+}
+
+// retry returns the time until the first lease ends
+func (sp *seatPool) retry(now time.Time) time.Duration {
+	var first time.Time
+	for _, expires := range sp.leases {
+		if first.IsZero() || expires.Before(first) {
+			first = expires
+		}
+	}
+	return first.Sub(now)
+}
+
+// seats are kept in memory, instances behind a load balancer need sticky sessions
+type seats struct {
+	sync.Mutex
+	conf  map[string]*SeatConfig
+	pools map[itemIdentifier]*seatPool
+}
+
+// WithSeats limits the simultaneous sessions per item or collection. seats are taken with the first delivery and
+// kept with deliveries or heartbeats at PUT /seats/:collection/:signature
+func WithSeats(conf map[string]*SeatConfig) Option {
+	return func(ctrl *mainController) error {
+		if len(conf) == 0 {
+			return nil
+		}
+		for collection, sc := range conf {
+			if sc.Seats <= 0 {
+				return errors.Errorf("invalid number of seats %d for collection %s", sc.Seats, collection)
+			}
+			if sc.Lease <= 0 {
+				sc.Lease = config.Duration(5 * time.Minute)
+			}
+		}
+		ctrl.seats = &seats{conf: conf, pools: map[itemIdentifier]*seatPool{}}
+		return nil
+	}
+}
+
+// limit returns the pool and the number of seats of an item, 0 if there is no limit
+func (s *seats) limit(collection, signature string) (itemIdentifier, *SeatConfig, int) {
+	sc, ok := s.conf[collection]
+	if !ok {
+		return itemIdentifier{}, nil, 0
+	}
+	if sc.Shared {
+		return itemIdentifier{collection: collection}, sc, sc.Seats
+	}
+	limit := sc.Seats
+	if n, ok := sc.Items[signature]; ok {
+		limit = n
+	}
+	return itemIdentifier{collection: collection, signature: signature}, sc, limit
+}
+
+// acquire takes or renews the seat of a session. if all seats are taken, the time until the first seat is free is returned
+func (s *seats) acquire(key itemIdentifier, sc *SeatConfig, limit int, session string, now time.Time) (bool, int, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	pool, ok := s.pools[key]
+	if !ok {
+		pool = &seatPool{leases: map[string]time.Time{}}
+		s.pools[key] = pool
+	}
+	pool.expire(now)
+	if _, ok := pool.leases[session]; ok || len(pool.leases) < limit {
+		pool.leases[session] = now.Add(time.Duration(sc.Lease))
+		return true, len(pool.leases), 0
+	}
+	return false, len(pool.leases), pool.retry(now)
+}
+
+func (s *seats) release(key itemIdentifier, session string) bool {
+	s.Lock()
+	defer s.Unlock()
+	pool, ok := s.pools[key]
+	if !ok {
+		return false
+	}
+	if _, ok := pool.leases[session]; !ok {
+		return false
+	}
+	delete(pool.leases, session)
+	if len(pool.leases) == 0 {
+		delete(s.pools, key)
+	}
+	return true
+}
+
+// checkSeat takes or renews the seat of the session and returns errNoSeat if all seats are taken
+func (ctrl *mainController) checkSeat(c *gin.Context, collection, signature, token string) error {
+	if ctrl.seats == nil {
+		return nil
+	}
+	key, sc, limit := ctrl.seats.limit(collection, signature)
+	if limit <= 0 {
+		return nil
+	}
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
+	}
+	if item.GetPublic() && !sc.IncludePublic {
+		return nil
+	}
+	_, claims := ctrl.verifiedClaims(collection, token)
+	ok, _, retry := ctrl.seats.acquire(key, sc, limit, requestSession(c, claims), time.Now())
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		traceDecision(c, "seats", "%d of %d taken", limit, limit)
+		return errors.Wrapf(errNoSeat, "%d seats of %s/%s in use", limit, collection, signature)
+	}
+	return nil
+}
+
+// seatResponse answers requests without free seat
+func (ctrl *mainController) seatResponse(c *gin.Context, collection, signature string, err error) {
+	_, _, limit := ctrl.seats.limit(collection, signature)
+	ctrl.logger.Info().Err(err).Msgf("no seat for %s/%s", collection, signature)
+	ctrl.errorResponse(c, http.StatusServiceUnavailable, collection, err, "no_seat", limit, collection+"/"+signature)
+}
+
+// seatAccess allows the seat endpoints to everybody who may access the media in the viewer
+func (ctrl *mainController) seatAccess(c *gin.Context) (string, string, bool) {
+	collection := c.Param("collection")
+	signature := c.Param("signature")
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("item %s/%s not found", collection, signature)})
+		return "", "", false
+	}
+	source, ok := ctrl.embedActions[item.GetMetadata().GetType()]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no viewer for %s/%s", collection, signature)})
+		return "", "", false
+	}
+	action, paramStr, _ := strings.Cut(normalizePath(source), "/")
+	if err := ctrl.authorize(c, collection, signature, action, paramStr, c.Query("token"), false); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("access denied for %s/%s", collection, signature)})
+		return "", "", false
+	}
+	return collection, signature, true
+}
+
+// seatLease takes (POST) or renews (PUT) the seat of the session
+func (ctrl *mainController) seatLease(c *gin.Context) {
+	if ctrl.seats == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	collection, signature, ok := ctrl.seatAccess(c)
+	if !ok {
+		return
+	}
+	key, sc, limit := ctrl.seats.limit(collection, signature)
+	if limit <= 0 {
+		c.JSON(http.StatusOK, gin.H{"seats": 0})
+		return
+	}
+	_, claims := ctrl.verifiedClaims(collection, c.Query("token"))
+	session := requestSession(c, claims)
+	now := time.Now()
+	if c.Request.Method == http.MethodPut {
+		// heartbeats do not take a free seat
+		ctrl.seats.Lock()
+		pool, ok := ctrl.seats.pools[key]
+		held := false
+		if ok {
+			pool.expire(now)
+			_, held = pool.leases[session]
+		}
+		ctrl.seats.Unlock()
+		if !held {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no seat held"})
+			return
+		}
+	}
+	ok, used, retry := ctrl.seats.acquire(key, sc, limit, session, now)
+	if !ok {
+		seconds := int(math.Ceil(retry.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"seats": limit, "used": used, "retryafter": seconds})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"seats": limit, "used": used, "expires": now.Add(time.Duration(sc.Lease)).UTC().Format(time.RFC3339)})
+}
+
+// seatRelease frees the seat of the session when the viewer is closed
+func (ctrl *mainController) seatRelease(c *gin.Context) {
+	if ctrl.seats == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	collection, signature, ok := ctrl.seatAccess(c)
+	if !ok {
+		return
+	}
+	key, _, limit := ctrl.seats.limit(collection, signature)
+	_, claims := ctrl.verifiedClaims(collection, c.Query("token"))
+	if limit <= 0 || !ctrl.seats.release(key, requestSession(c, claims)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no seat held"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// SeatUsage is the number of seats in use of an item or a shared collection
+type SeatUsage struct {
+	Collection string `json:"collection"`
+	Signature  string `json:"signature,omitempty"`
+	Seats      int    `json:"seats"`
+	Used       int    `json:"used"`
+}
+
+func (ctrl *mainController) adminSeats(c *gin.Context) {
+	if ctrl.seats == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "seats not configured"})
+		return
+	}
+	now := time.Now()
+	var result = []SeatUsage{}
+	ctrl.seats.Lock()
+	for key, pool := range ctrl.seats.pools {
+		pool.expire(now)
+		if len(pool.leases) == 0 {
+			continue
+		}
+		_, _, limit := ctrl.seats.limit(key.collection, key.signature)
+		result = append(result, SeatUsage{Collection: key.collection, Signature: key.signature, Seats: limit, Used: len(pool.leases)})
+	}
+	ctrl.seats.Unlock()
+	slices.SortFunc(result, func(a, b SeatUsage) int {
+		return strings.Compare(a.Collection+"/"+a.Signature, b.Collection+"/"+b.Signature)
+	})
+	c.JSON(http.StatusOK, result)
+}
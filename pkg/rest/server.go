@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"crypto/tls"
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerConfig holds the mandatory settings of an embedded mediaserver frontend
+type ServerConfig struct {
+	// Addr is the listen address used by Start
+	Addr string
+	// ExtAddr is the external address, its path is the prefix of all routes
+	ExtAddr   string
+	TLSConfig *tls.Config
+	JWTAlgs   []string
+	// IIIF is the address of the iiif image server
+	IIIF                  string
+	IIIFPrefix            string
+	IIIFBaseAction        string
+	DBClient              Database
+	ActionClient          Actions
+	VFS                   fs.FS
+	ItemCacheSize         int
+	CollectionCacheSize   int
+	CacheTimeout          time.Duration
+	ActionTemplateTimeout time.Duration
+	Logger                zLogger.ZLogger
+}
+
+// Server is the mediaserver frontend for use in other programs.
+// the frontend can either listen on its own (Start) or be mounted into another http server (Handler)
+type Server interface {
+	Start(wg *sync.WaitGroup) error
+	Stop()
+	GracefulStop()
+	ReloadVFS() error
+	// Handler returns the router with all routes below the path of the external address, behind the fast path for
+	// cached iiif responses if enabled
+	Handler() http.Handler
+	// Routes lists the routes of the enabled features
+	Routes() gin.RoutesInfo
+	Items() ItemService
+	Access() AccessService
+	Delivery() DeliveryService
+}
+
+var _ Server = (*mainController)(nil)
+
+// New creates a mediaserver frontend. custom services and middleware are added with options,
+// e.g. WithAccessService, WithMiddleware or WithGroupMiddleware
+func New(conf *ServerConfig, opts ...Option) (Server, error) {
+	if conf == nil {
+		return nil, errors.New("no server config")
+	}
+	if conf.DBClient == nil || conf.ActionClient == nil {
+		return nil, errors.New("database and action client are required")
+	}
+	if conf.Logger == nil {
+		return nil, errors.New("no logger")
+	}
+	itemCacheSize := conf.ItemCacheSize
+	if itemCacheSize <= 0 {
+		itemCacheSize = 1000
+	}
+	collectionCacheSize := conf.CollectionCacheSize
+	if collectionCacheSize <= 0 {
+		collectionCacheSize = 30
+	}
+	cacheTimeout := conf.CacheTimeout
+	if cacheTimeout <= 0 {
+		cacheTimeout = 10 * time.Minute
+	}
+	actionTemplateTimeout := conf.ActionTemplateTimeout
+	if actionTemplateTimeout <= 0 {
+		actionTemplateTimeout = 120 * time.Second
+	}
+	ctrl, err := NewMainController(conf.Addr, conf.ExtAddr, conf.TLSConfig, conf.JWTAlgs, conf.IIIF, conf.IIIFPrefix, conf.IIIFBaseAction, conf.DBClient, conf.ActionClient, conf.VFS, itemCacheSize, collectionCacheSize, cacheTimeout, actionTemplateTimeout, conf.Logger, opts...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ctrl, nil
+}
+
+// WithMiddleware adds handlers which run for all routes after access log, recovery and load shedding
+func WithMiddleware(handlers ...gin.HandlerFunc) Option {
+	return func(ctrl *mainController) error {
+		ctrl.middlewares = append(ctrl.middlewares, handlers...)
+		return nil
+	}
+}
+
+func (ctrl *mainController) Handler() http.Handler {
+	return ctrl.fastPathHandler(ctrl.router)
+}
+
+func (ctrl *mainController) Routes() gin.RoutesInfo {
+	return ctrl.router.Routes()
+}
+
+func (ctrl *mainController) Items() ItemService {
+	return ctrl.items
+}
+
+func (ctrl *mainController) Access() AccessService {
+	return ctrl.access
+}
+
+func (ctrl *mainController) Delivery() DeliveryService {
+	return ctrl.delivery
+}
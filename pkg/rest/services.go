@@ -0,0 +1,239 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"io"
+	"io/fs"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// ItemService provides items, metadata and collections
+type ItemService interface {
+	GetItem(collection, signature string) (*mediaserverproto.Item, error)
+	GetItemMetadata(collection, signature string) (string, error)
+	GetCollection(collection string) (*mediaserverproto.Collection, error)
+	// Invalidate removes locally cached data of an item
+	Invalidate(collection, signature string)
+}
+
+// AccessService decides whether an action of an item may be delivered
+type AccessService interface {
+	CheckAccess(collection, signature, action, paramStr, token string) error
+}
+
+// DeliveryService sends the files of derivatives and masters
+type DeliveryService interface {
+	ServeFile(c *gin.Context, path, mime, sha512 string)
+}
+
+// WithItemService replaces the cached database lookup of items and collections
+func WithItemService(svc ItemService) Option {
+	return func(ctrl *mainController) error {
+		if svc == nil {
+			return errors.New("no item service")
+		}
+		ctrl.items = svc
+		return nil
+	}
+}
+
+// WithAccessService replaces the public flag, public actions and token based access check
+func WithAccessService(svc AccessService) Option {
+	return func(ctrl *mainController) error {
+		if svc == nil {
+			return errors.New("no access service")
+		}
+		ctrl.access = svc
+		return nil
+	}
+}
+
+// WithDeliveryService replaces the delivery of files from the vfs
+func WithDeliveryService(svc DeliveryService) Option {
+	return func(ctrl *mainController) error {
+		if svc == nil {
+			return errors.New("no delivery service")
+		}
+		ctrl.delivery = svc
+		return nil
+	}
+}
+
+// cachedItemService loads items, metadata and collections through the caches of the tenant
+type cachedItemService struct {
+	ctrl *mainController
+}
+
+func (s *cachedItemService) Invalidate(collection, signature string) {
+	p := s.ctrl.partition(collection)
+	p.itemCache.Remove(itemIdentifier{collection: collection, signature: signature})
+	p.metadataCache.Remove(itemIdentifier{collection: collection, signature: signature})
+}
+
+func (s *cachedItemService) GetItem(collection, signature string) (*mediaserverproto.Item, error) {
+	key := itemIdentifier{collection: collection, signature: signature}
+	p := s.ctrl.partition(collection)
+	start := time.Now()
+	itemAny, err := p.itemCache.Get(key)
+	p.itemStats.access(key, start)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
+	}
+	item, ok := itemAny.(*mediaserverproto.Item)
+	if !ok {
+		return nil, errors.Errorf("invalid item type %T", itemAny)
+	}
+	return item, nil
+}
+
+func (s *cachedItemService) GetItemMetadata(collection, signature string) (string, error) {
+	key := itemIdentifier{collection: collection, signature: signature}
+	p := s.ctrl.partition(collection)
+	start := time.Now()
+	metadataAny, err := p.metadataCache.Get(key)
+	p.metadataStats.access(key, start)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get metadata %s/%s", collection, signature)
+	}
+	metadata, ok := metadataAny.(string)
+	if !ok {
+		return "", errors.Errorf("invalid metadata type %T", metadataAny)
+	}
+	return metadata, nil
+}
+
+func (s *cachedItemService) GetCollection(collection string) (*mediaserverproto.Collection, error) {
+	p := s.ctrl.partition(collection)
+	start := time.Now()
+	itemAny, err := p.collectionCache.Get(collection)
+	p.collectionStats.access(collection, start)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get item %s", collection)
+	}
+	coll, ok := itemAny.(*mediaserverproto.Collection)
+	if !ok {
+		return nil, errors.Errorf("invalid item type %T", itemAny)
+	}
+	return coll, nil
+}
+
+// tokenAccessService allows public items and actions and checks the jwt token of all other requests
+type tokenAccessService struct {
+	ctrl *mainController
+}
+
+func (s *tokenAccessService) CheckAccess(collection, signature, action, paramStr, token string) error {
+	if s.ctrl.publicAccess(collection, signature, action, paramStr) {
+		return nil
+	}
+	item, err := s.ctrl.getItem(collection, signature)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
+	}
+	// public items are always allowed
+	if item.GetPublic() {
+		s.ctrl.setPublicItem(collection, signature)
+		return nil
+	}
+	// check whether it's a public action
+	if publicActions := item.GetPublicActions(); len(publicActions) > 0 {
+		fullAction, err := s.ctrl.canonicalAction(item.GetMetadata().GetType(), action, paramStr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if slices.Contains(publicActions, fullAction) {
+			s.ctrl.setPublicAccess(collection, signature, action, paramStr)
+			return nil
+		}
+	}
+	if token == "" {
+		return errors.New("no token provided")
+	}
+	subject, err := s.ctrl.tokenSubject(collection, token)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	mediaType := item.GetMetadata().GetType()
+	_subject := s.ctrl.accessSubject(mediaType, collection, signature, action, paramStr)
+	if s.ctrl.canonicalSubject(mediaType, subject) != _subject {
+		return errors.Errorf("invalid subject '%s' in jwt token - should be '%s'", subject, _subject)
+	}
+
+	return nil
+}
+
+// contentSizeKey holds the size of the cache entry, used as length if the vfs does not know the size of the file
+const contentSizeKey = "mediaserver.size"
+
+// vfsDeliveryService streams files of the vfs with pooled buffers
+type vfsDeliveryService struct {
+	ctrl *mainController
+}
+
+func (s *vfsDeliveryService) ServeFile(c *gin.Context, path, mime, sha512 string) {
+	f, encoding, precompressed := s.ctrl.openPrecompressed(c, path, mime)
+	var err error
+	if precompressed {
+		c.Header("Content-Encoding", encoding)
+		if etag := c.Writer.Header().Get("ETag"); etag != "" {
+			c.Header("ETag", encodedETag(etag, encoding))
+		}
+	} else {
+		f, err = s.ctrl.vfs.Open(path)
+	}
+	if err != nil {
+		s.ctrl.logger.Error().Err(err).Msgf("cannot open %v/%s", s.ctrl.vfs, path)
+		status := http.StatusInternalServerError
+		if errors.Is(err, fs.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"error": fmt.Sprintf("cannot open %v/%s: %v", s.ctrl.vfs, path, err),
+		})
+		return
+	}
+	defer f.Close()
+	// the stored checksum is only valid for the unencoded file
+	if !precompressed {
+		setDigest(c, sha512)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		s.ctrl.logger.Error().Err(err).Msgf("cannot stat %v/%s", s.ctrl.vfs, path)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": fmt.Sprintf("cannot stat %v/%s: %v", s.ctrl.vfs, path, err),
+		})
+		return
+	}
+	defer s.ctrl.streamResponse(c, "vfs")()
+	pool := s.ctrl.streamBuffers.pool(mime)
+	if rs, ok := f.(io.ReadSeeker); ok {
+		pw := &pooledWriter{ResponseWriter: c.Writer, pool: pool, size: stat.Size()}
+		if rangeHeader := c.GetHeader("Range"); rangeHeader != "" {
+			c.Request.Header.Set("Range", s.ctrl.alignRange(rangeHeader, mime))
+		} else if !precompressed {
+			pw.firstScan = s.ctrl.firstScan(mime)
+		}
+		http.ServeContent(pw, c.Request, stat.Name(), stat.ModTime(), rs)
+		return
+	}
+	size := stat.Size()
+	if size <= 0 && !precompressed {
+		// some backends do not know the size of their files
+		size = c.GetInt64(contentSizeKey)
+	}
+	if size > 0 {
+		c.Header("Content-Length", fmt.Sprintf("%d", size))
+	}
+	c.Status(http.StatusOK)
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	if _, err := io.CopyBuffer(struct{ io.Writer }{c.Writer}, f, *buf); err != nil {
+		s.ctrl.logger.Error().Err(err).Msgf("cannot send %v/%s", s.ctrl.vfs, path)
+	}
+}
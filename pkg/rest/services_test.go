@@ -0,0 +1,45 @@
+package rest_test
+
+import (
+	"github.com/je4/mediaservermain/v2/pkg/fake"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"testing"
+	"time"
+)
+
+func BenchmarkAccessPublic(b *testing.B) {
+	access := newBenchServer(b).Controller.Access()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := access.CheckAccess(fake.Collection, fake.PublicImage, "item", "", ""); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAccessToken(b *testing.B) {
+	access := newBenchServer(b).Controller.Access()
+	token, err := rest.MintToken(benchCollectionKey, "HS256", rest.AccessSubject(fake.Collection, fake.RestrictedImage, "item", ""), time.Hour)
+	if err != nil {
+		b.Fatalf("cannot mint token: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := access.CheckAccess(fake.Collection, fake.RestrictedImage, "item", "", token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAccessDenied(b *testing.B) {
+	access := newBenchServer(b).Controller.Access()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := access.CheckAccess(fake.Collection, fake.RestrictedImage, "item", "", ""); err == nil {
+			b.Fatal("access granted without token")
+		}
+	}
+}
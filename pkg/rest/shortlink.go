@@ -0,0 +1,162 @@
+package rest
+
+import (
+	"crypto/rand"
+	"emperror.dev/errors"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"github.com/je4/utils/v2/pkg/config"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"time"
+)
+
+type ShortLinkConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Dir is a vfs folder shared by all instances, e.g. "vfs://testcache/shortlinks". if empty, links are kept in memory
+	Dir string `toml:"dir"`
+	// CacheSize is the number of links kept in memory
+	CacheSize int `toml:"cachesize"`
+	// MaxTTL limits the lifetime of short links
+	MaxTTL config.Duration `toml:"maxttl"`
+}
+
+type shortLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+type shortLinks struct {
+	dir    string
+	cache  gcache.Cache
+	maxTTL time.Duration
+}
+
+var shortLinkIDRegexp = regexp.MustCompile(`^[a-z2-7]{16}$`)
+
+var shortLinkEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// WithShortLinks resolves /s/:id to signed urls minted with "short": true at POST /admin/token
+func WithShortLinks(conf *ShortLinkConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		size := conf.CacheSize
+		if size <= 0 {
+			size = 10000
+		}
+		ctrl.shortLinks = &shortLinks{
+			dir:    conf.Dir,
+			cache:  gcache.New(size).LRU().Build(),
+			maxTTL: time.Duration(conf.MaxTTL),
+		}
+		return nil
+	}
+}
+
+func (sl *shortLinks) file(id string) string {
+	return path.Join(sl.dir, id[:2], id+".json")
+}
+
+// createShortLink stores the url and returns the short url
+func (ctrl *mainController) createShortLink(u string, ttl time.Duration) (string, error) {
+	sl := ctrl.shortLinks
+	if sl.maxTTL > 0 && ttl > sl.maxTTL {
+		ttl = sl.maxTTL
+	}
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "cannot create short link id")
+	}
+	id := shortLinkEncoding.EncodeToString(buf)
+	link := &shortLink{URL: u, Expires: time.Now().Add(ttl)}
+	if sl.dir != "" {
+		data, err := json.Marshal(link)
+		if err != nil {
+			return "", errors.Wrap(err, "cannot marshal short link")
+		}
+		fp, err := writefs.Create(ctrl.vfs, sl.file(id))
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot create %s", sl.file(id))
+		}
+		if _, err := fp.Write(data); err != nil {
+			fp.Close()
+			return "", errors.Wrapf(err, "cannot write %s", sl.file(id))
+		}
+		if err := fp.Close(); err != nil {
+			return "", errors.Wrapf(err, "cannot close %s", sl.file(id))
+		}
+	}
+	if err := sl.cache.SetWithExpire(id, link, ttl); err != nil {
+		return "", errors.Wrap(err, "cannot cache short link")
+	}
+	return ctrl.externalURL("s", id), nil
+}
+
+// getShortLink returns the link from memory or from the shared folder
+func (ctrl *mainController) getShortLink(id string) (*shortLink, error) {
+	sl := ctrl.shortLinks
+	if linkAny, err := sl.cache.Get(id); err == nil {
+		return linkAny.(*shortLink), nil
+	}
+	if sl.dir == "" {
+		return nil, gcache.KeyNotFoundError
+	}
+	data, err := fs.ReadFile(ctrl.vfs, sl.file(id))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, gcache.KeyNotFoundError
+		}
+		return nil, errors.Wrapf(err, "cannot read %s", sl.file(id))
+	}
+	link := &shortLink{}
+	if err := json.Unmarshal(data, link); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal %s", sl.file(id))
+	}
+	if remaining := time.Until(link.Expires); remaining > 0 {
+		if err := sl.cache.SetWithExpire(id, link, remaining); err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot cache short link %s", id)
+		}
+	}
+	return link, nil
+}
+
+func (ctrl *mainController) resolveShortLink(c *gin.Context) {
+	if ctrl.shortLinks == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "short links not enabled"})
+		return
+	}
+	id := c.Param("id")
+	if !shortLinkIDRegexp.MatchString(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("invalid short link '%s'", id)})
+		return
+	}
+	link, err := ctrl.getShortLink(id)
+	if err != nil {
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("short link '%s' not found", id)})
+			return
+		}
+		ctrl.logger.Error().Err(err).Msgf("cannot get short link %s", id)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot get short link '%s': %v", id, err)})
+		return
+	}
+	if time.Now().After(link.Expires) {
+		if ctrl.shortLinks.dir != "" {
+			if err := writefs.Remove(ctrl.vfs, ctrl.shortLinks.file(id)); err != nil {
+				ctrl.logger.Debug().Err(err).Msgf("cannot remove expired short link %s", id)
+			}
+		}
+		c.JSON(http.StatusGone, gin.H{"error": fmt.Sprintf("short link '%s' expired", id)})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, link.URL)
+}
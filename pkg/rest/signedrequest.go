@@ -0,0 +1,127 @@
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SigningKeyConfig struct {
+	Secret config.EnvString `toml:"secret"`
+	// Collections restricts the key to these collections. empty means all collections
+	Collections []string `toml:"collections"`
+}
+
+type RequestSigningConfig struct {
+	Enabled bool `toml:"enabled"`
+	// MaxAge is the accepted age of the request timestamp. timestamps ahead of the server time are accepted up to
+	// maxSigningClockSkew
+	MaxAge config.Duration `toml:"maxage"`
+	// Keys are api keys for machine clients. without keyid the hmac secret of the collection jwtkey is used
+	Keys map[string]*SigningKeyConfig `toml:"keys"`
+}
+
+// maxSigningClockSkew is the accepted difference of clocks for timestamps in the future
+const maxSigningClockSkew = 30 * time.Second
+
+// WithRequestSigning accepts hmac signed requests (?ts=<unix>&sig=<hex>[&keyid=<id>]) instead of jwt tokens.
+// the signature is hex(hmac-sha256(key, ts + "\n" + method + "\n" + path + "\n" + query)), the query is sorted
+// by key and does not contain sig
+func WithRequestSigning(conf *RequestSigningConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		ctrl.requestSigning = conf
+		if ctrl.requestSigning.MaxAge <= 0 {
+			ctrl.requestSigning.MaxAge = config.Duration(time.Minute)
+		}
+		for id, key := range conf.Keys {
+			if len(key.Secret) < hmacMinKeySize["HS256"] && !ctrl.jwtAllowWeakKeys {
+				return errors.Errorf("signing key '%s' too short: %d bytes, need %d", id, len(key.Secret), hmacMinKeySize["HS256"])
+			}
+		}
+		return nil
+	}
+}
+
+// RequestSignature returns the hex encoded signature of a request at time ts. the sig parameter of the query is
+// ignored, all other parameters including ts and keyid are signed
+func RequestSignature(secret []byte, ts int64, method, path string, query url.Values) string {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != "sig" {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	// Encode sorts by key
+	mac.Write([]byte(strings.Join([]string{strconv.FormatInt(ts, 10), strings.ToUpper(method), path, signed.Encode()}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingSecret returns the secret of an api key or of the collection
+func (ctrl *mainController) signingSecret(collection, keyID string) ([]byte, error) {
+	if keyID != "" {
+		key, ok := ctrl.requestSigning.Keys[keyID]
+		if !ok {
+			return nil, errors.Errorf("unknown signing key '%s'", keyID)
+		}
+		if len(key.Collections) > 0 && !slices.Contains(key.Collections, collection) {
+			return nil, errors.Errorf("signing key '%s' not valid for collection %s", keyID, collection)
+		}
+		return []byte(key.Secret), nil
+	}
+	coll, err := ctrl.getCollection(collection)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get collection %s", collection)
+	}
+	key, err := ctrl.collectionKey(collection, coll.GetJwtkey())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(key.secret) == 0 {
+		return nil, errors.Errorf("collection %s has no hmac key", collection)
+	}
+	if len(key.secret) < hmacMinKeySize["HS256"] {
+		if !ctrl.jwtAllowWeakKeys {
+			return nil, errors.Errorf("hmac key of collection %s too short: %d bytes, need %d", collection, len(key.secret), hmacMinKeySize["HS256"])
+		}
+		ctrl.logger.Warn().Msgf("weak hmac key of collection %s used for signed request", collection)
+	}
+	return key.secret, nil
+}
+
+// verifySignedRequest checks the hmac signature of a request. returns false if the request is not signed
+func (ctrl *mainController) verifySignedRequest(c *gin.Context, collection string) (bool, error) {
+	sig := c.Query("sig")
+	if ctrl.requestSigning == nil || sig == "" {
+		return false, nil
+	}
+	ts, err := strconv.ParseInt(c.Query("ts"), 10, 64)
+	if err != nil {
+		return false, errors.Errorf("invalid timestamp '%s'", c.Query("ts"))
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > time.Duration(ctrl.requestSigning.MaxAge) {
+		return false, errors.Errorf("request timestamp %d older than %v", ts, time.Duration(ctrl.requestSigning.MaxAge))
+	} else if -age > maxSigningClockSkew {
+		return false, errors.Errorf("request timestamp %d more than %v in the future", ts, maxSigningClockSkew)
+	}
+	secret, err := ctrl.signingSecret(collection, c.Query("keyid"))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	expected := RequestSignature(secret, ts, c.Request.Method, c.Request.URL.Path, c.Request.URL.Query())
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return false, errors.New("invalid request signature")
+	}
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package rest
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"github.com/rs/zerolog"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifySignedRequest(t *testing.T) {
+	logger := zerolog.Nop()
+	ctrl := &mainController{logger: &logger}
+	if err := WithRequestSigning(&RequestSigningConfig{
+		Enabled: true,
+		Keys:    map[string]*SigningKeyConfig{"harvester": {Secret: config.EnvString(testJWTSecret), Collections: []string{"test"}}},
+	})(ctrl); err != nil {
+		t.Fatal(err)
+	}
+	const path = "/test/image/resize/size32x24/formatpng"
+	now := time.Now().Unix()
+	sign := func(ts int64, method string, query url.Values) string {
+		query.Set("ts", strconv.FormatInt(ts, 10))
+		query.Set("keyid", "harvester")
+		query.Set("sig", RequestSignature([]byte(testJWTSecret), ts, method, path, query))
+		return query.Encode()
+	}
+	for _, tc := range []struct {
+		name       string
+		method     string
+		collection string
+		query      string
+		signed     bool
+		invalid    bool
+	}{
+		{name: "unsigned", query: "token=abc"},
+		{name: "signed", query: sign(now, "GET", url.Values{}), signed: true},
+		{name: "signed query", query: sign(now, "GET", url.Values{"download": {"1"}}), signed: true},
+		{name: "tampered query", query: sign(now, "GET", url.Values{"download": {"1"}}) + "&download=2", invalid: true},
+		{name: "added parameter", query: sign(now, "GET", url.Values{}) + "&download=1", invalid: true},
+		{name: "other method", method: "DELETE", query: sign(now, "GET", url.Values{}), invalid: true},
+		{name: "expired", query: sign(now-int64(time.Minute/time.Second)-1, "GET", url.Values{}), invalid: true},
+		{name: "clock skew", query: sign(now+10, "GET", url.Values{}), signed: true},
+		{name: "future", query: sign(now+int64(2*maxSigningClockSkew/time.Second), "GET", url.Values{}), invalid: true},
+		{name: "other collection", collection: "other", query: sign(now, "GET", url.Values{}), invalid: true},
+	} {
+		method := tc.method
+		if method == "" {
+			method = "GET"
+		}
+		collection := tc.collection
+		if collection == "" {
+			collection = "test"
+		}
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(method, path+"?"+tc.query, nil)
+		signed, err := ctrl.verifySignedRequest(c, collection)
+		if signed != tc.signed || (err != nil) != tc.invalid {
+			t.Errorf("%s: signed %v with error %v, expected signed %v and error %v", tc.name, signed, err, tc.signed, tc.invalid)
+		}
+	}
+}
+
+func TestWithRequestSigningWeakKey(t *testing.T) {
+	ctrl := &mainController{}
+	if err := WithRequestSigning(&RequestSigningConfig{
+		Enabled: true,
+		Keys:    map[string]*SigningKeyConfig{"weak": {Secret: "secret"}},
+	})(ctrl); err == nil {
+		t.Error("short signing key accepted")
+	}
+	if ctrl.requestSigning == nil || time.Duration(ctrl.requestSigning.MaxAge) != time.Minute {
+		t.Error("default max age not set")
+	}
+}
@@ -0,0 +1,173 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type SizeBudgetConfig struct {
+	// Actions maps "type::action" or action to the maximum derivative size in bytes, e.g. "video::resize" = 2147483648
+	Actions map[string]int64 `toml:"actions"`
+	// Refuse denies the delivery of derivatives above the budget, otherwise they are only reported
+	Refuse bool `toml:"refuse"`
+	// AlertURL receives a json POST for every derivative above the budget
+	AlertURL string          `toml:"alerturl"`
+	Timeout  config.Duration `toml:"timeout"`
+}
+
+var errOverBudget = errors.New("derivative exceeds the size budget")
+
+// SizeBudgetViolation is a derivative above the size budget of its action
+type SizeBudgetViolation struct {
+	Type       string    `json:"type"`
+	Collection string    `json:"collection"`
+	Signature  string    `json:"signature"`
+	Action     string    `json:"action"`
+	Params     string    `json:"params"`
+	Size       int64     `json:"size"`
+	Budget     int64     `json:"budget"`
+	Path       string    `json:"path"`
+	Detected   time.Time `json:"detected"`
+}
+
+// maxSizeBudgetViolations is the number of violations kept for /admin/sizebudget
+const maxSizeBudgetViolations = 100
+
+type sizeBudget struct {
+	sync.Mutex
+	conf       *SizeBudgetConfig
+	client     *http.Client
+	violations []*SizeBudgetViolation
+	// reported prevents repeated alerts for the same derivative
+	reported map[string]bool
+}
+
+// WithSizeBudget reports and optionally refuses derivatives larger than the budget of their action
+func WithSizeBudget(conf *SizeBudgetConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || len(conf.Actions) == 0 {
+			return nil
+		}
+		for action, budget := range conf.Actions {
+			if budget <= 0 {
+				return errors.Errorf("invalid size budget %d for %s", budget, action)
+			}
+		}
+		timeout := time.Duration(conf.Timeout)
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		ctrl.sizeBudget = &sizeBudget{
+			conf:     conf,
+			client:   &http.Client{Timeout: timeout},
+			reported: map[string]bool{},
+		}
+		return nil
+	}
+}
+
+// checkSizeBudget reports derivatives above the budget. errOverBudget is returned if they must not be delivered
+func (ctrl *mainController) checkSizeBudget(item *mediaserverproto.Item, cache *mediaserverproto.Cache) error {
+	sb := ctrl.sizeBudget
+	if sb == nil || cache == nil {
+		return nil
+	}
+	metadata := cache.GetMetadata()
+	mediaType := item.GetMetadata().GetType()
+	budget, ok := sb.conf.Actions[mediaType+"::"+metadata.GetAction()]
+	if !ok {
+		budget, ok = sb.conf.Actions[metadata.GetAction()]
+	}
+	if !ok || metadata.GetSize() <= budget {
+		return nil
+	}
+	violation := &SizeBudgetViolation{
+		Type:       mediaType,
+		Collection: item.GetIdentifier().GetCollection(),
+		Signature:  item.GetIdentifier().GetSignature(),
+		Action:     metadata.GetAction(),
+		Params:     metadata.GetParams(),
+		Size:       metadata.GetSize(),
+		Budget:     budget,
+		Path:       metadata.GetPath(),
+		Detected:   time.Now(),
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s", violation.Collection, violation.Signature, violation.Action, violation.Params)
+	sb.Lock()
+	if !sb.reported[key] {
+		if len(sb.reported) >= 10*maxSizeBudgetViolations {
+			clear(sb.reported)
+		}
+		sb.reported[key] = true
+		sb.violations = append(sb.violations, violation)
+		if len(sb.violations) > maxSizeBudgetViolations {
+			sb.violations = sb.violations[len(sb.violations)-maxSizeBudgetViolations:]
+		}
+		ctrl.logger.Warn().
+			Str("collection", violation.Collection).
+			Str("signature", violation.Signature).
+			Str("action", violation.Action).
+			Str("params", violation.Params).
+			Int64("size", violation.Size).
+			Int64("budget", violation.Budget).
+			Str("path", violation.Path).
+			Msg("derivative exceeds size budget")
+		if sb.conf.AlertURL != "" {
+			go ctrl.sizeBudgetAlert(violation)
+		}
+	}
+	sb.Unlock()
+	if sb.conf.Refuse {
+		return errors.Wrapf(errOverBudget, "%s is %d bytes, budget %d bytes", key, violation.Size, violation.Budget)
+	}
+	return nil
+}
+
+func (ctrl *mainController) sizeBudgetAlert(violation *SizeBudgetViolation) {
+	sb := ctrl.sizeBudget
+	data, err := json.Marshal(violation)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot marshal size budget alert")
+		return
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, sb.conf.AlertURL, bytes.NewReader(data))
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot create size budget alert for %s", sb.conf.AlertURL)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := sb.client.Do(req)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot send size budget alert to %s", sb.conf.AlertURL)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		ctrl.logger.Error().Msgf("size budget alert to %s: status %s", sb.conf.AlertURL, resp.Status)
+	}
+}
+
+func (ctrl *mainController) adminSizeBudget(c *gin.Context) {
+	sb := ctrl.sizeBudget
+	if sb == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "size budget not configured"})
+		return
+	}
+	sb.Lock()
+	violations := append([]*SizeBudgetViolation{}, sb.violations...)
+	sb.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"budgets":    sb.conf.Actions,
+		"refuse":     sb.conf.Refuse,
+		"violations": violations,
+	})
+}
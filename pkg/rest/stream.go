@@ -0,0 +1,140 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultStreamBufferSize = 64 << 10
+
+// WithStreamBuffers sets the copy buffer sizes for delivering files per media type.
+// keys are mime types ("video/mp4"), major types ("video") or "*"
+func WithStreamBuffers(sizes map[string]int) Option {
+	return func(ctrl *mainController) error {
+		for mime, size := range sizes {
+			if size < 4<<10 {
+				return errors.Errorf("stream buffer size %d for %s is smaller than 4KiB", size, mime)
+			}
+		}
+		ctrl.streamBuffers = newBufferPools(sizes)
+		return nil
+	}
+}
+
+// bufferPools holds a pool per buffer size
+type bufferPools struct {
+	sizes map[string]int
+	mutex sync.Mutex
+	pools map[int]*sync.Pool
+}
+
+func newBufferPools(sizes map[string]int) *bufferPools {
+	return &bufferPools{sizes: sizes, pools: map[int]*sync.Pool{}}
+}
+
+func (bp *bufferPools) size(mime string) int {
+	mime, _, _ = strings.Cut(mime, ";")
+	if size, ok := bp.sizes[mime]; ok {
+		return size
+	}
+	major, _, _ := strings.Cut(mime, "/")
+	if size, ok := bp.sizes[major]; ok {
+		return size
+	}
+	if size, ok := bp.sizes["*"]; ok {
+		return size
+	}
+	return defaultStreamBufferSize
+}
+
+func (bp *bufferPools) pool(mime string) *sync.Pool {
+	size := bp.size(mime)
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	p, ok := bp.pools[size]
+	if !ok {
+		p = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		bp.pools[size] = p
+	}
+	return p
+}
+
+// pooledWriter copies with a pooled buffer when http.ServeContent uses io.Copy
+type pooledWriter struct {
+	gin.ResponseWriter
+	pool *sync.Pool
+	// size of the file. http.ServeContent sends responses with Content-Encoding without length
+	size int64
+	// firstScan is the number of bytes flushed before the rest, 0 for none
+	firstScan int64
+}
+
+// rangeLength returns the length of a "bytes first-last/size" content range
+func rangeLength(contentRange string) (int64, bool) {
+	r, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	r, _, _ = strings.Cut(r, "/")
+	firstStr, lastStr, ok := strings.Cut(r, "-")
+	if !ok {
+		return 0, false
+	}
+	first, err := strconv.ParseInt(firstStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	last, err := strconv.ParseInt(lastStr, 10, 64)
+	if err != nil || last < first {
+		return 0, false
+	}
+	return last - first + 1, true
+}
+
+// WriteHeader sets the missing length of precompressed full and single range responses
+func (pw *pooledWriter) WriteHeader(code int) {
+	header := pw.Header()
+	if header.Get("Content-Length") == "" && header.Get("Content-Encoding") != "" {
+		switch code {
+		case http.StatusOK:
+			header.Set("Content-Length", strconv.FormatInt(pw.size, 10))
+		case http.StatusPartialContent:
+			if length, ok := rangeLength(header.Get("Content-Range")); ok {
+				header.Set("Content-Length", strconv.FormatInt(length, 10))
+			}
+		}
+	}
+	pw.ResponseWriter.WriteHeader(code)
+}
+
+func (pw *pooledWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := pw.pool.Get().(*[]byte)
+	defer pw.pool.Put(buf)
+	// hide ReadFrom of the writer to make CopyBuffer use the buffer
+	w := struct{ io.Writer }{pw.ResponseWriter}
+	if pw.firstScan <= 0 {
+		return io.CopyBuffer(w, r, *buf)
+	}
+	n, err := io.CopyBuffer(w, io.LimitReader(r, pw.firstScan), *buf)
+	pw.firstScan = 0
+	if err != nil {
+		return n, err
+	}
+	pw.Flush()
+	m, err := io.CopyBuffer(w, r, *buf)
+	return n + m, err
+}
+
+// serveFile delivers a file of the vfs or its pre-compressed variant. seekable files support range and conditional requests.
+// sha512 is the stored checksum of the file, if any
+func (ctrl *mainController) serveFile(c *gin.Context, path, mime, sha512 string) {
+	ctrl.delivery.ServeFile(c, path, mime, sha512)
+}
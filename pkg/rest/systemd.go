@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemd socket activation (sd_listen_fds(3)), first passed descriptor is 3
+const systemdFirstFD = 3
+
+type systemdSocket struct {
+	name     string
+	listener net.Listener
+}
+
+var systemdSockets = sync.OnceValues(func() ([]systemdSocket, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	num, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid LISTEN_FDS '%s'", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var sockets []systemdSocket
+	for i := 0; i < num; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdFirstFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot use systemd socket %d (%s)", systemdFirstFD+i, name)
+		}
+		sockets = append(sockets, systemdSocket{name: name, listener: l})
+	}
+	return sockets, nil
+})
+
+// systemdListener returns the activated socket for the listen address.
+// sockets are matched by FileDescriptorName= first and by position otherwise
+func systemdListener(addr string, pos int) (net.Listener, bool, error) {
+	sockets, err := systemdSockets()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, s := range sockets {
+		if s.name == addr {
+			return s.listener, true, nil
+		}
+	}
+	if pos < len(sockets) {
+		return sockets[pos].listener, true, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,187 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TenantConfig assigns collections and virtual hosts to a tenant with own caches and rate limit
+type TenantConfig struct {
+	CollectionPrefixes  []string `toml:"collectionprefixes"`
+	Hosts               []string `toml:"hosts"`
+	ItemCacheSize       int      `toml:"itemcachesize"`
+	CollectionCacheSize int      `toml:"collectioncachesize"`
+	// RateLimit is the number of requests per second, 0 is unlimited
+	RateLimit float64 `toml:"ratelimit"`
+	Burst     int     `toml:"burst"`
+}
+
+type tenant struct {
+	name      string
+	conf      *TenantConfig
+	partition *cachePartition
+	limiter   *tokenBucket
+	requests  atomic.Int64
+	limited   atomic.Int64
+	failures  atomic.Int64
+}
+
+// WithTenants partitions caches, rate limits and metrics by tenant.
+// collections without tenant use the global caches
+func WithTenants(tenants map[string]*TenantConfig) Option {
+	return func(ctrl *mainController) error {
+		if len(tenants) == 0 {
+			return nil
+		}
+		ctrl.tenants = map[string]*tenant{}
+		for name, conf := range tenants {
+			if len(conf.CollectionPrefixes) == 0 && len(conf.Hosts) == 0 {
+				return errors.Errorf("tenant %s has neither collection prefixes nor hosts", name)
+			}
+			if conf.ItemCacheSize <= 0 {
+				conf.ItemCacheSize = 1000
+			}
+			if conf.CollectionCacheSize <= 0 {
+				conf.CollectionCacheSize = 30
+			}
+			t := &tenant{
+				name:      name,
+				conf:      conf,
+				partition: ctrl.newCachePartition(conf.ItemCacheSize, conf.CollectionCacheSize, ctrl.cacheTimeout),
+			}
+			if conf.RateLimit > 0 {
+				t.limiter = newTokenBucket(conf.RateLimit, conf.Burst)
+			}
+			ctrl.tenants[name] = t
+		}
+		return nil
+	}
+}
+
+// tenantByCollection returns the tenant with the longest matching collection prefix
+func (ctrl *mainController) tenantByCollection(collection string) *tenant {
+	var result *tenant
+	var length = -1
+	for _, t := range ctrl.tenants {
+		for _, prefix := range t.conf.CollectionPrefixes {
+			if strings.HasPrefix(collection, prefix) && len(prefix) > length {
+				result, length = t, len(prefix)
+			}
+		}
+	}
+	return result
+}
+
+func (ctrl *mainController) tenantByHost(host string) *tenant {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, t := range ctrl.tenants {
+		if slices.ContainsFunc(t.conf.Hosts, func(s string) bool { return strings.EqualFold(s, host) }) {
+			return t
+		}
+	}
+	return nil
+}
+
+// partition returns the caches of the tenant of the collection
+func (ctrl *mainController) partition(collection string) *cachePartition {
+	if t := ctrl.tenantByCollection(collection); t != nil {
+		return t.partition
+	}
+	return ctrl.cachePartition
+}
+
+// tenantMiddleware applies the rate limit of the tenant of the virtual host or collection
+func (ctrl *mainController) tenantMiddleware(c *gin.Context) {
+	t := ctrl.tenantByHost(c.Request.Host)
+	if t == nil {
+		if collection := c.Param("collection"); collection != "" {
+			t = ctrl.tenantByCollection(collection)
+		}
+	}
+	if t == nil {
+		c.Next()
+		return
+	}
+	t.requests.Add(1)
+	if t.limiter != nil {
+		if ok, wait := t.limiter.take(); !ok {
+			t.limited.Add(1)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit of tenant exceeded"})
+			return
+		}
+	}
+	c.Next()
+	if c.Writer.Status() >= 500 {
+		t.failures.Add(1)
+	}
+}
+
+type TenantStats struct {
+	Name        string `json:"name"`
+	Requests    int64  `json:"requests"`
+	RateLimited int64  `json:"ratelimited"`
+	Failures    int64  `json:"failures"`
+	Items       int    `json:"items"`
+	Metadata    int    `json:"metadata"`
+	Collections int    `json:"collections"`
+}
+
+func (ctrl *mainController) adminTenants(c *gin.Context) {
+	var result = []*TenantStats{}
+	for _, t := range ctrl.tenants {
+		result = append(result, &TenantStats{
+			Name:        t.name,
+			Requests:    t.requests.Load(),
+			RateLimited: t.limited.Load(),
+			Failures:    t.failures.Load(),
+			Items:       t.partition.itemCache.Len(true),
+			Metadata:    t.partition.metadataCache.Len(true),
+			Collections: t.partition.collectionCache.Len(true),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	c.JSON(http.StatusOK, result)
+}
+
+// tokenBucket is a simple rate limiter
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take removes a token. if none is available it returns the time until the next one
+func (tb *tokenBucket) take() (bool, time.Duration) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	now := time.Now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
@@ -0,0 +1,191 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+type TileHintsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Push pushes the tiles of the level below the first one on http/2 connections. only for public requests
+	Push bool `toml:"push"`
+	// CacheSize is the number of items whose preload links are cached for early hints
+	CacheSize int `toml:"cachesize"`
+}
+
+type tileHints struct {
+	links gcache.Cache
+	push  bool
+}
+
+type tileHintsKey struct {
+	collection, signature, version string
+}
+
+type tileHintsEntry struct {
+	preload []string
+	push    []string
+}
+
+// maxInfoSize limits the info.json documents parsed for tile hints
+const maxInfoSize = 1024 * 1024
+
+// maxTileHints limits the number of tiles announced or pushed per level
+const maxTileHints = 16
+
+// WithTileHints adds preload links for the first tile level to info.json responses and sends them as early hints (103)
+func WithTileHints(conf *TileHintsConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		size := conf.CacheSize
+		if size <= 0 {
+			size = 10000
+		}
+		ctrl.tileHints = &tileHints{
+			links: gcache.New(size).LRU().Build(),
+			push:  conf.Push,
+		}
+		return nil
+	}
+}
+
+type iiifInfo struct {
+	ID     string `json:"id"`
+	ID2    string `json:"@id"`
+	Width  int64  `json:"width"`
+	Height int64  `json:"height"`
+	Tiles  []struct {
+		Width        int64   `json:"width"`
+		Height       int64   `json:"height"`
+		ScaleFactors []int64 `json:"scaleFactors"`
+	} `json:"tiles"`
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+// levelTiles returns the tile urls of a scale factor the way deep zoom viewers request them
+func (info *iiifInfo) levelTiles(version string, scale int64) []string {
+	id := info.ID
+	if id == "" {
+		id = info.ID2
+	}
+	tw, th := info.Tiles[0].Width, info.Tiles[0].Height
+	if th <= 0 {
+		th = tw
+	}
+	regionW, regionH := tw*scale, th*scale
+	cols, rows := ceilDiv(info.Width, regionW), ceilDiv(info.Height, regionH)
+	var tiles []string
+	for y := int64(0); y < rows; y++ {
+		for x := int64(0); x < cols; x++ {
+			rx, ry := x*regionW, y*regionH
+			rw, rh := min(regionW, info.Width-rx), min(regionH, info.Height-ry)
+			region := fmt.Sprintf("%d,%d,%d,%d", rx, ry, rw, rh)
+			if cols == 1 && rows == 1 {
+				region = "full"
+			}
+			size := fmt.Sprintf("%d,", ceilDiv(rw, scale))
+			if version == "3" {
+				size = fmt.Sprintf("%d,%d", ceilDiv(rw, scale), ceilDiv(rh, scale))
+			}
+			tiles = append(tiles, strings.TrimRight(id, "/")+"/"+region+"/"+size+"/0/default.jpg")
+			if len(tiles) >= maxTileHints {
+				return tiles
+			}
+		}
+	}
+	return tiles
+}
+
+// newTileHintsEntry computes the tiles of the first level and of the level below from an info.json document
+func newTileHintsEntry(version string, data []byte) *tileHintsEntry {
+	info := &iiifInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil
+	}
+	if info.Width <= 0 || info.Height <= 0 || len(info.Tiles) == 0 || info.Tiles[0].Width <= 0 || len(info.Tiles[0].ScaleFactors) == 0 {
+		return nil
+	}
+	scales := slices.Clone(info.Tiles[0].ScaleFactors)
+	slices.Sort(scales)
+	entry := &tileHintsEntry{preload: info.levelTiles(version, scales[len(scales)-1])}
+	if len(scales) > 1 {
+		entry.push = info.levelTiles(version, scales[len(scales)-2])
+	}
+	return entry
+}
+
+func (entry *tileHintsEntry) linkHeader() string {
+	var links []string
+	for _, tile := range entry.preload {
+		links = append(links, fmt.Sprintf("<%s>; rel=preload; as=image", tile))
+	}
+	return strings.Join(links, ", ")
+}
+
+// earlyHints sends cached preload links of an item as 103 Early Hints before the info.json is fetched
+func (ctrl *mainController) earlyHints(c *gin.Context, collection, signature, version string) {
+	if ctrl.tileHints == nil {
+		return
+	}
+	entryAny, err := ctrl.tileHints.links.GetIFPresent(tileHintsKey{collection: collection, signature: signature, version: version})
+	if err != nil {
+		return
+	}
+	entry := entryAny.(*tileHintsEntry)
+	var w http.ResponseWriter = c.Writer
+	for {
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	// the links of the final response are restored after the early hints
+	links := w.Header().Values("Link")
+	w.Header().Set("Link", entry.linkHeader())
+	w.WriteHeader(http.StatusEarlyHints)
+	w.Header().Del("Link")
+	for _, l := range links {
+		w.Header().Add("Link", l)
+	}
+}
+
+// infoWithHints reads an info.json response, adds preload links for the first tile level and pushes the level below
+func (ctrl *mainController) infoWithHints(c *gin.Context, collection, signature, version, token string, body io.Reader) io.Reader {
+	data, err := io.ReadAll(io.LimitReader(body, maxInfoSize+1))
+	if err != nil || len(data) > maxInfoSize {
+		return io.MultiReader(bytes.NewReader(data), body)
+	}
+	entry := newTileHintsEntry(version, data)
+	if entry == nil {
+		return bytes.NewReader(data)
+	}
+	ctrl.tileHints.links.Set(tileHintsKey{collection: collection, signature: signature, version: version}, entry)
+	c.Writer.Header().Add("Link", entry.linkHeader())
+	if pusher := c.Writer.Pusher(); ctrl.tileHints.push && pusher != nil && token == "" {
+		for _, tile := range entry.push {
+			u, err := url.Parse(tile)
+			if err != nil {
+				continue
+			}
+			if err := pusher.Push(u.RequestURI(), nil); err != nil {
+				ctrl.logger.Debug().Err(err).Msgf("cannot push %s", tile)
+				break
+			}
+		}
+	}
+	return bytes.NewReader(data)
+}
@@ -0,0 +1,75 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"github.com/bluele/gcache"
+	"github.com/golang-jwt/jwt/v5"
+	"time"
+)
+
+type tokenCacheEntry struct {
+	subject string
+}
+
+// WithTokenCache caches successful token validations for their remaining lifetime, at most maxTTL
+func WithTokenCache(size int, maxTTL time.Duration) Option {
+	return func(ctrl *mainController) error {
+		if size <= 0 || maxTTL <= 0 {
+			return nil
+		}
+		ctrl.tokenCache = gcache.New(size).LRU().Build()
+		ctrl.tokenCacheTTL = maxTTL
+		return nil
+	}
+}
+
+func tokenCacheKey(collection, token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(collection + "\x00" + token))
+}
+
+// tokenSubject verifies the token with the collection keys and returns its subject
+func (ctrl *mainController) tokenSubject(collection, token string) (string, error) {
+	cacheKey := tokenCacheKey(collection, token)
+	if ctrl.tokenCache != nil {
+		if entryAny, err := ctrl.tokenCache.Get(cacheKey); err == nil {
+			if entry, ok := entryAny.(*tokenCacheEntry); ok {
+				return entry.subject, nil
+			}
+		}
+	}
+	coll, err := ctrl.getCollection(collection)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get collection %s", collection)
+	}
+	key, err := ctrl.collectionKey(collection, coll.GetJwtkey())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	maxTTL, clockSkew := ctrl.tokenPolicy(collection)
+	jwtToken, err := ctrl.parseToken(token, ctrl.collectionAlgs(collection), key, jwt.WithLeeway(clockSkew))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := checkTokenLifetime(jwtToken, maxTTL, clockSkew); err != nil {
+		return "", errors.WithStack(err)
+	}
+	subject, err := jwtToken.Claims.GetSubject()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get subject from jwt token '%s'", token)
+	}
+	if ctrl.tokenCache != nil {
+		ttl := ctrl.tokenCacheTTL
+		if exp, err := jwtToken.Claims.GetExpirationTime(); err == nil && exp != nil {
+			if remaining := time.Until(exp.Time); remaining < ttl {
+				ttl = remaining
+			}
+		}
+		if ttl > 0 {
+			if err := ctrl.tokenCache.SetWithExpire(cacheKey, &tokenCacheEntry{subject: subject}, ttl); err != nil {
+				ctrl.logger.Error().Err(err).Msg("cannot cache token")
+			}
+		}
+	}
+	return subject, nil
+}
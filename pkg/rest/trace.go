@@ -0,0 +1,216 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceKey = "mediaserver.trace"
+
+type RequestLogConfig struct {
+	// SampleRate is the fraction of successful requests written to the access log (0..1)
+	SampleRate float64 `toml:"samplerate"`
+	// SlowThreshold marks requests as slow. slow requests are always logged with all spans
+	SlowThreshold config.Duration `toml:"slowthreshold"`
+	// SlowThresholds overrides SlowThreshold per route pattern, e.g. "/:collection/:signature/:action/*params"
+	SlowThresholds map[string]config.Duration `toml:"slowthresholds"`
+}
+
+// WithRequestLog configures access log sampling and the slow request log
+func WithRequestLog(conf *RequestLogConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf != nil {
+			ctrl.requestLog = conf
+		}
+		return nil
+	}
+}
+
+type span struct {
+	name     string
+	duration time.Duration
+}
+
+// requestTrace collects the durations of the processing phases and backend calls of a request
+type requestTrace struct {
+	sync.Mutex
+	start     time.Time
+	spans     []span
+	decisions []decision
+}
+
+func getTrace(c *gin.Context) *requestTrace {
+	if t, ok := c.Get(traceKey); ok {
+		if trace, ok := t.(*requestTrace); ok {
+			return trace
+		}
+	}
+	return nil
+}
+
+// startSpan measures a phase of the request. call the returned function at the end of the phase
+func startSpan(c *gin.Context, name string) func() {
+	trace := getTrace(c)
+	if trace == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		trace.Lock()
+		defer trace.Unlock()
+		trace.spans = append(trace.spans, span{name: name, duration: time.Since(start)})
+	}
+}
+
+func (ctrl *mainController) slowThreshold(route string) time.Duration {
+	if ctrl.requestLog == nil {
+		return 0
+	}
+	if threshold, ok := ctrl.requestLog.SlowThresholds[route]; ok {
+		return time.Duration(threshold)
+	}
+	return time.Duration(ctrl.requestLog.SlowThreshold)
+}
+
+// accessLog replaces the gin logger. errors and slow requests are always logged, everything else sampled
+func (ctrl *mainController) accessLog(c *gin.Context) {
+	trace := &requestTrace{start: time.Now()}
+	c.Set(traceKey, trace)
+	c.Next()
+	ctrl.logRequest(c.Request, c.FullPath(), c.Writer.Status(), c.Writer.Size(), trace)
+}
+
+// logRequest writes the access log entry of a finished request
+func (ctrl *mainController) logRequest(r *http.Request, route string, httpStatus, size int, trace *requestTrace) {
+	duration := time.Since(trace.start)
+	threshold := ctrl.slowThreshold(route)
+	slow := threshold > 0 && duration >= threshold
+	if !slow && httpStatus < 500 {
+		rate := 1.0
+		if ctrl.requestLog != nil {
+			rate = ctrl.requestLog.SampleRate
+		}
+		if rate < 1 && rand.Float64() >= rate {
+			return
+		}
+	}
+	evt := ctrl.logger.Info()
+	if slow {
+		evt = ctrl.logger.Warn().Bool("slow", true)
+		trace.Lock()
+		for _, s := range trace.spans {
+			evt = evt.Dur("span."+s.name, s.duration)
+		}
+		trace.Unlock()
+	}
+	evt.Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Str("route", route).
+		Int("status", httpStatus).
+		Int("size", size).
+		Dur("duration", duration).
+		Str("remote", remoteHost(r)).
+		Msg("request")
+}
+
+// WithServerTiming emits the phase durations of a request in a Server-Timing header
+func WithServerTiming(enabled bool) Option {
+	return func(ctrl *mainController) error {
+		ctrl.serverTiming = enabled
+		return nil
+	}
+}
+
+var spanDescriptions = map[string]string{
+	"item":     "item lookup",
+	"access":   "access check",
+	"cache":    "cache lookup",
+	"generate": "generation",
+	"delivery": "delivery",
+}
+
+func serverTimingValue(spans []span) string {
+	var parts []string
+	for _, s := range spans {
+		part := fmt.Sprintf("%s;dur=%.1f", s.name, float64(s.duration.Microseconds())/1000)
+		if desc, ok := spanDescriptions[s.name]; ok {
+			part += fmt.Sprintf(`;desc="%s"`, desc)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// serverTimingWriter adds the spans measured so far before the header is written
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	trace       *requestTrace
+	headerStart time.Time
+	// trailer is set if the delivery phase is sent as trailer
+	trailer bool
+}
+
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *serverTimingWriter) inject() {
+	if !w.headerStart.IsZero() {
+		return
+	}
+	w.headerStart = time.Now()
+	w.trace.Lock()
+	value := serverTimingValue(w.trace.spans)
+	w.trace.Unlock()
+	if value != "" {
+		w.Header().Set("Server-Timing", value)
+	}
+	// a trailer needs a chunked response, responses with known length keep the header only
+	if w.Header().Get("Content-Length") == "" {
+		w.trailer = true
+		w.Header().Add("Trailer", "Server-Timing")
+	}
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	w.inject()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.inject()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(data []byte) (int, error) {
+	w.inject()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *serverTimingWriter) WriteString(s string) (int, error) {
+	w.inject()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// serverTimingMiddleware must run after accessLog, which creates the trace
+func (ctrl *mainController) serverTimingMiddleware(c *gin.Context) {
+	trace := getTrace(c)
+	if trace == nil {
+		c.Next()
+		return
+	}
+	w := &serverTimingWriter{ResponseWriter: c.Writer, trace: trace}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if w.trailer {
+		// the delivery phase is only known after the body is written. sent as trailer for chunked responses
+		c.Writer.Header().Set("Server-Timing", serverTimingValue([]span{{name: "delivery", duration: time.Since(w.headerStart)}}))
+	}
+}
@@ -0,0 +1,299 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/utils/v2/pkg/config"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type TranscriptionConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Collections accepting transcriptions
+	Collections []string `toml:"collections"`
+	// MaxLength of a transcription in characters, default 20000
+	MaxLength int `toml:"maxlength"`
+	// MaxLinks of a transcription, more links are rejected as spam. default 2
+	MaxLinks int `toml:"maxlinks"`
+	// Submissions per client within Window, default 10 within 1h
+	Submissions int             `toml:"submissions"`
+	Window      config.Duration `toml:"window"`
+}
+
+// TranscriptionSubmission is the body of POST /transcriptions/:collection/:signature
+type TranscriptionSubmission struct {
+	// Page of the item starting with 1, 0 for single page items
+	Page int    `json:"page"`
+	Text string `json:"text" binding:"required"`
+	Lang string `json:"lang"`
+	// Name of the volunteer, shown as creator of the annotation
+	Name string `json:"name"`
+	// Website is a honeypot field of submission forms which must stay empty
+	Website string `json:"website"`
+}
+
+// TranscriptionInfo is a submission waiting for moderation
+type TranscriptionInfo struct {
+	ID         string         `json:"id"`
+	Collection string         `json:"collection"`
+	Signature  string         `json:"signature"`
+	Created    time.Time      `json:"created"`
+	Annotation map[string]any `json:"annotation"`
+}
+
+type transcriptions struct {
+	sync.Mutex
+	conf    *TranscriptionConfig
+	window  time.Duration
+	clients map[string][]time.Time
+}
+
+// WithTranscriptions accepts transcriptions of item pages from volunteers at POST /transcriptions/:collection/:signature.
+// they are stored as pending annotations and published after approval at /admin/transcriptions. needs [annotations]
+func WithTranscriptions(conf *TranscriptionConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if len(conf.Collections) == 0 {
+			return errors.New("no transcription collections configured")
+		}
+		if conf.MaxLength <= 0 {
+			conf.MaxLength = 20000
+		}
+		if conf.MaxLinks <= 0 {
+			conf.MaxLinks = 2
+		}
+		if conf.Submissions <= 0 {
+			conf.Submissions = 10
+		}
+		tr := &transcriptions{
+			conf:    conf,
+			window:  time.Duration(conf.Window),
+			clients: map[string][]time.Time{},
+		}
+		if tr.window <= 0 {
+			tr.window = time.Hour
+		}
+		ctrl.transcriptions = tr
+		return nil
+	}
+}
+
+// allow counts a submission of a client. it returns false above the limit of the window
+func (tr *transcriptions) allow(client string, now time.Time) bool {
+	tr.Lock()
+	defer tr.Unlock()
+	for key, times := range tr.clients {
+		times = slices.DeleteFunc(times, func(t time.Time) bool {
+			return now.Sub(t) >= tr.window
+		})
+		if len(times) == 0 {
+			delete(tr.clients, key)
+			continue
+		}
+		tr.clients[key] = times
+	}
+	if len(tr.clients[client]) >= tr.conf.Submissions {
+		return false
+	}
+	tr.clients[client] = append(tr.clients[client], now)
+	return true
+}
+
+// transcriptionDocument builds the supplementing annotation of a page
+func (ctrl *mainController) transcriptionDocument(collection, signature string, req *TranscriptionSubmission) map[string]any {
+	body := map[string]any{
+		"type":   "TextualBody",
+		"value":  req.Text,
+		"format": "text/plain",
+	}
+	if req.Lang != "" {
+		body["language"] = req.Lang
+	}
+	var target any = ctrl.canvasURL(collection, signature)
+	if req.Page > 0 {
+		target = map[string]any{
+			"type":   "SpecificResource",
+			"source": target,
+			"selector": map[string]any{
+				"type":       "FragmentSelector",
+				"conformsTo": "http://tools.ietf.org/rfc/rfc3778",
+				"value":      fmt.Sprintf("page=%d", req.Page),
+			},
+		}
+	}
+	doc := map[string]any{
+		"type":       "Annotation",
+		"motivation": "supplementing",
+		"body":       body,
+		"target":     target,
+	}
+	if req.Name != "" {
+		doc["creator"] = map[string]any{"type": "Person", "name": req.Name}
+	}
+	return doc
+}
+
+// submitTranscription stores the transcription of a page as pending annotation. items must be readable with the
+// token of the request
+func (ctrl *mainController) submitTranscription(c *gin.Context) {
+	tr := ctrl.transcriptions
+	if tr == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !slices.Contains(tr.conf.Collections, c.Param("collection")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no transcriptions for collection %s", c.Param("collection"))})
+		return
+	}
+	collection, signature, ok := ctrl.annotationAccess(c, false)
+	if !ok {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, ctrl.annotations.conf.MaxSize)
+	var req TranscriptionSubmission
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Page < 0 || req.Text == "" || utf8.RuneCountInString(req.Text) > tr.conf.MaxLength || len(req.Name) > maxPrintRequestField {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("text is required and limited to %d characters", tr.conf.MaxLength)})
+		return
+	}
+	// bots fill the hidden field, they get the regular answer without the submission being stored
+	if req.Website != "" {
+		ctrl.logger.Info().Str("audit", "transcription").Msgf("spam submission for %s/%s from %s dropped", collection, signature, c.ClientIP())
+		c.JSON(http.StatusAccepted, gin.H{"status": AnnotationPending})
+		return
+	}
+	if links := strings.Count(req.Text, "http://") + strings.Count(req.Text, "https://"); links > tr.conf.MaxLinks {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("transcriptions are limited to %d links", tr.conf.MaxLinks)})
+		return
+	}
+	if !tr.allow(c.ClientIP(), time.Now()) {
+		c.Header("Retry-After", fmt.Sprintf("%d", int(tr.window.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("more than %d transcriptions within %s", tr.conf.Submissions, tr.window)})
+		return
+	}
+	document, err := json.Marshal(ctrl.transcriptionDocument(collection, signature, &req))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot marshal transcription: %v", err)})
+		return
+	}
+	// repeated submissions of the same text are not stored twice
+	an := ctrl.annotations
+	an.Lock()
+	duplicate := slices.ContainsFunc(an.items[itemIdentifier{collection: collection, signature: signature}], func(a *Annotation) bool {
+		return string(a.Document) == string(document)
+	})
+	an.Unlock()
+	if duplicate {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("transcription already submitted for %s/%s", collection, signature)})
+		return
+	}
+	a, err := ctrl.addAnnotation(collection, signature, document, AnnotationPending)
+	if err != nil {
+		if errors.Is(err, errAnnotationLimit) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctrl.logger.Info().Str("audit", "transcription").Str("collection", collection).Str("signature", signature).Msgf("transcription %s submitted", a.ID)
+	c.JSON(http.StatusAccepted, gin.H{"id": a.ID, "status": AnnotationPending})
+}
+
+// adminTranscriptions lists the pending transcriptions, oldest first
+func (ctrl *mainController) adminTranscriptions(c *gin.Context) {
+	if ctrl.transcriptions == nil || ctrl.annotations == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "transcriptions not enabled"})
+		return
+	}
+	an := ctrl.annotations
+	var pending []Annotation
+	an.Lock()
+	for _, items := range an.items {
+		for _, a := range items {
+			if a.Status == AnnotationPending {
+				pending = append(pending, *a)
+			}
+		}
+	}
+	an.Unlock()
+	slices.SortFunc(pending, func(a, b Annotation) int {
+		return a.Created.Compare(b.Created)
+	})
+	var result = []TranscriptionInfo{}
+	for i := range pending {
+		a := &pending[i]
+		doc, err := ctrl.annotationDocument(a)
+		if err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot read transcription %s", a.ID)
+			continue
+		}
+		result = append(result, TranscriptionInfo{
+			ID:         a.ID,
+			Collection: a.Collection,
+			Signature:  a.Signature,
+			Created:    a.Created,
+			Annotation: doc,
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// adminDecideTranscription publishes (approve) or removes (reject) a pending transcription
+func (ctrl *mainController) adminDecideTranscription(c *gin.Context) {
+	if ctrl.transcriptions == nil || ctrl.annotations == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "transcriptions not enabled"})
+		return
+	}
+	id := c.Param("id")
+	decision := c.Param("decision")
+	if decision != "approve" && decision != "reject" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid decision '%s' - should be approve or reject", decision)})
+		return
+	}
+	an := ctrl.annotations
+	an.Lock()
+	defer an.Unlock()
+	for key, items := range an.items {
+		idx := slices.IndexFunc(items, func(a *Annotation) bool {
+			return a.ID == id && a.Status == AnnotationPending
+		})
+		if idx < 0 {
+			continue
+		}
+		if decision == "approve" {
+			if countAnnotations(items, "") >= an.conf.MaxPerCanvas {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s/%s has %d annotations", key.collection, key.signature, an.conf.MaxPerCanvas)})
+				return
+			}
+			items[idx].Status = ""
+		} else {
+			an.setItems(key, slices.Delete(slices.Clone(items), idx, idx+1))
+		}
+		if err := ctrl.saveAnnotations(); err != nil {
+			items[idx].Status = AnnotationPending
+			an.setItems(key, items)
+			ctrl.logger.Error().Err(err).Msg("cannot save annotations")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot save annotations: %v", err)})
+			return
+		}
+		ctrl.logger.Info().Str("audit", "transcription").Str("collection", key.collection).Str("signature", key.signature).Msgf("transcription %s: %s", id, decision)
+		c.JSON(http.StatusOK, gin.H{"id": id, "decision": decision})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no pending transcription %s", id)})
+}
@@ -0,0 +1,152 @@
+package rest
+
+import (
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VFSMappingConfig redirects the files of collections or storages to another vfs.
+// "vfs://<name>/<path>" is read as "vfs://<mapped name>/<path>". collection mappings take precedence
+type VFSMappingConfig struct {
+	Collections map[string]string `toml:"collections"`
+	Storages    map[string]string `toml:"storages"`
+}
+
+// WithVFSMapping maps collections and storages to specific vfs names
+func WithVFSMapping(conf *VFSMappingConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		for _, m := range []map[string]string{conf.Collections, conf.Storages} {
+			for from, to := range m {
+				if to == "" || strings.Contains(to, "/") {
+					return errors.Errorf("invalid vfs name '%s' for %s", to, from)
+				}
+			}
+		}
+		ctrl.vfsMapping = conf
+		return nil
+	}
+}
+
+// mapVFS rewrites the vfs name of a path according to the mapping of the collection or storage
+func (ctrl *mainController) mapVFS(collection, storage, path string) string {
+	if ctrl.vfsMapping == nil || !strings.HasPrefix(path, "vfs://") {
+		return path
+	}
+	name, ok := ctrl.vfsMapping.Collections[collection]
+	if !ok {
+		if name, ok = ctrl.vfsMapping.Storages[storage]; !ok {
+			return path
+		}
+	}
+	_, rest, _ := strings.Cut(strings.TrimPrefix(path, "vfs://"), "/")
+	return fmt.Sprintf("vfs://%s/%s", name, rest)
+}
+
+// VFSLoader creates a new vfs, e.g. from a reloaded configuration
+type VFSLoader func() (fs.FS, error)
+
+// reloadableFS delegates to the current vfs, which can be replaced at runtime
+type reloadableFS struct {
+	mutex  sync.RWMutex
+	fs     fs.FS
+	owned  bool
+	loader VFSLoader
+	grace  time.Duration
+}
+
+func (rfs *reloadableFS) Open(name string) (fs.File, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+	return rfs.fs.Open(name)
+}
+
+func (rfs *reloadableFS) String() string {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+	return fmt.Sprintf("%v", rfs.fs)
+}
+
+func (rfs *reloadableFS) Create(name string) (writefs.FileWrite, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+	return writefs.Create(rfs.fs, name)
+}
+
+func (rfs *reloadableFS) Remove(name string) error {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+	return writefs.Remove(rfs.fs, name)
+}
+
+// reload replaces the vfs. the previous one is closed after the grace period, so running deliveries can finish
+func (rfs *reloadableFS) reload() error {
+	newFS, err := rfs.loader()
+	if err != nil {
+		return errors.Wrap(err, "cannot load vfs")
+	}
+	rfs.mutex.Lock()
+	old, owned := rfs.fs, rfs.owned
+	rfs.fs, rfs.owned = newFS, true
+	rfs.mutex.Unlock()
+	// the initial vfs belongs to the caller of NewMainController
+	if closer, ok := old.(io.Closer); ok && owned {
+		time.AfterFunc(rfs.grace, func() { closer.Close() })
+	}
+	return nil
+}
+
+// Close closes the current vfs if it has been created by a reload
+func (rfs *reloadableFS) Close() error {
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+	if closer, ok := rfs.fs.(io.Closer); ok && rfs.owned {
+		rfs.owned = false
+		return closer.Close()
+	}
+	return nil
+}
+
+// WithVFSReload allows replacing the vfs at runtime with ReloadVFS or POST /admin/vfs/reload.
+// grace is the time until a replaced vfs is closed
+func WithVFSReload(loader VFSLoader, grace time.Duration) Option {
+	return func(ctrl *mainController) error {
+		if loader == nil {
+			return nil
+		}
+		ctrl.reloadableVFS = &reloadableFS{fs: ctrl.vfs, loader: loader, grace: grace}
+		ctrl.vfs = ctrl.reloadableVFS
+		return nil
+	}
+}
+
+// ReloadVFS replaces the vfs by a newly loaded one
+func (ctrl *mainController) ReloadVFS() error {
+	if ctrl.reloadableVFS == nil {
+		return errors.New("vfs reload not configured")
+	}
+	if err := ctrl.reloadableVFS.reload(); err != nil {
+		return errors.WithStack(err)
+	}
+	ctrl.logger.Info().Msgf("vfs reloaded: %v", ctrl.reloadableVFS)
+	return nil
+}
+
+func (ctrl *mainController) adminReloadVFS(c *gin.Context) {
+	if err := ctrl.ReloadVFS(); err != nil {
+		ctrl.logger.Error().Err(err).Msg("cannot reload vfs")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("cannot reload vfs: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reloaded": true})
+}
@@ -0,0 +1,263 @@
+package rest
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type VFSHealthConfig struct {
+	Interval config.Duration `toml:"interval"`
+	Timeout  config.Duration `toml:"timeout"`
+	// Probes maps the vfs name to a file which is checked, e.g. testcache = "vfs://testcache/probe.txt"
+	Probes map[string]string `toml:"probes"`
+}
+
+// WithVFSHealth checks the probe files periodically and collects read metrics per vfs.
+// unhealthy storages make /readyz fail
+func WithVFSHealth(conf *VFSHealthConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil {
+			return nil
+		}
+		for name, probe := range conf.Probes {
+			if !strings.HasPrefix(probe, "vfs://") {
+				return errors.Errorf("invalid probe '%s' for vfs %s", probe, name)
+			}
+		}
+		vh := &vfsHealth{conf: conf, storages: map[string]*storageStats{}}
+		if vh.conf.Interval <= 0 {
+			vh.conf.Interval = config.Duration(time.Minute)
+		}
+		if vh.conf.Timeout <= 0 {
+			vh.conf.Timeout = config.Duration(10 * time.Second)
+		}
+		ctrl.vfsHealth = vh
+		ctrl.vfs = &metricsFS{FS: ctrl.vfs, health: vh}
+		return nil
+	}
+}
+
+type storageStats struct {
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"lastcheck,omitempty"`
+	LastError string    `json:"lasterror,omitempty"`
+	Opens     int64     `json:"opens"`
+	Errors    int64     `json:"errors"`
+	ReadBytes int64     `json:"readbytes"`
+	// open latency in milliseconds
+	LatencyAvg float64 `json:"latencyavg"`
+	LatencyMax float64 `json:"latencymax"`
+	latencySum time.Duration
+	latencyMax time.Duration
+}
+
+type vfsHealth struct {
+	conf *VFSHealthConfig
+	// onChange is called when a probe starts failing or succeeds again
+	onChange func(name string, healthy bool, err error)
+	mutex    sync.Mutex
+	storages map[string]*storageStats
+}
+
+// vfsName returns the name of the vfs of "vfs://<name>/<path>"
+func vfsName(path string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(path, "vfs://"), "/")
+	return name
+}
+
+// stats returns the stats of a storage. the mutex must be held
+func (vh *vfsHealth) stats(name string) *storageStats {
+	st, ok := vh.storages[name]
+	if !ok {
+		st = &storageStats{Healthy: true}
+		vh.storages[name] = st
+	}
+	return st
+}
+
+func (vh *vfsHealth) recordOpen(name string, latency time.Duration, err error) {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+	st := vh.stats(name)
+	st.Opens++
+	st.latencySum += latency
+	if latency > st.latencyMax {
+		st.latencyMax = latency
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		st.Errors++
+		st.LastError = err.Error()
+	}
+}
+
+func (vh *vfsHealth) recordRead(name string, n int, err error) {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+	st := vh.stats(name)
+	st.ReadBytes += int64(n)
+	if err != nil && err != io.EOF {
+		st.Errors++
+		st.LastError = err.Error()
+	}
+}
+
+func (vh *vfsHealth) check(ctx context.Context, fsys fs.FS) {
+	for name, probe := range vh.conf.Probes {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(vh.conf.Timeout))
+		result := make(chan error, 1)
+		go func() {
+			_, err := fs.Stat(fsys, probe)
+			result <- err
+		}()
+		var err error
+		select {
+		case err = <-result:
+		case <-ctx.Done():
+			err = errors.Errorf("probe %s timed out after %s", probe, time.Duration(vh.conf.Timeout))
+		}
+		cancel()
+		vh.mutex.Lock()
+		st := vh.stats(name)
+		st.LastCheck = time.Now()
+		changed := st.Healthy != (err == nil)
+		st.Healthy = err == nil
+		if err != nil {
+			st.LastError = err.Error()
+		}
+		vh.mutex.Unlock()
+		if changed && vh.onChange != nil {
+			vh.onChange(name, err == nil, err)
+		}
+	}
+}
+
+func (vh *vfsHealth) run(ctx context.Context, fsys fs.FS) {
+	vh.check(ctx, fsys)
+	ticker := time.NewTicker(time.Duration(vh.conf.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			vh.check(ctx, fsys)
+		}
+	}
+}
+
+type StorageHealth struct {
+	Name string `json:"name"`
+	storageStats
+}
+
+func (vh *vfsHealth) snapshot() ([]*StorageHealth, bool) {
+	vh.mutex.Lock()
+	defer vh.mutex.Unlock()
+	var result = []*StorageHealth{}
+	healthy := true
+	for name, st := range vh.storages {
+		sh := &StorageHealth{Name: name, storageStats: *st}
+		if st.Opens > 0 {
+			sh.LatencyAvg = float64(st.latencySum.Microseconds()) / float64(st.Opens) / 1000
+		}
+		sh.LatencyMax = float64(st.latencyMax.Microseconds()) / 1000
+		if !st.Healthy {
+			healthy = false
+		}
+		result = append(result, sh)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, healthy
+}
+
+// metricsFS records open latency, read volume and errors per vfs name
+type metricsFS struct {
+	fs.FS
+	health *vfsHealth
+}
+
+func (mfs *metricsFS) Open(name string) (fs.File, error) {
+	start := time.Now()
+	f, err := mfs.FS.Open(name)
+	vfs := vfsName(name)
+	mfs.health.recordOpen(vfs, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	mf := &metricsFile{File: f, vfs: vfs, health: mfs.health}
+	// deliveries check for io.Seeker, so only seekable files get Seek
+	if s, ok := f.(io.Seeker); ok {
+		return &metricsSeekFile{metricsFile: mf, seeker: s}, nil
+	}
+	return mf, nil
+}
+
+func (mfs *metricsFS) Create(name string) (writefs.FileWrite, error) {
+	return writefs.Create(mfs.FS, name)
+}
+
+func (mfs *metricsFS) Remove(name string) error {
+	return writefs.Remove(mfs.FS, name)
+}
+
+func (mfs *metricsFS) String() string {
+	if s, ok := mfs.FS.(interface{ String() string }); ok {
+		return s.String()
+	}
+	return "vfs"
+}
+
+type metricsFile struct {
+	fs.File
+	vfs    string
+	health *vfsHealth
+}
+
+func (mf *metricsFile) Read(p []byte) (int, error) {
+	n, err := mf.File.Read(p)
+	mf.health.recordRead(mf.vfs, n, err)
+	return n, err
+}
+
+// metricsSeekFile is a metricsFile of a seekable file, which keeps range requests working
+type metricsSeekFile struct {
+	*metricsFile
+	seeker io.Seeker
+}
+
+func (mf *metricsSeekFile) Seek(offset int64, whence int) (int64, error) {
+	return mf.seeker.Seek(offset, whence)
+}
+
+// readyz reports whether all storages are healthy
+func (ctrl *mainController) readyz(c *gin.Context) {
+	if ctrl.vfsHealth == nil {
+		c.JSON(http.StatusOK, gin.H{"ready": true})
+		return
+	}
+	storages, healthy := ctrl.vfsHealth.snapshot()
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": healthy, "storages": storages})
+}
+
+func (ctrl *mainController) adminVFSMetrics(c *gin.Context) {
+	if ctrl.vfsHealth == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "vfs health not configured"})
+		return
+	}
+	storages, _ := ctrl.vfsHealth.snapshot()
+	c.JSON(http.StatusOK, storages)
+}
@@ -0,0 +1,192 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/filesystem/v3/pkg/writefs"
+	"github.com/je4/utils/v2/pkg/config"
+	"io/fs"
+	"math"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ViewQuotaConfig struct {
+	// Limit is the number of different items a session may view within the window, e.g. the pages of a book
+	Limit int `toml:"limit"`
+	// Window starts with the first view of a session, default 24h
+	Window config.Duration `toml:"window"`
+	// IncludePublic counts public items as well
+	IncludePublic bool `toml:"includepublic"`
+	// Dir is a vfs folder shared by all instances, e.g. "vfs://testcache/viewquota". if empty, sessions are kept in memory
+	Dir string `toml:"dir"`
+	// CacheSize is the number of sessions kept in memory, default 100000
+	CacheSize int `toml:"cachesize"`
+}
+
+var errViewQuota = errors.New("view quota exhausted")
+
+type viewQuotaEntry struct {
+	Start      time.Time `json:"start"`
+	Signatures []string  `json:"signatures"`
+}
+
+type viewQuota struct {
+	sync.Mutex
+	limit         int
+	window        time.Duration
+	includePublic bool
+	dir           string
+	sessions      gcache.Cache
+}
+
+// WithViewQuotas limits the items a session may view per collection. the quota is checked after the access check
+func WithViewQuotas(quotas map[string]*ViewQuotaConfig) Option {
+	return func(ctrl *mainController) error {
+		for collection, conf := range quotas {
+			if conf.Limit <= 0 {
+				return errors.Errorf("invalid view quota %d for collection %s", conf.Limit, collection)
+			}
+			size := conf.CacheSize
+			if size <= 0 {
+				size = 100000
+			}
+			vq := &viewQuota{
+				limit:         conf.Limit,
+				window:        time.Duration(conf.Window),
+				includePublic: conf.IncludePublic,
+				dir:           conf.Dir,
+				sessions:      gcache.New(size).LRU().Build(),
+			}
+			if vq.window <= 0 {
+				vq.window = 24 * time.Hour
+			}
+			if ctrl.viewQuotas == nil {
+				ctrl.viewQuotas = map[string]*viewQuota{}
+			}
+			ctrl.viewQuotas[collection] = vq
+		}
+		return nil
+	}
+}
+
+// perRequestAccess reports whether the access of a collection depends on the request, so responses must not be cached
+func (ctrl *mainController) perRequestAccess(collection string) bool {
+	_, ok := ctrl.viewQuotas[collection]
+	if ctrl.seats != nil {
+		_, seats := ctrl.seats.conf[collection]
+		ok = ok || seats
+	}
+	return ok || ctrl.hasPolicy(collection)
+}
+
+// file returns the session file. sessions are hashed, claims may contain any character
+func (vq *viewQuota) file(collection, session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return path.Join(vq.dir, collection, hex.EncodeToString(sum[:16])+".json")
+}
+
+// load returns the entry of a session or nil. the lock must be held
+func (ctrl *mainController) loadViewQuota(vq *viewQuota, collection, session string) (*viewQuotaEntry, error) {
+	if vq.dir == "" {
+		entryAny, err := vq.sessions.Get(session)
+		if err != nil {
+			return nil, nil
+		}
+		return entryAny.(*viewQuotaEntry), nil
+	}
+	name := vq.file(collection, session)
+	data, err := fs.ReadFile(ctrl.vfs, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "cannot read %s", name)
+	}
+	entry := &viewQuotaEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal %s", name)
+	}
+	return entry, nil
+}
+
+// store saves the entry of a session until the end of its window. the lock must be held
+func (ctrl *mainController) storeViewQuota(vq *viewQuota, collection, session string, entry *viewQuotaEntry) error {
+	if vq.dir == "" {
+		return errors.WithStack(vq.sessions.SetWithExpire(session, entry, time.Until(entry.Start.Add(vq.window))))
+	}
+	name := vq.file(collection, session)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal view quota")
+	}
+	fp, err := writefs.Create(ctrl.vfs, name)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", name)
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return errors.Wrapf(err, "cannot write %s", name)
+	}
+	return errors.Wrapf(fp.Close(), "cannot close %s", name)
+}
+
+// checkViewQuota counts the item for the session and returns errViewQuota if the session has seen too many items.
+// views of an item already counted are always allowed
+func (ctrl *mainController) checkViewQuota(c *gin.Context, collection, signature, token string) error {
+	vq, ok := ctrl.viewQuotas[collection]
+	if !ok {
+		return nil
+	}
+	item, err := ctrl.getItem(collection, signature)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
+	}
+	if item.GetPublic() && !vq.includePublic {
+		return nil
+	}
+	_, claims := ctrl.verifiedClaims(collection, token)
+	session := requestSession(c, claims)
+	vq.Lock()
+	defer vq.Unlock()
+	entry, err := ctrl.loadViewQuota(vq, collection, session)
+	if err != nil {
+		// an unavailable shared folder must not block the delivery
+		ctrl.logger.Error().Err(err).Msgf("cannot load view quota of collection %s", collection)
+	}
+	now := time.Now()
+	if entry == nil || now.Sub(entry.Start) >= vq.window {
+		entry = &viewQuotaEntry{Start: now}
+	}
+	if slices.Contains(entry.Signatures, signature) {
+		return nil
+	}
+	if len(entry.Signatures) >= vq.limit {
+		retry := entry.Start.Add(vq.window).Sub(now)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		traceDecision(c, "viewquota", "%d items since %s", len(entry.Signatures), entry.Start.Format(time.RFC3339))
+		return errors.Wrapf(errViewQuota, "%d of %d items viewed in collection %s", len(entry.Signatures), vq.limit, collection)
+	}
+	entry.Signatures = append(entry.Signatures, signature)
+	if err := ctrl.storeViewQuota(vq, collection, session, entry); err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot store view quota of collection %s", collection)
+	}
+	return nil
+}
+
+// viewQuotaResponse answers requests above the view quota
+func (ctrl *mainController) viewQuotaResponse(c *gin.Context, collection string, err error) {
+	vq := ctrl.viewQuotas[collection]
+	ctrl.logger.Info().Err(err).Msgf("view quota exhausted for collection %s", collection)
+	window := strings.TrimSuffix(strings.TrimSuffix(vq.window.String(), "0s"), "0m")
+	ctrl.errorResponse(c, http.StatusTooManyRequests, collection, err, "view_quota", vq.limit, window)
+}
@@ -1,16 +1,15 @@
 package rest
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"emperror.dev/errors"
 	"fmt"
 	"github.com/bluele/gcache"
-	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
+	genericproto "github.com/je4/genericproto/v2/pkg/generic/proto"
 	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
-	"github.com/je4/mediaservermain/v2/data/web/static"
 	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"google.golang.org/grpc/codes"
@@ -18,6 +17,7 @@ import (
 	"html/template"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,15 +34,22 @@ type itemIdentifier struct {
 	signature  string
 }
 
-func NewMainController(addr, extAddr string, tlsConfig *tls.Config, jwtAlgs []string, iiif, iiifPrefix, iiifBaseAction string, dbClient mediaserverproto.DatabaseClient, actionControllerClient mediaserverproto.ActionClient, vfs fs.FS, itemCacheSize, collectionCachesize int, cacheTimout, actionTemplateTimeout time.Duration, logger zLogger.ZLogger) (*mainController, error) {
+func NewMainController(addr, extAddr string, tlsConfig *tls.Config, jwtAlgs []string, iiif, iiifPrefix, iiifBaseAction string, dbClient Database, actionControllerClient Actions, vfs fs.FS, itemCacheSize, collectionCachesize int, cacheTimout, actionTemplateTimeout time.Duration, logger zLogger.ZLogger, opts ...Option) (*mainController, error) {
 	u, err := url.Parse(extAddr)
 	if err != nil {
 		return nil, errors.Wrapf(err, "invalid external address '%s'", extAddr)
 	}
 	subpath := "/" + strings.Trim(u.Path, "/")
+	// the jwt parser accepts any algorithm without list
+	if len(jwtAlgs) == 0 {
+		return nil, errors.New("no jwt algorithms configured")
+	}
+	if err := validateAlgs(jwtAlgs); err != nil {
+		return nil, errors.Wrap(err, "invalid jwt algorithms")
+	}
 
 	gin.SetMode(gin.DebugMode)
-	router := gin.Default()
+	router := gin.New()
 
 	_logger := logger.With().Str("httpService", "mainController").Logger()
 	parts := strings.SplitN(iiifBaseAction, "/", 2)
@@ -55,6 +63,7 @@ func NewMainController(addr, extAddr string, tlsConfig *tls.Config, jwtAlgs []st
 	}
 
 	c := &mainController{
+		cacheTimeout:           cacheTimout,
 		addr:                   addr,
 		extAddr:                extAddr,
 		jwtAlgs:                jwtAlgs,
@@ -67,48 +76,30 @@ func NewMainController(addr, extAddr string, tlsConfig *tls.Config, jwtAlgs []st
 		logger:                 &_logger,
 		dbClient:               dbClient,
 		actionControllerClient: actionControllerClient,
-		actionParams:           map[string][]string{},
+		actionParams:           map[actionSignature][]string{},
+		streamBuffers:          newBufferPools(nil),
+		embedActions:           defaultEmbedActions,
+		embedFrameAncestors:    []string{"*"},
+		capabilityActions:      defaultCapabilityActions,
+		layersField:            "layers",
+		layersViewerAction:     "resize/size2048x2048/formatjpeg",
+		manifest:               defaultManifestConfig,
 		vfs:                    vfs,
 		actionTemplates:        gcache.New(100).LRU().Expiration(actionTemplateTimeout).Build(),
-		itemCache: gcache.New(itemCacheSize).
-			LRU().Expiration(cacheTimout).
-			LoaderFunc(func(key any) (any, error) {
-				it, ok := key.(itemIdentifier)
-				if !ok {
-					return nil, errors.Errorf("invalid key type %T", key)
-				}
-				resp, err := dbClient.GetItem(context.Background(), &mediaserverproto.ItemIdentifier{
-					Collection: it.collection,
-					Signature:  it.signature,
-				})
-				if err != nil {
-					if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
-						return nil, gcache.KeyNotFoundError
-					}
-					return nil, errors.Wrapf(err, "cannot get item %s/%s", it.collection, it.signature)
-				}
-				return resp, nil
-			}).
-			Build(),
-		collectionCache: gcache.New(collectionCachesize).
-			LRU().Expiration(cacheTimout).
-			LoaderFunc(func(key any) (any, error) {
-				collectionName, ok := key.(string)
-				if !ok {
-					return nil, errors.Errorf("invalid key type %T", key)
-				}
-				resp, err := dbClient.GetCollection(context.Background(), &mediaserverproto.CollectionIdentifier{
-					Collection: collectionName,
-				})
-				if err != nil {
-					if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
-						return nil, gcache.KeyNotFoundError
-					}
-					return nil, errors.Wrapf(err, "cannot get collection %s", collectionName)
-				}
-				return resp, nil
-			}).
-			Build(),
+	}
+	// options may wrap ctrl.dbClient, so the listing of changes is taken from the database itself
+	c.itemChanges, _ = dbClient.(ItemChanges)
+	// the cache loaders use ctrl.dbClient, which may be wrapped by options
+	c.cachePartition = c.newCachePartition(itemCacheSize, collectionCachesize, cacheTimout)
+	c.items = &cachedItemService{ctrl: c}
+	c.access = &tokenAccessService{ctrl: c}
+	c.delivery = &vfsDeliveryService{ctrl: c}
+	// the defaults are valid
+	c.headerPolicy, _ = newHeaderPolicy(nil)
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, errors.Wrap(err, "cannot apply option")
+		}
 	}
 	if err := c.Init(tlsConfig); err != nil {
 		return nil, errors.Wrap(err, "cannot initialize rest controller")
@@ -116,46 +107,246 @@ func NewMainController(addr, extAddr string, tlsConfig *tls.Config, jwtAlgs []st
 	return c, nil
 }
 
+// cachePartition holds the item, metadata and collection caches of a tenant
+type cachePartition struct {
+	itemCache       gcache.Cache
+	metadataCache   gcache.Cache
+	collectionCache gcache.Cache
+	itemStats       *cacheStats
+	metadataStats   *cacheStats
+	collectionStats *cacheStats
+}
+
+func (ctrl *mainController) newCachePartition(itemCacheSize, collectionCacheSize int, cacheTimeout time.Duration) *cachePartition {
+	p := &cachePartition{
+		itemStats:       newCacheStats(),
+		metadataStats:   newCacheStats(),
+		collectionStats: newCacheStats(),
+	}
+	p.itemCache = gcache.New(itemCacheSize).
+		LRU().Expiration(cacheTimeout).
+		LoaderFunc(ctrl.loadItem).
+		AddedFunc(p.itemStats.added).EvictedFunc(p.itemStats.evicted).
+		Build()
+	p.metadataCache = gcache.New(itemCacheSize).
+		LRU().Expiration(cacheTimeout).
+		LoaderFunc(ctrl.loadMetadata).
+		AddedFunc(p.metadataStats.added).EvictedFunc(p.metadataStats.evicted).
+		Build()
+	p.collectionCache = gcache.New(collectionCacheSize).
+		LRU().Expiration(cacheTimeout).
+		LoaderFunc(ctrl.loadCollection).
+		AddedFunc(p.collectionStats.added).EvictedFunc(p.collectionStats.evicted).
+		Build()
+	return p
+}
+
+func (ctrl *mainController) loadItem(key any) (any, error) {
+	it, ok := key.(itemIdentifier)
+	if !ok {
+		return nil, errors.Errorf("invalid key type %T", key)
+	}
+	resp, err := ctrl.dbClient.GetItem(context.Background(), &mediaserverproto.ItemIdentifier{
+		Collection: it.collection,
+		Signature:  it.signature,
+	})
+	if err != nil {
+		if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+			return nil, gcache.KeyNotFoundError
+		}
+		return nil, errors.Wrapf(err, "cannot get item %s/%s", it.collection, it.signature)
+	}
+	return resp, nil
+}
+
+func (ctrl *mainController) loadMetadata(key any) (any, error) {
+	it, ok := key.(itemIdentifier)
+	if !ok {
+		return nil, errors.Errorf("invalid key type %T", key)
+	}
+	resp, err := ctrl.dbClient.GetItemMetadata(context.Background(), &mediaserverproto.ItemIdentifier{
+		Collection: it.collection,
+		Signature:  it.signature,
+	})
+	if err != nil {
+		if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+			return nil, gcache.KeyNotFoundError
+		}
+		return nil, errors.Wrapf(err, "cannot get metadata %s/%s", it.collection, it.signature)
+	}
+	return resp.GetValue(), nil
+}
+
+func (ctrl *mainController) loadCollection(key any) (any, error) {
+	collectionName, ok := key.(string)
+	if !ok {
+		return nil, errors.Errorf("invalid key type %T", key)
+	}
+	resp, err := ctrl.dbClient.GetCollection(context.Background(), &mediaserverproto.CollectionIdentifier{
+		Collection: collectionName,
+	})
+	if err != nil {
+		if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+			return nil, gcache.KeyNotFoundError
+		}
+		return nil, errors.Wrapf(err, "cannot get collection %s", collectionName)
+	}
+	return resp, nil
+}
+
 type mainController struct {
 	server                 http.Server
 	router                 *gin.Engine
 	addr                   string
+	addrs                  []string
 	subpath                string
 	logger                 zLogger.ZLogger
-	dbClient               mediaserverproto.DatabaseClient
-	actionControllerClient mediaserverproto.ActionClient
-	actionParams           map[string][]string
-	itemCache              gcache.Cache
-	collectionCache        gcache.Cache
-	vfs                    fs.FS
-	jwtAlgs                []string
-	iiif                   string
-	iiifPrefix             string
-	extAddr                string
-	iiifBaseAction         string
-	iiifBaseActionParams   string
-	actionTemplates        gcache.Cache
+	dbClient               Database
+	actionControllerClient Actions
+	actionParams           map[actionSignature][]string
+	actionParamsMutex      sync.RWMutex
+	*cachePartition
+	cacheTimeout         time.Duration
+	vfs                  fs.FS
+	jwtAlgs              []string
+	iiif                 string
+	iiifPrefix           string
+	extAddr              string
+	iiifBaseAction       string
+	iiifBaseActionParams string
+	actionTemplates      gcache.Cache
+	adminKey             string
+	surrogateHeader      string
+	purger               Purger
+	collectionJWT        map[string]*CollectionJWTConfig
+	jwtAllowWeakKeys     bool
+	metsALTOAction       string
+	collectionLanguages  map[string]string
+	requestLog           *RequestLogConfig
+	serverTiming         bool
+	loadShed             *loadShedder
+	generations          atomic.Int64
+	readOnly             atomic.Bool
+	listenerMutex        sync.Mutex
+	listeners            map[string]net.Listener
+	defaultActions       map[string]string
+	actionDeps           map[string][]string
+	infoThumbnailAction  string
+	infoTemplatePath     string
+	layersField          string
+	layersViewerAction   string
+	vfsMapping           *VFSMappingConfig
+	reloadableVFS        *reloadableFS
+	vfsHealth            *vfsHealth
+	cancelBackground     context.CancelFunc
+	streamBuffers        *bufferPools
+	precompressed        []string
+	fallback             *FallbackConfig
+	tenants              map[string]*tenant
+	itemChanges          ItemChanges
+	activityPageSize     int
+	tokenCache           gcache.Cache
+	accessCache          gcache.Cache
+	receiptSigner        *receiptSigner
+	tileHints            *tileHints
+	requestSigning       *RequestSigningConfig
+	shortLinks           *shortLinks
+	embedActions         map[string]string
+	embedFrameAncestors  []string
+	beacons              *beacons
+	capabilityActions    map[string][]string
+	headerPolicy         *headerPolicy
+	actionCatalog        ActionCatalog
+	discovered           discoveredActions
+	tokenCacheTTL        time.Duration
+	responseCache        *responseCache
+	groupMiddleware      map[string][]gin.HandlerFunc
+	middlewares          []gin.HandlerFunc
+	items                ItemService
+	access               AccessService
+	delivery             DeliveryService
+	rpcMetrics           *RPCMetrics
+	pids                 *pids
+	pidMinting           *pidMinting
+	preview              *PreviewConfig
+	alternativeActions   map[string][]*AlternativeConfig
+	captions             *captions
+	audioRenditions      []*AudioRendition
+	dataSaverParams      map[string]string
+	clientHints          *clientHints
+	sizeBudget           *sizeBudget
+	storageQuota         *storageQuota
+	accounting           *accounting
+	dark                 darkCollections
+	exhibitions          *exhibitions
+	responseFilterConfig map[string][]*ResponseFilterConfig
+	responseFilterTypes  map[string]ResponseFilterFactory
+	responseFilters      map[string][]*configuredFilter
+	accessPolicies       map[string]AccessPolicy
+	viewQuotas           map[string]*viewQuota
+	seats                *seats
+	printRequests        *printRequests
+	mailer               Mailer
+	mailConfig           *MailerConfig
+	mailTemplates        mailTemplates
+	reports              *ReportConfig
+	actionErrors         *actionErrors
+	quarantine           *quarantine
+	generationFlights    generationFlights
+	generationPeers      *generationPeers
+	disconnects          disconnects
+	progressive          *ProgressiveConfig
+	infoCache            gcache.Cache
+	annotations          *annotations
+	transcriptions       *transcriptions
+	rights               *rights
+	metadataEmbed        *metadataEmbed
+	fastPath             *fastPath
+	cachePolicy          *CachePolicyConfig
+	backpressure         *backpressure
+	manifest             ManifestConfig
 }
 
 func (ctrl *mainController) Init(tlsConfig *tls.Config) error {
-	ctrl.router.Use(cors.Default())
-	ctrl.router.StaticFS("/static", http.FS(static.FS))
-	ctrl.router.GET("/iiif/:version/:collection/:signature/*params", ctrl.iiifAction)
-	ctrl.router.GET("/:collection/:signature/:action", ctrl.action)
-	ctrl.router.GET("/:collection/:signature/:action/*params", ctrl.action)
+	ctrl.router.Use(ctrl.accessLog, gin.Recovery())
+	if ctrl.serverTiming {
+		ctrl.router.Use(ctrl.serverTimingMiddleware)
+	}
+	if ctrl.loadShed != nil {
+		ctrl.router.Use(ctrl.loadShedMiddleware)
+	}
+	ctrl.router.Use(ctrl.debugMiddleware)
+	ctrl.router.Use(ctrl.middlewares...)
+	if err := ctrl.initResponseFilters(); err != nil {
+		return errors.Wrap(err, "cannot initialize response filters")
+	}
+	ctrl.initRoutes()
 
 	ctrl.server = http.Server{
 		Addr:      ctrl.addr,
-		Handler:   ctrl.router,
+		Handler:   ctrl.Handler(),
 		TLSConfig: tlsConfig,
 	}
 
 	return nil
 }
 
+// externalURL builds an absolute url below the external address of the service
+func (ctrl *mainController) externalURL(elem ...string) string {
+	u, err := url.JoinPath(ctrl.extAddr, elem...)
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot join url '%s' and %v", ctrl.extAddr, elem)
+		return strings.TrimRight(ctrl.extAddr, "/") + "/" + strings.Join(elem, "/")
+	}
+	return u
+}
+
 func (ctrl *mainController) getParams(mediaType string, action string) ([]string, error) {
-	sig := fmt.Sprintf("%s::%s", mediaType, action)
-	if params, ok := ctrl.actionParams[sig]; ok {
+	sig := actionSignature{mediaType: mediaType, action: action}
+	ctrl.actionParamsMutex.RLock()
+	params, ok := ctrl.actionParams[sig]
+	ctrl.actionParamsMutex.RUnlock()
+	if ok {
 		return params, nil
 	}
 	resp, err := ctrl.actionControllerClient.GetParams(context.Background(), &mediaserverproto.ParamsParam{
@@ -166,53 +357,136 @@ func (ctrl *mainController) getParams(mediaType string, action string) ([]string
 		return nil, errors.Wrapf(err, "cannot get params for %s::%s", mediaType, action)
 	}
 	ctrl.logger.Debug().Msgf("params for %s::%s: %v", mediaType, action, resp.GetValues())
+	ctrl.actionParamsMutex.Lock()
 	ctrl.actionParams[sig] = resp.GetValues()
+	ctrl.actionParamsMutex.Unlock()
 	return resp.GetValues(), nil
 }
 
 func (ctrl *mainController) getItem(collection, signature string) (*mediaserverproto.Item, error) {
-	itemAny, err := ctrl.itemCache.Get(itemIdentifier{collection: collection, signature: signature})
-	if err != nil {
-		return nil, errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
-	}
-	item, ok := itemAny.(*mediaserverproto.Item)
-	if !ok {
-		return nil, errors.Errorf("invalid item type %T", itemAny)
+	return ctrl.items.GetItem(collection, signature)
+}
+
+// getChildItems loads all child items of an item, page by page
+func (ctrl *mainController) getChildItems(collection, signature string) ([]*mediaserverproto.Item, error) {
+	const pageSize = 100
+	var items []*mediaserverproto.Item
+	for pageNo := int64(0); ; pageNo++ {
+		resp, err := ctrl.dbClient.GetChildItems(context.Background(), &mediaserverproto.ItemsRequest{
+			Identifier: &mediaserverproto.ItemIdentifier{
+				Collection: collection,
+				Signature:  signature,
+			},
+			PageRequest: &genericproto.PageRequest{
+				PageRequest: &genericproto.PageRequest_Page{
+					Page: &genericproto.Page{PageSize: pageSize, PageNo: pageNo},
+				},
+			},
+		})
+		if err != nil {
+			if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
+				return items, nil
+			}
+			return nil, errors.Wrapf(err, "cannot get child items of %s/%s", collection, signature)
+		}
+		items = append(items, resp.GetItems()...)
+		total := resp.GetPageResponse().GetPageResult().GetTotal()
+		if len(resp.GetItems()) < pageSize || (total > 0 && int64(len(items)) >= total) {
+			return items, nil
+		}
 	}
-	return item, nil
+}
+
+func (ctrl *mainController) getItemMetadata(collection, signature string) (string, error) {
+	return ctrl.items.GetItemMetadata(collection, signature)
 }
 
 func (ctrl *mainController) getCollection(collection string) (*mediaserverproto.Collection, error) {
-	itemAny, err := ctrl.collectionCache.Get(collection)
+	return ctrl.items.GetCollection(collection)
+}
+
+// Start serves all addresses. it fails if not a single listener could be started, failing addresses among
+// working ones are logged
+func (ctrl *mainController) Start(wg *sync.WaitGroup) error {
+	checkCtx, checkCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := ctrl.checkCollectionNames(checkCtx)
+	checkCancel()
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot get item %s", collection)
+		return errors.Wrap(err, "reserved collection names")
 	}
-	coll, ok := itemAny.(*mediaserverproto.Collection)
-	if !ok {
-		return nil, errors.Errorf("invalid item type %T", itemAny)
+	ctx, cancel := context.WithCancel(context.Background())
+	ctrl.cancelBackground = cancel
+	if ctrl.vfsHealth != nil {
+		ctrl.vfsHealth.onChange = ctrl.storageAlert
+		go ctrl.vfsHealth.run(ctx, ctrl.vfs)
 	}
-	return coll, nil
+	if ctrl.storageQuota != nil {
+		go ctrl.runStorageQuota(ctx)
+	}
+	if ctrl.accounting != nil {
+		go ctrl.runAccounting(ctx)
+	}
+	if ctrl.reports != nil {
+		go ctrl.runReports(ctx)
+	}
+	if ctrl.actionErrors != nil {
+		go ctrl.runActionErrors(ctx)
+	}
+	addrs := ctrl.addrs
+	if len(addrs) == 0 {
+		addrs = []string{ctrl.addr}
+	}
+	ctrl.listenerMutex.Lock()
+	defer ctrl.listenerMutex.Unlock()
+	ctrl.listeners = map[string]net.Listener{}
+	var errs []error
+	for pos, addr := range addrs {
+		l, inherited, err := inheritedListener(addr)
+		if err != nil {
+			ctrl.logger.Error().Err(err).Msgf("cannot take over listener for '%s'", addr)
+		}
+		if !inherited {
+			l, inherited, err = systemdListener(addr, pos)
+			if err != nil {
+				ctrl.logger.Error().Err(err).Msgf("cannot use systemd socket for '%s'", addr)
+			}
+		}
+		if !inherited {
+			l, err = listen(addr)
+			if err != nil {
+				ctrl.logger.Error().Err(err).Msgf("cannot start server on '%s'", addr)
+				errs = append(errs, errors.Wrapf(err, "cannot start server on '%s'", addr))
+				continue
+			}
+		}
+		ctrl.listeners[addr] = l
+		ctrl.serve(wg, addr, l)
+	}
+	if len(ctrl.listeners) == 0 {
+		cancel()
+		return errors.Wrap(errors.Combine(errs...), "no listener started")
+	}
+	return nil
 }
 
-func (ctrl *mainController) Start(wg *sync.WaitGroup) {
+func (ctrl *mainController) serve(wg *sync.WaitGroup, addr string, l net.Listener) {
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
 		defer wg.Done() // let main know we are done cleaning up
 
+		var err error
 		if ctrl.server.TLSConfig == nil {
-			fmt.Printf("starting server at http://%s\n", ctrl.addr)
-			if err := ctrl.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-				// unexpected error. port in use?
-				fmt.Errorf("server on '%s' ended: %v", ctrl.addr, err)
-			}
+			fmt.Printf("starting server at http://%s\n", addr)
+			err = ctrl.server.Serve(l)
 		} else {
-			fmt.Printf("starting server at https://%s\n", ctrl.addr)
-			if err := ctrl.server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
-				// unexpected error. port in use?
-				fmt.Errorf("server on '%s' ended: %v", ctrl.addr, err)
-			}
+			fmt.Printf("starting server at https://%s\n", addr)
+			err = ctrl.server.ServeTLS(l, "", "")
 		}
 		// always returns error. ErrServerClosed on graceful close
+		if !errors.Is(err, http.ErrServerClosed) {
+			// unexpected error
+			ctrl.logger.Error().Err(err).Msgf("server on '%s' ended", addr)
+		}
 	}()
 }
 
@@ -222,70 +496,59 @@ func (ctrl *mainController) Stop() {
 
 func (ctrl *mainController) GracefulStop() {
 	ctrl.server.Shutdown(context.Background())
+	if ctrl.cancelBackground != nil {
+		ctrl.cancelBackground()
+	}
+	if ctrl.reloadableVFS != nil {
+		if err := ctrl.reloadableVFS.Close(); err != nil {
+			ctrl.logger.Error().Err(err).Msg("cannot close vfs")
+		}
+	}
 }
 
 var isUrlRegexp = regexp.MustCompile(`^[a-z]+://`)
 
 var pathRegexp = regexp.MustCompile(`"/?(.+?)/(.+?)/(.+)?(/(.+?))?$`)
 
-func (ctrl *mainController) checkAccess(collection, signature, action, paramStr, token string) error {
-	item, err := ctrl.getItem(collection, signature)
-	if err != nil {
-		return errors.Wrapf(err, "cannot get item %s/%s", collection, signature)
-	}
-	// public items are always allowed
-	if item.GetPublic() {
-		return nil
-	}
-	// check whether it's a public action
-	if publicActions := item.GetPublicActions(); len(publicActions) > 0 {
-		actionParams, err := ctrl.getParams(item.GetMetadata().GetType(), action)
-		if err != nil {
-			return errors.Wrapf(err, "cannot get params for %s::%s", item.GetMetadata().GetType(), action)
-		}
-		ap := actionCache.ActionParams{}
-		ap.SetString(paramStr, actionParams)
-		fullAction := fmt.Sprintf("%s/%s", action, ap.String())
-		if slices.Contains(publicActions, fullAction) {
-			return nil
-		}
-	}
-	if token == "" {
-		return errors.New("no token provided")
-	}
-	coll, err := ctrl.getCollection(collection)
-	if err != nil {
-		return errors.Wrapf(err, "cannot get collection %s", collection)
+// checkAccess checks the access, applies the policy of the collection and takes a seat and a view of the quota
+func (ctrl *mainController) checkAccess(c *gin.Context, collection, signature, action, paramStr, token string) error {
+	return ctrl.authorize(c, collection, signature, action, paramStr, token, true)
+}
+
+// authorize is checkAccess with the seat check optional, seat leases check the access without taking a seat
+func (ctrl *mainController) authorize(c *gin.Context, collection, signature, action, paramStr, token string, seat bool) error {
+	var err error
+	// open exhibition windows make items public regardless of the access service
+	if !ctrl.exhibited(collection, signature, action) {
+		err = ctrl.access.CheckAccess(collection, signature, action, paramStr, token)
 	}
-	jwtKey := coll.GetJwtkey()
-	if jwtKey == "" {
-		return errors.New("no jwt key in collection configured. please ask administrator")
+	if err := ctrl.applyPolicy(c, collection, signature, action, paramStr, token, err); err != nil {
+		return err
 	}
-	jwtToken, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		tokenAlg := token.Method.Alg()
-		for _, alg := range ctrl.jwtAlgs {
-			if tokenAlg == alg {
-				return []byte(jwtKey), nil
-			}
+	if seat {
+		if err := ctrl.checkSeat(c, collection, signature, token); err != nil {
+			return err
 		}
-		return nil, fmt.Errorf("alg: %v not supported", tokenAlg)
-	})
-	if err != nil {
-		return errors.Wrapf(err, "cannot parse jwt token '%s'", token)
 	}
-	if !jwtToken.Valid {
-		return errors.Errorf("invalid jwt token '%s'", token)
-	}
-	subject, err := jwtToken.Claims.GetSubject()
-	if err != nil {
-		return errors.Wrapf(err, "cannot get subject from jwt token '%s'", token)
-	}
-	_subject := strings.Trim(fmt.Sprintf("%s/%s/%s/%s", collection, signature, action, paramStr), "/")
-	if subject != _subject {
-		return errors.Errorf("invalid subject '%s' in jwt token - should be '%s'", subject, _subject)
+	return ctrl.checkViewQuota(c, collection, signature, token)
+}
+
+// limitResponse answers requests refused by the seat or view quota limits
+func (ctrl *mainController) limitResponse(c *gin.Context, collection, signature string, err error) bool {
+	switch {
+	case errors.Is(err, errNoSeat):
+		ctrl.seatResponse(c, collection, signature, err)
+	case errors.Is(err, errViewQuota):
+		ctrl.viewQuotaResponse(c, collection, err)
+	default:
+		return false
 	}
+	return true
+}
 
-	return nil
+// bodyAllowedForStatus reports whether a response with the status may have a body
+func bodyAllowedForStatus(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
 }
 
 func (ctrl *mainController) iiifAction(c *gin.Context) {
@@ -294,10 +557,7 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 	versionInt, err := strconv.Atoi(version)
 	if err != nil {
 		ctrl.logger.Error().Err(err).Msgf("invalid IIIF version '%s'", version)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("invalid IIIF version '%s'", version),
-		})
-		c.Abort()
+		ctrl.errorResponse(c, http.StatusBadRequest, c.Param("collection"), errors.Errorf("invalid IIIF version '%s'", version), "invalid_request", fmt.Sprintf("IIIF %s", version))
 		return
 	}
 	collection := c.Param("collection")
@@ -306,25 +566,48 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 	token := c.Query("token")
 	ctrl.logger.Debug().Msgf("collection: %s, signature: %s, action: %s, params: %s", collection, signature, action, paramStr)
 
+	ctrl.traceItemCache(c, collection, signature)
+	endSpan := startSpan(c, "item")
 	item, err := ctrl.getItem(collection, signature)
+	endSpan()
 	if err != nil {
-		httpStatus := http.StatusInternalServerError
+		ctrl.logger.Error().Err(err).Msgf("cannot get item %s/%s", collection, signature)
 		if errors.Is(err, gcache.KeyNotFoundError) {
-			httpStatus = http.StatusNotFound
+			ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_not_found", collection+"/"+signature)
+		} else {
+			ctrl.errorResponse(c, http.StatusInternalServerError, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_error", collection+"/"+signature)
 		}
-		ctrl.logger.Error().Err(err).Msgf("cannot get item %s/%s", collection, signature)
-		c.JSON(httpStatus, gin.H{
-			"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err),
-		})
-		c.Abort()
 		return
 	}
-	if err := ctrl.checkAccess(collection, signature, action, paramStr, token); err != nil {
+	ctrl.setSurrogateKeys(c, collection, signature)
+	ctrl.typeHeaders(c, item)
+	ctrl.rightsHeader(c, collection, signature)
+	setHeaders(c, ctrl.headerPolicy.iiif)
+	endSpan = startSpan(c, "access")
+	signed, err := ctrl.verifySignedRequest(c, collection)
+	if err == nil && !signed {
+		err = ctrl.checkAccess(c, collection, signature, action, paramStr, token)
+	}
+	endSpan()
+	traceAccess(c, item, signed, token, err)
+	if ctrl.limitResponse(c, collection, signature, err) {
+		return
+	}
+	if err != nil {
 		ctrl.logger.Info().Err(err).Msgf("access denied for %s/%s/%s/%s", collection, signature, action, paramStr)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("access denied for %s/%s/%s/%s: %v", collection, signature, action, paramStr, err)})
-		c.Abort()
+		ctrl.errorResponse(c, http.StatusUnauthorized, collection, errors.Wrapf(err, "access denied for %s/%s/%s/%s", collection, signature, action, paramStr), "access_denied", collection+"/"+signature)
+		return
+	}
+	// policies and view quotas are evaluated for every request, so cached responses would bypass them. exhibitions
+	// end, cached responses would outlive their window
+	if token == "" && !signed && !ctrl.perRequestAccess(collection) && !ctrl.exhibited(collection, signature, action) {
+		c.Set(publicResponseKey, collection+"/"+signature)
+	}
+	isInfoJSON := strings.TrimPrefix(paramStr, "/") == "info.json"
+	if isInfoJSON && ctrl.serveCachedInfo(c, item, collection, signature, version) {
 		return
 	}
+	endSpan = startSpan(c, "cache")
 	cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
 		Identifier: &mediaserverproto.ItemIdentifier{
 			Collection: collection,
@@ -333,6 +616,12 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 		Action: ctrl.iiifBaseAction,
 		Params: ctrl.iiifBaseActionParams,
 	})
+	endSpan()
+	if err != nil {
+		traceDecision(c, "cache", "miss %s/%s: %v", ctrl.iiifBaseAction, ctrl.iiifBaseActionParams, status.Code(err))
+	} else {
+		traceDecision(c, "cache", "hit %s/%s", ctrl.iiifBaseAction, ctrl.iiifBaseActionParams)
+	}
 	if err != nil {
 		stat, ok := status.FromError(err)
 		if !ok || stat.Code() != codes.NotFound {
@@ -365,12 +654,32 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 		params.SetString(ctrl.iiifBaseActionParams, allowedParams)
 
 		// cache not found, create it
-		cache, err = ctrl.actionControllerClient.Action(context.Background(), &mediaserverproto.ActionParam{
+		endSpan = startSpan(c, "generate")
+		cache, err = ctrl.generateFor(c, &mediaserverproto.ActionParam{
 			Item:    item,
 			Action:  ctrl.iiifBaseAction,
 			Params:  params,
 			Storage: coll.GetStorage(),
 		})
+		endSpan()
+		traceDecision(c, "generate", "%s/%s", ctrl.iiifBaseAction, params.String())
+		if errors.Is(err, errQuarantined) {
+			c.Header("Cache-Control", "no-store")
+			ctrl.errorResponse(c, http.StatusServiceUnavailable, collection, err, "quarantined", collection+"/"+signature)
+			return
+		}
+		if errors.Is(err, errReadOnly) {
+			ctrl.errorResponse(c, http.StatusServiceUnavailable, collection, err, "read_only")
+			return
+		}
+		if errors.Is(err, errOverBudget) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			ctrl.errorResponse(c, http.StatusInsufficientStorage, collection, err, "quota_exceeded", collection)
+			return
+		}
 		if err != nil {
 			ctrl.logger.Error().Err(err).Msgf("cannot get cache for %s/%s/%s: %v", collection, signature, action, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -415,6 +724,7 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 		}
 		fullpath = stor.GetFilebase() + "/" + fullpath
 	}
+	traceStorage(c, cache.GetMetadata(), fullpath)
 	iifPath := strings.Replace(strings.TrimPrefix(fullpath, ctrl.iiifPrefix), "/", "$$", -1)
 
 	u, err := url.JoinPath(ctrl.iiif, strconv.Itoa(versionInt), iifPath, paramStr)
@@ -429,11 +739,8 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 	ctrl.logger.Debug().Msgf("proxy to %s", u)
 	req2, err := http.NewRequest("GET", u, nil)
 	if err != nil {
-		fmt.Printf("cantaloupe request error: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": fmt.Sprintf("cannot create new request to %s: %v", u, err),
-		})
-		c.Abort()
+		ctrl.logger.Error().Err(err).Msgf("cannot create new request to %s", u)
+		ctrl.errorResponse(c, http.StatusInternalServerError, collection, errors.Wrapf(err, "cannot create new request to %s", u), "internal_error")
 		return
 	}
 
@@ -463,12 +770,18 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 	req2.Header.Add("X-Forwarded-Port", p.Port())
 	// req2.Header.Add("X-Forwarded-Path", SingleJoiningSlash(baseurl.RawPath, SingleJoiningSlash(ms.iiifPrefix, signature+"/"+newtoken)+"/"))
 	req2.Header.Add("X-Forwarded-Path", p.Path)
-	req2.Header.Add("X-Forwarded-For", c.Request.RemoteAddr[:strings.IndexByte(c.Request.RemoteAddr, ':')])
-	req2.Header.Add("X-Forwarded-ID", fmt.Sprintf("%s/%s", collection, signature))
+	if host := remoteHost(c.Request); host != "" {
+		req2.Header.Add("X-Forwarded-For", host)
+	}
+	req2.Header.Add("X-Forwarded-ID", collection+"/"+signature)
 
 	for k, v := range req2.Header {
 		ctrl.logger.Debug().Msgf("header %s: %v", k, v)
 	}
+	isInfo := ctrl.tileHints != nil && strings.HasSuffix(paramStr, "info.json")
+	if isInfo {
+		ctrl.earlyHints(c, collection, signature, version)
+	}
 	client := &http.Client{}
 	rs, err := client.Do(req2)
 	if err != nil {
@@ -488,9 +801,22 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 		}
 	}
 
+	var body io.Reader = rs.Body
+	if isInfo && rs.StatusCode == http.StatusOK {
+		body = ctrl.infoWithHints(c, collection, signature, version, token, rs.Body)
+	}
+	if isInfoJSON && ctrl.infoCache != nil && rs.StatusCode == http.StatusOK {
+		body = ctrl.cacheInfo(collection, signature, version, rs.Header.Get("Content-Type"), body)
+	}
+	// the length of responses without one is only known for info.json, which is read completely anyway.
+	// everything else is streamed, chunked if the iiif server does not send the length
+	if br, ok := body.(*bytes.Reader); ok && rs.ContentLength < 0 && bodyAllowedForStatus(rs.StatusCode) {
+		c.Header("Content-Length", strconv.Itoa(br.Len()))
+	}
+	defer ctrl.streamResponse(c, "iiif")()
 	c.Writer.WriteHeader(rs.StatusCode)
 	c.Writer.WriteHeaderNow()
-	if _, err := io.Copy(c.Writer, rs.Body); err != nil {
+	if _, err := io.Copy(c.Writer, body); err != nil {
 		ctrl.logger.Error().Err(err).Msgf("cannot copy from iiif server: %v", err)
 		return
 	}
@@ -499,15 +825,17 @@ func (ctrl *mainController) iiifAction(c *gin.Context) {
 
 func (ctrl *mainController) doTemplate(c *gin.Context, tpl *template.Template, collection, signature string) {
 	data := map[string]string{
-		"BaseURL":    ctrl.extAddr,
+		"BaseURL":    ctrl.externalURL(),
+		"SubPath":    ctrl.subpath,
+		"StaticURL":  ctrl.externalURL("static"),
 		"Collection": collection,
 		"Signature":  signature,
 	}
 	c.Header("Content-Type", "text/html")
 	if err := tpl.Execute(c.Writer, data); err != nil {
-		ctrl.logger.Error().Err(err).Msgf("cannot execute template %v/%s", ctrl.vfs, tpl)
+		ctrl.logger.Error().Err(err).Msgf("cannot execute template %v/%s", ctrl.vfs, tpl.Name())
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": fmt.Sprintf("cannot execute template %v/%s: %v", ctrl.vfs, tpl, err),
+			"error": fmt.Sprintf("cannot execute template %v/%s: %v", ctrl.vfs, tpl.Name(), err),
 		})
 		return
 	}
@@ -524,34 +852,62 @@ func (ctrl *mainController) action(c *gin.Context) {
 	token := c.Query("token")
 	ctrl.logger.Debug().Msgf("collection: %s, signature: %s, action: %s, params: %s", collection, signature, action, paramStr)
 
+	ctrl.traceItemCache(c, collection, signature)
+	endSpan := startSpan(c, "item")
 	item, err := ctrl.getItem(collection, signature)
+	endSpan()
 	if err != nil {
-		httpStatus := http.StatusInternalServerError
-		stat, ok := status.FromError(err)
-		if !ok || stat.Code() != codes.NotFound {
-			httpStatus = http.StatusNotFound
-		}
 		ctrl.logger.Error().Err(err).Msgf("cannot get item %s/%s", collection, signature)
-		c.JSON(httpStatus, gin.H{
-			"error": fmt.Sprintf("cannot get item %s/%s: %v", collection, signature, err),
-		})
-		c.Abort()
+		if errors.Is(err, gcache.KeyNotFoundError) {
+			ctrl.errorResponse(c, http.StatusNotFound, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_not_found", collection+"/"+signature)
+		} else {
+			ctrl.errorResponse(c, http.StatusInternalServerError, collection, errors.Wrapf(err, "cannot get item %s/%s", collection, signature), "item_error", collection+"/"+signature)
+		}
+		return
+	}
+	ctrl.setSurrogateKeys(c, collection, signature)
+	ctrl.typeHeaders(c, item)
+	ctrl.rightsHeader(c, collection, signature)
+	if ctrl.audioMode(c, item, collection, signature, action) {
+		return
+	}
+	if action == "preview" {
+		// the thumbnail action checks the access
+		ctrl.previewRedirect(c, item, collection, signature)
 		return
 	}
-	if err := ctrl.checkAccess(collection, signature, action, paramStr, token); err != nil {
+	if action == "alternatives" {
+		ctrl.alternatives(c, item, collection, signature, paramStr, token)
+		return
+	}
+	if action == "captions" {
+		ctrl.serveCaptions(c, item, collection, signature, paramStr, token)
+		return
+	}
+	endSpan = startSpan(c, "access")
+	signed, err := ctrl.verifySignedRequest(c, collection)
+	if err == nil && !signed {
+		err = ctrl.checkAccess(c, collection, signature, action, paramStr, token)
+	}
+	endSpan()
+	traceAccess(c, item, signed, token, err)
+	if ctrl.limitResponse(c, collection, signature, err) {
+		return
+	}
+	if err != nil {
 		ctrl.logger.Info().Err(err).Msgf("access denied for %s/%s/%s/%s", collection, signature, action, paramStr)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": fmt.Sprintf("access denied for %s/%s/%s/%s: %v", collection, signature, action, paramStr, err)})
-		c.Abort()
+		ctrl.errorResponse(c, http.StatusUnauthorized, collection, errors.Wrapf(err, "access denied for %s/%s/%s/%s", collection, signature, action, paramStr), "access_denied", collection+"/"+signature)
 		return
 	}
+	// policies and view quotas are evaluated for every request, so cached responses would bypass them. exhibitions
+	// end, cached responses would outlive their window
+	if token == "" && !signed && !ctrl.perRequestAccess(collection) && !ctrl.exhibited(collection, signature, action) {
+		c.Set(publicResponseKey, collection+"/"+signature)
+	}
 	if action == "metadata" {
-		metadata, err := ctrl.dbClient.GetItemMetadata(context.Background(), &mediaserverproto.ItemIdentifier{
-			Collection: collection,
-			Signature:  signature,
-		})
+		metadata, err := ctrl.getItemMetadata(collection, signature)
 		if err != nil {
-			stat, ok := status.FromError(err)
-			if !ok || stat.Code() != codes.NotFound {
+			if !errors.Is(err, gcache.KeyNotFoundError) {
 				ctrl.logger.Error().Err(err).Msgf("cannot get metadata for %s/%s", collection, signature)
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error": fmt.Sprintf("cannot get metadata for %s/%s: %v", collection, signature, err),
@@ -567,7 +923,39 @@ func (ctrl *mainController) action(c *gin.Context) {
 			return
 		}
 
-		c.Data(http.StatusOK, "application/json", []byte(metadata.GetValue()))
+		if notModified(c, itemLastModified(item), contentETag([]byte(metadata))) {
+			return
+		}
+		c.Data(http.StatusOK, "application/json", []byte(metadata))
+		return
+	}
+
+	if action == "provenance" {
+		ctrl.provenance(c, item, collection, signature, paramStr)
+		return
+	}
+	if action == "mets" {
+		ctrl.mets(c, item, collection, signature, paramStr, token)
+		return
+	}
+	if action == "layers" {
+		ctrl.layers(c, item, collection, signature, paramStr, token)
+		return
+	}
+	if action == "manifest.json" {
+		ctrl.serveManifest(c, item, collection, signature, token)
+		return
+	}
+	if action == "info" {
+		ctrl.info(c, item, collection, signature)
+		return
+	}
+	if action == "capabilities" {
+		ctrl.capabilities(c, item, collection, signature)
+		return
+	}
+	if action == "receipt" {
+		ctrl.receipt(c, item, collection, signature, paramStr, token)
 		return
 	}
 
@@ -582,9 +970,14 @@ func (ctrl *mainController) action(c *gin.Context) {
 			return
 		}
 		params.SetString(paramStr, allowedParams)
+		ctrl.applyClientHints(c, item.GetMetadata().GetType(), action, params)
+		ctrl.applyDataSaver(c, item.GetMetadata().GetType(), action, params, allowedParams)
+		ctrl.applyMetadataEmbed(c, item, action, params, allowedParams)
 	}
 
-	actionID := fmt.Sprintf("%s/%s", action, params.String())
+	// the canonical params are the key of cache entries and templates, built once per request
+	paramsKey := params.String()
+	actionID := action + "/" + paramsKey
 	if tplAny, err := ctrl.actionTemplates.Get(actionID); err == nil {
 		tpl, ok := tplAny.(*template.Template)
 		if !ok {
@@ -594,18 +987,26 @@ func (ctrl *mainController) action(c *gin.Context) {
 			})
 			return
 		}
+		traceDecision(c, "template", "%s", actionID)
 		ctrl.doTemplate(c, tpl, collection, signature)
 		return
 	}
 
+	endSpan = startSpan(c, "cache")
 	cache, err := ctrl.dbClient.GetCache(context.Background(), &mediaserverproto.CacheRequest{
 		Identifier: &mediaserverproto.ItemIdentifier{
 			Collection: collection,
 			Signature:  signature,
 		},
 		Action: action,
-		Params: params.String(),
+		Params: paramsKey,
 	})
+	endSpan()
+	if err != nil {
+		traceDecision(c, "cache", "miss %s: %v", actionID, status.Code(err))
+	} else {
+		traceDecision(c, "cache", "hit %s", actionID)
+	}
 	if err != nil {
 		stat, ok := status.FromError(err)
 		if !ok || stat.Code() != codes.NotFound {
@@ -615,7 +1016,7 @@ func (ctrl *mainController) action(c *gin.Context) {
 			})
 			return
 		}
-		collAny, err := ctrl.collectionCache.Get(collection)
+		collAny, err := ctrl.partition(collection).collectionCache.Get(collection)
 		if err != nil {
 			ctrl.logger.Error().Err(err).Msgf("cannot get collection %s", collection)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -626,12 +1027,41 @@ func (ctrl *mainController) action(c *gin.Context) {
 		coll, ok := collAny.(*mediaserverproto.Collection)
 
 		// cache not found, create it
-		cache, err = ctrl.actionControllerClient.Action(context.Background(), &mediaserverproto.ActionParam{
+		endSpan = startSpan(c, "generate")
+		cache, err = ctrl.generateFor(c, &mediaserverproto.ActionParam{
 			Item:    item,
 			Action:  action,
 			Params:  params,
 			Storage: coll.GetStorage(),
 		})
+		endSpan()
+		if err != nil {
+			traceDecision(c, "generate", "%s failed: %v", actionID, err)
+		} else {
+			traceDecision(c, "generate", "%s", actionID)
+		}
+		if err != nil || cache == nil {
+			if fallback, ok := ctrl.fallbackCache(c, collection, signature, action, params); ok {
+				traceDecision(c, "fallback", "%s/%s", fallback.GetMetadata().GetAction(), fallback.GetMetadata().GetParams())
+				cache, err = fallback, nil
+			}
+		}
+		if errors.Is(err, errQuarantined) {
+			ctrl.quarantineResponse(c, item, err)
+			return
+		}
+		if errors.Is(err, errReadOnly) {
+			ctrl.errorResponse(c, http.StatusServiceUnavailable, collection, err, "read_only")
+			return
+		}
+		if errors.Is(err, errOverBudget) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			ctrl.errorResponse(c, http.StatusInsufficientStorage, collection, err, "quota_exceeded", collection)
+			return
+		}
 		if err != nil {
 			ctrl.logger.Error().Err(err).Msgf("cannot get cache for %s/%s/%s: %v", collection, signature, action, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -647,6 +1077,11 @@ func (ctrl *mainController) action(c *gin.Context) {
 			return
 		}
 	}
+	// derivatives stored before a budget was configured
+	if err := ctrl.checkSizeBudget(item, cache); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
 	metadata := cache.GetMetadata()
 	path := metadata.GetPath()
 	matches := dataRegexp.FindStringSubmatch(path)
@@ -664,7 +1099,12 @@ func (ctrl *mainController) action(c *gin.Context) {
 			ctrl.doTemplate(c, tpl, collection, signature)
 			return
 		} else {
+			ctrl.cacheControlHeader(c, collection)
+			if notModified(c, itemLastModified(item), contentETag([]byte(matches[2]))) {
+				return
+			}
 			c.Header("Content-Type", metadata.GetMimeType())
+			c.Header("Content-Length", strconv.Itoa(len(matches[2])))
 			if _, err := io.WriteString(c.Writer, matches[2]); err != nil {
 				ctrl.logger.Error().Err(err).Msgf("cannot write data %s", matches[2])
 				c.JSON(http.StatusInternalServerError, gin.H{
@@ -678,14 +1118,16 @@ func (ctrl *mainController) action(c *gin.Context) {
 	if !isUrlRegexp.MatchString(path) {
 		stor := metadata.GetStorage()
 		if stor == nil {
-			ctrl.logger.Error().Msgf("no storage defined for %s/%s/%s/%s", collection, signature, action, params.String())
+			ctrl.logger.Error().Msgf("no storage defined for %s/%s/%s/%s", collection, signature, action, paramsKey)
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("no storage defined for %s/%s/%s/%s", collection, signature, action, params.String()),
+				"error": fmt.Sprintf("no storage defined for %s/%s/%s/%s", collection, signature, action, paramsKey),
 			})
 			return
 		}
 		path = stor.GetFilebase() + "/" + path
 	}
+	path = ctrl.mapVFS(collection, metadata.GetStorage().GetName(), path)
+	traceStorage(c, metadata, path)
 
 	mime := metadata.GetMimeType()
 	switch mime {
@@ -708,7 +1150,11 @@ func (ctrl *mainController) action(c *gin.Context) {
 			return
 		}
 		c.Header("Content-Type", "text/html")
-		if err := tpl.Execute(c.Writer, map[string]string{"BaseURL": ctrl.extAddr}); err != nil {
+		if err := tpl.Execute(c.Writer, map[string]string{
+			"BaseURL":   ctrl.externalURL(),
+			"SubPath":   ctrl.subpath,
+			"StaticURL": ctrl.externalURL("static"),
+		}); err != nil {
 			ctrl.logger.Error().Err(err).Msgf("cannot execute template %v/%s", ctrl.vfs, path)
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": fmt.Sprintf("cannot execute template %v/%s: %v", ctrl.vfs, path, err),
@@ -717,7 +1163,21 @@ func (ctrl *mainController) action(c *gin.Context) {
 		}
 	default:
 		c.Header("Content-Type", mime)
-		c.FileFromFS(path, http.FS(ctrl.vfs))
+		var sha512 string
+		if action == "item" || action == "master" {
+			sha512 = item.GetMetadata().GetSha512()
+		}
+		ctrl.setReceiptLink(c, collection, signature, action, paramsKey)
+		ctrl.cacheControlHeader(c, collection)
+		etag := derivativeETag(item, metadata, sha512)
+		if len(ctrl.precompressed) > 0 && compressibleMime(mime) {
+			// the delivery service chooses the encoding and answers conditional requests for its variant
+			c.Header("ETag", etag)
+		} else if notModified(c, itemLastModified(item), etag) {
+			return
+		}
+		c.Set(contentSizeKey, metadata.GetSize())
+		ctrl.serveFile(c, path, mime, sha512)
 	}
 	return
 }
@@ -0,0 +1,124 @@
+package rest_test
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaservermain/v2/pkg/fake"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"github.com/je4/mediaservermain/v2/pkg/webtest"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"github.com/je4/utils/v2/pkg/config"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchCollectionKey is the jwt key of the fixture collection for token benchmarks
+const benchCollectionKey = "bench-collection-key-0123456789abcdef"
+
+var benchTile = []byte("\xff\xd8\xff\xe0 not a real tile \xff\xd9")
+
+var benchInfoJSON = []byte(`{"@context":"http://iiif.io/api/image/3/context.json","type":"ImageService3","width":64,"height":48,"tiles":[{"width":32,"scaleFactors":[1,2]}]}`)
+
+// newBenchServer starts the test server with the token, access and response caches of a production setup and a
+// stand-in for the iiif image server
+func newBenchServer(b *testing.B) *webtest.Server {
+	b.Helper()
+	// the route listing of gin would end up in the results
+	gin.DefaultWriter = io.Discard
+	iiif := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/info.json") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(benchInfoJSON)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(benchTile)
+	}))
+	b.Cleanup(iiif.Close)
+	srv, err := webtest.NewServerWithConfig(func(conf *rest.ServerConfig) {
+		conf.IIIF = iiif.URL
+		conf.IIIFPrefix = "vfs://"
+		conf.IIIFBaseAction = "item"
+	},
+		rest.WithTokenCache(10000, 10*time.Minute),
+		rest.WithAccessCache(10000, time.Minute),
+		rest.WithResponseCache(&rest.ResponseCacheConfig{
+			Enabled:    true,
+			Dir:        b.TempDir(),
+			MaxSize:    64 << 20,
+			DefaultTTL: config.Duration(time.Hour),
+		}),
+	)
+	if err != nil {
+		b.Fatalf("cannot start test server: %v", err)
+	}
+	b.Cleanup(srv.Close)
+	srv.Fixture.DB.AddCollection(&mediaserverproto.Collection{
+		Name:    fake.Collection,
+		Jwtkey:  benchCollectionKey,
+		Storage: srv.Fixture.Storage,
+	})
+	return srv
+}
+
+// benchGet serves a request in process and fails on unexpected status codes
+func benchGet(b *testing.B, h http.Handler, path string, header map[string]string, status int) http.Header {
+	req := httptest.NewRequest(http.MethodGet, webtest.Prefix+path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != status {
+		b.Fatalf("%s: status %d, expected %d: %s", path, w.Code, status, w.Body.String())
+	}
+	return w.Header()
+}
+
+func BenchmarkTileCacheHit(b *testing.B) {
+	h := newBenchServer(b).Controller.Handler()
+	tilePath := "/iiif/3/" + fake.Collection + "/" + fake.PublicImage + "/0,0,32,32/32,/0/default.jpg"
+	benchGet(b, h, tilePath, nil, http.StatusOK)
+	if hit := benchGet(b, h, tilePath, nil, http.StatusOK).Get("X-Cache"); hit != "HIT" {
+		b.Fatalf("%s: tile not served from response cache: X-Cache '%s'", tilePath, hit)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchGet(b, h, tilePath, nil, http.StatusOK)
+	}
+}
+
+func BenchmarkItem(b *testing.B) {
+	h := newBenchServer(b).Controller.Handler()
+	itemPath := "/" + fake.Collection + "/" + fake.PublicImage + "/item"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchGet(b, h, itemPath, nil, http.StatusOK)
+	}
+}
+
+func BenchmarkMetadata(b *testing.B) {
+	h := newBenchServer(b).Controller.Handler()
+	metadataPath := "/" + fake.Collection + "/" + fake.PublicImage + "/metadata"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchGet(b, h, metadataPath, nil, http.StatusOK)
+	}
+}
+
+func BenchmarkMetadataNotModified(b *testing.B) {
+	h := newBenchServer(b).Controller.Handler()
+	metadataPath := "/" + fake.Collection + "/" + fake.PublicImage + "/metadata"
+	etag := map[string]string{"If-None-Match": benchGet(b, h, metadataPath, nil, http.StatusOK).Get("ETag")}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchGet(b, h, metadataPath, etag, http.StatusNotModified)
+	}
+}
@@ -0,0 +1,171 @@
+package rest
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/bluele/gcache"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaserveraction/v2/pkg/actionCache"
+	mediaserverproto "github.com/je4/mediaserverproto/v2/pkg/mediaserver/proto"
+	"io"
+	"slices"
+	"time"
+)
+
+type MetadataEmbedConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Actions embedding the metadata, "<action>" or "<type>::<action>", default ["image::resize"]
+	Actions []string `toml:"actions"`
+	// Param is the action param with the hex encoded json {"rights", "credit", "source"} written as xmp/iptc by the
+	// action, default "xmp". it is only set for actions declaring the param
+	Param string `toml:"param"`
+	// CreditField is the metadata field with the attribution, default "attribution"
+	CreditField string `toml:"creditfield"`
+	// Verify searches generated derivatives for the embedded metadata. failures are logged and listed at
+	// /admin/actionerrors
+	Verify bool `toml:"verify"`
+	// VerifySize is the number of bytes at the start of derivatives searched for the xmp packet, default 256KiB
+	VerifySize int64 `toml:"verifysize"`
+}
+
+// EmbeddedMetadata is passed to the actions embedding rights and attribution into derivatives
+type EmbeddedMetadata struct {
+	Rights string `json:"rights,omitempty"`
+	Credit string `json:"credit,omitempty"`
+	// Source is the url of the item
+	Source string `json:"source"`
+}
+
+var errMetadataNotEmbedded = errors.New("metadata not embedded")
+
+type metadataEmbed struct {
+	conf  *MetadataEmbedConfig
+	cache gcache.Cache
+}
+
+// WithMetadataEmbed asks image actions to embed the rights and attribution of the item into derivatives, so
+// downloaded files carry their provenance
+func WithMetadataEmbed(conf *MetadataEmbedConfig) Option {
+	return func(ctrl *mainController) error {
+		if conf == nil || !conf.Enabled {
+			return nil
+		}
+		if len(conf.Actions) == 0 {
+			conf.Actions = []string{"image::resize"}
+		}
+		if conf.Param == "" {
+			conf.Param = "xmp"
+		}
+		if conf.CreditField == "" {
+			conf.CreditField = "attribution"
+		}
+		if conf.VerifySize <= 0 {
+			conf.VerifySize = 256 << 10
+		}
+		me := &metadataEmbed{conf: conf}
+		me.cache = gcache.New(10000).LRU().Expiration(time.Hour).LoaderFunc(func(key any) (any, error) {
+			it, ok := key.(itemIdentifier)
+			if !ok {
+				return nil, errors.Errorf("invalid key type %T", key)
+			}
+			return ctrl.loadEmbeddedMetadata(it.collection, it.signature)
+		}).Build()
+		ctrl.metadataEmbed = me
+		return nil
+	}
+}
+
+// loadEmbeddedMetadata returns the hex encoded metadata of an item
+func (ctrl *mainController) loadEmbeddedMetadata(collection, signature string) (string, error) {
+	em := EmbeddedMetadata{
+		Rights: ctrl.itemRights(collection, signature),
+		Source: ctrl.externalURL(collection, signature),
+	}
+	if metadata, err := ctrl.getItemMetadata(collection, signature); err == nil {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(metadata), &fields); err == nil {
+			em.Credit, _ = fields[ctrl.metadataEmbed.conf.CreditField].(string)
+		}
+	}
+	data, err := json.Marshal(em)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot marshal embedded metadata of %s/%s", collection, signature)
+	}
+	// params are path segments of the cache key, hex survives lower casing and contains no slashes
+	return hex.EncodeToString(data), nil
+}
+
+// removeEmbeddedMetadata deletes the cached metadata of an item
+func (ctrl *mainController) removeEmbeddedMetadata(collection, signature string) {
+	if ctrl.metadataEmbed == nil {
+		return
+	}
+	ctrl.metadataEmbed.cache.Remove(itemIdentifier{collection: collection, signature: signature})
+}
+
+// applyMetadataEmbed sets the metadata param of configured actions. values of the request are never used
+func (ctrl *mainController) applyMetadataEmbed(c *gin.Context, item *mediaserverproto.Item, action string, params actionCache.ActionParams, allowedParams []string) {
+	me := ctrl.metadataEmbed
+	if me == nil || !slices.Contains(allowedParams, me.conf.Param) {
+		return
+	}
+	params.Del(me.conf.Param)
+	mediaType := item.GetMetadata().GetType()
+	if !slices.Contains(me.conf.Actions, mediaType+"::"+action) && !slices.Contains(me.conf.Actions, action) {
+		return
+	}
+	collection := item.GetIdentifier().GetCollection()
+	signature := item.GetIdentifier().GetSignature()
+	valueAny, err := me.cache.Get(itemIdentifier{collection: collection, signature: signature})
+	if err != nil {
+		ctrl.logger.Error().Err(err).Msgf("cannot get embedded metadata of %s/%s", collection, signature)
+		return
+	}
+	params.Set(me.conf.Param, valueAny.(string))
+	traceDecision(c, "xmp", "embed metadata in %s", action)
+}
+
+// verifyMetadataEmbed searches a generated derivative for the xmp packet with the source and rights of the item
+func (ctrl *mainController) verifyMetadataEmbed(param *mediaserverproto.ActionParam, cache *mediaserverproto.Cache) error {
+	me := ctrl.metadataEmbed
+	if me == nil || !me.conf.Verify {
+		return nil
+	}
+	value, ok := param.GetParams()[me.conf.Param]
+	if !ok {
+		return nil
+	}
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return errors.Wrapf(err, "invalid embedded metadata '%s'", value)
+	}
+	var em EmbeddedMetadata
+	if err := json.Unmarshal(data, &em); err != nil {
+		return errors.Wrapf(err, "invalid embedded metadata '%s'", string(data))
+	}
+	fullpath, err := cachePath(cache.GetMetadata())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if dataRegexp.MatchString(fullpath) {
+		return nil
+	}
+	fullpath = ctrl.mapVFS(param.GetItem().GetIdentifier().GetCollection(), cache.GetMetadata().GetStorage().GetName(), fullpath)
+	fp, err := ctrl.vfs.Open(fullpath)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open %s", fullpath)
+	}
+	defer fp.Close()
+	head, err := io.ReadAll(io.LimitReader(fp, me.conf.VerifySize))
+	if err != nil {
+		return errors.Wrapf(err, "cannot read %s", fullpath)
+	}
+	for _, expected := range []string{"x:xmpmeta", em.Source, em.Rights} {
+		if expected != "" && !bytes.Contains(head, []byte(expected)) {
+			return errors.Wrapf(errMetadataNotEmbedded, "'%s' not found in %s", expected, fullpath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+// Package soak runs a load generator against the rest controller with the in-memory backends of package fake
+// and reports growth of the heap, goroutines, caches and open grpc streams over the run
+package soak
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/mediaservermain/v2/pkg/fake"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"github.com/je4/mediaservermain/v2/pkg/webtest"
+	"io"
+	"net/http"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	// Duration of the load after the warmup, default 1h
+	Duration time.Duration
+	// Warmup fills the caches before sampling starts, default 5m
+	Warmup time.Duration
+	// Interval between samples, default 1m
+	Interval time.Duration
+	// Concurrency is the number of clients, default 8
+	Concurrency int
+	// Keys is the number of distinct items and sizes requested besides the contract. it should exceed the cache
+	// sizes to force evictions, default 2000
+	Keys int
+	// Tolerance is the allowed growth of the second half of the samples over the first half, default 0.1
+	Tolerance float64
+	// Goroutines is the allowed number of goroutines above the idle level before the load, default 5
+	Goroutines int
+	// Progress is called with every sample and the number of requests sent so far
+	Progress func(sample *rest.RuntimeStats, requests int64)
+}
+
+type Report struct {
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Requests int64         `json:"requests"`
+	Errors   int64         `json:"errors"`
+	Status   map[int]int64 `json:"status"`
+	// Baseline and Final are sampled without load before and after the run
+	Baseline *rest.RuntimeStats   `json:"baseline"`
+	Final    *rest.RuntimeStats   `json:"final"`
+	Samples  []*rest.RuntimeStats `json:"samples"`
+	// OpenStreams are the grpc streams of the fake database neither drained nor canceled after the run
+	OpenStreams int64    `json:"openstreams"`
+	Leaks       []string `json:"leaks"`
+}
+
+func (r *Report) OK() bool {
+	return len(r.Leaks) == 0
+}
+
+// request returns the i-th request of the load. contract requests alternate with requests for changing items and
+// derivative sizes, so that caches evict entries
+func request(i int64, keys int) *webtest.Request {
+	if i%2 == 0 {
+		return webtest.Contract[(i/2)%int64(len(webtest.Contract))]
+	}
+	k := (i / 2) % int64(keys)
+	if k%2 == 0 {
+		return &webtest.Request{Name: "soak-missing", Path: fmt.Sprintf("/%s/soak-%d/item", fake.Collection, k)}
+	}
+	return &webtest.Request{Name: "soak-resize", Path: fmt.Sprintf("/%s/%s/resize/size%dx%d/formatpng", fake.Collection, fake.PublicImage, 1+k%64, 1+(k/64)%64)}
+}
+
+// sample collects the garbage and reads the runtime figures of the server. the server has to run in this process
+func sample(srv *webtest.Server) (*rest.RuntimeStats, error) {
+	runtime.GC()
+	resp, err := srv.Do(&webtest.Request{Name: "soak-runtime", Path: "/admin/runtime", Admin: true})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot get runtime stats: %s", resp.Status)
+	}
+	var stats = &rest.RuntimeStats{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, errors.Wrap(err, "cannot decode runtime stats")
+	}
+	return stats, nil
+}
+
+// growth reports values whose maximum in the second half of the samples exceeds the first half by the tolerance
+func growth(name string, values []float64, tolerance, slack float64) string {
+	half := len(values) / 2
+	first := slices.Max(values[:half])
+	second := slices.Max(values[half:])
+	if second <= first*(1+tolerance)+slack {
+		return ""
+	}
+	return fmt.Sprintf("%s grows from %.0f to %.0f", name, first, second)
+}
+
+// Run sends requests with conf.Concurrency clients until the warmup and duration have passed or ctx is done
+func Run(ctx context.Context, srv *webtest.Server, conf *Config) (*Report, error) {
+	if conf.Duration <= 0 {
+		conf.Duration = time.Hour
+	}
+	if conf.Warmup <= 0 {
+		conf.Warmup = 5 * time.Minute
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = time.Minute
+	}
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = 8
+	}
+	if conf.Keys <= 0 {
+		conf.Keys = 2000
+	}
+	if conf.Tolerance <= 0 {
+		conf.Tolerance = 0.1
+	}
+	if conf.Goroutines <= 0 {
+		conf.Goroutines = 5
+	}
+	if conf.Duration/conf.Interval < 4 {
+		return nil, errors.Errorf("duration %v allows less than 4 samples with interval %v", conf.Duration, conf.Interval)
+	}
+	report := &Report{Start: time.Now(), Status: map[int]int64{}}
+	var err error
+	if report.Baseline, err = sample(srv); err != nil {
+		return nil, errors.Wrap(err, "cannot sample baseline")
+	}
+
+	loadCtx, cancel := context.WithTimeout(ctx, conf.Warmup+conf.Duration)
+	defer cancel()
+	var requests, failures atomic.Int64
+	var statusMutex sync.Mutex
+	var wg sync.WaitGroup
+	for range conf.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for loadCtx.Err() == nil {
+				resp, err := srv.Do(request(requests.Add(1)-1, conf.Keys))
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				statusMutex.Lock()
+				report.Status[resp.StatusCode]++
+				statusMutex.Unlock()
+			}
+		}()
+	}
+
+	warmup := time.After(conf.Warmup)
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	sampling := false
+loop:
+	for {
+		select {
+		case <-loadCtx.Done():
+			break loop
+		case <-warmup:
+			sampling = true
+		case <-ticker.C:
+			if !sampling {
+				continue
+			}
+			s, err := sample(srv)
+			if err != nil {
+				cancel()
+				wg.Wait()
+				return nil, errors.Wrap(err, "cannot sample")
+			}
+			report.Samples = append(report.Samples, s)
+			if conf.Progress != nil {
+				conf.Progress(s, requests.Load())
+			}
+		}
+	}
+	wg.Wait()
+	report.Requests = requests.Load()
+	report.Errors = failures.Load()
+
+	// connections of the clients are not part of the server
+	srv.CloseClientConnections()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if report.Final, err = sample(srv); err != nil {
+			return nil, errors.Wrap(err, "cannot sample after load")
+		}
+		if report.Final.Goroutines <= report.Baseline.Goroutines+conf.Goroutines || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	report.OpenStreams = srv.Fixture.DB.OpenStreams()
+	report.End = time.Now()
+	report.check(conf)
+	return report, nil
+}
+
+func (r *Report) check(conf *Config) {
+	if len(r.Samples) >= 4 {
+		var heap, goroutines []float64
+		sizes := map[string][]float64{}
+		for _, s := range r.Samples {
+			heap = append(heap, float64(s.HeapAlloc))
+			goroutines = append(goroutines, float64(s.Goroutines))
+			for name, size := range s.Sizes {
+				sizes[name] = append(sizes[name], float64(size))
+			}
+		}
+		r.addLeak(growth("heap", heap, conf.Tolerance, 0))
+		r.addLeak(growth("goroutines", goroutines, conf.Tolerance, float64(conf.Goroutines)))
+		names := make([]string, 0, len(sizes))
+		for name := range sizes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// sizes missing in early samples are not compared
+			if len(sizes[name]) == len(r.Samples) {
+				r.addLeak(growth(name, sizes[name], conf.Tolerance, 1))
+			}
+		}
+	} else {
+		r.addLeak(fmt.Sprintf("only %d samples, no growth computed", len(r.Samples)))
+	}
+	if r.Final.Goroutines > r.Baseline.Goroutines+conf.Goroutines {
+		r.addLeak(fmt.Sprintf("%d goroutines after the load, %d before", r.Final.Goroutines, r.Baseline.Goroutines))
+	}
+	if r.OpenStreams > 0 {
+		r.addLeak(fmt.Sprintf("%d grpc streams neither drained nor canceled", r.OpenStreams))
+	}
+	if n := r.Final.Sizes["generations"]; n > 0 {
+		r.addLeak(fmt.Sprintf("%d generations still registered after the load", n))
+	}
+	for name, size := range r.Final.Sizes {
+		cache, ok := strings.CutSuffix(name, ".stats")
+		if ok && size > r.Final.Sizes[cache] {
+			r.addLeak(fmt.Sprintf("%s has %d entries for %d cached", name, size, r.Final.Sizes[cache]))
+		}
+	}
+	sort.Strings(r.Leaks)
+}
+
+func (r *Report) addLeak(leak string) {
+	if leak != "" {
+		r.Leaks = append(r.Leaks, leak)
+	}
+}
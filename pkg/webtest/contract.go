@@ -0,0 +1,169 @@
+package webtest
+
+import (
+	"emperror.dev/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/je4/mediaservermain/v2/pkg/fake"
+	"strings"
+)
+
+// item returns the path of an item of the fixture collection
+func item(signature string, elem ...string) string {
+	p := "/" + fake.Collection + "/" + signature
+	for _, e := range elem {
+		p += "/" + e
+	}
+	return p
+}
+
+// jsonHeader is the content type header of requests with a json body
+var jsonHeader = map[string]string{"Content-Type": "application/json"}
+
+// Contract covers every route of the test server with the fixture data. golden files are in testdata/golden.
+// requests changing the state of the server come after the requests reading it and leave the fixture data unchanged
+var Contract = []*Request{
+	{Name: "prefix-redirect", Route: "", Path: ""},
+	{Name: "readyz", Route: "/readyz", Path: "/readyz"},
+	{Name: "static", Route: "/static/*filepath", Path: "/static/foliatereader/reader.js"},
+	{Name: "static-head", Method: "HEAD", Route: "/static/*filepath", Path: "/static/foliatereader/reader.js"},
+	{Name: "preflight", Method: "OPTIONS", Route: "/*path", Path: item(fake.PublicImage, "item"), Header: map[string]string{
+		"Origin":                        "https://example.org",
+		"Access-Control-Request-Method": "GET",
+	}},
+
+	// media
+	{Name: "default-action", Route: "/:collection/:signature", Path: item(fake.PublicImage)},
+	{Name: "item-public", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "item")},
+	{Name: "item-range", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "item"), Header: map[string]string{"Range": "bytes=0-7"}},
+	{Name: "item-restricted", Route: "/:collection/:signature/:action", Path: item(fake.RestrictedImage, "item")},
+	{Name: "item-public-action", Route: "/:collection/:signature/:action", Path: item(fake.Video, "item")},
+	{Name: "item-not-found", Route: "/:collection/:signature/:action", Path: item("missing", "item")},
+	{Name: "resize", Route: "/:collection/:signature/:action/*params", Path: item(fake.PublicImage, "resize", "size32x24", "formatpng")},
+	{Name: "metadata", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "metadata")},
+	{Name: "metadata-restricted", Route: "/:collection/:signature/:action", Path: item(fake.RestrictedImage, "metadata")},
+	{Name: "capabilities", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "capabilities"), Header: map[string]string{"Accept": "image/webp,*/*"}},
+	{Name: "info", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "info")},
+	{Name: "manifest", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "manifest.json")},
+	{Name: "layers", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "layers")},
+	{Name: "mets", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "mets"), Volatile: true},
+	{Name: "provenance", Route: "/:collection/:signature/:action/*params", Path: item(fake.PublicImage, "provenance", "item")},
+	{Name: "receipt", Route: "/:collection/:signature/:action/*params", Path: item(fake.PublicImage, "receipt", "item")},
+	{Name: "preview", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "preview")},
+	{Name: "alternatives", Route: "/:collection/:signature/:action/*params", Path: item(fake.PublicImage, "alternatives", "audio", "en")},
+	{Name: "captions", Route: "/:collection/:signature/:action/*params", Path: item(fake.Video, "captions", "en")},
+	{Name: "unknown-action", Route: "/:collection/:signature/:action", Path: item(fake.PublicImage, "unknown")},
+
+	// metadata
+	{Name: "actions", Route: "/actions", Path: "/actions", Volatile: true},
+	{Name: "activity", Route: "/activity/all-changes", Path: "/activity/all-changes"},
+	{Name: "activity-first", Route: "/activity/page/first", Path: "/activity/page/first"},
+	{Name: "activity-last", Route: "/activity/page/last", Path: "/activity/page/last"},
+	{Name: "activity-after-invalid", Route: "/activity/page/after/:cursor", Path: "/activity/page/after/invalid"},
+	{Name: "activity-before-invalid", Route: "/activity/page/before/:cursor", Path: "/activity/page/before/invalid"},
+
+	// iiif
+	{Name: "iiif-invalid-version", Route: "/iiif/:version/:collection/:signature/*params", Path: "/iiif/x/" + fake.Collection + "/" + fake.PublicImage + "/info.json"},
+	{Name: "iiif-restricted", Route: "/iiif/:version/:collection/:signature/*params", Path: "/iiif/3/" + fake.Collection + "/" + fake.RestrictedImage + "/info.json"},
+
+	// viewer
+	{Name: "embed", Route: "/embed/:collection/:signature", Path: "/embed/" + fake.Collection + "/" + fake.PublicImage},
+	{Name: "embed-restricted", Route: "/embed/:collection/:signature", Path: "/embed/" + fake.Collection + "/" + fake.RestrictedImage},
+	{Name: "qr-svg", Route: "/qr/*path", Path: "/qr" + item(fake.PublicImage, "item") + "?format=svg"},
+	{Name: "qr-png", Route: "/qr/*path", Path: "/qr" + item(fake.PublicImage, "item")},
+	{Name: "shortlink-disabled", Route: "/s/:id", Path: "/s/abcdefghijklmnop"},
+	{Name: "resolve-disabled", Route: "/resolve/*identifier", Path: "/resolve/ark:/12345/x1"},
+	{Name: "beacon-disabled", Method: "POST", Route: "/beacon", Path: "/beacon", Body: `{"type":"view"}`, Header: map[string]string{"Origin": "http://mediaserver.test"}},
+	{Name: "annotations", Route: "/annotations/:collection/:signature", Path: "/annotations/" + fake.Collection + "/" + fake.PublicImage},
+	{Name: "annotation", Route: "/annotations/:collection/:signature/:id", Path: "/annotations/" + fake.Collection + "/" + fake.PublicImage + "/missing"},
+	{Name: "annotation-create-unauthorized", Method: "POST", Route: "/annotations/:collection/:signature", Path: "/annotations/" + fake.Collection + "/" + fake.PublicImage, Header: jsonHeader, Body: `{}`},
+	{Name: "annotation-delete-unauthorized", Method: "DELETE", Route: "/annotations/:collection/:signature/:id", Path: "/annotations/" + fake.Collection + "/" + fake.PublicImage + "/missing"},
+	{Name: "seat-lease", Method: "POST", Route: "/seats/:collection/:signature", Path: "/seats/" + fake.Collection + "/" + fake.RestrictedImage},
+	{Name: "seat-renew", Method: "PUT", Route: "/seats/:collection/:signature", Path: "/seats/" + fake.Collection + "/" + fake.RestrictedImage},
+	{Name: "seat-release", Method: "DELETE", Route: "/seats/:collection/:signature", Path: "/seats/" + fake.Collection + "/" + fake.RestrictedImage},
+	{Name: "print-request", Method: "POST", Route: "/print/:collection/:signature", Path: "/print/" + fake.Collection + "/" + fake.RestrictedImage, Header: jsonHeader, Body: `{}`},
+	{Name: "transcription", Method: "POST", Route: "/transcriptions/:collection/:signature", Path: "/transcriptions/" + fake.Collection + "/" + fake.PublicImage, Header: jsonHeader, Body: `{}`},
+
+	// admin
+	{Name: "admin-unauthorized", Route: "/admin/collections", Path: "/admin/collections"},
+	{Name: "admin-collections", Route: "/admin/collections", Path: "/admin/collections", Admin: true},
+	{Name: "admin-collection", Route: "/admin/collections/:collection", Path: "/admin/collections/" + fake.Collection, Admin: true},
+	{Name: "admin-public-actions", Route: "/admin/items/:collection/:signature/public", Path: "/admin/items/" + fake.Collection + "/" + fake.Video + "/public", Admin: true},
+	{Name: "admin-validate-public-actions", Method: "POST", Route: "/admin/items/:collection/:signature/public/validate", Path: "/admin/items/" + fake.Collection + "/" + fake.Video + "/public/validate", Admin: true, Header: jsonHeader,
+		Body: `{"publicactions":["item","resize/formatpng/size32x24"]}`},
+	{Name: "admin-preview", Route: "/admin/items/:collection/:signature/preview", Path: "/admin/items/" + fake.Collection + "/" + fake.PublicImage + "/preview", Admin: true},
+	{Name: "admin-captions", Route: "/admin/items/:collection/:signature/captions", Path: "/admin/items/" + fake.Collection + "/" + fake.Video + "/captions", Admin: true},
+	{Name: "admin-canonical", Method: "POST", Route: "/admin/canonical", Path: "/admin/canonical", Admin: true, Header: jsonHeader,
+		Body: `{"collection":"test","signature":"image","action":"resize/formatpng/size32x24"}`},
+	{Name: "admin-stats-disabled", Route: "/admin/stats", Path: "/admin/stats", Admin: true},
+	{Name: "admin-runtime", Route: "/admin/runtime", Path: "/admin/runtime", Admin: true, Volatile: true},
+	{Name: "admin-stream-metrics", Route: "/admin/stream/metrics", Path: "/admin/stream/metrics", Admin: true},
+	{Name: "admin-vfs-metrics", Route: "/admin/vfs/metrics", Path: "/admin/vfs/metrics", Admin: true},
+	{Name: "admin-grpc-metrics", Route: "/admin/grpc/metrics", Path: "/admin/grpc/metrics", Admin: true},
+	{Name: "admin-fastpath", Route: "/admin/fastpath", Path: "/admin/fastpath", Admin: true},
+	{Name: "admin-disconnects", Route: "/admin/disconnects", Path: "/admin/disconnects", Admin: true, Volatile: true},
+	{Name: "admin-sizebudget", Route: "/admin/sizebudget", Path: "/admin/sizebudget", Admin: true},
+	{Name: "admin-cache-dump", Route: "/admin/cache/dump", Path: "/admin/cache/dump", Admin: true, Volatile: true},
+	{Name: "admin-accounting", Route: "/admin/accounting", Path: "/admin/accounting", Admin: true},
+	{Name: "admin-reports", Route: "/admin/reports", Path: "/admin/reports", Admin: true},
+	{Name: "admin-tenants", Route: "/admin/tenants", Path: "/admin/tenants", Admin: true},
+	{Name: "admin-quota", Route: "/admin/quota", Path: "/admin/quota", Admin: true},
+	{Name: "admin-seats", Route: "/admin/seats", Path: "/admin/seats", Admin: true},
+	{Name: "admin-dark", Route: "/admin/dark", Path: "/admin/dark", Admin: true},
+	{Name: "admin-quarantine", Route: "/admin/quarantine", Path: "/admin/quarantine", Admin: true},
+	{Name: "admin-actionerrors", Route: "/admin/actionerrors", Path: "/admin/actionerrors", Admin: true},
+	{Name: "admin-exhibitions", Route: "/admin/exhibitions", Path: "/admin/exhibitions", Admin: true},
+	{Name: "admin-pid", Route: "/admin/pids/*identifier", Path: "/admin/pids/ark:/12345/x1", Admin: true},
+	{Name: "admin-printrequests", Route: "/admin/printrequests", Path: "/admin/printrequests", Admin: true},
+	{Name: "admin-transcriptions", Route: "/admin/transcriptions", Path: "/admin/transcriptions", Admin: true},
+
+	// admin requests changing the state
+	{Name: "admin-token-invalid", Method: "POST", Route: "/admin/token", Path: "/admin/token", Admin: true, Header: jsonHeader, Body: `{}`},
+	{Name: "admin-generate-missing", Method: "POST", Route: "/admin/generate", Path: "/admin/generate", Admin: true, Header: jsonHeader,
+		Body: `{"collection":"test","signature":"missing","action":"resize","params":{"size":"32x24","format":"png"}}`},
+	{Name: "admin-prewarm-invalid", Method: "POST", Route: "/admin/prewarm", Path: "/admin/prewarm", Admin: true, Header: jsonHeader, Body: `{}`},
+	{Name: "admin-export-bagit-invalid", Method: "POST", Route: "/admin/export/bagit", Path: "/admin/export/bagit", Admin: true, Header: jsonHeader, Body: `{"items":[]}`},
+	{Name: "admin-invalidate", Method: "POST", Route: "/admin/invalidate/:collection/:signature", Path: "/admin/invalidate/" + fake.Collection + "/" + fake.PublicImage, Admin: true},
+	{Name: "admin-readonly-off", Method: "POST", Route: "/admin/readonly", Path: "/admin/readonly", Admin: true, Header: jsonHeader, Body: `{"enabled":false}`},
+	{Name: "admin-vfs-reload", Method: "POST", Route: "/admin/vfs/reload", Path: "/admin/vfs/reload", Admin: true},
+	{Name: "admin-quota-scan", Method: "POST", Route: "/admin/quota/scan", Path: "/admin/quota/scan", Admin: true},
+	{Name: "admin-reports-send", Method: "POST", Route: "/admin/reports", Path: "/admin/reports", Admin: true},
+	{Name: "admin-dark-set", Method: "PUT", Route: "/admin/dark/:collection", Path: "/admin/dark/other", Admin: true},
+	{Name: "admin-dark-release", Method: "DELETE", Route: "/admin/dark/:collection", Path: "/admin/dark/other", Admin: true},
+	{Name: "admin-dark-reserved", Method: "PUT", Route: "/admin/dark/:collection", Path: "/admin/dark/embed", Admin: true},
+	{Name: "admin-quarantine-set", Method: "PUT", Route: "/admin/quarantine/:collection/:signature", Path: "/admin/quarantine/" + fake.Collection + "/missing", Admin: true},
+	{Name: "admin-quarantine-release", Method: "DELETE", Route: "/admin/quarantine/:collection/:signature", Path: "/admin/quarantine/" + fake.Collection + "/missing", Admin: true},
+	{Name: "admin-actionerrors-retry", Method: "POST", Route: "/admin/actionerrors/retry", Path: "/admin/actionerrors/retry", Admin: true},
+	{Name: "admin-actionerrors-delete", Method: "DELETE", Route: "/admin/actionerrors", Path: "/admin/actionerrors", Admin: true},
+	{Name: "admin-exhibition-invalid", Method: "PUT", Route: "/admin/exhibitions/:id", Path: "/admin/exhibitions/summer", Admin: true, Header: jsonHeader, Body: `{}`},
+	{Name: "admin-exhibition-delete", Method: "DELETE", Route: "/admin/exhibitions/:id", Path: "/admin/exhibitions/summer", Admin: true},
+	{Name: "admin-caption-invalid", Method: "PUT", Route: "/admin/items/:collection/:signature/captions/:lang", Path: "/admin/items/" + fake.Collection + "/" + fake.Video + "/captions/en", Admin: true},
+	{Name: "admin-caption-delete", Method: "DELETE", Route: "/admin/items/:collection/:signature/captions/:lang", Path: "/admin/items/" + fake.Collection + "/" + fake.Video + "/captions/en", Admin: true},
+	{Name: "admin-pid-mint", Method: "POST", Route: "/admin/items/:collection/:signature/pid", Path: "/admin/items/" + fake.Collection + "/" + fake.PublicImage + "/pid", Admin: true},
+	{Name: "admin-pid-put", Method: "PUT", Route: "/admin/pids/*identifier", Path: "/admin/pids/ark:/12345/x1", Admin: true, Header: jsonHeader, Body: `{}`},
+	{Name: "admin-pid-delete", Method: "DELETE", Route: "/admin/pids/*identifier", Path: "/admin/pids/ark:/12345/x1", Admin: true},
+	{Name: "admin-printrequest-decide", Method: "POST", Route: "/admin/printrequests/:id/:decision", Path: "/admin/printrequests/missing/approve", Admin: true, Header: jsonHeader, Body: `{}`},
+	{Name: "admin-transcription-decide", Method: "POST", Route: "/admin/transcriptions/:id/:decision", Path: "/admin/transcriptions/missing/approve", Admin: true, Header: jsonHeader, Body: `{}`},
+}
+
+// RouteContract checks that every route has a request in the contract and every request names an existing route
+func RouteContract(routes gin.RoutesInfo, requests []*Request) error {
+	covered := map[string]bool{}
+	for _, req := range requests {
+		covered[req.routeKey()] = true
+	}
+	var errs []error
+	known := map[string]bool{}
+	for _, route := range routes {
+		key := route.Method + " " + strings.TrimPrefix(route.Path, Prefix)
+		known[key] = true
+		if !covered[key] {
+			errs = append(errs, errors.Errorf("no contract request for route %s", key))
+		}
+	}
+	for _, req := range requests {
+		if !known[req.routeKey()] {
+			errs = append(errs, errors.Errorf("%s: unknown route %s", req.Name, req.routeKey()))
+		}
+	}
+	return errors.Combine(errs...)
+}
@@ -0,0 +1,172 @@
+package webtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Request is a request of the contract
+type Request struct {
+	// Name is the file name of the golden file without extension
+	Name   string
+	Method string
+	Path   string
+	Header map[string]string
+	Body   string
+	// Admin adds an admin token
+	Admin bool
+	// Route is the route of the request below the prefix, e.g. "/:collection/:signature/:action"
+	Route string
+	// Volatile leaves the body out of the golden file, e.g. for runtime statistics
+	Volatile bool
+}
+
+func (req *Request) method() string {
+	if req.Method == "" {
+		return http.MethodGet
+	}
+	return req.Method
+}
+
+func (req *Request) routeKey() string {
+	return req.method() + " " + req.Route
+}
+
+func (req *Request) httpRequest(s *Server) (*http.Request, error) {
+	var body io.Reader
+	if req.Body != "" {
+		body = strings.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequest(req.method(), s.URL(req.Path), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create request %s", req.Name)
+	}
+	for k, v := range req.Header {
+		httpReq.Header.Set(k, v)
+	}
+	if req.Admin {
+		token, err := s.AdminToken()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot mint admin token")
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	return httpReq, nil
+}
+
+// Headers are the response headers recorded in golden files. volatile headers like Date are left out
+var Headers = []string{
+	"Access-Control-Allow-Origin",
+	"Cache-Control",
+	"Content-Encoding",
+	"Content-Security-Policy",
+	"Content-Type",
+	"Digest",
+	"ETag",
+	"Link",
+	"Location",
+	"Repr-Digest",
+	"Retry-After",
+	"Vary",
+}
+
+// Snapshot is the recorded response of a request
+type Snapshot struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"`
+	Status int               `json:"status"`
+	Header map[string]string `json:"header"`
+	// Body is the text of textual responses or the checksum and size of binary ones
+	Body string `json:"body"`
+}
+
+func textual(contentType string) bool {
+	for _, t := range []string{"application/json", "application/ld+json", "text/html", "text/plain", "image/svg+xml", "application/xml"} {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record sends a request and returns its snapshot
+func (s *Server) Record(req *Request) (*Snapshot, error) {
+	resp, err := s.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read response of %s", req.Name)
+	}
+	snap := &Snapshot{
+		Method: resp.Request.Method,
+		Path:   req.Path,
+		Status: resp.StatusCode,
+		Header: map[string]string{},
+	}
+	for _, h := range Headers {
+		if v := resp.Header.Values(h); len(v) > 0 {
+			snap.Header[h] = strings.Join(v, ", ")
+		}
+	}
+	if req.Volatile {
+		snap.Body = ""
+	} else if textual(resp.Header.Get("Content-Type")) {
+		snap.Body = string(data)
+	} else if len(data) > 0 {
+		sum := sha256.Sum256(data)
+		snap.Body = fmt.Sprintf("sha256:%s (%d bytes)", hex.EncodeToString(sum[:]), len(data))
+	}
+	return snap, nil
+}
+
+// Compare records a request and compares it with the golden file dir/<name>.json.
+// with update the golden file is written instead
+func (s *Server) Compare(dir string, req *Request, update bool) error {
+	snap, err := s.Record(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "cannot marshal snapshot of %s", req.Name)
+	}
+	data = append(data, '\n')
+	name := filepath.Join(dir, req.Name+".json")
+	if update {
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			return errors.Wrapf(err, "cannot write %s", name)
+		}
+		return nil
+	}
+	golden, err := os.ReadFile(name)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read %s", name)
+	}
+	if !bytes.Equal(golden, data) {
+		return errors.Errorf("%s: response differs from %s:\n--- golden\n%s\n--- got\n%s", req.Name, name, golden, data)
+	}
+	return nil
+}
+
+// CompareAll compares all requests of the contract and returns all differences
+func (s *Server) CompareAll(dir string, requests []*Request, update bool) error {
+	var errs []error
+	for _, req := range requests {
+		if err := s.Compare(dir, req, update); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Combine(errs...)
+}
@@ -0,0 +1,25 @@
+package webtest
+
+import (
+	"flag"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "write the golden files in testdata/golden instead of comparing them")
+
+// TestContract compares the responses of the contract with the golden files. go test -update rewrites them
+func TestContract(t *testing.T) {
+	srv, err := NewServer(rest.WithActivityStream(10))
+	if err != nil {
+		t.Fatalf("cannot start test server: %v", err)
+	}
+	defer srv.Close()
+	// every route needs a request, so new routes cannot miss the contract
+	if err := RouteContract(srv.Controller.Routes(), Contract); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.CompareAll("testdata/golden", Contract, *update); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,90 @@
+// Package webtest runs the rest controller on an httptest server with the in-memory backends of package fake
+// and compares responses of all routes with golden files
+package webtest
+
+import (
+	"emperror.dev/errors"
+	"github.com/je4/mediaservermain/v2/pkg/fake"
+	"github.com/je4/mediaservermain/v2/pkg/rest"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// AdminKey is the admin jwt key of the test server
+const AdminKey = "webtest-admin-key-0123456789abcdef"
+
+// ExtAddr is the external address of the test server. it does not depend on the listener, so that golden files are stable
+const ExtAddr = "http://mediaserver.test" + Prefix
+
+// Prefix is the path of the external address
+const Prefix = "/media"
+
+type Server struct {
+	*httptest.Server
+	Fixture    *fake.Fixture
+	Controller rest.Server
+}
+
+// NewServer starts a test server with the fixture data. options are applied after the defaults of the test server
+func NewServer(opts ...rest.Option) (*Server, error) {
+	return NewServerWithConfig(nil, opts...)
+}
+
+// NewServerWithConfig starts a test server whose config may be changed by configure, e.g. to add an iiif server
+func NewServerWithConfig(configure func(conf *rest.ServerConfig), opts ...rest.Option) (*Server, error) {
+	ts := httptest.NewUnstartedServer(nil)
+	fixture := fake.NewFixture()
+	_logger := zerolog.New(io.Discard)
+	var logger zLogger.ZLogger = &_logger
+	conf := &rest.ServerConfig{
+		ExtAddr:      ExtAddr,
+		JWTAlgs:      []string{"HS256", "HS384", "HS512"},
+		DBClient:     fixture.DB,
+		ActionClient: fixture.Actions,
+		VFS:          fixture.FS,
+		Logger:       logger,
+	}
+	if configure != nil {
+		configure(conf)
+	}
+	ctrl, err := rest.New(conf, append([]rest.Option{rest.WithAdminKey(AdminKey)}, opts...)...)
+	if err != nil {
+		ts.Listener.Close()
+		return nil, errors.Wrap(err, "cannot create controller")
+	}
+	ts.Config.Handler = ctrl.Handler()
+	ts.Start()
+	return &Server{Server: ts, Fixture: fixture, Controller: ctrl}, nil
+}
+
+// URL returns the absolute url of a path below the prefix
+func (s *Server) URL(path string) string {
+	return s.Server.URL + Prefix + path
+}
+
+// AdminToken returns a token for the admin api
+func (s *Server) AdminToken() (string, error) {
+	return rest.MintToken(AdminKey, "HS256", rest.AdminSubject, time.Hour)
+}
+
+// Do sends a request to a path below the prefix without following redirects
+func (s *Server) Do(req *Request) (*http.Response, error) {
+	httpReq, err := req.httpRequest(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot %s %s", req.Method, req.Path)
+	}
+	return resp, nil
+}